@@ -11,11 +11,13 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -63,6 +65,9 @@ The encryption sequence will carry out the following tasks:
 	MSG_E_ERASE_NO_CONF       = "The erase operation must contact key server in order to erase a key, but cryptctl configuration is empty."
 
 	ClientDaemonService = "cryptctl-client"
+
+	CLIENT_TLS_PATH                = "/etc/cryptctl/clienttls" // CLIENT_TLS_PATH is the default directory for storing client certificate and key
+	CERT_REQUEST_POLL_INTERVAL_SEC = 10                        // CERT_REQUEST_POLL_INTERVAL_SEC is the interval at which client checks whether its certificate request has been approved
 )
 
 // Prompt user to enter key server's CA file, host name, and port. Defaults are provided by existing configuration.
@@ -213,7 +218,8 @@ func ManOfflineUnlockFS() error {
 /*
 Sub-command: contact key server to retrieve encryption key to unlock a single file system, then continuously send alive
 reports to server to indicate that computer is still holding onto the encrypted disk.
-Block caller until the program quits or server rejects this computer.
+Block caller until the program quits or server rejects this computer. Upon SIGTERM, such as when the service is stopped,
+tell server to release the key so that other computers may use it right away.
 */
 func AutoOnlineUnlockFS(uuid string) error {
 	sys.LockMem()
@@ -229,10 +235,42 @@ func AutoOnlineUnlockFS(uuid string) error {
 	if err != nil {
 		return err
 	}
-	if err := routine.AutoOnlineUnlockFS(os.Stdout, client, uuid, ONLINE_UNLOCK_RETRY_SEC); err != nil {
+	// Alive messages are sent frequently, reuse the connection for all of them.
+	client.Persistent = true
+	defer client.Close()
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	leaseID, err := routine.AutoOnlineUnlockFS(os.Stdout, client, uuid, ONLINE_UNLOCK_RETRY_SEC)
+	if err != nil {
+		if leaseID != "" {
+			releaseKey(client, uuid, leaseID)
+		}
+		return err
+	}
+	aliveErr := make(chan error, 1)
+	go func() {
+		aliveErr <- routine.ReportAlive(os.Stderr, client, uuid, leaseID)
+	}()
+	select {
+	case err = <-aliveErr:
 		return err
+	case sig := <-term:
+		sys.NewLogger().Info("AutoOnlineUnlockFS: received signal, releasing key", "uuid", uuid, "signal", sig.String())
+		releaseKey(client, uuid, leaseID)
+		return nil
+	}
+}
+
+// releaseKey tells key server that this computer no longer holds the key of the disk. Failures are logged.
+func releaseKey(client *keyserv.CryptClient, uuid, leaseID string) {
+	hostname, _ := sys.GetHostnameAndIP()
+	if _, err := client.ReleaseKey(keyserv.ReleaseKeyReq{
+		Hostname: hostname,
+		UUIDs:    []string{uuid},
+		LeaseID:  leaseID,
+	}); err != nil {
+		sys.NewLogger().Warning("releaseKey: failed to release key", "uuid", uuid, "error", err)
 	}
-	return routine.ReportAlive(os.Stderr, client, uuid)
 }
 
 /*
@@ -276,7 +314,8 @@ func EraseKey() error {
 
 /*
 ClientDaemon runs the main routine of "client-daemon" sub-command.
-The routine primarily polls for pending commands and execute them.
+The routine primarily waits for pending commands and execute them. Key servers that cannot push commands to the daemon
+are polled every 30 seconds instead.
 */
 func ClientDaemon() error {
 	sys.LockMem()
@@ -288,49 +327,82 @@ func ClientDaemon() error {
 		fmt.Println(MSG_UNLOCK_IS_NOP)
 		return nil
 	}
+	if err := sys.ApplyLogSysconfig(sysconf); err != nil {
+		return err
+	}
 	client, err := keyserv.NewCryptClientFromSysconfig(sysconf)
 	if err != nil {
 		return err
 	}
-	log.Printf("Going to poll for commands from server %s every 30 seconds.", client.Address)
+	logger := sys.NewLogger("server", client.Address)
+	// The daemon polls for commands periodically, reuse the connection for all polls.
+	client.Persistent = true
+	defer client.Close()
+	if hello, err := client.Hello(); err != nil {
+		logger.Warning("ClientDaemon: failed to learn key server's version", "error", err)
+	} else {
+		logger.Info("ClientDaemon: connected to key server", "server_version", hello.ServerVersion, "protocol_version", hello.ProtocolVersion)
+	}
+	longPoll, announced := false, false
 	for {
-		time.Sleep(30 * time.Second)
-
-		devs := fs.GetBlockDevices()
-		uuids := make([]string, 0, len(devs))
-		for _, dev := range devs {
-			if dev.UUID != "" {
-				uuids = append(uuids, dev.UUID)
+		// Server may have become reachable since, the answer is remembered once it succeeds.
+		hello, err := client.Hello()
+		if supported := err == nil && hello.Supports("WaitCommand"); supported != longPoll || !announced {
+			longPoll, announced = supported, true
+			if longPoll {
+				logger.Info("ClientDaemon: going to wait for commands pushed by key server")
+			} else {
+				logger.Info("ClientDaemon: going to poll for commands every 30 seconds")
 			}
 		}
-
-		resp, err := client.PollCommand(keyserv.PollCommandReq{UUIDs: uuids})
+		var resp keyserv.PollCommandResp
+		if longPoll {
+			resp, err = client.WaitCommand(keyserv.WaitCommandReq{UUIDs: getBlockDeviceUUIDs(), TimeoutSec: keyserv.MaxWaitCommandSec})
+		} else {
+			time.Sleep(30 * time.Second)
+			resp, err = client.PollCommand(keyserv.PollCommandReq{UUIDs: getBlockDeviceUUIDs()})
+		}
 		if err != nil {
-			log.Printf("Failed to poll for pending commands: %v", err)
+			logger.Warning("ClientDaemon: failed to poll for pending commands", "error", err)
+			if longPoll {
+				// Do not hammer the server that is having trouble
+				time.Sleep(30 * time.Second)
+			}
 			continue
 		}
 		for uuid, cmds := range resp.Commands {
 			for _, cmd := range cmds {
 				if cmd.IsValid() {
-					log.Printf("Going to execute command %+v", cmd)
+					logger.Info("ClientDaemon: going to execute command", "uuid", uuid, "command", cmd.Kind, "command_id", cmd.ID, "valid_from", cmd.ValidFrom)
 					ExecutePendingCommand(client, uuid, cmd)
 				} else {
-					log.Printf("Ignoring expired command: %+v\n", cmd)
+					logger.Info("ClientDaemon: ignoring expired command", "uuid", uuid, "command", cmd.Kind, "command_id", cmd.ID, "valid_from", cmd.ValidFrom)
 				}
 			}
 		}
+	}
+}
 
+// getBlockDeviceUUIDs returns the UUID of all block devices on this computer, they are used to poll for commands.
+func getBlockDeviceUUIDs() []string {
+	devs := fs.GetBlockDevices()
+	uuids := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		if dev.UUID != "" {
+			uuids = append(uuids, dev.UUID)
+		}
 	}
+	return uuids
 }
 
 /*
 UmountCryptDev un-mounts and closes the crypt block device associated with the block device specified in UUID.
 Returns human-readable result text.
 */
-func UmountCryptDev(uuid string) string {
+func UmountCryptDev(client *keyserv.CryptClient, uuid string) string {
 	/*
 		First steps should umount and close the disk.
-		At very last, if no errors are encountered, stop reporting alive-messages.
+		At very last, if no errors are encountered, stop reporting alive-messages and release the key.
 	*/
 	devs := fs.GetBlockDevices()
 	underlyingDev, found := devs.GetByCriteria(uuid, "", "", "", "", "", "")
@@ -345,12 +417,12 @@ func UmountCryptDev(uuid string) string {
 		return "The disk is not mounted to begin with"
 	}
 	time.Sleep(3 * time.Second)
-	log.Printf("Umount %s ...", cryptDev.MountPoint)
+	sys.NewLogger().Info("UmountCryptDev: umount", "uuid", uuid, "mount_point", cryptDev.MountPoint)
 	if err := fs.Umount(cryptDev.MountPoint); err != nil {
 		return fmt.Sprintf("Failed to umount encrypted device - %v", err)
 	}
 	time.Sleep(3 * time.Second)
-	log.Printf("Closing down %s ...", cryptDev.Path)
+	sys.NewLogger().Info("UmountCryptDev: closing down", "uuid", uuid, "device", cryptDev.Path)
 	if err := fs.CryptClose(cryptDev.Path); err != nil {
 		return fmt.Sprintf("Failed to close encrypted device - %v", err)
 	}
@@ -358,33 +430,163 @@ func UmountCryptDev(uuid string) string {
 	if err := sys.SystemctlStop(AUTO_UNLOCK_DAEMON + uuid); err != nil {
 		return fmt.Sprintf("failed to stop service %s - %v", serviceName, err)
 	}
+	// The service releases its lease as it stops, release the key regardless of lease in case the service was not running.
+	releaseKey(client, uuid, "")
 	return "Success"
 }
 
 /*
 ExecutePendingCommand is called by client daemon to execute a freshly polled pending command.
-Execution result is logged into
+Execution result is logged and then saved on key server.
 */
 func ExecutePendingCommand(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) {
-	result := "Success"
-	if cmd.Content == PendingCommandMount {
+	kind := cmd.Kind
+	if kind == "" {
+		// Key servers that predate typed commands only tell command content
+		kind = fmt.Sprint(cmd.Content)
+	}
+	var details map[string]string
+	var err error
+	switch kind {
+	case PendingCommandMount:
 		// Mounting an already mounted disk will result in a failure and no other negative consequence
-		if err := sys.SystemctlStart(AUTO_UNLOCK_DAEMON + uuid); err != nil {
-			result = fmt.Sprintf("Failed to start background daemon that reports disk status - %v", err)
+		if err = sys.SystemctlStart(AUTO_UNLOCK_DAEMON + uuid); err != nil {
+			err = fmt.Errorf("Failed to start background daemon that reports disk status - %v", err)
 		}
-	} else if cmd.Content == PendingCommandUmount {
+	case PendingCommandUmount:
 		// Similar to mount, umount a disk that is not mounted is a failure and results in no other negative consequence.
-		result = UmountCryptDev(uuid)
-	} else {
-		result = fmt.Sprintf("Client does not understand command \"%v\"", cmd.Content)
+		if result := UmountCryptDev(client, uuid); result != "Success" {
+			err = errors.New(result)
+		}
+	case keyserv.CommandErase:
+		details, err = eraseRemotely(client, uuid)
+	case keyserv.CommandStatus:
+		details, err = reportStatus(uuid)
+	case keyserv.CommandVerifyKey:
+		details, err = verifyKey(client, uuid, cmd)
+	case keyserv.CommandAddRecoveryKeyslot:
+		details, err = addRecoveryKeyslot(client, uuid, cmd)
+	case keyserv.CommandRotateKey:
+		details, err = rotateKey(client, uuid, cmd)
+	default:
+		err = fmt.Errorf("Client does not understand command \"%s\"", kind)
+	}
+	result := "Success"
+	if err != nil {
+		result = err.Error()
 	}
-	log.Printf("ExecutePendingCommand: result is %s", result)
+	logger := sys.NewLogger("uuid", uuid, "command", kind, "command_id", cmd.ID)
+	logger.Info("ExecutePendingCommand: command is executed", "result", result)
 	if err := client.SaveCommandResult(keyserv.SaveCommandResultReq{
 		UUID:           uuid,
+		CommandID:      cmd.ID,
 		CommandContent: cmd.Content,
 		Result:         result,
+		Success:        err == nil,
+		Details:        details,
 	}); err != nil {
-		log.Printf("ExecutePendingCommand: failed to save command result - %v", err)
+		logger.Warning("ExecutePendingCommand: failed to save command result", "error", err)
 	}
 	return
 }
+
+/*
+RequestClientCert is a client routine that generates a new key, submits a certificate request to key server, waits
+for administrator's approval, and then saves the key and signed certificate along with key server settings.
+*/
+func RequestClientCert() error {
+	sys.LockMem()
+	sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, true)
+	if err != nil {
+		return err
+	}
+	defaultHost := sysconf.GetString(keyserv.CLIENT_CONF_HOST, "")
+	host := sys.Input(true, defaultHost, MSG_ASK_HOSTNAME)
+	if host == "" {
+		host = defaultHost
+	}
+	defaultPort := sysconf.GetInt(keyserv.CLIENT_CONF_PORT, keyserv.SRV_DEFAULT_PORT)
+	port := sys.InputInt(true, defaultPort, 1, 65535, MSG_ASK_PORT)
+	if port == 0 {
+		port = defaultPort
+	}
+	defaultCAFile := sysconf.GetString(keyserv.CLIENT_CONF_CA, "")
+	caFile := sys.InputAbsFilePath(false, defaultCAFile, MSG_ASK_CA)
+	if caFile == "" {
+		caFile = defaultCAFile
+	}
+	var caCert []byte
+	if caFile != "" {
+		if caCert, err = ioutil.ReadFile(caFile); err != nil {
+			return fmt.Errorf(MSG_E_READ_FILE, caFile, err)
+		}
+	}
+	myHostname, _ := sys.GetHostnameAndIP()
+	commonName := sys.Input(false, myHostname, "Host name to carry in the client certificate")
+	if commonName == "" {
+		commonName = myHostname
+	}
+	defaultCertFile := sysconf.GetString(keyserv.CLIENT_CONF_CERT, path.Join(CLIENT_TLS_PATH, commonName+".crt"))
+	certFile := sys.InputAbsFilePath(false, defaultCertFile, "Where should the client certificate be saved")
+	if certFile == "" {
+		certFile = defaultCertFile
+	}
+	defaultCertKeyFile := sysconf.GetString(keyserv.CLIENT_CONF_CERT_KEY, path.Join(CLIENT_TLS_PATH, commonName+".key"))
+	certKeyFile := sys.InputAbsFilePath(false, defaultCertKeyFile, "Where should the client key be saved")
+	if certKeyFile == "" {
+		certKeyFile = defaultCertKeyFile
+	}
+
+	// Key stays in memory until the certificate arrives
+	keyPEM, csrPEM, err := keyserv.NewClientCertRequest(commonName)
+	if err != nil {
+		return err
+	}
+	client, err := keyserv.NewCryptClient("tcp", fmt.Sprintf("%s:%d", host, port), caCert, "", "")
+	if err != nil {
+		return err
+	}
+	id, err := client.SubmitCertRequest(keyserv.SubmitCertRequestReq{Hostname: myHostname, CSRPEM: csrPEM})
+	if err != nil {
+		return err
+	}
+	fmt.Printf(`Certificate request has been submitted, the request ID is:
+%s
+
+Please run "cryptctl approve-client" on the key server to approve the request.
+Waiting for approval, press Ctrl+C to give up...
+`, id)
+	var resp keyserv.CollectClientCertResp
+	for {
+		if resp, err = client.CollectClientCert(keyserv.CollectClientCertReq{ID: id}); err != nil {
+			return err
+		}
+		if resp.Approved {
+			break
+		}
+		time.Sleep(CERT_REQUEST_POLL_INTERVAL_SEC * time.Second)
+	}
+
+	// Save key and certificate, then remember them in configuration
+	for _, dir := range []string{path.Dir(certFile), path.Dir(certKeyFile)} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("Failed to create directory \"%s\" - %v", dir, err)
+		}
+	}
+	if err := ioutil.WriteFile(certKeyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("Failed to write client key into \"%s\" - %v", certKeyFile, err)
+	}
+	if err := ioutil.WriteFile(certFile, resp.CertPEM, 0644); err != nil {
+		return fmt.Errorf("Failed to write client certificate into \"%s\" - %v", certFile, err)
+	}
+	sysconf.Set(keyserv.CLIENT_CONF_HOST, host)
+	sysconf.Set(keyserv.CLIENT_CONF_PORT, strconv.Itoa(port))
+	sysconf.Set(keyserv.CLIENT_CONF_CA, caFile)
+	sysconf.Set(keyserv.CLIENT_CONF_CERT, certFile)
+	sysconf.Set(keyserv.CLIENT_CONF_CERT_KEY, certKeyFile)
+	if err := ioutil.WriteFile(CLIENT_CONFIG_PATH, []byte(sysconf.ToText()), 0600); err != nil {
+		return fmt.Errorf(MSG_E_SAVE_SYSCONF, CLIENT_CONFIG_PATH, err)
+	}
+	fmt.Printf("The request has been approved, client certificate is saved in \"%s\" and key in \"%s\".\n", certFile, certKeyFile)
+	return nil
+}
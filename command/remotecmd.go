@@ -0,0 +1,153 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package command
+
+import (
+	"cryptctl/fs"
+	"cryptctl/keydb"
+	"cryptctl/keyserv"
+	"cryptctl/sys"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// findEncryptedDisk returns the underlying block device of the encrypted disk identified by UUID, and its crypt device if the disk is unlocked.
+func findEncryptedDisk(uuid string) (underlying, cryptDev fs.BlockDevice, unlocked bool, err error) {
+	devs := fs.GetBlockDevices()
+	underlying, found := devs.GetByCriteria(uuid, "", "", "", "", "", "")
+	if !found {
+		return fs.BlockDevice{}, fs.BlockDevice{}, false, errors.New("The disk disappeared from system")
+	}
+	cryptDev, unlocked = devs.GetByCriteria("", "", "crypt", "", "", underlying.Name, "")
+	return
+}
+
+// retrieveCommandKey asks key server for the key material needed to execute the pending command.
+func retrieveCommandKey(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) (keyserv.RetrieveCommandKeyResp, error) {
+	hostname, _ := sys.GetHostnameAndIP()
+	return client.RetrieveCommandKey(keyserv.RetrieveCommandKeyReq{Hostname: hostname, UUID: uuid, CommandID: cmd.ID})
+}
+
+/*
+eraseRemotely umounts and locks the encrypted disk if it is in use, and then erases its encryption headers so that
+the content becomes irreversibly lost.
+*/
+func eraseRemotely(client *keyserv.CryptClient, uuid string) (map[string]string, error) {
+	underlying, cryptDev, unlocked, err := findEncryptedDisk(uuid)
+	if err != nil {
+		return nil, err
+	}
+	if unlocked {
+		if cryptDev.MountPoint != "" {
+			if err := fs.Umount(cryptDev.MountPoint); err != nil {
+				return nil, fmt.Errorf("Failed to umount encrypted device - %v", err)
+			}
+		}
+		if err := fs.CryptClose(cryptDev.Path); err != nil {
+			return nil, fmt.Errorf("Failed to close encrypted device - %v", err)
+		}
+	}
+	serviceName := AUTO_UNLOCK_DAEMON + uuid
+	if err := sys.SystemctlStop(serviceName); err != nil {
+		return nil, fmt.Errorf("failed to stop service %s - %v", serviceName, err)
+	}
+	releaseKey(client, uuid, "")
+	if err := fs.CryptErase(underlying.Path); err != nil {
+		return nil, err
+	}
+	return map[string]string{"erased_device": underlying.Path}, nil
+}
+
+// reportStatus gathers the status of the encrypted disk for administrator's inspection.
+func reportStatus(uuid string) (map[string]string, error) {
+	underlying, cryptDev, unlocked, err := findEncryptedDisk(uuid)
+	if err != nil {
+		return nil, err
+	}
+	details := map[string]string{
+		"device":         underlying.Path,
+		"size_byte":      strconv.FormatInt(underlying.SizeByte, 10),
+		"unlocked":       strconv.FormatBool(unlocked),
+		"mount_point":    cryptDev.MountPoint,
+		"unlock_service": strconv.FormatBool(sys.SystemctlIsRunning(AUTO_UNLOCK_DAEMON + uuid)),
+	}
+	if unlocked {
+		details["crypt_device"] = cryptDev.Path
+		if mapping, err := fs.CryptStatus(cryptDev.Name); err == nil {
+			details["cipher"] = mapping.Cipher
+			details["key_size"] = strconv.Itoa(mapping.KeySize)
+		}
+	}
+	return details, nil
+}
+
+// verifyKey makes sure that the key kept by key server still unlocks the encrypted disk.
+func verifyKey(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) (map[string]string, error) {
+	underlying, _, _, err := findEncryptedDisk(uuid)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := retrieveCommandKey(client, uuid, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.CryptTestKey(keys.Key, underlying.Path); err != nil {
+		return nil, err
+	}
+	return map[string]string{"key_unlocks_disk": "true"}, nil
+}
+
+// addRecoveryKeyslot adds the recovery passphrase chosen by administrator to a free key slot of the encrypted disk.
+func addRecoveryKeyslot(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) (map[string]string, error) {
+	underlying, _, _, err := findEncryptedDisk(uuid)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := retrieveCommandKey(client, uuid, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.CryptAddKey(keys.Key, keys.NewKey, underlying.Path); err != nil {
+		return nil, err
+	}
+	return map[string]string{"recovery_keyslot_added": "true"}, nil
+}
+
+/*
+rotateKey puts a new key to use on the encrypted disk. The new key is added to the disk and tested before key server is
+told to replace the old key, and the old key is removed from the disk only after key server has been told so. Should
+anything fail in between, the disk remains usable with whichever key key server holds.
+*/
+func rotateKey(client *keyserv.CryptClient, uuid string, cmd keydb.PendingCommand) (map[string]string, error) {
+	underlying, _, _, err := findEncryptedDisk(uuid)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := retrieveCommandKey(client, uuid, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.CryptAddKey(keys.Key, keys.NewKey, underlying.Path); err != nil {
+		return nil, err
+	}
+	if err := fs.CryptTestKey(keys.NewKey, underlying.Path); err != nil {
+		// Leave the unusable key slot behind rather than risking the removal of the working key
+		return nil, err
+	}
+	// Key server replaces the key upon the first successful result
+	if err := client.SaveCommandResult(keyserv.SaveCommandResultReq{
+		UUID:      uuid,
+		CommandID: cmd.ID,
+		Result:    "The new key has been added",
+		Success:   true,
+	}); err != nil {
+		return nil, fmt.Errorf("Failed to tell key server about the new key, the old key remains in use - %v", err)
+	}
+	details := map[string]string{"new_key_added": "true", "old_key_removed": "true"}
+	if err := fs.CryptRemoveKey(keys.Key, underlying.Path); err != nil {
+		sys.NewLogger().Warning("rotateKey: failed to remove the old key", "uuid", uuid, "error", err)
+		details["old_key_removed"] = "false"
+	}
+	return details, nil
+}
@@ -7,28 +7,37 @@ import (
 	"cryptctl/keyserv"
 	"cryptctl/routine"
 	"cryptctl/sys"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const (
-	SERVER_DAEMON      = "cryptctl-server"
-	SERVER_CONFIG_PATH = "/etc/sysconfig/cryptctl-server"
-	SERVER_GENTLS_PATH = "/etc/cryptctl/servertls"
-	TIME_OUTPUT_FORMAT = "2006-01-02 15:04:05"
-	MIN_PASSWORD_LEN   = 10
-
-	PendingCommandMount  = "mount"  // PendingCommandMount is the content of a pending command that tells client computer to mount that disk.
-	PendingCommandUmount = "umount" // PendingCommandUmount is the content of a pending command that tells client computer to umount that disk.
+	SERVER_DAEMON              = "cryptctl-server"
+	SERVER_CONFIG_PATH         = "/etc/sysconfig/cryptctl-server"
+	SERVER_GENTLS_PATH         = "/etc/cryptctl/servertls"
+	SERVER_CLIENTTLS_PATH      = "/etc/cryptctl/clienttls"
+	SERVER_CA_CERT_FILE        = "ca.crt"
+	SERVER_CA_KEY_FILE         = "ca.key"
+	TIME_OUTPUT_FORMAT         = "2006-01-02 15:04:05"
+	COMMAND_START_INPUT_FORMAT = "2006-01-02 15:04"
+	MIN_PASSWORD_LEN           = 10
+
+	PendingCommandMount  = keyserv.CommandMount  // PendingCommandMount is the content of a pending command that tells client computer to mount that disk.
+	PendingCommandUmount = keyserv.CommandUmount // PendingCommandUmount is the content of a pending command that tells client computer to umount that disk.
 )
 
 /*
@@ -149,7 +158,7 @@ Would you like to re-configure it?`) {
 		newPwd := keyserv.HashPassword(newSalt, pwd)
 		sysconf.Set(keyserv.SRV_CONF_PASS_HASH, hex.EncodeToString(newPwd[:]))
 	}
-	// Ask for TLS certificate and key, or generate a self-signed one if user wishes to.
+	// Ask for TLS certificate and key, or generate one using the built-in certificate authority if user wishes to.
 	generateCert := false
 	if reconfigure {
 		// Server was previously initialised
@@ -159,9 +168,9 @@ Would you like to re-configure it?`) {
 			sysconf.Set(keyserv.SRV_CONF_TLS_CERT, tlsCert)
 		}
 	} else {
-		// Propose to generate a self-signed certificate
+		// Propose to generate a certificate
 		if tlsCert := sys.InputAbsFilePath(false, "", `PEM-encoded TLS certificate or a certificate chain file
-(leave blank to auto-generate self-signed certificate)`); tlsCert == "" {
+(leave blank to auto-generate a certificate using built-in certificate authority)`); tlsCert == "" {
 			generateCert = true
 		} else {
 			sysconf.Set(keyserv.SRV_CONF_TLS_CERT, tlsCert)
@@ -179,42 +188,57 @@ Would you like to re-configure it?`) {
 		if err := os.MkdirAll(SERVER_GENTLS_PATH, 0700); err != nil {
 			return fmt.Errorf("Failed to create directory \"%s\" for storing generated certificates - %v", SERVER_GENTLS_PATH, err)
 		}
-		// While openssl generates the certificate, print dots to stdout to show that program is busy.
-		fmt.Println("Generating certificate...")
-		opensslDone := make(chan bool, 1)
-		go func() {
-			for {
-				select {
-				case <-opensslDone:
-					return
-				case <-time.After(1 * time.Second):
-					fmt.Print(".")
-					os.Stdout.Sync()
-				}
+		// The built-in certificate authority is created only once and then reused to issue more certificates
+		caCertPath := path.Join(SERVER_GENTLS_PATH, SERVER_CA_CERT_FILE)
+		caKeyPath := path.Join(SERVER_GENTLS_PATH, SERVER_CA_KEY_FILE)
+		ca, err := keyserv.LoadCertAuthority(caCertPath, caKeyPath)
+		if err != nil {
+			// Files of an unusable certificate authority are only replaced with the user's consent
+			if err := confirmOverwrite(caCertPath, caKeyPath); err != nil {
+				return err
 			}
-		}()
+			if ca, err = keyserv.NewCertAuthority(certCommonName + " CA"); err != nil {
+				return err
+			}
+			if err := ca.Save(caCertPath, caKeyPath); err != nil {
+				return err
+			}
+		}
 		certPath := path.Join(SERVER_GENTLS_PATH, certCommonName+".crt")
 		keyPath := path.Join(SERVER_GENTLS_PATH, certCommonName+".key")
-		err := routine.GenerateSelfSignedCertificate(certCommonName, certPath, keyPath)
-		opensslDone <- true
-		if err != nil {
+		altNames := make([]string, 0, 1)
+		if hostIP != "" && hostIP != certCommonName {
+			altNames = append(altNames, hostIP)
+		}
+		if err := confirmOverwrite(certPath, keyPath); err != nil {
+			return err
+		}
+		if err := ca.IssueServerCert(certCommonName, altNames, certPath, keyPath); err != nil {
 			return err
 		}
 		fmt.Printf(`
-Self-signed certificate has been generated for host name "%s":
+Certificate has been generated for host name "%s" by the built-in certificate authority:
 %s
 %s
 
 Important notes for client computers:
-- They must have a copy of certificate file "%s" to communicate securely with this server.
+- They must have a copy of certificate authority file "%s" to communicate securely with this server.
 - In cryptctl commands, the key server's host name must use "%s".
 - When cryptctl commands ask for key server's CA, they must be given "/path/to/%s".
+- Client certificates can be issued by command "cryptctl issue-client-cert".
 - Consult manual page cryptctl(8) section Communication Security for more information.
 
-`, certCommonName, certPath, keyPath, path.Base(certPath), certCommonName, path.Base(certPath))
+`, certCommonName, certPath, keyPath, caCertPath, certCommonName, path.Base(caCertPath))
 		// Point sysconfig values to the generated certificate
 		sysconf.Set(keyserv.SRV_CONF_TLS_CERT, certPath)
 		sysconf.Set(keyserv.SRV_CONF_TLS_KEY, keyPath)
+		// The CA setting also verifies client certificates, an existing custom CA must stay in place.
+		if existingCA := sysconf.GetString(keyserv.SRV_CONF_TLS_CA, ""); existingCA == "" || existingCA == caCertPath {
+			sysconf.Set(keyserv.SRV_CONF_TLS_CA, caCertPath)
+			sysconf.Set(keyserv.SRV_CONF_TLS_CA_KEY, caKeyPath)
+		} else {
+			fmt.Printf("Client certificates are still verified by certificate authority \"%s\", the built-in one does not issue them.\n\n", existingCA)
+		}
 	} else {
 		// If certificate was specified, ask for its key file
 		if tlsKey := sys.InputAbsFilePath(!reconfigure,
@@ -241,7 +265,7 @@ Important notes for client computers:
 		sysconf.Set(keyserv.SRV_CONF_KEYDB_DIR, keyDBDir)
 	}
 	// Walk through client certificate verification settings
-	validateClient := sys.InputBool(sysconf.GetString(keyserv.SRV_CONF_TLS_CA, "") != "",
+	validateClient := sys.InputBool(sysconf.GetBool(keyserv.SRV_CONF_TLS_VALIDATE_CLIENT, false),
 		"Should clients present their certificate in order to access this server?")
 	sysconf.Set(keyserv.SRV_CONF_TLS_VALIDATE_CLIENT, validateClient)
 	if validateClient {
@@ -249,6 +273,9 @@ Important notes for client computers:
 			sys.InputAbsFilePath(true,
 				sysconf.GetString(keyserv.SRV_CONF_TLS_CA, ""),
 				"PEM-encoded TLS certificate authority that will issue client certificates"))
+		sysconf.Set(keyserv.SRV_CONF_TLS_CERT_ENROLMENT,
+			sys.InputBool(sysconf.GetBool(keyserv.SRV_CONF_TLS_CERT_ENROLMENT, false),
+				"Should clients without a certificate be allowed to request one?"))
 	}
 	// Walk through KMIP settings
 	useExternalKMIPServer := sys.InputBool(sysconf.GetString(keyserv.SRV_CONF_KMIP_SERVER_ADDRS, "") != "",
@@ -356,6 +383,9 @@ func KeyRPCDaemon() error {
 	if err != nil {
 		return fmt.Errorf("Failed to read configuratioon file \"%s\" - %v", SERVER_CONFIG_PATH, err)
 	}
+	if err := sys.ApplyLogSysconfig(sysconf); err != nil {
+		return fmt.Errorf("Failed to load configuration from file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+	}
 	srvConf := keyserv.CryptServiceConfig{}
 	if err := srvConf.ReadFromSysconfig(sysconf); err != nil {
 		return fmt.Errorf("Failed to load configuration from file \"%s\" - %v", SERVER_CONFIG_PATH, err)
@@ -368,15 +398,15 @@ func KeyRPCDaemon() error {
 	}
 	// Print helpful information regarding server's initial setup and mailer configuration
 	if nonFatalErr := srv.CheckInitialSetup(); nonFatalErr != nil {
-		log.Print("Key server is not confiured yet. Please run `cryptctl init-server` to complete initial setup.")
+		srv.Log.Warning("KeyRPCDaemon: key server is not confiured yet, please run `cryptctl init-server` to complete initial setup")
 	}
 	if nonFatalErr := mailer.ValidateConfig(); nonFatalErr == nil {
-		log.Printf("Email notifications will be sent from %s to %v via %s",
-			mailer.FromAddress, mailer.Recipients, mailer.AgentAddressPort)
+		srv.Log.Info("KeyRPCDaemon: email notifications are enabled",
+			"from", mailer.FromAddress, "recipients", mailer.Recipients, "agent", mailer.AgentAddressPort)
 	} else {
-		log.Printf("Email notifications are not enabled: %v", nonFatalErr)
+		srv.Log.Info("KeyRPCDaemon: email notifications are not enabled", "error", nonFatalErr)
 	}
-	log.Printf("GOMAXPROCS is currently: %d", runtime.GOMAXPROCS(-1))
+	srv.Log.Info("KeyRPCDaemon: starting", "version", keyserv.Version, "gomaxprocs", runtime.GOMAXPROCS(-1))
 	// Start two RPC servers, one on TCP and the other on Unix domain socket.
 	if err := srv.ListenTCP(); err != nil {
 		return fmt.Errorf("KeyRPCDaemon: failed to listen for TCP connections - %v", err)
@@ -384,19 +414,137 @@ func KeyRPCDaemon() error {
 	if err := srv.ListenUnix(); err != nil {
 		return fmt.Errorf("KeyRPCDaemon: failed to listen for domain socket connections - %v", err)
 	}
+	if err := srv.ListenMetrics(); err != nil {
+		return fmt.Errorf("KeyRPCDaemon: failed to listen for metrics connections - %v", err)
+	}
+	if err := srv.ListenREST(); err != nil {
+		return fmt.Errorf("KeyRPCDaemon: failed to listen for REST API connections - %v", err)
+	}
 	go srv.HandleUnixConnections()
+	go srv.RunMailDigest()
+	go srv.RunLivenessScan()
+	if srv.MetricsListener != nil {
+		go srv.HandleMetricsConnections()
+	}
+	if srv.RESTListener != nil {
+		go srv.HandleRESTConnections()
+	}
+	go ReloadKeyRPCDaemonOnSignal(srv)
+	// Stop accepting connections upon SIGTERM, the requests in progress are given a chance to complete.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-term
+		srv.Log.Info("KeyRPCDaemon: received signal, shutting down", "signal", sig.String())
+		srv.TCPListener.Close()
+	}()
 	srv.HandleTCPConnections() // intentionally block here
+	timeout := time.Duration(srvConf.ShutdownTimeoutSec) * time.Second
+	srv.Log.Info("KeyRPCDaemon: waiting for requests in progress to complete", "timeout", timeout.String())
+	if srv.GracefulShutdown(timeout) {
+		srv.Log.Info("KeyRPCDaemon: all requests have completed")
+	}
 	return nil
 }
 
-// Server - print all key records sorted according to last access.
-func ListKeys() error {
+// ReloadKeyRPCDaemonOnSignal re-reads server configuration file and applies the settings to server upon SIGHUP.
+func ReloadKeyRPCDaemonOnSignal(srv *keyserv.CryptServer) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		srv.Log.Info("ReloadKeyRPCDaemonOnSignal: reloading configuration", "file", SERVER_CONFIG_PATH)
+		sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, false)
+		if err != nil {
+			srv.Log.Error("ReloadKeyRPCDaemonOnSignal: failed to read configuration file", "error", err)
+			continue
+		}
+		srvConf := keyserv.CryptServiceConfig{}
+		if err := srvConf.ReadFromSysconfig(sysconf); err != nil {
+			srv.Log.Error("ReloadKeyRPCDaemonOnSignal: configuration is not valid, keep using the current settings", "error", err)
+			continue
+		}
+		if err := sys.ApplyLogSysconfig(sysconf); err != nil {
+			srv.Log.Error("ReloadKeyRPCDaemonOnSignal: log settings are not valid, keep using the current ones", "error", err)
+		}
+		mailer := keyserv.Mailer{}
+		mailer.ReadFromSysconfig(sysconf)
+		changes, err := srv.Reload(srvConf, mailer)
+		for _, change := range changes {
+			srv.Log.Info("ReloadKeyRPCDaemonOnSignal: setting has changed", "change", change)
+		}
+		if err != nil {
+			srv.Log.Error("ReloadKeyRPCDaemonOnSignal: failed to apply some of the settings", "error", err)
+		} else if len(changes) == 0 {
+			srv.Log.Info("ReloadKeyRPCDaemonOnSignal: nothing has changed")
+		}
+	}
+}
+
+/*
+ConnectToAdminServer connects to the key server for administration. If keyServer is empty, the connection is made to
+the local key server via domain socket; otherwise the user is asked for CA and client certificate, defaults are read
+from client configuration file. The password is read from terminal and checked by pinging the server.
+*/
+func ConnectToAdminServer(keyServer string) (client *keyserv.CryptClient, password string, err error) {
 	sys.LockMem()
-	db, err := OpenKeyDB("")
+	if keyServer != "" {
+		sysconf, err := sys.ParseSysconfigFile(CLIENT_CONFIG_PATH, true)
+		if err != nil {
+			return nil, "", err
+		}
+		defaultCAFile := sysconf.GetString(keyserv.CLIENT_CONF_CA, "")
+		caFile := sys.InputAbsFilePath(false, defaultCAFile, MSG_ASK_CA)
+		if caFile == "" {
+			caFile = defaultCAFile
+		}
+		defaultCertFile := sysconf.GetString(keyserv.CLIENT_CONF_CERT, "")
+		certFile := sys.InputAbsFilePath(false, defaultCertFile, MSG_ASK_CLIENT_CERT)
+		if certFile == "" {
+			certFile = defaultCertFile
+		}
+		var certKeyFile string
+		if certFile != "" {
+			defaultCertKeyFile := sysconf.GetString(keyserv.CLIENT_CONF_CERT_KEY, "")
+			if certKeyFile = sys.InputAbsFilePath(false, defaultCertKeyFile, MSG_ASK_CLIENT_CERT_KEY); certKeyFile == "" {
+				certKeyFile = defaultCertKeyFile
+			}
+		}
+		return ConnectToKeyServer(caFile, certFile, certKeyFile, keyServer)
+	}
+	client, err = keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	password = sys.InputPassword(true, "", "Enter key server's password (no echo)")
+	// Test the connection and password
+	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
+		return nil, "", err
+	}
+	return
+}
+
+/*
+Server - print all key records sorted according to last access.
+If keyServer is empty, the records are read from local key database; otherwise they are retrieved from the key server.
+*/
+func ListKeys(keyServer string) error {
+	sys.LockMem()
+	var recList []keydb.Record
+	if keyServer == "" {
+		db, err := OpenKeyDB("")
+		if err != nil {
+			return err
+		}
+		recList = db.List()
+	} else {
+		client, password, err := ConnectToAdminServer(keyServer)
+		if err != nil {
+			return err
+		}
+		if recList, err = client.ListRecords(keyserv.ListRecordsReq{PlainPassword: password}); err != nil {
+			return err
+		}
 	}
-	recList := db.List()
 	fmt.Printf("Total: %d records (date and time are in zone %s)\n", len(recList), time.Now().Format("MST"))
 	// Print mount point last, making output possible to be parsed by a program
 	// Max field length: 15 (IP), 19 (IP When), 12(ID), 36 (UUID), 9 (Max Active), 9 (Current Active) last field (mount point)
@@ -411,17 +559,8 @@ func ListKeys() error {
 	return nil
 }
 
-// Server - let user edit key details such as mount point and mount options
-func EditKey(uuid string) error {
-	sys.LockMem()
-	db, err := OpenKeyDB(uuid)
-	if err != nil {
-		return err
-	}
-	rec, found := db.GetByUUID(uuid)
-	if !found {
-		return fmt.Errorf("Cannot find record for UUID %s", uuid)
-	}
+// Interactively ask user for new mount and key usage settings of a record.
+func promptRecordChanges(rec *keydb.Record) {
 	// Similar to the encryption routine, ask user all the configuration questions.
 	newMountPoint := sys.Input(false, rec.MountPoint, "Mount point")
 	if newMountPoint != "" {
@@ -443,36 +582,102 @@ func EditKey(uuid string) error {
 		}
 		rec.AliveCount = roundedAliveTimeout / routine.REPORT_ALIVE_INTERVAL_SEC
 	}
-	// Write record file and restart server to let it reload all records into memory
-	if _, err := db.Upsert(rec); err != nil {
-		return fmt.Errorf("Failed to update database record - %v", err)
-	}
-	fmt.Println("Record has been updated successfully.")
-	if sys.SystemctlIsRunning(SERVER_DAEMON) {
-		fmt.Println("Restarting key server...")
-		if err := sys.SystemctlEnableRestart(SERVER_DAEMON); err != nil {
-			return err
+	for {
+		newLabels := sys.Input(false, formatNameValues(rec.Labels), "Labels that select the disk in commands (space-separated name=value, \"-\" to remove all)")
+		if newLabels == "" {
+			break
+		} else if newLabels == "-" {
+			rec.Labels = nil
+			break
 		}
-		fmt.Println("All done.")
+		labels, err := keydb.ParseLabels(newLabels)
+		if err == nil {
+			rec.Labels = labels
+			break
+		}
+		fmt.Println(err)
 	}
-	return nil
 }
 
-// Server - show key record details but hide key content
-func ShowKey(uuid string) error {
+/*
+Server - let user edit key details such as mount point and mount options.
+If keyServer is empty and the local key server is not running, the record is edited in local key database; otherwise
+the change is made by the key server and takes effect immediately.
+*/
+func EditKey(keyServer, uuid string) error {
 	sys.LockMem()
-	db, err := OpenKeyDB(uuid)
+	if keyServer == "" && !sys.SystemctlIsRunning(SERVER_DAEMON) {
+		db, err := OpenKeyDB(uuid)
+		if err != nil {
+			return err
+		}
+		rec, found := db.GetByUUID(uuid)
+		if !found {
+			return fmt.Errorf("Cannot find record for UUID %s", uuid)
+		}
+		promptRecordChanges(&rec)
+		if _, err := db.Upsert(nil, rec); err != nil {
+			return fmt.Errorf("Failed to update database record - %v", err)
+		}
+		fmt.Println("Record has been updated successfully.")
+		return nil
+	}
+	client, password, err := ConnectToAdminServer(keyServer)
+	if err != nil {
+		return err
+	}
+	rec, err := client.GetRecord(keyserv.GetRecordReq{PlainPassword: password, UUID: uuid})
 	if err != nil {
 		return err
 	}
-	rec, found := db.GetByUUID(uuid)
-	if !found {
-		return fmt.Errorf("Cannot find record for UUID %s", uuid)
+	promptRecordChanges(&rec)
+	if err := client.UpdateRecord(keyserv.UpdateRecordReq{
+		PlainPassword:    password,
+		UUID:             uuid,
+		MountPoint:       rec.MountPoint,
+		MountOptions:     rec.MountOptions,
+		MaxActive:        rec.MaxActive,
+		AliveIntervalSec: rec.AliveIntervalSec,
+		AliveCount:       rec.AliveCount,
+		UpdateLabels:     true,
+		Labels:           rec.Labels,
+	}); err != nil {
+		return fmt.Errorf("Failed to update database record - %v", err)
+	}
+	fmt.Println("Record has been updated successfully.")
+	return nil
+}
+
+/*
+Server - show key record details but hide key content.
+If keyServer is empty, the record is read from local key database; otherwise it is retrieved from the key server.
+*/
+func ShowKey(keyServer, uuid string) error {
+	sys.LockMem()
+	var rec keydb.Record
+	if keyServer == "" {
+		db, err := OpenKeyDB(uuid)
+		if err != nil {
+			return err
+		}
+		var found bool
+		if rec, found = db.GetByUUID(uuid); !found {
+			return fmt.Errorf("Cannot find record for UUID %s", uuid)
+		}
+	} else {
+		client, password, err := ConnectToAdminServer(keyServer)
+		if err != nil {
+			return err
+		}
+		if rec, err = client.GetRecord(keyserv.GetRecordReq{PlainPassword: password, UUID: uuid}); err != nil {
+			return err
+		}
 	}
 	rec.RemoveDeadHosts()
 	fmt.Printf("%-34s%s\n", "UUID", rec.UUID)
 	fmt.Printf("%-34s%s\n", "Mount Point", rec.MountPoint)
 	fmt.Printf("%-34s%s\n", "Mount Options", rec.GetMountOptionStr())
+	fmt.Printf("%-34s%s\n", "Labels", formatNameValues(rec.Labels))
 	fmt.Printf("%-34s%d\n", "Maximum Computers", rec.MaxActive)
 	fmt.Printf("%-34s%d\n", "Computer Keep-Alive Timeout (sec)", rec.AliveCount*rec.AliveIntervalSec)
 	fmt.Printf("%-34s%s (%s)\n", "Last Retrieved By", rec.LastRetrieval.IP, rec.LastRetrieval.Hostname)
@@ -488,14 +693,25 @@ func ShowKey(uuid string) error {
 			}
 		}
 	}
+	fmt.Printf("%-34s%s\n", "Known Computers", strings.Join(rec.KnownHosts, " "))
+	if len(rec.PendingHosts) > 0 {
+		fmt.Printf("%-34s%d\n", "Computers Awaiting Approval", len(rec.PendingHosts))
+		for _, attempt := range rec.PendingHosts {
+			outputTime := time.Unix(attempt.Timestamp, 0).Format(TIME_OUTPUT_FORMAT)
+			fmt.Printf("%-34s%s %s (%s)\n", "", outputTime, attempt.IP, attempt.Hostname)
+		}
+	}
 	fmt.Printf("%-34s%d\n", "Pending Commands", len(rec.PendingCommands))
 	if len(rec.PendingCommands) > 0 {
 		for ip, cmds := range rec.PendingCommands {
 			for _, cmd := range cmds {
 				validFromStr := cmd.ValidFrom.Format(TIME_OUTPUT_FORMAT)
 				validTillStr := cmd.ValidFrom.Add(cmd.Validity).Format(TIME_OUTPUT_FORMAT)
-				fmt.Printf("%45s\tValidFrom=\"%s\"\tValidTo=\"%s\"\tContent=\"%v\"\tFetched? %v\tResult=\"%v\"\n",
-					ip, validFromStr, validTillStr, cmd.Content, cmd.SeenByClient, cmd.ClientResult)
+				fmt.Printf("%45s\tID=\"%s\"\tValidFrom=\"%s\"\tValidTo=\"%s\"\tKind=\"%s\"\tParams=\"%s\"\tFetched? %v\tResult=\"%v\"\n",
+					ip, cmd.ID, validFromStr, validTillStr, cmd.Kind, formatNameValues(cmd.Params), cmd.SeenByClient, cmd.ClientResult)
+				if len(cmd.Result.Details) > 0 {
+					fmt.Printf("%45s\tSuccess? %v\tDetails=\"%s\"\n", "", cmd.Result.Success, formatNameValues(cmd.Result.Details))
+				}
 			}
 		}
 	}
@@ -503,55 +719,245 @@ func ShowKey(uuid string) error {
 	return nil
 }
 
-// SendCommand is a server routine that saves a new pending command to database record.
-func SendCommand() error {
+// formatNameValues returns labels, command parameters, or result details as space separated name=value pairs in sorted order.
+func formatNameValues(params map[string]string) string {
+	pairs := make([]string, 0, len(params))
+	for name, value := range params {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+/*
+SendCommand is a server routine that saves a new pending command to database record.
+If keyServer is empty, the command is sent to the local key server.
+*/
+func SendCommand(keyServer string) error {
 	sys.LockMem()
-	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	client, password, err := ConnectToAdminServer(keyServer)
 	if err != nil {
 		return err
 	}
-	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
-	// Test the connection and password
-	if err := client.Ping(keyserv.PingRequest{PlainPassword: password}); err != nil {
+	// Only offer the commands that the server understands
+	hello, err := client.Hello()
+	if err != nil {
 		return err
 	}
+	if !hello.Supports("SendCommand") {
+		return fmt.Errorf("Key server version \"%s\" does not support sending commands, please upgrade the server.", hello.ServerVersion)
+	}
 	// Interactively gather pending command details
-	uuid := sys.Input(true, "", "What is the UUID of disk affected by this command?")
-	db, err := OpenKeyDB(uuid)
-	if err != nil {
-		return err
+	var sel keyserv.CommandSelector
+	if hello.Supports("SendCommandBatch") {
+		if sel, err = promptCommandSelector(); err != nil {
+			return err
+		}
+	} else {
+		sel.UUID = sys.Input(true, "", "What is the UUID of disk affected by this command?")
+	}
+	if sel.UUID != "" {
+		if _, err := client.GetRecord(keyserv.GetRecordReq{PlainPassword: password, UUID: sel.UUID}); err != nil {
+			return err
+		}
+	}
+	if !hello.Supports("SendCommandBatch") {
+		sel.IP = sys.Input(true, "", "What is the IP address of computer who will receive this command?")
 	}
-	ip := sys.Input(true, "", "What is the IP address of computer who will receive this command?")
 	var cmd string
 	for {
-		if cmd = sys.Input(false, "umount", "What should the computer do? (%s|%s)", PendingCommandMount, PendingCommandUmount); cmd == "" {
-			cmd = "umount" // default action is "umount"
+		if cmd = sys.Input(false, PendingCommandUmount, "What should the computer do? (%s)", strings.Join(hello.CommandTypes, "|")); cmd == "" {
+			cmd = PendingCommandUmount // default action is "umount"
 		}
-		if cmd == PendingCommandUmount {
-			break
-		} else if cmd == PendingCommandMount {
+		if isCommandType(hello.CommandTypes, cmd) {
 			break
-		} else {
-			continue
 		}
 	}
+	var secret []byte
+	switch cmd {
+	case keyserv.CommandErase:
+		if !sys.InputBool(false, "The computers will irreversibly erase all data on the chosen disks, are you sure?") {
+			return errors.New("The command has been cancelled.")
+		}
+	case keyserv.CommandAddRecoveryKeyslot:
+		for {
+			passphrase := sys.InputPassword(true, "", "Enter the recovery passphrase that will unlock the disk (no echo)")
+			if passphrase == sys.InputPassword(true, "", "Enter the recovery passphrase again (no echo)") {
+				secret = []byte(passphrase)
+				break
+			}
+			fmt.Println("The passphrases do not match, please try again.")
+		}
+	}
+	var validFrom time.Time
+	if hello.Supports("ListCommands") {
+		// Key servers that predate scheduled commands would carry out the command right away
+		validFrom = promptCommandStart()
+	}
 	expireMin := sys.InputInt(true, 10, 1, 10080, "In how many minutes does the command expire (including the result)?")
+	validity := time.Duration(expireMin) * time.Minute
+	if sel.UUID == "" || sel.IP == "" {
+		// Fan out to many computers or disks
+		resp, err := client.SendCommandBatch(keyserv.SendCommandBatchReq{
+			PlainPassword: password,
+			Selector:      sel,
+			Kind:          cmd,
+			Secret:        secret,
+			ValidFrom:     validFrom,
+			Validity:      validity,
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to update database records - %v", err)
+		}
+		for _, target := range resp.Targets {
+			fmt.Printf("%45s\t%s\n", target.IP, target.UUID)
+		}
+		fmt.Printf("All done! The above %d computer(s) will be informed of the command when they come online and poll from this server.\n", len(resp.Targets))
+		fmt.Printf("To see the results, run \"cryptctl show-batch %s\".\n", resp.BatchID)
+		return nil
+	}
+	req := keyserv.SendCommandReq{
+		PlainPassword: password,
+		UUID:          sel.UUID,
+		IP:            sel.IP,
+		Kind:          cmd,
+		Secret:        secret,
+		ValidFrom:     validFrom,
+		Validity:      validity,
+	}
+	if cmd == PendingCommandMount || cmd == PendingCommandUmount {
+		// Key servers that predate typed commands only understand command content
+		req.Content = cmd
+	}
 	// Place the new pending command into database record
-	rec, _ := db.GetByUUID(uuid)
-	rec.AddPendingCommand(ip, keydb.PendingCommand{
-		ValidFrom: time.Now(),
-		Validity:  time.Duration(expireMin) * time.Minute,
-		Content:   cmd,
-	})
-	if _, err := db.Upsert(rec); err != nil {
+	if err := client.SendCommand(req); err != nil {
 		return fmt.Errorf("Failed to update database record - %v", err)
 	}
-	// Ask server to reload the record from disk
-	client.ReloadRecord(keyserv.ReloadRecordReq{PlainPassword: password, UUID: uuid})
-	fmt.Printf("All done! Computer %s will be informed of the command when it comes online and polls from this server.\n", ip)
+	fmt.Printf("All done! Computer %s will be informed of the command when it comes online and polls from this server.\n", sel.IP)
+	return nil
+}
+
+// promptCommandStart interactively asks for the moment from which on a command is handed to the computers, zero time means immediately.
+func promptCommandStart() time.Time {
+	for {
+		start := sys.Input(false, "", "When should the command be carried out? (\"YYYY-MM-DD HH:MM\" in zone %s, empty for now)", time.Now().Format("MST"))
+		if start == "" {
+			return time.Time{}
+		}
+		validFrom, err := time.ParseInLocation(COMMAND_START_INPUT_FORMAT, start, time.Local)
+		if err == nil {
+			return validFrom
+		}
+		fmt.Printf("Please enter date and time in the format \"%s\".\n", COMMAND_START_INPUT_FORMAT)
+	}
+}
+
+// promptCommandSelector interactively asks for the disks and computers that will receive a command.
+func promptCommandSelector() (sel keyserv.CommandSelector, err error) {
+	disks := sys.Input(true, "", "Which disks are affected by this command? Enter a disk UUID, or labels such as rack=r12")
+	if strings.Contains(disks, "=") {
+		if sel.Labels, err = keydb.ParseLabels(disks); err != nil {
+			return
+		}
+	} else {
+		sel.UUID = disks
+	}
+	computers := sys.Input(true, "", "Which computers will receive this command? Enter an IP address, a host group name, "+
+		"or \"*\" for all computers currently using the disks")
+	switch {
+	case computers == "*":
+		sel.AliveHosts = true
+	case net.ParseIP(computers) != nil:
+		sel.IP = computers
+	default:
+		sel.HostGroup = computers
+	}
+	return
+}
+
+/*
+ShowCommandBatch is a server routine that displays the commands sent to many computers or disks at once, along with
+their results. If keyServer is empty, the batch is looked up on the local key server.
+*/
+func ShowCommandBatch(keyServer, batchID string) error {
+	sys.LockMem()
+	client, password, err := ConnectToAdminServer(keyServer)
+	if err != nil {
+		return err
+	}
+	batch, err := client.GetCommandBatch(keyserv.GetCommandBatchReq{PlainPassword: password, BatchID: batchID})
+	if err != nil {
+		return err
+	}
+	tally := batch.Tally()
+	fmt.Printf("%-34s%s\n", "Batch", batch.ID)
+	fmt.Printf("%-34s%d\n", "Commands", len(batch.Commands))
+	for _, state := range []string{keydb.CommandStatePending, keydb.CommandStateDelivered, keydb.CommandStateSucceeded, keydb.CommandStateFailed} {
+		fmt.Printf("%-34s%d\n", strings.Title(state), tally[state])
+	}
+	for _, batchCmd := range batch.Commands {
+		cmd := batchCmd.Command
+		fmt.Printf("%45s\t%s (%s)\tKind=\"%s\"\tState=\"%s\"\tResult=\"%v\"\n",
+			cmd.IP, batchCmd.UUID, batchCmd.MountPoint, cmd.Kind, cmd.State(), cmd.ClientResult)
+		if len(cmd.Result.Details) > 0 {
+			fmt.Printf("%45s\tDetails=\"%s\"\n", "", formatNameValues(cmd.Result.Details))
+		}
+	}
+	return nil
+}
+
+/*
+ListCommands is a server routine that displays the scheduled, pending, delivered, and completed commands of all
+records. If keyServer is empty, the commands are listed by the local key server.
+*/
+func ListCommands(keyServer string) error {
+	sys.LockMem()
+	client, password, err := ConnectToAdminServer(keyServer)
+	if err != nil {
+		return err
+	}
+	cmds, err := client.ListCommands(keyserv.ListCommandsReq{PlainPassword: password})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Total: %d commands (date and time are in zone %s)\n", len(cmds), time.Now().Format("MST"))
+	// Completed commands are those that have succeeded or failed
+	sections := []struct {
+		title  string
+		states []string
+	}{
+		{"Scheduled", []string{keydb.CommandStateScheduled}},
+		{"Pending", []string{keydb.CommandStatePending}},
+		{"Delivered", []string{keydb.CommandStateDelivered}},
+		{"Completed", []string{keydb.CommandStateSucceeded, keydb.CommandStateFailed}},
+	}
+	for _, section := range sections {
+		fmt.Printf("\n%s:\n", section.title)
+		// Print result last, making output possible to be parsed by a program
+		// Max field length: 19 (Start), 19 (Expiry), 15 (IP), 20 (Kind), 9 (State), 36 (UUID), last field (result)
+		fmt.Println("Start               Expiry              Computer        Kind                 State     UUID                                 Result")
+		for _, diskCmd := range cmds {
+			cmd := diskCmd.Command
+			if !isCommandType(section.states, cmd.State()) {
+				continue
+			}
+			fmt.Printf("%-19s %-19s %-15s %-20s %-9s %-36s %s\n", cmd.ValidFrom.Format(TIME_OUTPUT_FORMAT),
+				cmd.ValidFrom.Add(cmd.Validity).Format(TIME_OUTPUT_FORMAT), cmd.IP, cmd.Kind, cmd.State(), diskCmd.UUID, cmd.ClientResult)
+		}
+	}
 	return nil
 }
 
+// isCommandType returns true only if the command content is among the command types.
+func isCommandType(commandTypes []string, cmd string) bool {
+	for _, cmdType := range commandTypes {
+		if cmdType == cmd {
+			return true
+		}
+	}
+	return false
+}
+
 // ClearPendingCommands is a server routine that clears all pending commands in a database record.
 func ClearPendingCommands() error {
 	sys.LockMem()
@@ -571,7 +977,7 @@ func ClearPendingCommands() error {
 	}
 	rec, _ := db.GetByUUID(uuid)
 	rec.ClearPendingCommands()
-	if _, err := db.Upsert(rec); err != nil {
+	if _, err := db.Upsert(nil, rec); err != nil {
 		return fmt.Errorf("Failed to update database record - %v", err)
 	}
 	// Ask server to reload the record from disk
@@ -579,3 +985,323 @@ func ClearPendingCommands() error {
 	fmt.Printf("All of %s's pending commands have been successfully cleared.\n", uuid)
 	return nil
 }
+
+/*
+confirmOverwrite asks user whether the existing files among those to be generated may be overwritten, and removes them
+if so. An error is returned if user wishes to keep them.
+*/
+func confirmOverwrite(filePaths ...string) error {
+	existing := make([]string, 0, len(filePaths))
+	for _, filePath := range filePaths {
+		if _, err := os.Stat(filePath); err == nil {
+			existing = append(existing, filePath)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	if !sys.InputBool(false, "The following files already exist:\n%s\nWould you like to overwrite them?", strings.Join(existing, "\n")) {
+		return fmt.Errorf("Existing files have been left untouched, please move them elsewhere and try again: %s", strings.Join(existing, ", "))
+	}
+	for _, filePath := range existing {
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("Failed to remove \"%s\" - %v", filePath, err)
+		}
+	}
+	return nil
+}
+
+// IssueClientCert is a server routine that uses the built-in certificate authority to issue a client certificate.
+func IssueClientCert() error {
+	sys.LockMem()
+	sysconf, err := sys.ParseSysconfigFile(SERVER_CONFIG_PATH, false)
+	if err != nil {
+		return fmt.Errorf("Failed to read configuration file \"%s\" - %v", SERVER_CONFIG_PATH, err)
+	}
+	caCertPath := sysconf.GetString(keyserv.SRV_CONF_TLS_CA, "")
+	caKeyPath := sysconf.GetString(keyserv.SRV_CONF_TLS_CA_KEY, "")
+	if caCertPath == "" || caKeyPath == "" {
+		return errors.New("This key server does not use the built-in certificate authority. Please issue client certificates using your own certificate authority.")
+	}
+	ca, err := keyserv.LoadCertAuthority(caCertPath, caKeyPath)
+	if err != nil {
+		return err
+	}
+	commonName := sys.Input(true, "", "Host name of the client computer")
+	outDir := SERVER_CLIENTTLS_PATH
+	for {
+		if outDir = sys.Input(false, SERVER_CLIENTTLS_PATH, "Directory to store the client certificate and key"); outDir == "" {
+			outDir = SERVER_CLIENTTLS_PATH
+		}
+		if path.IsAbs(outDir) {
+			break
+		}
+		fmt.Println("Please enter an absolute path led by a slash.")
+	}
+	if err := os.MkdirAll(outDir, 0700); err != nil {
+		return fmt.Errorf("Failed to create directory \"%s\" - %v", outDir, err)
+	}
+	certPath := path.Join(outDir, commonName+".crt")
+	keyPath := path.Join(outDir, commonName+".key")
+	if err := confirmOverwrite(certPath, keyPath); err != nil {
+		return err
+	}
+	if err := ca.IssueClientCert(commonName, certPath, keyPath); err != nil {
+		return err
+	}
+	fmt.Printf(`
+Client certificate has been issued for host name "%s":
+%s
+%s
+
+Copy both files to the client computer, along with certificate authority file "%s".
+Enter their locations when cryptctl commands on the client computer ask for client certificate and key.
+To make the key server require client certificates, run "cryptctl init-server" and answer yes to client validation.
+`, commonName, certPath, keyPath, caCertPath)
+	return nil
+}
+
+// ApproveClient is a server routine that lists pending client certificate requests and approves or rejects one of them.
+func ApproveClient() error {
+	sys.LockMem()
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return err
+	}
+	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
+	reqs, err := client.ListCertRequests(keyserv.ListCertRequestsReq{PlainPassword: password})
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]keyserv.ClientCertRequest)
+	fmt.Printf("%-32s %-19s %-15s %-30s %s\n", "Request ID", "Submitted", "IP", "Host Name", "Common Name")
+	for _, req := range reqs {
+		if req.IsApproved() {
+			// Approved requests only wait for client to collect the certificate
+			continue
+		}
+		pending[req.ID] = req
+		fmt.Printf("%-32s %-19s %-15s %-30s %s\n", req.ID, req.SubmittedAt.Format(TIME_OUTPUT_FORMAT), req.IP, req.Hostname, req.CommonName)
+	}
+	if len(pending) == 0 {
+		fmt.Println("There are no certificate requests waiting for approval.")
+		return nil
+	}
+	fmt.Println()
+	var id string
+	for {
+		id = sys.Input(true, "", "Enter the request ID to approve or reject")
+		if _, found := pending[id]; found {
+			break
+		}
+		fmt.Println("Cannot find the request ID.")
+	}
+	req := pending[id]
+	if sys.InputBool(false, `Issue a client certificate to %s (%s) for common name "%s"`, req.IP, req.Hostname, req.CommonName) {
+		if err := client.ApproveCertRequest(keyserv.ApproveCertRequestReq{PlainPassword: password, ID: id}); err != nil {
+			return err
+		}
+		fmt.Println("The request has been approved, the client computer will collect its certificate shortly.")
+		return nil
+	}
+	if !sys.InputBool(false, "Reject and remove the request") {
+		return errors.New("Operation is cancelled.")
+	}
+	if err := client.ApproveCertRequest(keyserv.ApproveCertRequestReq{PlainPassword: password, ID: id, Reject: true}); err != nil {
+		return err
+	}
+	fmt.Println("The request has been rejected.")
+	return nil
+}
+
+// ApproveHost is a server routine that approves or refuses a computer that asked for a key it is not known to use.
+func ApproveHost() error {
+	sys.LockMem()
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return err
+	}
+	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
+	recs, err := client.ListRecords(keyserv.ListRecordsReq{PlainPassword: password})
+	if err != nil {
+		return err
+	}
+	type pendingHost struct {
+		rec     keydb.Record
+		attempt keydb.AliveMessage
+	}
+	pending := make([]pendingHost, 0, 0)
+	for _, rec := range recs {
+		for _, attempt := range rec.PendingHosts {
+			pending = append(pending, pendingHost{rec: rec, attempt: attempt})
+		}
+	}
+	if len(pending) == 0 {
+		fmt.Println("There are no computers waiting for approval.")
+		return nil
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].attempt.Timestamp < pending[j].attempt.Timestamp
+	})
+	fmt.Printf("%-4s %-15s %-30s %-19s %-36s %s\n", "No.", "IP", "Host Name", "Latest Attempt", "UUID", "Mount Point")
+	for i, host := range pending {
+		fmt.Printf("%-4d %-15s %-30s %-19s %-36s %s\n", i+1, host.attempt.IP, host.attempt.Hostname,
+			time.Unix(host.attempt.Timestamp, 0).Format(TIME_OUTPUT_FORMAT), host.rec.UUID, host.rec.MountPoint)
+	}
+	fmt.Println()
+	host := pending[sys.InputInt(true, 1, 1, len(pending), "Enter the number of the computer to approve or refuse")-1]
+	req := keyserv.ApproveHostReq{PlainPassword: password, UUID: host.rec.UUID, IP: host.attempt.IP}
+	if sys.InputBool(false, `Let %s (%s) retrieve the key of "%s" without password`, host.attempt.IP, host.attempt.Hostname, host.rec.MountPoint) {
+		if err := client.ApproveHost(req); err != nil {
+			return err
+		}
+		fmt.Println("The computer has been approved, it will retrieve the key shortly.")
+		return nil
+	}
+	if !sys.InputBool(false, "Refuse the computer") {
+		return errors.New("Operation is cancelled.")
+	}
+	req.Reject = true
+	if err := client.ApproveHost(req); err != nil {
+		return err
+	}
+	fmt.Println("The computer has been refused.")
+	return nil
+}
+
+// ApproveOperation is a server routine that approves or rejects an operation submitted by another administrator.
+func ApproveOperation() error {
+	sys.LockMem()
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return err
+	}
+	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
+	approvals, err := client.ListApprovals(keyserv.ListApprovalsReq{PlainPassword: password})
+	if err != nil {
+		return err
+	}
+	pending := make(map[string]keyserv.PendingApproval)
+	fmt.Printf("%-32s %-19s %-16s %-20s %-15s %s\n", "Approval ID", "Requested", "Operation", "Requester", "IP", "Host Name")
+	for _, approval := range approvals {
+		if approval.IsApproved() {
+			// Approved operations only wait for the requester to execute them
+			continue
+		}
+		pending[approval.ID] = approval
+		fmt.Printf("%-32s %-19s %-16s %-20s %-15s %s\n", approval.ID, approval.RequestedAt.Format(TIME_OUTPUT_FORMAT),
+			approval.Operation, approval.Requester, approval.IP, approval.Hostname)
+	}
+	if len(pending) == 0 {
+		fmt.Println("There are no operations waiting for approval.")
+		return nil
+	}
+	fmt.Println()
+	var id string
+	for {
+		id = sys.Input(true, "", "Enter the approval ID to approve or reject")
+		if _, found := pending[id]; found {
+			break
+		}
+		fmt.Println("Cannot find the approval ID.")
+	}
+	approval := pending[id]
+	fmt.Printf("%s on %s (%s) wants to carry out %s of:\n", approval.Requester, approval.IP, approval.Hostname, approval.Operation)
+	for _, uuid := range approval.UUIDs {
+		fmt.Printf("  %s\n", uuid)
+	}
+	if sys.InputBool(false, "Approve the operation") {
+		if err := client.ApproveOperation(keyserv.ApproveOperationReq{PlainPassword: password, ID: id}); err != nil {
+			return err
+		}
+		fmt.Println("The operation has been approved, the requester will carry it out shortly.")
+		return nil
+	}
+	if !sys.InputBool(false, "Reject and remove the operation") {
+		return errors.New("Operation is cancelled.")
+	}
+	if err := client.ApproveOperation(keyserv.ApproveOperationReq{PlainPassword: password, ID: id, Reject: true}); err != nil {
+		return err
+	}
+	fmt.Println("The operation has been rejected.")
+	return nil
+}
+
+// RevokeClient is a server routine that revokes client certificates, denies hosts, and lifts earlier revocations.
+func RevokeClient() error {
+	sys.LockMem()
+	client, err := keyserv.NewCryptClient("unix", keyserv.DomainSocketFile, nil, "", "")
+	if err != nil {
+		return err
+	}
+	password := sys.InputPassword(true, "", "Enter key server's password (no echo)")
+	revocations, err := client.ListRevocations(keyserv.ListRevocationsReq{PlainPassword: password})
+	if err != nil {
+		return err
+	}
+	if len(revocations) > 0 {
+		fmt.Printf("%-4s %-11s %-64s %-19s %s\n", "No.", "Kind", "Value", "Revoked", "Reason")
+		for i, entry := range revocations {
+			fmt.Printf("%-4d %-11s %-64s %-19s %s\n", i+1, entry.Kind, entry.Value, entry.RevokedAt.Format(TIME_OUTPUT_FORMAT), entry.Reason)
+		}
+		fmt.Println()
+	}
+	fmt.Println(`What would you like to do?
+  1. Revoke a client certificate file
+  2. Revoke a client certificate by its serial number
+  3. Revoke a client certificate by its SHA-256 fingerprint
+  4. Deny a host by its IP address or host name
+  5. Lift an existing revocation`)
+	req := keyserv.RevokeClientReq{PlainPassword: password}
+	switch sys.InputInt(true, 1, 1, 5, "Please enter a number") {
+	case 1:
+		certPath := sys.InputAbsFilePath(true, "", "Path of the PEM-encoded client certificate")
+		certPEM, err := ioutil.ReadFile(certPath)
+		if err != nil {
+			return fmt.Errorf("Failed to read file \"%s\" - %v", certPath, err)
+		}
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			return fmt.Errorf("File \"%s\" does not contain a PEM-encoded certificate", certPath)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("Failed to parse certificate \"%s\" - %v", certPath, err)
+		}
+		req.Kind = keyserv.RevokeSerial
+		req.Value = keyserv.CertSerial(cert)
+	case 2:
+		req.Kind = keyserv.RevokeSerial
+		req.Value = sys.Input(true, "", "Serial number in hex")
+	case 3:
+		req.Kind = keyserv.RevokeFingerprint
+		req.Value = sys.Input(true, "", "SHA-256 fingerprint in hex")
+	case 4:
+		req.Kind = keyserv.RevokeHost
+		req.Value = sys.Input(true, "", "IP address or host name")
+	case 5:
+		if len(revocations) == 0 {
+			fmt.Println("There is nothing to lift.")
+			return nil
+		}
+		num := sys.InputInt(true, 0, 1, len(revocations), "Number of the revocation to lift")
+		if num == 0 {
+			return errors.New("Operation is cancelled.")
+		}
+		entry := revocations[num-1]
+		req.Kind = entry.Kind
+		req.Value = entry.Value
+		req.Lift = true
+		if err := client.RevokeClient(req); err != nil {
+			return err
+		}
+		fmt.Printf("Revocation of %s \"%s\" has been lifted.\n", entry.Kind, entry.Value)
+		return nil
+	}
+	req.Reason = sys.Input(false, "", "(Optional) reason of the revocation")
+	if err := client.RevokeClient(req); err != nil {
+		return err
+	}
+	fmt.Printf("%s \"%s\" has been revoked, the key server will refuse its connections from now on.\n", req.Kind, req.Value)
+	return nil
+}
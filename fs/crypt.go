@@ -7,6 +7,7 @@ import (
 	"cryptctl/sys"
 	"fmt"
 	"os"
+	"os/exec"
 	"path"
 	"strconv"
 	"strings"
@@ -80,6 +81,66 @@ func CryptErase(blockDev string) error {
 	return nil
 }
 
+// Call cryptsetup luksOpen in test mode to find out whether the key unlocks the block device node.
+func CryptTestKey(key []byte, blockDev string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	_, stdout, stderr, err := sys.Exec(bytes.NewReader(key), nil, nil,
+		BIN_CRYPTSETUP, "--batch-mode", "luksOpen", "--test-passphrase", "--key-file=-", blockDev)
+	if err != nil {
+		return fmt.Errorf("CryptTestKey: the key does not unlock \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return nil
+}
+
+/*
+Call cryptsetup luksAddKey to add the new key into a free key slot of the block device node, the existing key authorises
+the operation. Neither key is ever written to a file.
+*/
+func CryptAddKey(key, newKey []byte, blockDev string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	// The existing key comes from stdin, the new key comes from a pipe inherited as file descriptor 3.
+	newKeyIn, newKeyOut, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("CryptAddKey: failed to create pipe - %v", err)
+	}
+	defer newKeyIn.Close()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(BIN_CRYPTSETUP, "--batch-mode", "luksAddKey", "--key-file=-", blockDev, "/dev/fd/3")
+	cmd.Stdin = bytes.NewReader(key)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.ExtraFiles = []*os.File{newKeyIn}
+	if err := cmd.Start(); err != nil {
+		newKeyOut.Close()
+		return fmt.Errorf("CryptAddKey: failed to start cryptsetup - %v", err)
+	}
+	go func() {
+		newKeyOut.Write(newKey)
+		newKeyOut.Close()
+	}()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("CryptAddKey: failed to add key to \"%s\" - %v %s %s", blockDev, err, stdout.String(), stderr.String())
+	}
+	return nil
+}
+
+// Call cryptsetup luksRemoveKey to remove the key slot that the key unlocks from the block device node.
+func CryptRemoveKey(key []byte, blockDev string) error {
+	if err := CheckBlockDevice(blockDev); err != nil {
+		return err
+	}
+	_, stdout, stderr, err := sys.Exec(bytes.NewReader(key), nil, nil,
+		BIN_CRYPTSETUP, "--batch-mode", "luksRemoveKey", "--key-file=-", blockDev)
+	if err != nil {
+		return fmt.Errorf("CryptRemoveKey: failed to remove key from \"%s\" - %v %s %s", blockDev, err, stdout, stderr)
+	}
+	return nil
+}
+
 // Call cryptsetup luksClose on the mapped device node.
 func CryptClose(name string) error {
 	_, stdout, stderr, err := sys.Exec(nil, nil, nil,
@@ -4,13 +4,12 @@ package keydb
 
 import (
 	"cryptctl/fs"
+	"cryptctl/sys"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
-	"reflect"
 	"sort"
 	"strconv"
 	"sync"
@@ -22,17 +21,30 @@ const (
 	DB_REC_FILE_MODE = 0600
 )
 
+var ErrRecordNotFound = errors.New("record does not exist") // ErrRecordNotFound is returned when a record of the UUID does not exist.
+
 /*
 The database of key records reside in a directory, each key record is serialised into a file.
 All key records are read into memory upon startup for fast retrieval.
+Functions that change records take the logger of the request they are made for, nil stands for the database's logger.
 All exported functions are safe for concurrent usage.
 */
 type DB struct {
 	Dir             string
-	RecordsByUUID   map[string]Record // key is record UUID string
-	RecordsByID     map[string]Record // when saved by built-in KMIP server, the ID is a sequence number; otherwise it can be anything.
-	LastSequenceNum int64             // the last sequence number currently in-use
-	Lock            *sync.RWMutex     // prevent concurrent access to records
+	RecordsByUUID   map[string]Record        // key is record UUID string
+	RecordsByID     map[string]Record        // when saved by built-in KMIP server, the ID is a sequence number; otherwise it can be anything.
+	LastSequenceNum int64                    // the last sequence number currently in-use
+	Lock            *sync.RWMutex            // prevent concurrent access to records
+	Log             *sys.Logger              // Log is the logger of operations that are not made on behalf of a request.
+	cmdWaiters      map[string]chan struct{} // cmdWaiters are closed to wake up computers (by IP) waiting for pending commands
+}
+
+// logger returns the logger of a database operation, or the database's logger if it is nil.
+func (db *DB) logger(log *sys.Logger) *sys.Logger {
+	if log == nil {
+		return db.Log
+	}
+	return log
 }
 
 // Open a key database directory and read all key records into memory. Caller should consider to lock memory.
@@ -127,7 +139,7 @@ func (db *DB) ReloadDB() error {
 				recordsToUpgrade = append(recordsToUpgrade, keyRecord)
 			}
 		} else {
-			log.Printf("DB.ReloadDB: non-fatal failure occured when reading record \"%s\" - %v", filePath, err)
+			db.Log.Warning("DB.ReloadDB: non-fatal failure occured when reading record", "file", filePath, "error", err)
 		}
 	}
 	/*
@@ -140,7 +152,7 @@ func (db *DB) ReloadDB() error {
 			return err
 		}
 	}
-	log.Printf("DB.ReloadDB: successfully loaded database of %d records", len(db.RecordsByUUID))
+	db.Log.Info("DB.ReloadDB: successfully loaded database", "records", len(db.RecordsByUUID))
 	return nil
 }
 
@@ -153,7 +165,34 @@ func (db *DB) UpgradeRecord(record Record) error {
 		// Version 2 brings PendingCommands map
 		record.Version = 2
 		record.PendingCommands = make(map[string][]PendingCommand)
-		if _, err := db.upsert(record, true); err != nil {
+		fallthrough
+	case 2:
+		// Version 3 brings known hosts, computers that have used the key so far continue to be trusted.
+		record.Version = 3
+		for ip := range record.AliveMessages {
+			record.AddKnownHost(ip)
+		}
+		if record.LastRetrieval.IP != "" {
+			record.AddKnownHost(record.LastRetrieval.IP)
+		}
+		fallthrough
+	case 3:
+		// Version 4 brings typed pending commands, the content of older commands was the kind - "mount" or "umount".
+		record.Version = 4
+		for _, cmds := range record.PendingCommands {
+			for i, cmd := range cmds {
+				if cmds[i].ID == "" {
+					var err error
+					if cmds[i].ID, err = NewCommandID(); err != nil {
+						return err
+					}
+				}
+				if kind, isString := cmd.Content.(string); isString && cmd.Kind == "" {
+					cmds[i].Kind = kind
+				}
+			}
+		}
+		if _, err := db.upsert(nil, record, true); err != nil {
 			return err
 		}
 	default:
@@ -171,18 +210,18 @@ func (db *DB) UpgradeRecordToVersion1(record Record) error {
 		By contract, upsert assigns a record a sequence number if it does not yet have one.
 		After successful update, the record is updated in both RecordsByUUID and RecordsByID.
 	*/
-	_, err := db.upsert(record, true)
+	_, err := db.upsert(nil, record, true)
 	if err != nil {
 		return err
 	}
-	log.Printf("DB.UpgradeRecordToVersion1: just upgraded record \"%s\"", record.UUID)
+	db.Log.Info("DB.UpgradeRecordToVersion1: just upgraded record", "uuid", record.UUID)
 	return nil
 }
 
 // Log the input error, then return a new error with a more comprehensive and friendlier message.
-func (db *DB) logIOFailure(rec Record, err error) error {
+func (db *DB) logIOFailure(log *sys.Logger, rec Record, err error) error {
 	failMessage := fmt.Sprintf("keydb: failed to write db record file for %s - %v", rec.UUID, err)
-	log.Print(failMessage)
+	db.logger(log).Error("DB.upsert: failed to write db record file", "uuid", rec.UUID, "error", err)
 	return errors.New(failMessage)
 }
 
@@ -191,7 +230,7 @@ Create/update and immediately persist a key record.
 If the record does not yet have a KMIP ID, it will be given a sequence number as ID.
 IO errors are returned and logged to stderr.
 */
-func (db *DB) upsert(rec Record, doSync bool) (string, error) {
+func (db *DB) upsert(log *sys.Logger, rec Record, doSync bool) (string, error) {
 	// Initialise incomplete nil values of the struct
 	if rec.PendingCommands == nil {
 		rec.PendingCommands = make(map[string][]PendingCommand)
@@ -208,14 +247,14 @@ func (db *DB) upsert(rec Record, doSync bool) (string, error) {
 	if err == nil {
 		defer fh.Close()
 	} else {
-		return "", db.logIOFailure(rec, err)
+		return "", db.logIOFailure(log, rec, err)
 	}
 	if _, err := fh.Write(rec.Serialise()); err != nil {
-		return "", db.logIOFailure(rec, err)
+		return "", db.logIOFailure(log, rec, err)
 	}
 	if doSync {
 		if err := fh.Sync(); err != nil {
-			return "", db.logIOFailure(rec, err)
+			return "", db.logIOFailure(log, rec, err)
 		}
 	}
 	// The in-memory copy of record is kept up to date with the copy on disk.
@@ -225,10 +264,86 @@ func (db *DB) upsert(rec Record, doSync bool) (string, error) {
 }
 
 // Create/update and immediately persist a key record. IO errors are returned and logged to stderr.
-func (db *DB) Upsert(rec Record) (kmipID string, err error) {
+func (db *DB) Upsert(log *sys.Logger, rec Record) (kmipID string, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	// The caller keeps its copy of the record and may change it afterwards
+	return db.upsert(log, rec.Copy(), true)
+}
+
+/*
+recordToChange returns a copy of the record by UUID. The database changes a copy and then upserts it, instead of
+changing its record in place, because the records handed out to readers share maps and slices with it.
+Caller must hold the lock.
+*/
+func (db *DB) recordToChange(uuid string) (rec Record, found bool) {
+	rec, found = db.RecordsByUUID[uuid]
+	if found {
+		rec = rec.Copy()
+	}
+	return
+}
+
+/*
+Update lets the function make changes to a key record, and then immediately persists the record.
+If the function returns an error, the record is not saved and the error is returned.
+*/
+func (db *DB) Update(log *sys.Logger, uuid string, change func(rec *Record) error) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.recordToChange(uuid)
+	if !found {
+		return fmt.Errorf("DB.Update: %w - %s", ErrRecordNotFound, uuid)
+	}
+	if err := change(&rec); err != nil {
+		return err
+	}
+	_, err := db.upsert(log, rec, true)
+	return err
+}
+
+/*
+AddPendingCommand stores a pending command in a key record along with its optional secret, immediately persists the record,
+and wakes up the computer if it is waiting for commands. The woken computer polls a record that is never changed
+afterwards, as the command is added to a copy of the record.
+*/
+func (db *DB) AddPendingCommand(log *sys.Logger, uuid, ip string, cmd PendingCommand, secret []byte) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.recordToChange(uuid)
+	if !found {
+		return fmt.Errorf("DB.AddPendingCommand: %w - %s", ErrRecordNotFound, uuid)
+	}
+	rec.AddPendingCommand(ip, cmd)
+	if secret != nil {
+		rec.SetCommandSecret(cmd.ID, secret)
+	}
+	if _, err := db.upsert(log, rec, true); err != nil {
+		return err
+	}
+	if waiter, found := db.cmdWaiters[ip]; found {
+		close(waiter)
+		delete(db.cmdWaiters, ip)
+	}
+	return nil
+}
+
+/*
+CommandNotification returns a channel that is closed as soon as a pending command is added for the computer of the IP.
+A computer may wait on the channel instead of polling for commands repeatedly.
+*/
+func (db *DB) CommandNotification(ip string) <-chan struct{} {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
-	return db.upsert(rec, true)
+	if db.cmdWaiters == nil {
+		db.cmdWaiters = make(map[string]chan struct{})
+	}
+	waiter, found := db.cmdWaiters[ip]
+	if !found {
+		waiter = make(chan struct{})
+		db.cmdWaiters[ip] = waiter
+	}
+	return waiter
 }
 
 // Retrieve a key record by its KMIP ID.
@@ -248,14 +363,14 @@ func (db *DB) GetByUUID(uuid string) (rec Record, found bool) {
 }
 
 // Record and immediately persist alive message that came from a host.
-func (db *DB) UpdateAliveMessage(latest AliveMessage, uuids ...string) (rejected []string) {
+func (db *DB) UpdateAliveMessage(log *sys.Logger, latest AliveMessage, uuids ...string) (rejected []string) {
 	rejected = make([]string, 0, 8)
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
 	for _, uuid := range uuids {
-		if record, exists := db.RecordsByUUID[uuid]; exists {
+		if record, exists := db.recordToChange(uuid); exists {
 			if record.UpdateAliveMessage(latest) {
-				db.upsert(record, false) // IO error is logged
+				db.upsert(log, record, false) // IO error is logged
 			} else {
 				// Host is no longer considered to be alive
 				rejected = append(rejected, uuid)
@@ -268,22 +383,36 @@ func (db *DB) UpdateAliveMessage(latest AliveMessage, uuids ...string) (rejected
 	return
 }
 
+// Release the leases held by a host on the records of those UUIDs, and immediately persist the records that have changed.
+func (db *DB) ReleaseLease(log *sys.Logger, hostIP, leaseID string, uuids ...string) (released []string) {
+	released = make([]string, 0, len(uuids))
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	for _, uuid := range uuids {
+		if record, exists := db.recordToChange(uuid); exists && record.ReleaseLease(hostIP, leaseID) {
+			db.upsert(log, record, true) // IO error is logged
+			released = append(released, uuid)
+		}
+	}
+	return
+}
+
 // Retrieve key records that belong to those UUIDs, and immediately persist last-retrieval information on those records.
-func (db *DB) Select(aliveMessage AliveMessage, checkMaxActive bool, uuids ...string) (found map[string]Record, rejected, missing []string) {
+func (db *DB) Select(log *sys.Logger, aliveMessage AliveMessage, checkMaxActive bool, uuids ...string) (found map[string]Record, rejected, missing []string) {
 	found = make(map[string]Record)
 	rejected = make([]string, 0, 8)
 	missing = make([]string, 0, 8)
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
 	for _, uuid := range uuids {
-		if record, exists := db.RecordsByUUID[uuid]; exists {
+		if record, exists := db.recordToChange(uuid); exists {
 			// Log dead hosts
 			ok, deadFinalMessage := record.UpdateLastRetrieval(aliveMessage, checkMaxActive)
 			if len(deadFinalMessage) > 0 {
-				log.Printf("DB.Select: record %s has not heard %d from these hosts: %+v", uuid, time.Now().Unix(), deadFinalMessage)
+				db.logger(log).Info("DB.Select: record has not heard from these hosts", "uuid", uuid, "time", time.Now().Unix(), "dead_hosts", deadFinalMessage)
 			}
 			if ok {
-				db.upsert(record, true) // IO error is logged
+				db.upsert(log, record, true) // IO error is logged
 				found[record.UUID] = record
 			} else {
 				// Too many active hosts
@@ -304,6 +433,7 @@ func (db *DB) List() (sortedRecords RecordSlice) {
 	for _, rec := range db.RecordsByUUID {
 		// Do not return encryption key
 		rec.Key = nil
+		rec.CommandSecrets = nil
 		sortedRecords = append(sortedRecords, rec)
 	}
 	sort.Sort(sortedRecords)
@@ -311,7 +441,7 @@ func (db *DB) List() (sortedRecords RecordSlice) {
 }
 
 // Erase a record from both memory and disk.
-func (db *DB) Erase(uuid string) error {
+func (db *DB) Erase(log *sys.Logger, uuid string) error {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
 	rec, exists := db.RecordsByUUID[uuid]
@@ -323,50 +453,76 @@ func (db *DB) Erase(uuid string) error {
 	if err := fs.SecureErase(path.Join(db.Dir, uuid), true); err != nil {
 		return fmt.Errorf("DB.Erase: failed to delete db record for %s - %v", uuid, err)
 	}
+	db.logger(log).Info("DB.Erase: erased record", "uuid", uuid)
 	return nil
 }
 
 /*
 UpdateSeenFlag updates "seen" flag of a pending command to true.
-The flag is updated by looking for a command record matched to the specified IP, array index, and content.
+The flag is updated by looking for a command record matched to the specified IP and command ID.
 If a matching record is not found, the function will do nothing.
 */
-func (db *DB) UpdateSeenFlag(uuid, ip string, content interface{}) {
+func (db *DB) UpdateSeenFlag(log *sys.Logger, uuid, ip, id string) {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
-	rec, found := db.RecordsByUUID[uuid]
+	rec, found := db.recordToChange(uuid)
 	if !found {
 		return
 	}
 	cmds, found := rec.PendingCommands[ip]
 	for i, cmd := range cmds {
-		if reflect.DeepEqual(cmd.Content, content) {
+		if cmd.ID == id {
 			cmds[i].SeenByClient = true
 			break
 		}
 	}
-	db.upsert(rec, false)
+	db.upsert(log, rec, false)
 }
 
 /*
-UpdateCommandResult updates execution result of a pending command.
-The pending command is updated by looking for a command record matched to the specified UUID, IP, and content.
+UpdateCommandResult updates execution result of a pending command, and forgets the command's secret.
+The pending command is updated by looking for a command record matched to the specified UUID, IP, and command ID.
 If a matching record is not found, the function will do nothing.
 */
-func (db *DB) UpdateCommandResult(uuid, ip string, content interface{}, result string) {
+func (db *DB) UpdateCommandResult(log *sys.Logger, uuid, ip, id, clientResult string, result CommandResult) {
 	db.Lock.Lock()
 	defer db.Lock.Unlock()
-	rec, found := db.RecordsByUUID[uuid]
+	rec, found := db.recordToChange(uuid)
 	if !found {
 		return
 	}
-	cmds, found := rec.PendingCommands[ip]
-	for i, cmd := range cmds {
-		if cmd.Content == content {
-			cmds[i].SeenByClient = true
-			cmds[i].ClientResult = result
-			break
-		}
+	_, hadSecret := rec.CommandSecrets[id]
+	if rec.SetCommandResult(ip, id, clientResult, result) {
+		// The secret must not linger in the record file
+		db.upsert(log, rec, hadSecret)
 	}
-	db.upsert(rec, false)
+}
+
+/*
+ReplaceKey gives a record a new encryption key and immediately persists the record. If the key is stored on an external
+KMIP server, the new KMIP ID replaces the old one instead. The secret of the command that delivered the new key is removed
+along the way. Return the old KMIP ID.
+*/
+func (db *DB) ReplaceKey(log *sys.Logger, uuid, commandID, newID string, newKey []byte) (oldID string, err error) {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	rec, found := db.recordToChange(uuid)
+	if !found {
+		return "", fmt.Errorf("DB.ReplaceKey: %w - %s", ErrRecordNotFound, uuid)
+	}
+	oldID = rec.ID
+	if newID != "" {
+		rec.ID = newID
+	}
+	if newKey != nil {
+		rec.Key = newKey
+	}
+	delete(rec.CommandSecrets, commandID)
+	if _, err = db.upsert(log, rec, true); err != nil {
+		return
+	}
+	if oldID != rec.ID {
+		delete(db.RecordsByID, oldID)
+	}
+	return
 }
@@ -3,8 +3,11 @@
 package keydb
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -52,10 +55,10 @@ func TestRecordCRUD(t *testing.T) {
 	rec2Alive := rec2
 	rec2Alive.LastRetrieval = aliveMsg
 	rec2Alive.AliveMessages = map[string][]AliveMessage{aliveMsg.IP: []AliveMessage{aliveMsg}}
-	if seq, err := db.Upsert(rec1); err != nil || seq != "1" {
+	if seq, err := db.Upsert(nil, rec1); err != nil || seq != "1" {
 		t.Fatal(err, seq)
 	}
-	if seq, err := db.Upsert(rec2); err != nil || seq != "2" {
+	if seq, err := db.Upsert(nil, rec2); err != nil || seq != "2" {
 		t.Fatal(err, seq)
 	}
 	// Match sequence number in my copy of records with their should-be ones
@@ -64,17 +67,17 @@ func TestRecordCRUD(t *testing.T) {
 	rec2.ID = "2"
 	rec2Alive.ID = "2"
 	// Select one record and then select both records
-	if found, rejected, missing := db.Select(aliveMsg, true, "1", "doesnotexist"); !reflect.DeepEqual(found, map[string]Record{rec1.UUID: rec1Alive}) ||
+	if found, rejected, missing := db.Select(nil, aliveMsg, true, "1", "doesnotexist"); !reflect.DeepEqual(found, map[string]Record{rec1.UUID: rec1Alive}) ||
 		!reflect.DeepEqual(rejected, []string{}) ||
 		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
 		t.Fatalf("\n%+v\n%+v\n%+v\n%+v\n", found, map[string]Record{rec1.UUID: rec1Alive}, rejected, missing)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, true, "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec2.UUID: rec2Alive}) ||
+	if found, rejected, missing := db.Select(nil, aliveMsg, true, "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec2.UUID: rec2Alive}) ||
 		!reflect.DeepEqual(rejected, []string{"1"}) ||
 		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
 		t.Fatal(found, rejected, missing)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, false, "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec1.UUID: rec1Alive, rec2.UUID: rec2Alive}) ||
+	if found, rejected, missing := db.Select(nil, aliveMsg, false, "1", "doesnotexist", "2"); !reflect.DeepEqual(found, map[string]Record{rec1.UUID: rec1Alive, rec2.UUID: rec2Alive}) ||
 		!reflect.DeepEqual(rejected, []string{}) ||
 		!reflect.DeepEqual(missing, []string{"doesnotexist"}) {
 		t.Fatal(found, rejected, missing)
@@ -85,7 +88,7 @@ func TestRecordCRUD(t *testing.T) {
 		IP:        "ip1",
 		Timestamp: time.Now().Unix(),
 	}
-	if rejected := db.UpdateAliveMessage(newAlive, "1", "2", "doesnotexist"); !reflect.DeepEqual(rejected, []string{"doesnotexist"}) {
+	if rejected := db.UpdateAliveMessage(nil, newAlive, "1", "2", "doesnotexist"); !reflect.DeepEqual(rejected, []string{"doesnotexist"}) {
 		t.Fatal(rejected)
 	}
 	if len(db.RecordsByUUID["1"].AliveMessages["ip1"]) != 2 || len(db.RecordsByUUID["2"].AliveMessages["ip1"]) != 2 {
@@ -95,13 +98,13 @@ func TestRecordCRUD(t *testing.T) {
 		t.Fatal(db.RecordsByUUID)
 	}
 	// Erase a record
-	if err := db.Erase("doesnotexist"); err == nil {
+	if err := db.Erase(nil, "doesnotexist"); err == nil {
 		t.Fatal("did not error")
 	}
-	if err := db.Erase(rec1.UUID); err != nil {
+	if err := db.Erase(nil, rec1.UUID); err != nil {
 		t.Fatal(err)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, true, "1"); len(found) != 0 ||
+	if found, rejected, missing := db.Select(nil, aliveMsg, true, "1"); len(found) != 0 ||
 		!reflect.DeepEqual(rejected, []string{}) ||
 		!reflect.DeepEqual(missing, []string{"1"}) {
 		t.Fatal(found, rejected, missing)
@@ -111,7 +114,7 @@ func TestRecordCRUD(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if found, rejected, missing := db.Select(aliveMsg, true, "1", "2"); len(found) != 0 ||
+	if found, rejected, missing := db.Select(nil, aliveMsg, true, "1", "2"); len(found) != 0 ||
 		!reflect.DeepEqual(rejected, []string{"2"}) ||
 		!reflect.DeepEqual(missing, []string{"1"}) {
 		t.Fatal(found, missing)
@@ -138,7 +141,7 @@ func TestOpenDBOneRecord(t *testing.T) {
 		AliveMessages:   make(map[string][]AliveMessage),
 		PendingCommands: make(map[string][]PendingCommand),
 	}
-	if seq, err := db.Upsert(rec); err != nil || seq != "1" {
+	if seq, err := db.Upsert(nil, rec); err != nil || seq != "1" {
 		t.Fatal(err)
 	}
 	dbOneRecord, err := OpenDBOneRecord(TestDBDir, "a")
@@ -215,13 +218,13 @@ func TestList(t *testing.T) {
 	}
 	rec3NoKey := rec3
 	rec3NoKey.Key = nil
-	if seq, err := db.Upsert(rec1); err != nil || seq != "1" {
+	if seq, err := db.Upsert(nil, rec1); err != nil || seq != "1" {
 		t.Fatal(err, seq)
 	}
-	if seq, err := db.Upsert(rec2); err != nil || seq != "2" {
+	if seq, err := db.Upsert(nil, rec2); err != nil || seq != "2" {
 		t.Fatal(err)
 	}
-	if seq, err := db.Upsert(rec3); err != nil || seq != "3" {
+	if seq, err := db.Upsert(nil, rec3); err != nil || seq != "3" {
 		t.Fatal(err)
 	}
 	rec1NoKey.ID = "1"
@@ -260,7 +263,7 @@ func TestDB_LoadRecord(t *testing.T) {
 		},
 		AliveMessages: make(map[string][]AliveMessage),
 	}
-	if seq, err := db.Upsert(rec); err != nil || seq != "1" {
+	if seq, err := db.Upsert(nil, rec); err != nil || seq != "1" {
 		t.Fatal(err)
 	}
 	// Load the newly created record in the second database instance
@@ -282,7 +285,7 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := db.Upsert(Record{ID: "id1", UUID: "a", Key: []byte{}}); err != nil {
+	if _, err := db.Upsert(nil, Record{ID: "id1", UUID: "a", Key: []byte{}}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -294,27 +297,30 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 		ValidFrom: start,
 		Validity:  10 * time.Hour,
 		IP:        "1.1.1.1",
-		Content:   "1st command",
+		ID:        "1",
+		Kind:      "1st command",
 	})
 	// Record 2 is expired
 	recA.AddPendingCommand("1.1.1.1", PendingCommand{
 		ValidFrom: start.Add(-11 * time.Hour),
 		Validity:  10 * time.Hour,
 		IP:        "1.1.1.1",
-		Content:   "2nd command",
+		ID:        "2",
+		Kind:      "2nd command",
 	})
 	// Record 3 is valid
 	recA.AddPendingCommand("2.2.2.2", PendingCommand{
 		ValidFrom: start,
 		Validity:  10 * time.Hour,
 		IP:        "2.2.2.2",
-		Content:   "3rd command",
+		ID:        "3",
+		Kind:      "3rd command",
 	})
 	db.RecordsByUUID["a"] = recA
 
-	db.UpdateSeenFlag("a", "1.1.1.1", "1st command")
-	db.UpdateCommandResult("a", "1.1.1.1", "2nd command", "success")
-	db.UpdateCommandResult("a", "2.2.2.2", "3rd command", "failure")
+	db.UpdateSeenFlag(nil, "a", "1.1.1.1", "1")
+	db.UpdateCommandResult(nil, "a", "1.1.1.1", "2", "success", CommandResult{Success: true})
+	db.UpdateCommandResult(nil, "a", "2.2.2.2", "3", "failure", CommandResult{Details: map[string]string{"a": "b"}})
 
 	expected := map[string][]PendingCommand{
 		"1.1.1.1": {
@@ -322,7 +328,8 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 				ValidFrom:    start,
 				Validity:     10 * time.Hour,
 				IP:           "1.1.1.1",
-				Content:      "1st command",
+				ID:           "1",
+				Kind:         "1st command",
 				SeenByClient: true,
 			},
 		},
@@ -331,9 +338,11 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 				ValidFrom:    start,
 				Validity:     10 * time.Hour,
 				IP:           "2.2.2.2",
-				Content:      "3rd command",
+				ID:           "3",
+				Kind:         "3rd command",
 				SeenByClient: true,
 				ClientResult: "failure",
+				Result:       CommandResult{Details: map[string]string{"a": "b"}},
 			},
 		},
 	}
@@ -344,3 +353,218 @@ func TestDB_UpdateSeenFlag(t *testing.T) {
 		t.Fatalf("\n%+v\n%+v\n", expected, db.RecordsByID["id1"].PendingCommands)
 	}
 }
+
+func TestDB_Update(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(nil, Record{UUID: "a", Key: []byte{1, 2, 3}, MountPoint: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(nil, "doesnotexist", func(rec *Record) error { return nil }); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatal(err)
+	}
+	// Failed change is not saved
+	if err := db.Update(nil, "a", func(rec *Record) error {
+		rec.MountPoint = "/b"
+		return errors.New("test")
+	}); err == nil || err.Error() != "test" {
+		t.Fatal(err)
+	}
+	if rec, _ := db.GetByUUID("a"); rec.MountPoint != "/a" {
+		t.Fatal(rec)
+	}
+	if err := db.Update(nil, "a", func(rec *Record) error {
+		rec.MountPoint = "/b"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The change is persisted on disk
+	db2, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := db2.GetByUUID("a"); rec.MountPoint != "/b" || !reflect.DeepEqual(rec.Key, []byte{1, 2, 3}) {
+		t.Fatal(rec)
+	}
+}
+
+// Run with -race to make sure that the records handed out are not changed while they are read.
+func TestDB_ConcurrentReadAndChange(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(nil, Record{UUID: "a", Key: []byte{1, 2, 3}, MountPoint: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	done := new(sync.WaitGroup)
+	done.Add(1)
+	go func() {
+		defer done.Done()
+		// Poll for commands the same way key server does
+		for i := 0; i < 200; i++ {
+			rec, _ := db.GetByUUID("a")
+			for _, cmd := range rec.PendingCommands["1.1.1.1"] {
+				if !cmd.SeenByClient {
+					db.UpdateSeenFlag(nil, "a", "1.1.1.1", cmd.ID)
+				}
+			}
+			for range rec.AliveMessages {
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		cmd := PendingCommand{ID: fmt.Sprint(i), Kind: "status", ValidFrom: time.Now(), Validity: time.Hour, IP: "1.1.1.1"}
+		if err := db.AddPendingCommand(nil, "a", "1.1.1.1", cmd, nil); err != nil {
+			t.Fatal(err)
+		}
+		db.UpdateAliveMessage(nil, AliveMessage{IP: fmt.Sprintf("2.2.2.%d", i), Timestamp: time.Now().Unix()}, "a")
+		if err := db.Update(nil, "a", func(rec *Record) error {
+			rec.AddKnownHost(fmt.Sprintf("3.3.3.%d", i))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done.Wait()
+	// A copy handed out earlier is not affected by later changes
+	before, _ := db.GetByUUID("a")
+	db.UpdateCommandResult(nil, "a", "1.1.1.1", "0", "done", CommandResult{Success: true})
+	if before.PendingCommands["1.1.1.1"][0].ClientResult != "" {
+		t.Fatalf("%+v", before.PendingCommands["1.1.1.1"][0])
+	}
+	if after, _ := db.GetByUUID("a"); after.PendingCommands["1.1.1.1"][0].ClientResult != "done" || len(after.PendingCommands["1.1.1.1"]) != 200 {
+		t.Fatalf("%+v", after.PendingCommands["1.1.1.1"][0])
+	}
+}
+
+func TestDB_UpgradeRecordToVersion3(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Computers that have used the key of an older record become known hosts
+	if _, err := db.Upsert(nil, Record{ID: "1", Version: 2, UUID: "a", Key: []byte{},
+		LastRetrieval: AliveMessage{IP: "1.1.1.1"},
+		AliveMessages: map[string][]AliveMessage{"2.2.2.2": {{IP: "2.2.2.2"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	rec, found := db.GetByUUID("a")
+	if !found || rec.Version != CurrentRecordVersion || !rec.IsKnownHost("1.1.1.1") || !rec.IsKnownHost("2.2.2.2") ||
+		len(rec.KnownHosts) != 2 {
+		t.Fatal(rec, found)
+	}
+}
+
+func TestDB_CommandNotification(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(nil, Record{UUID: "a", Key: []byte{1, 2, 3}, MountPoint: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	cmd := PendingCommand{ID: "1", Kind: "add-recovery-keyslot", ValidFrom: time.Now(), Validity: time.Hour, IP: "1.1.1.1"}
+	if err := db.AddPendingCommand(nil, "doesnotexist", "1.1.1.1", cmd, nil); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatal(err)
+	}
+	waiter1 := db.CommandNotification("1.1.1.1")
+	waiter2 := db.CommandNotification("2.2.2.2")
+	if err := db.AddPendingCommand(nil, "a", "1.1.1.1", cmd, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	// Only the computer the command is addressed to is woken up
+	select {
+	case <-waiter1:
+	default:
+		t.Fatal("did not notify")
+	}
+	select {
+	case <-waiter2:
+		t.Fatal("should not notify")
+	default:
+	}
+	// Waiters that come afterwards wait for the next command
+	select {
+	case <-db.CommandNotification("1.1.1.1"):
+		t.Fatal("should not notify")
+	default:
+	}
+	if rec, _ := db.GetByUUID("a"); len(rec.PendingCommands["1.1.1.1"]) != 1 || string(rec.CommandSecrets["1"]) != "secret" {
+		t.Fatal(rec.PendingCommands, rec.CommandSecrets)
+	}
+	// Secrets are not listed
+	if list := db.List(); len(list) != 1 || list[0].CommandSecrets != nil {
+		t.Fatal(list)
+	}
+}
+
+func TestDB_UpgradeRecordToVersion4(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Commands of an older record carry their kind as content
+	if _, err := db.Upsert(nil, Record{ID: "1", Version: 3, UUID: "a", Key: []byte{},
+		PendingCommands: map[string][]PendingCommand{"1.1.1.1": {{ValidFrom: time.Now(), Validity: time.Hour, Content: "umount"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	rec, found := db.GetByUUID("a")
+	if !found || rec.Version != CurrentRecordVersion {
+		t.Fatal(rec, found)
+	}
+	if cmd := rec.PendingCommands["1.1.1.1"][0]; len(cmd.ID) != 2*LenCommandID || cmd.Kind != "umount" || cmd.Content != "umount" {
+		t.Fatal(cmd)
+	}
+}
+
+func TestDB_ReplaceKey(t *testing.T) {
+	defer os.RemoveAll(TestDBDir)
+	os.RemoveAll(TestDBDir)
+	db, err := OpenDB(TestDBDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Upsert(nil, Record{ID: "1", UUID: "a", Key: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ReplaceKey(nil, "doesnotexist", "", "", []byte{2}); !errors.Is(err, ErrRecordNotFound) {
+		t.Fatal(err)
+	}
+	// Built-in key storage keeps the ID
+	if oldID, err := db.ReplaceKey(nil, "a", "", "", []byte{2}); err != nil || oldID != "1" {
+		t.Fatal(oldID, err)
+	}
+	if rec, _ := db.GetByID("1"); !reflect.DeepEqual(rec.Key, []byte{2}) {
+		t.Fatal(rec)
+	}
+	// Key on external KMIP server is replaced by its ID
+	if oldID, err := db.ReplaceKey(nil, "a", "", "2", nil); err != nil || oldID != "1" {
+		t.Fatal(oldID, err)
+	}
+	if _, found := db.GetByID("1"); found {
+		t.Fatal("old ID should be gone")
+	}
+	if rec, found := db.GetByID("2"); !found || rec.UUID != "a" {
+		t.Fatal(rec, found)
+	}
+}
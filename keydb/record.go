@@ -4,19 +4,24 @@ package keydb
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
 const (
-	CurrentRecordVersion = 2 // CurrentRecordVersion is the version of new database records to be created by cryptctl.
+	CurrentRecordVersion = 4  // CurrentRecordVersion is the version of new database records to be created by cryptctl.
+	LenCommandID         = 16 // LenCommandID is the number of random bytes in a pending command ID.
 )
 
-var RegexUUID = regexp.MustCompile("^[a-zA-Z0-9-]+$") // RegexUUID matches characters that are allowed in a UUID
+var RegexUUID = regexp.MustCompile("^[a-zA-Z0-9-]+$")    // RegexUUID matches characters that are allowed in a UUID
+var RegexLabel = regexp.MustCompile("^[a-zA-Z0-9_.-]+$") // RegexLabel matches characters that are allowed in a label name or value
 
 /*
 ValidateUUID returns an error only if the input string is empty, or if there are illegal
@@ -31,6 +36,22 @@ func ValidateUUID(in string) error {
 	return nil
 }
 
+/*
+ParseLabels reads space separated name=value pairs into labels. An empty input results in empty labels. Returns an
+error if a pair is malformed or if there are illegal characters in a name or value.
+*/
+func ParseLabels(in string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Fields(in) {
+		nameValue := strings.SplitN(pair, "=", 2)
+		if len(nameValue) != 2 || !RegexLabel.MatchString(nameValue[0]) || !RegexLabel.MatchString(nameValue[1]) {
+			return nil, fmt.Errorf("ParseLabels: label \"%s\" should look like name=value and only contain letters, digits, and _.-", pair)
+		}
+		labels[nameValue[0]] = nameValue[1]
+	}
+	return labels, nil
+}
+
 /*
 AliveMessage is a component of key database record, it represents a heartbeat sent by a computer who is actively
 using an encryption key - i.e. the encrypted disk is currently unlocked and online.
@@ -39,16 +60,65 @@ type AliveMessage struct {
 	Hostname  string // Hostname is the host name reported by client computer itself.
 	IP        string // IP is the client computer's IP as seen by cryptctl server.
 	Timestamp int64  // Timestamp is the moment the message arrived at cryptctl server.
+	LeaseID   string // LeaseID identifies the key retrieval that the computer renews with alive reports, empty for older clients.
+}
+
+// CommandResult is the structured execution result of a pending command, reported by the client computer.
+type CommandResult struct {
+	Success bool              // Success is true only if the command has been carried out.
+	Details map[string]string // Details are the facts gathered by the command, such as the status of a disk.
 }
 
 // PendingCommand is a time-restricted command issued by cryptctl server administrator to be polled by a client.
 type PendingCommand struct {
-	ValidFrom    time.Time     // ValidFrom is the timestamp at which moment the command was created.
-	Validity     time.Duration // Validity determines the point in time the command expires. Expired commands disappear almost immediately.
-	IP           string        // IP is the client computer's IP the command is issued to.
-	Content      interface{}   // Content is the command content, serialised and transmitted between server and client.
-	SeenByClient bool          // SeenByClient is updated to true via RPC once the client has seen this command.
-	ClientResult string        // ClientResult is updated via RPC once client has finished executing this command.
+	ID           string            // ID uniquely identifies the command, the client reports execution result against it.
+	Kind         string            // Kind tells the client what to do, such as "umount" or "status".
+	Params       map[string]string // Params are the parameters specific to the kind of command.
+	ValidFrom    time.Time         // ValidFrom is the timestamp from which on the command is handed to the computer, usually the moment it was created.
+	Validity     time.Duration     // Validity determines the point in time the command expires. Expired commands disappear almost immediately.
+	IP           string            // IP is the client computer's IP the command is issued to.
+	Content      interface{}       // Content is the command kind for clients that predate typed commands, it is only set for mount and umount.
+	SeenByClient bool              // SeenByClient is updated to true via RPC once the client has seen this command.
+	ClientResult string            // ClientResult is updated via RPC once client has finished executing this command.
+	Result       CommandResult     // Result is the structured execution result, updated along with ClientResult.
+	BatchID      string            // BatchID is shared by the commands sent to several computers or disks at once, or empty.
+}
+
+// NewCommandID returns a random ID for a new pending command.
+func NewCommandID() (string, error) {
+	idBytes := make([]byte, LenCommandID)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("NewCommandID: failed to read from random source - %v", err)
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+const (
+	CommandStateScheduled = "scheduled" // CommandStateScheduled is the state of a command that will be handed to the computer at a later time.
+	CommandStatePending   = "pending"   // CommandStatePending is the state of a command that the computer has not yet picked up.
+	CommandStateDelivered = "delivered" // CommandStateDelivered is the state of a command picked up by the computer, which has not yet told the result.
+	CommandStateSucceeded = "succeeded" // CommandStateSucceeded is the state of a command that the computer has carried out.
+	CommandStateFailed    = "failed"    // CommandStateFailed is the state of a command that the computer has failed to carry out.
+)
+
+// State returns the progress of the command, one of the CommandState constants.
+func (cmd *PendingCommand) State() string {
+	switch {
+	case cmd.ClientResult != "" && cmd.Result.Success:
+		return CommandStateSucceeded
+	case cmd.ClientResult != "":
+		return CommandStateFailed
+	case cmd.SeenByClient:
+		return CommandStateDelivered
+	case !cmd.IsDue():
+		return CommandStateScheduled
+	}
+	return CommandStatePending
+}
+
+// IsDue returns true only if the time has come for the computer to carry out the command.
+func (cmd *PendingCommand) IsDue() bool {
+	return !cmd.ValidFrom.After(time.Now())
 }
 
 // IsValid returns true only if the command has not expired.
@@ -78,6 +148,66 @@ type Record struct {
 	LastRetrieval   AliveMessage                // LastRetrieval is the computer who most recently successfully retrieved the key.
 	AliveMessages   map[string][]AliveMessage   // AliveMessages are the most recent alive reports in IP - message array pairs.
 	PendingCommands map[string][]PendingCommand // PendingCommands are some command to be periodcally polled by clients carrying the IP address (keys).
+
+	KnownHosts   []string                // KnownHosts are the IPs of computers that may retrieve the key without password.
+	PendingHosts map[string]AliveMessage // PendingHosts are the computers that asked for the key but await administrator's approval, in IP - latest attempt pairs.
+
+	/*
+		CommandSecrets are the key material of pending commands, such as a recovery passphrase, in command ID - secret pairs.
+		They are kept in the record file with the same protection as Key, and are removed as soon as the command's result
+		arrives, be it success or failure.
+	*/
+	CommandSecrets map[string][]byte
+
+	Labels map[string]string // Labels are name - value pairs chosen by administrator to select records, such as "rack" - "r12".
+}
+
+/*
+Copy returns a deep copy of the record. The database changes a copy of its record rather than the record itself, so that
+the copies handed out earlier are never changed underneath their readers.
+*/
+func (rec *Record) Copy() Record {
+	ret := *rec
+	if rec.Key != nil {
+		ret.Key = append([]byte{}, rec.Key...)
+	}
+	if rec.MountOptions != nil {
+		ret.MountOptions = append([]string{}, rec.MountOptions...)
+	}
+	if rec.KnownHosts != nil {
+		ret.KnownHosts = append([]string{}, rec.KnownHosts...)
+	}
+	if rec.AliveMessages != nil {
+		ret.AliveMessages = make(map[string][]AliveMessage, len(rec.AliveMessages))
+		for ip, msgs := range rec.AliveMessages {
+			ret.AliveMessages[ip] = append([]AliveMessage{}, msgs...)
+		}
+	}
+	if rec.PendingCommands != nil {
+		ret.PendingCommands = make(map[string][]PendingCommand, len(rec.PendingCommands))
+		for ip, cmds := range rec.PendingCommands {
+			ret.PendingCommands[ip] = append([]PendingCommand{}, cmds...)
+		}
+	}
+	if rec.PendingHosts != nil {
+		ret.PendingHosts = make(map[string]AliveMessage, len(rec.PendingHosts))
+		for ip, attempt := range rec.PendingHosts {
+			ret.PendingHosts[ip] = attempt
+		}
+	}
+	if rec.CommandSecrets != nil {
+		ret.CommandSecrets = make(map[string][]byte, len(rec.CommandSecrets))
+		for id, secret := range rec.CommandSecrets {
+			ret.CommandSecrets[id] = append([]byte{}, secret...)
+		}
+	}
+	if rec.Labels != nil {
+		ret.Labels = make(map[string]string, len(rec.Labels))
+		for name, value := range rec.Labels {
+			ret.Labels[name] = value
+		}
+	}
+	return ret
 }
 
 // Return mount options in a single string, as accepted by mount command.
@@ -85,6 +215,28 @@ func (rec *Record) GetMountOptionStr() string {
 	return strings.Join(rec.MountOptions, ",")
 }
 
+// MatchLabels returns true only if the record carries all of the labels with identical values.
+func (rec *Record) MatchLabels(labels map[string]string) bool {
+	for name, value := range labels {
+		if recValue, found := rec.Labels[name]; !found || recValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// AliveHostIPs returns the IPs of computers that currently hold the key and keep reporting alive, in sorted order.
+func (rec *Record) AliveHostIPs() []string {
+	ips := make([]string, 0, len(rec.AliveMessages))
+	for hostIP := range rec.AliveMessages {
+		if alive, _ := rec.IsHostAlive(hostIP); alive {
+			ips = append(ips, hostIP)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
 // Determine whether a host is still alive according to recent alive messages.
 func (rec *Record) IsHostAlive(hostIP string) (alive bool, finalMessage AliveMessage) {
 	if beat, found := rec.AliveMessages[hostIP]; found {
@@ -98,6 +250,48 @@ func (rec *Record) IsHostAlive(hostIP string) (alive bool, finalMessage AliveMes
 	return
 }
 
+// IsKnownHost returns true only if the computer may retrieve the key without password.
+func (rec *Record) IsKnownHost(hostIP string) bool {
+	for _, known := range rec.KnownHosts {
+		if known == hostIP {
+			return true
+		}
+	}
+	return false
+}
+
+// AddKnownHost lets the computer retrieve the key without password from now on, and removes it from pending hosts.
+func (rec *Record) AddKnownHost(hostIP string) {
+	delete(rec.PendingHosts, hostIP)
+	if !rec.IsKnownHost(hostIP) {
+		rec.KnownHosts = append(rec.KnownHosts, hostIP)
+	}
+}
+
+// RemoveKnownHost stops the computer from retrieving the key without password.
+func (rec *Record) RemoveKnownHost(hostIP string) {
+	remaining := make([]string, 0, len(rec.KnownHosts))
+	for _, known := range rec.KnownHosts {
+		if known != hostIP {
+			remaining = append(remaining, known)
+		}
+	}
+	rec.KnownHosts = remaining
+}
+
+/*
+AddPendingHost remembers the latest attempt of an unknown computer to retrieve the key, so that an administrator may
+approve it. Return true if the computer was not already waiting for approval.
+*/
+func (rec *Record) AddPendingHost(attempt AliveMessage) (isNew bool) {
+	if rec.PendingHosts == nil {
+		rec.PendingHosts = make(map[string]AliveMessage)
+	}
+	_, exists := rec.PendingHosts[attempt.IP]
+	rec.PendingHosts[attempt.IP] = attempt
+	return !exists
+}
+
 // Remove all dead hosts from alive message history, return each dead host's final alive .
 func (rec *Record) RemoveDeadHosts() (deadFinalMessage map[string]AliveMessage) {
 	deadFinalMessage = make(map[string]AliveMessage)
@@ -123,6 +317,8 @@ func (rec *Record) RemoveExpiredPendingCommands() {
 		for _, cmd := range commands {
 			if cmd.IsValid() {
 				remainingCommands = append(remainingCommands, cmd)
+			} else {
+				delete(rec.CommandSecrets, cmd.ID)
 			}
 		}
 		if len(remainingCommands) > 0 {
@@ -145,9 +341,43 @@ func (rec *Record) AddPendingCommand(ip string, cmd PendingCommand) {
 	rec.PendingCommands[ip] = append(rec.PendingCommands[ip], cmd)
 }
 
-// ClearPendingCommands removes all pending commands, and clears expired pending commands along the way.
+// ClearPendingCommands removes all pending commands and their secrets.
 func (rec *Record) ClearPendingCommands() {
 	rec.PendingCommands = make(map[string][]PendingCommand)
+	rec.CommandSecrets = nil
+}
+
+// GetPendingCommand returns the pending command of the ID issued to the computer of the IP.
+func (rec *Record) GetPendingCommand(ip, id string) (PendingCommand, bool) {
+	for _, cmd := range rec.PendingCommands[ip] {
+		if cmd.ID == id {
+			return cmd, true
+		}
+	}
+	return PendingCommand{}, false
+}
+
+// SetCommandSecret remembers the key material of a pending command until the command's result arrives.
+func (rec *Record) SetCommandSecret(id string, secret []byte) {
+	if rec.CommandSecrets == nil {
+		rec.CommandSecrets = make(map[string][]byte)
+	}
+	rec.CommandSecrets[id] = secret
+}
+
+// SetCommandResult saves the execution result of a pending command and forgets its secret. Return false if the command is not found.
+func (rec *Record) SetCommandResult(ip, id, clientResult string, result CommandResult) bool {
+	cmds := rec.PendingCommands[ip]
+	for i, cmd := range cmds {
+		if cmd.ID == id {
+			cmds[i].SeenByClient = true
+			cmds[i].ClientResult = clientResult
+			cmds[i].Result = result
+			delete(rec.CommandSecrets, id)
+			return true
+		}
+	}
+	return false
 }
 
 /*
@@ -173,9 +403,16 @@ func (rec *Record) UpdateLastRetrieval(latestBeat AliveMessage, checkMaxActive b
 	return
 }
 
-// Record the latest alive message in message history.
+/*
+Record the latest alive message in message history. If the message carries a lease ID, it renews only the lease that
+the computer was given upon key retrieval.
+*/
 func (rec *Record) UpdateAliveMessage(latestBeat AliveMessage) bool {
 	if beats, found := rec.AliveMessages[latestBeat.IP]; found {
+		if latestBeat.LeaseID != "" && len(beats) > 0 && beats[len(beats)-1].LeaseID != latestBeat.LeaseID {
+			// The lease has been released, or superseded by a later retrieval
+			return false
+		}
 		if len(beats) >= rec.AliveCount {
 			// Remove the oldest message and push the latest one to the end
 			rec.AliveMessages[latestBeat.IP] = append(beats[len(beats)-rec.AliveCount+1:], latestBeat)
@@ -188,6 +425,22 @@ func (rec *Record) UpdateAliveMessage(latestBeat AliveMessage) bool {
 	return false
 }
 
+/*
+ReleaseLease removes the computer from alive message history so that its MaxActive slot is freed right away. If lease
+ID is given, the computer's current lease must match it. Return true only if the computer was holding the key.
+*/
+func (rec *Record) ReleaseLease(hostIP, leaseID string) bool {
+	beats, found := rec.AliveMessages[hostIP]
+	if !found {
+		return false
+	}
+	if leaseID != "" && (len(beats) == 0 || beats[len(beats)-1].LeaseID != leaseID) {
+		return false
+	}
+	delete(rec.AliveMessages, hostIP)
+	return true
+}
+
 // Return an error if a record attribute does not make sense.
 func (rec *Record) Validate() error {
 	if len(rec.UUID) < 3 {
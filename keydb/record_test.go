@@ -416,3 +416,149 @@ func TestRecord_RemoveExpiredPendingCommands(t *testing.T) {
 		t.Fatalf("%+v", rec.PendingCommands)
 	}
 }
+
+func TestRecord_KnownHosts(t *testing.T) {
+	rec := Record{UUID: "a", KnownHosts: []string{"1.1.1.1"}}
+	if !rec.IsKnownHost("1.1.1.1") || rec.IsKnownHost("2.2.2.2") {
+		t.Fatal(rec.KnownHosts)
+	}
+	attempt := AliveMessage{IP: "2.2.2.2", Hostname: "b", Timestamp: 1}
+	if !rec.AddPendingHost(attempt) {
+		t.Fatal("should be new")
+	}
+	attempt.Timestamp = 2
+	if rec.AddPendingHost(attempt) || rec.PendingHosts["2.2.2.2"].Timestamp != 2 {
+		t.Fatal(rec.PendingHosts)
+	}
+	rec.AddKnownHost("2.2.2.2")
+	rec.AddKnownHost("2.2.2.2")
+	if len(rec.PendingHosts) != 0 || !reflect.DeepEqual(rec.KnownHosts, []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Fatal(rec.PendingHosts, rec.KnownHosts)
+	}
+	rec.RemoveKnownHost("1.1.1.1")
+	if !reflect.DeepEqual(rec.KnownHosts, []string{"2.2.2.2"}) {
+		t.Fatal(rec.KnownHosts)
+	}
+}
+
+func TestRecord_Lease(t *testing.T) {
+	rec := Record{UUID: "a", MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4, AliveMessages: map[string][]AliveMessage{}}
+	if ok, _ := rec.UpdateLastRetrieval(AliveMessage{IP: "1.1.1.1", Timestamp: time.Now().Unix(), LeaseID: "l1"}, true); !ok {
+		t.Fatal("did not retrieve")
+	}
+	// Alive reports renew the lease they carry, reports of older clients carry no lease
+	if !rec.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: time.Now().Unix(), LeaseID: "l1"}) ||
+		!rec.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: time.Now().Unix()}) {
+		t.Fatal(rec.AliveMessages)
+	}
+	// The slot is occupied until the lease is released
+	if ok, _ := rec.UpdateLastRetrieval(AliveMessage{IP: "2.2.2.2", Timestamp: time.Now().Unix(), LeaseID: "l2"}, true); ok {
+		t.Fatal("should not retrieve")
+	}
+	if rec.ReleaseLease("1.1.1.1", "wrong") || rec.ReleaseLease("2.2.2.2", "") {
+		t.Fatal("should not release")
+	}
+	if ok, _ := rec.UpdateLastRetrieval(AliveMessage{IP: "1.1.1.1", Timestamp: time.Now().Unix(), LeaseID: "l3"}, false); !ok {
+		t.Fatal("did not retrieve")
+	}
+	// The superseded lease can no longer be renewed or released
+	if rec.UpdateAliveMessage(AliveMessage{IP: "1.1.1.1", Timestamp: time.Now().Unix(), LeaseID: "l1"}) || rec.ReleaseLease("1.1.1.1", "l1") {
+		t.Fatal(rec.AliveMessages)
+	}
+	if !rec.ReleaseLease("1.1.1.1", "l3") || len(rec.AliveMessages) != 0 {
+		t.Fatal(rec.AliveMessages)
+	}
+	if ok, _ := rec.UpdateLastRetrieval(AliveMessage{IP: "2.2.2.2", Timestamp: time.Now().Unix(), LeaseID: "l2"}, true); !ok {
+		t.Fatal("did not retrieve")
+	}
+	if !rec.ReleaseLease("2.2.2.2", "") {
+		t.Fatal("did not release")
+	}
+}
+
+func TestRecord_CommandResult(t *testing.T) {
+	rec := Record{UUID: "a", PendingCommands: map[string][]PendingCommand{}}
+	rec.AddPendingCommand("1.1.1.1", PendingCommand{ID: "1", Kind: "rotate-key", ValidFrom: time.Now(), Validity: time.Hour})
+	rec.AddPendingCommand("1.1.1.1", PendingCommand{ID: "2", Kind: "rotate-key", ValidFrom: time.Now().Add(-2 * time.Hour), Validity: time.Hour})
+	rec.SetCommandSecret("1", []byte{1})
+	rec.SetCommandSecret("2", []byte{2})
+	if cmd, found := rec.GetPendingCommand("1.1.1.1", "1"); !found || cmd.Kind != "rotate-key" {
+		t.Fatal(cmd, found)
+	}
+	if _, found := rec.GetPendingCommand("2.2.2.2", "1"); found {
+		t.Fatal("should not find")
+	}
+	// Secret of an expired command disappears along with the command
+	rec.RemoveExpiredPendingCommands()
+	if len(rec.CommandSecrets) != 1 || rec.CommandSecrets["1"][0] != 1 {
+		t.Fatal(rec.CommandSecrets)
+	}
+	// Secret is forgotten once the result arrives
+	if rec.SetCommandResult("2.2.2.2", "1", "done", CommandResult{Success: true}) {
+		t.Fatal("should not find")
+	}
+	if !rec.SetCommandResult("1.1.1.1", "1", "done", CommandResult{Success: true}) || len(rec.CommandSecrets) != 0 {
+		t.Fatal(rec.CommandSecrets)
+	}
+	if cmd, _ := rec.GetPendingCommand("1.1.1.1", "1"); !cmd.SeenByClient || cmd.ClientResult != "done" || !cmd.Result.Success {
+		t.Fatal(cmd)
+	}
+}
+
+func TestRecord_Labels(t *testing.T) {
+	labels, err := ParseLabels(" rack=r12  env=prod ")
+	if err != nil || !reflect.DeepEqual(labels, map[string]string{"rack": "r12", "env": "prod"}) {
+		t.Fatal(labels, err)
+	}
+	if labels, err := ParseLabels(""); err != nil || len(labels) != 0 {
+		t.Fatal(labels, err)
+	}
+	for _, malformed := range []string{"rack", "=r12", "rack=", "rack=r 12=", "rack=r;12"} {
+		if _, err := ParseLabels(malformed); err == nil {
+			t.Fatal("did not error", malformed)
+		}
+	}
+	rec := Record{Labels: map[string]string{"rack": "r12", "env": "prod", "os": "sles"}}
+	if !rec.MatchLabels(labels) || !rec.MatchLabels(map[string]string{"os": "sles"}) ||
+		rec.MatchLabels(map[string]string{"rack": "r13"}) || rec.MatchLabels(map[string]string{"zone": "a"}) {
+		t.Fatal("wrong match")
+	}
+	if (&Record{}).MatchLabels(labels) {
+		t.Fatal("wrong match")
+	}
+}
+
+func TestRecord_AliveHostIPs(t *testing.T) {
+	rec := Record{AliveIntervalSec: 1, AliveCount: 4, AliveMessages: map[string][]AliveMessage{
+		"2.2.2.2": {{IP: "2.2.2.2", Timestamp: time.Now().Unix()}},
+		"1.1.1.1": {{IP: "1.1.1.1", Timestamp: time.Now().Unix()}},
+		"3.3.3.3": {{IP: "3.3.3.3", Timestamp: time.Now().Unix() - 100}},
+	}}
+	if ips := rec.AliveHostIPs(); !reflect.DeepEqual(ips, []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Fatal(ips)
+	}
+}
+
+func TestPendingCommand_State(t *testing.T) {
+	cmd := PendingCommand{ValidFrom: time.Now().Add(time.Hour)}
+	if state := cmd.State(); state != CommandStateScheduled || cmd.IsDue() {
+		t.Fatal(state)
+	}
+	cmd.ValidFrom = time.Now()
+	if state := cmd.State(); state != CommandStatePending || !cmd.IsDue() {
+		t.Fatal(state)
+	}
+	cmd.SeenByClient = true
+	if state := cmd.State(); state != CommandStateDelivered {
+		t.Fatal(state)
+	}
+	cmd.ClientResult = "disk is busy"
+	if state := cmd.State(); state != CommandStateFailed {
+		t.Fatal(state)
+	}
+	cmd.ClientResult = "Success"
+	cmd.Result.Success = true
+	if state := cmd.State(); state != CommandStateSucceeded {
+		t.Fatal(state)
+	}
+}
@@ -0,0 +1,379 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_APPROVAL_OPERATIONS = "APPROVAL_REQUIRED_FOR"
+	SRV_CONF_APPROVAL_TIMEOUT    = "APPROVAL_TIMEOUT_SEC"
+
+	ApprovalManualRetrieval = "manual-retrieval" // ApprovalManualRetrieval is the operation of retrieving keys using password.
+	ApprovalKeyErasure      = "key-erasure"      // ApprovalKeyErasure is the operation of erasing a key.
+
+	LenApprovalID       = 16   // LenApprovalID is the number of random bytes in an approval ID.
+	MaxPendingApprovals = 1000 // MaxPendingApprovals is the upper limit of operations waiting for approval.
+
+	NotifyApprovalRequest = "approval-request" // NotifyApprovalRequest is the event of an operation waiting for approval by another administrator.
+
+	AuditApprovalRequest  = "approval-request"  // AuditApprovalRequest is the event type of an operation submitted for approval.
+	AuditApprovalDecision = "approval-decision" // AuditApprovalDecision is the event type of an operation approved or rejected by another administrator.
+)
+
+// ApprovalOperations are the operations that may require approval by a second administrator.
+var ApprovalOperations = []string{ApprovalManualRetrieval, ApprovalKeyErasure}
+
+var (
+	ErrApprovalRequired = errors.New("the operation requires approval by another administrator")                                         // ErrApprovalRequired is returned when an operation is made without an approval ID.
+	ErrSameAdmin        = errors.New("an administrator cannot approve their own request")                                                // ErrSameAdmin is returned when the requester tries to approve their own request.
+	ErrUnverifiedAdmin  = errors.New("the administrator must be identified by a client certificate or a user account on the key server") // ErrUnverifiedAdmin is returned when the connection does not carry an administrator's identity.
+)
+
+// PendingApproval is an operation submitted by an administrator, it executes only after another administrator approves it.
+type PendingApproval struct {
+	ID          string    // ID is a random string that identifies the approval.
+	Operation   string    // Operation is one of ApprovalOperations.
+	UUIDs       []string  // UUIDs of the disks the operation is about.
+	Requester   string    // Requester identifies the administrator who submitted the operation.
+	IP          string    // IP is the requester's IP as seen by cryptctl server, the operation must be executed from there.
+	Hostname    string    // Hostname is the host name reported by requester's computer.
+	RequestedAt time.Time // RequestedAt is the moment the operation was submitted.
+	Approver    string    // Approver identifies the administrator who approved the operation, it is empty for pending operations.
+	ApproverIP  string    // ApproverIP is the approver's IP as seen by cryptctl server.
+	ApprovedAt  time.Time // ApprovedAt is the moment the operation was approved, it is zero for pending operations.
+	ExpiresAt   time.Time // ExpiresAt is the moment by which the operation must be approved, or executed if it has been approved.
+}
+
+// IsApproved returns true only if another administrator has approved the operation.
+func (approval *PendingApproval) IsApproved() bool {
+	return !approval.ApprovedAt.IsZero()
+}
+
+// IsExpired returns true if the operation was not approved or executed in time.
+func (approval *PendingApproval) IsExpired() bool {
+	return !approval.ExpiresAt.After(time.Now())
+}
+
+// Note describes the requester and approver in a line of text for log and audit messages.
+func (approval *PendingApproval) Note() string {
+	return fmt.Sprintf("requested by %s from %s, approved by %s from %s (approval %s)",
+		approval.Requester, approval.IP, approval.Approver, approval.ApproverIP, approval.ID)
+}
+
+/*
+ApprovalQueue keeps operations waiting for approval by another administrator. The operations are kept in memory only,
+as they expire shortly anyway. All exported functions are safe for concurrent usage.
+*/
+type ApprovalQueue struct {
+	Approvals map[string]PendingApproval // key is approval ID
+	Lock      *sync.Mutex
+}
+
+// NewApprovalQueue returns an initialised empty queue.
+func NewApprovalQueue() *ApprovalQueue {
+	return &ApprovalQueue{Approvals: make(map[string]PendingApproval), Lock: new(sync.Mutex)}
+}
+
+// removeExpired deletes all operations that were not approved or executed in time. Caller must hold the lock.
+func (queue *ApprovalQueue) removeExpired() {
+	for id, approval := range queue.Approvals {
+		if approval.IsExpired() {
+			delete(queue.Approvals, id)
+		}
+	}
+}
+
+// Submit places a new operation into the queue, it must be approved within the timeout.
+func (queue *ApprovalQueue) Submit(operation string, uuids []string, requester, ip, hostname string, timeout time.Duration) (PendingApproval, error) {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	if len(queue.Approvals) >= MaxPendingApprovals {
+		return PendingApproval{}, errors.New("ApprovalQueue.Submit: there are too many operations waiting for approval")
+	}
+	idBytes := make([]byte, LenApprovalID)
+	if _, err := rand.Read(idBytes); err != nil {
+		return PendingApproval{}, fmt.Errorf("ApprovalQueue.Submit: failed to read from random source - %v", err)
+	}
+	now := time.Now()
+	approval := PendingApproval{
+		ID:          hex.EncodeToString(idBytes),
+		Operation:   operation,
+		UUIDs:       uuids,
+		Requester:   requester,
+		IP:          ip,
+		Hostname:    hostname,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(timeout),
+	}
+	queue.Approvals[approval.ID] = approval
+	return approval, nil
+}
+
+// Get retrieves an operation by its ID.
+func (queue *ApprovalQueue) Get(id string) (approval PendingApproval, found bool) {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	approval, found = queue.Approvals[id]
+	return
+}
+
+// List returns all operations sorted by submission time, the oldest operation comes first.
+func (queue *ApprovalQueue) List() []PendingApproval {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	ret := make([]PendingApproval, 0, len(queue.Approvals))
+	for _, approval := range queue.Approvals {
+		ret = append(ret, approval)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].RequestedAt.Before(ret[j].RequestedAt)
+	})
+	return ret
+}
+
+// Approve lets the requester execute a pending operation within the timeout. The approver must not be the requester.
+func (queue *ApprovalQueue) Approve(id, approver, approverIP string, timeout time.Duration) (PendingApproval, error) {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	approval, found := queue.Approvals[id]
+	if !found {
+		return approval, fmt.Errorf("ApprovalQueue.Approve: cannot find operation %s, it may have expired", id)
+	} else if approval.IsApproved() {
+		return approval, fmt.Errorf("ApprovalQueue.Approve: operation %s has already been approved", id)
+	} else if approval.Requester == approver {
+		return approval, fmt.Errorf("ApprovalQueue.Approve: %w", ErrSameAdmin)
+	}
+	approval.Approver = approver
+	approval.ApproverIP = approverIP
+	approval.ApprovedAt = time.Now()
+	approval.ExpiresAt = approval.ApprovedAt.Add(timeout)
+	queue.Approvals[id] = approval
+	return approval, nil
+}
+
+// Reject removes a pending operation from the queue.
+func (queue *ApprovalQueue) Reject(id string) (PendingApproval, error) {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	approval, found := queue.Approvals[id]
+	if !found {
+		return approval, fmt.Errorf("ApprovalQueue.Reject: cannot find operation %s", id)
+	}
+	delete(queue.Approvals, id)
+	return approval, nil
+}
+
+/*
+Consume removes an approved operation from the queue so that it executes exactly once. The operation, disk UUIDs, and
+requester's IP must match those that were approved.
+*/
+func (queue *ApprovalQueue) Consume(id, operation string, uuids []string, ip string) (PendingApproval, error) {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	approval, found := queue.Approvals[id]
+	if !found || approval.IP != ip {
+		return approval, fmt.Errorf("ApprovalQueue.Consume: cannot find operation %s, it may have been rejected or expired", id)
+	} else if !approval.IsApproved() {
+		return approval, fmt.Errorf("ApprovalQueue.Consume: operation %s has not yet been approved", id)
+	} else if approval.Operation != operation || !reflect.DeepEqual(sortedCopy(approval.UUIDs), sortedCopy(uuids)) {
+		return approval, fmt.Errorf("ApprovalQueue.Consume: operation %s was approved for %s of %s", id, approval.Operation, strings.Join(approval.UUIDs, ", "))
+	}
+	delete(queue.Approvals, id)
+	return approval, nil
+}
+
+// sortedCopy returns a sorted copy of the string slice.
+func sortedCopy(in []string) []string {
+	ret := make([]string, len(in))
+	copy(ret, in)
+	sort.Strings(ret)
+	return ret
+}
+
+// approvalRequired returns true only if the operation must be approved by another administrator.
+func (srv *CryptServer) approvalRequired(operation string) bool {
+	for _, required := range srv.Config.ApprovalOperations {
+		if required == operation {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+adminIdentity identifies the administrator behind the connection by an identity that the server has verified: the
+common name of client certificate, or the user account on the key server for domain socket connections. Names typed in
+by administrators cannot tell them apart, hence a connection without verified identity takes no part in approvals.
+*/
+func (rpcConn *CryptServiceConn) adminIdentity() (string, error) {
+	if rpcConn.PeerCommonName != "" {
+		return "cert:" + rpcConn.PeerCommonName, nil
+	} else if rpcConn.PeerUser != "" {
+		return "user:" + rpcConn.PeerUser, nil
+	}
+	return "", fmt.Errorf("adminIdentity: %w", ErrUnverifiedAdmin)
+}
+
+/*
+consumeApproval checks that the operation may execute: if the operation requires approval, the approval ID must refer
+to an approved operation. Return a note about the requester and approver that is appended to audit messages.
+*/
+func (rpcConn *CryptServiceConn) consumeApproval(approvalID, operation string, uuids []string) (note string, err error) {
+	if !rpcConn.Svc.approvalRequired(operation) {
+		return "", nil
+	}
+	if approvalID == "" {
+		return "", ErrApprovalRequired
+	}
+	approval, err := rpcConn.Svc.Approvals.Consume(approvalID, operation, uuids, rpcConn.RemoteHost)
+	if err != nil {
+		return "", err
+	}
+	rpcConn.Log.Info("CryptServiceConn.consumeApproval: executing approved operation", "operation", operation, "uuids", uuids,
+		"approval_id", approval.ID, "requester", approval.Requester, "approver", approval.Approver)
+	return " - " + approval.Note(), nil
+}
+
+// RequestApprovalReq submits an operation for approval by another administrator.
+type RequestApprovalReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+	Admin         string         // Admin is no longer used, the requester is identified by client certificate or user account.
+	Operation     string         // Operation is one of ApprovalOperations.
+	UUIDs         []string       // UUIDs of the disks the operation is about
+	Hostname      string         // client's host name (for logging only)
+}
+
+/*
+RequestApproval places an operation in the queue for approval by another administrator. Once approved, the requester
+executes the operation from the same computer by presenting the approval ID.
+*/
+func (rpcConn *CryptServiceConn) RequestApproval(req RequestApprovalReq, resp *PendingApproval) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	requester, err := rpcConn.adminIdentity()
+	if err != nil {
+		return err
+	}
+	if !rpcConn.Svc.approvalRequired(req.Operation) {
+		return fmt.Errorf("RequestApproval: %w - operation \"%s\" does not require approval", ErrInvalidRequest, req.Operation)
+	} else if len(req.UUIDs) == 0 {
+		return fmt.Errorf("RequestApproval: %w - UUIDs must not be empty", ErrInvalidRequest)
+	}
+	timeout := time.Duration(rpcConn.Svc.Config.ApprovalTimeoutSec) * time.Second
+	approval, err := rpcConn.Svc.Approvals.Submit(req.Operation, req.UUIDs, requester, rpcConn.RemoteHost, req.Hostname, timeout)
+	if err != nil {
+		return err
+	}
+	*resp = approval
+	rpcConn.Log.Info("CryptServiceConn.RequestApproval: administrator has requested approval", "operation", req.Operation,
+		"uuids", req.UUIDs, "requester", requester, "hostname", req.Hostname, "approval_id", approval.ID)
+	for _, uuid := range req.UUIDs {
+		rpcConn.audit(AuditApprovalRequest, AuditOutcomeSuccess, uuid, req.Hostname,
+			fmt.Sprintf("%s requested by %s (approval %s)", req.Operation, requester, approval.ID))
+	}
+	// Send optional notifications in background
+	rpcConn.notify(NotifyEvent{
+		Type:     NotifyApprovalRequest,
+		Hostname: req.Hostname,
+		UUIDs:    req.UUIDs,
+		Critical: true,
+		Subject:  fmt.Sprintf("Approval request for %s - %s %s", req.Operation, rpcConn.RemoteHost, req.Hostname),
+		Text: fmt.Sprintf("Administrator %s on computer %s (%s) is waiting for approval of %s of the following file systems:\r\n\r\n%s\r\n\r\n"+
+			"The approval ID is %s. Run \"cryptctl approve-operation\" on the key server within %d seconds to approve or reject it.\r\n",
+			requester, rpcConn.RemoteHost, req.Hostname, req.Operation, strings.Join(req.UUIDs, "\r\n"), approval.ID,
+			rpcConn.Svc.Config.ApprovalTimeoutSec),
+	})
+	return nil
+}
+
+// GetApprovalReq asks for the status of an operation submitted for approval.
+type GetApprovalReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+	ID            string         // ID of the approval
+}
+
+// GetApproval returns an operation submitted for approval. An error is returned if it was rejected or has expired.
+func (rpcConn *CryptServiceConn) GetApproval(req GetApprovalReq, resp *PendingApproval) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	approval, found := rpcConn.Svc.Approvals.Get(req.ID)
+	if !found {
+		return fmt.Errorf("GetApproval: cannot find operation %s, it may have been rejected or expired", req.ID)
+	}
+	*resp = approval
+	return nil
+}
+
+// ListApprovalsReq asks for all operations waiting for approval.
+type ListApprovalsReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+}
+
+// ListApprovals returns all operations submitted for approval, the oldest operation comes first.
+func (rpcConn *CryptServiceConn) ListApprovals(req ListApprovalsReq, resp *[]PendingApproval) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	*resp = rpcConn.Svc.Approvals.List()
+	return nil
+}
+
+// ApproveOperationReq approves or rejects an operation submitted by another administrator.
+type ApproveOperationReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+	Admin         string         // Admin is no longer used, the approver is identified by client certificate or user account.
+	ID            string         // ID of the approval
+	Reject        bool           // Reject removes the operation from queue instead of approving it
+}
+
+// ApproveOperation approves or rejects an operation submitted by another administrator.
+func (rpcConn *CryptServiceConn) ApproveOperation(req ApproveOperationReq, _ *DummyAttr) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	approver, err := rpcConn.adminIdentity()
+	if err != nil {
+		return err
+	}
+	var approval PendingApproval
+	outcome, decision := AuditOutcomeSuccess, "approved"
+	if req.Reject {
+		approval, err = rpcConn.Svc.Approvals.Reject(req.ID)
+		outcome, decision = AuditOutcomeFailure, "rejected"
+	} else {
+		approval, err = rpcConn.Svc.Approvals.Approve(req.ID, approver, rpcConn.RemoteHost,
+			time.Duration(rpcConn.Svc.Config.ApprovalTimeoutSec)*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	rpcConn.Log.Info("CryptServiceConn.ApproveOperation: administrator has made a decision", "decision", decision,
+		"operation", approval.Operation, "uuids", approval.UUIDs, "requester", approval.Requester, "approver", approver, "approval_id", approval.ID)
+	for _, uuid := range approval.UUIDs {
+		rpcConn.audit(AuditApprovalDecision, outcome, uuid, approval.Hostname,
+			fmt.Sprintf("%s requested by %s from %s has been %s by %s (approval %s)",
+				approval.Operation, approval.Requester, approval.IP, decision, approver, approval.ID))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"net"
+	"os/user"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApprovalQueue(t *testing.T) {
+	queue := NewApprovalQueue()
+	approval, err := queue.Submit(ApprovalKeyErasure, []string{"b", "a"}, "alice", "1.1.1.1", "host", time.Minute)
+	if err != nil || len(approval.ID) != 2*LenApprovalID || approval.IsApproved() || approval.IsExpired() {
+		t.Fatal(approval, err)
+	}
+	// Unapproved operation cannot be consumed
+	if _, err := queue.Consume(approval.ID, ApprovalKeyErasure, []string{"a", "b"}, "1.1.1.1"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Requester cannot approve their own request
+	if _, err := queue.Approve(approval.ID, "alice", "2.2.2.2", time.Minute); !errors.Is(err, ErrSameAdmin) {
+		t.Fatal(err)
+	}
+	if approval, err = queue.Approve(approval.ID, "bob", "2.2.2.2", time.Minute); err != nil || !approval.IsApproved() ||
+		approval.Approver != "bob" || approval.ApproverIP != "2.2.2.2" {
+		t.Fatal(approval, err)
+	}
+	if _, err := queue.Approve(approval.ID, "carol", "3.3.3.3", time.Minute); err == nil {
+		t.Fatal("did not error")
+	}
+	// Approval only applies to the same operation, disks, and requester IP
+	if _, err := queue.Consume(approval.ID, ApprovalManualRetrieval, []string{"a", "b"}, "1.1.1.1"); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := queue.Consume(approval.ID, ApprovalKeyErasure, []string{"a"}, "1.1.1.1"); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := queue.Consume(approval.ID, ApprovalKeyErasure, []string{"a", "b"}, "2.2.2.2"); err == nil {
+		t.Fatal("did not error")
+	}
+	if consumed, err := queue.Consume(approval.ID, ApprovalKeyErasure, []string{"a", "b"}, "1.1.1.1"); err != nil ||
+		consumed.ID != approval.ID || !strings.Contains(consumed.Note(), "approved by bob") {
+		t.Fatal(consumed, err)
+	}
+	// Approval is used only once
+	if _, err := queue.Consume(approval.ID, ApprovalKeyErasure, []string{"a", "b"}, "1.1.1.1"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Expired and rejected operations disappear
+	expiring, _ := queue.Submit(ApprovalKeyErasure, []string{"a"}, "alice", "1.1.1.1", "host", time.Millisecond)
+	rejected, _ := queue.Submit(ApprovalKeyErasure, []string{"a"}, "alice", "1.1.1.1", "host", time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if _, found := queue.Get(expiring.ID); found {
+		t.Fatal("did not expire")
+	}
+	if list := queue.List(); len(list) != 1 || list[0].ID != rejected.ID {
+		t.Fatal(list)
+	}
+	if _, err := queue.Reject(rejected.ID); err != nil {
+		t.Fatal(err)
+	}
+	if list := queue.List(); len(list) != 0 {
+		t.Fatal(list)
+	}
+}
+
+func TestApprovalRPC(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.ApprovalOperations = []string{ApprovalKeyErasure}
+	srv.Config.ApprovalTimeoutSec = 60
+	if hello, err := client.Hello(); err != nil || !hello.RequiresApproval(ApprovalKeyErasure) || hello.RequiresApproval(ApprovalManualRetrieval) {
+		t.Fatal(hello, err)
+	}
+	// Erasure without approval is refused
+	if err := client.EraseKey(EraseKeyReq{PlainPassword: TEST_RPC_PASS, UUID: "approval-test"}); err == nil ||
+		!strings.Contains(err.Error(), ErrApprovalRequired.Error()) {
+		t.Fatal(err)
+	}
+	// Administrators must be identified by something other than the password and a typed-in name
+	if _, err := client.RequestApproval(RequestApprovalReq{PlainPassword: TEST_RPC_PASS, Admin: "alice",
+		Operation: ApprovalKeyErasure, UUIDs: []string{"approval-test"}}); err == nil || !strings.Contains(err.Error(), ErrUnverifiedAdmin.Error()) {
+		t.Fatal(err)
+	}
+	alice := srv.newServiceConn("127.0.0.1")
+	alice.PeerCommonName = "alice"
+	// Operations that do not require approval cannot be submitted
+	var approval PendingApproval
+	if err := alice.RequestApproval(RequestApprovalReq{PlainPassword: TEST_RPC_PASS,
+		Operation: ApprovalManualRetrieval, UUIDs: []string{"approval-test"}}, &approval); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := alice.RequestApproval(RequestApprovalReq{PlainPassword: TEST_RPC_PASS,
+		Operation: ApprovalKeyErasure, UUIDs: []string{"approval-test"}, Hostname: "host"}, &approval); err != nil ||
+		approval.Requester != "cert:alice" || approval.IP != "127.0.0.1" {
+		t.Fatal(approval, err)
+	}
+	if list, err := client.ListApprovals(ListApprovalsReq{PlainPassword: TEST_RPC_PASS}); err != nil || len(list) != 1 || list[0].ID != approval.ID {
+		t.Fatal(list, err)
+	}
+	if err := client.EraseKey(EraseKeyReq{PlainPassword: TEST_RPC_PASS, UUID: "approval-test", ApprovalID: approval.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	// The same credential cannot approve its own request, no matter the name it declares
+	var dummy DummyAttr
+	for _, name := range []string{"", "alice", "bob"} {
+		if err := srv.newServiceConn("127.0.0.1").ApproveOperation(ApproveOperationReq{PlainPassword: TEST_RPC_PASS, Admin: name, ID: approval.ID}, &dummy); err == nil ||
+			!errors.Is(err, ErrUnverifiedAdmin) {
+			t.Fatal(err)
+		}
+		if err := alice.ApproveOperation(ApproveOperationReq{PlainPassword: TEST_RPC_PASS, Admin: name, ID: approval.ID}, &dummy); !errors.Is(err, ErrSameAdmin) {
+			t.Fatal(err)
+		}
+	}
+	if approval, err := client.GetApproval(GetApprovalReq{PlainPassword: TEST_RPC_PASS, ID: approval.ID}); err != nil || approval.IsApproved() {
+		t.Fatal(approval, err)
+	}
+	// Another administrator logged in on the key server approves it
+	bob := srv.newServiceConn("127.0.0.1")
+	bob.PeerUser = "bob"
+	if err := bob.ApproveOperation(ApproveOperationReq{PlainPassword: TEST_RPC_PASS, ID: approval.ID}, &dummy); err != nil {
+		t.Fatal(err)
+	}
+	if approval, err := client.GetApproval(GetApprovalReq{PlainPassword: TEST_RPC_PASS, ID: approval.ID}); err != nil ||
+		!approval.IsApproved() || approval.Approver != "user:bob" {
+		t.Fatal(approval, err)
+	}
+	// The key does not exist, but the approval is consumed nonetheless
+	if err := client.EraseKey(EraseKeyReq{PlainPassword: TEST_RPC_PASS, UUID: "approval-test", ApprovalID: approval.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetApproval(GetApprovalReq{PlainPassword: TEST_RPC_PASS, ID: approval.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Rejected operation disappears
+	if err := alice.RequestApproval(RequestApprovalReq{PlainPassword: TEST_RPC_PASS,
+		Operation: ApprovalKeyErasure, UUIDs: []string{"approval-test"}}, &approval); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.ApproveOperation(ApproveOperationReq{PlainPassword: TEST_RPC_PASS, ID: approval.ID, Reject: true}, &dummy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetApproval(GetApprovalReq{PlainPassword: TEST_RPC_PASS, ID: approval.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestUnixPeerUser(t *testing.T) {
+	sockPath := path.Join(t.TempDir(), "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := listener.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := unixPeerUser(server); err != nil || name != current.Username {
+		t.Fatal(name, err)
+	}
+}
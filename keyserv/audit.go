@@ -0,0 +1,313 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bufio"
+	"bytes"
+	"cryptctl/sys"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_AUDIT_SYSLOG_ADDR = "AUDIT_SYSLOG_ADDRESS"
+	SRV_CONF_AUDIT_SYSLOG_CA   = "AUDIT_SYSLOG_CA_PEM"
+	SRV_CONF_AUDIT_SYSLOG_CERT = "AUDIT_SYSLOG_TLS_CERT_PEM"
+	SRV_CONF_AUDIT_SYSLOG_KEY  = "AUDIT_SYSLOG_TLS_CERT_KEY_PEM"
+
+	AuditBufferFileSuffix = "-audit-buffer" // AuditBufferFileSuffix is appended to key database directory to make file name of undelivered audit events.
+
+	AUDIT_RETRY_SEC        = 30               // AUDIT_RETRY_SEC is the interval at which undelivered audit events are sent again.
+	AUDIT_QUEUE_LEN        = 1024             // AUDIT_QUEUE_LEN is the number of audit events waiting in memory before they overflow to disk.
+	AUDIT_BUFFER_MAX_BYTES = 64 * 1024 * 1024 // AUDIT_BUFFER_MAX_BYTES is the size limit of undelivered events on disk, further events are dropped.
+
+	AuditAppName = "cryptctl" // AuditAppName is the APP-NAME of syslog messages.
+	/*
+		AuditSDID is the ID of structured data element that carries event details. The enterprise number 32473 is
+		reserved for documentation by RFC 5612.
+	*/
+	AuditSDID = "cryptctl@32473"
+
+	AuditKeyCreation  = "key-creation"  // AuditKeyCreation is the event type of a new key saved by a client.
+	AuditKeyRetrieval = "key-retrieval" // AuditKeyRetrieval is the event type of a key granted to or rejected from a client.
+	AuditKeyErasure   = "key-erasure"   // AuditKeyErasure is the event type of a key erased by a client.
+	AuditLoginFailure = "login-failure" // AuditLoginFailure is the event type of an incorrect password presented by a client.
+
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+
+	syslogFacilityAuthPriv = 10 // syslogFacilityAuthPriv is the facility of security/authorization messages.
+	syslogSeverityWarning  = 4
+	syslogSeverityNotice   = 5
+)
+
+// AuditEvent is a security relevant event reported to the remote syslog collector.
+type AuditEvent struct {
+	Time     time.Time
+	Type     string // Type is one of AuditKeyCreation, AuditKeyRetrieval, AuditKeyErasure, AuditLoginFailure, AuditHostDead, AuditHostRecovered, AuditApprovalRequest, AuditApprovalDecision, AuditHostApproval, AuditKeyRelease, AuditKeyRotation.
+	Outcome  string // Outcome is either AuditOutcomeSuccess or AuditOutcomeFailure.
+	UUID     string // UUID of the disk the event is about, empty if not applicable.
+	IP       string // IP of the client computer.
+	Hostname string // Hostname of the client computer as reported by the client, empty if unknown.
+	Message  string // Message describes the event in plain text.
+}
+
+// escapeSDParam escapes the characters that must not appear literally in a structured data parameter value.
+func escapeSDParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// syslogHeaderField returns the value, or the nil value "-" if it is empty, spaces are not allowed in a header field.
+func syslogHeaderField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Replace(value, " ", "_", -1)
+}
+
+/*
+FormatRFC5424 returns the event as an RFC 5424 syslog message sent from the local host. The message does not contain
+line breaks, hence it can be stored in a line of text.
+*/
+func (event AuditEvent) FormatRFC5424(localHost string, procID int) string {
+	severity := syslogSeverityNotice
+	if event.Outcome != AuditOutcomeSuccess {
+		severity = syslogSeverityWarning
+	}
+	msg := strings.NewReplacer("\r", " ", "\n", " ").Replace(event.Message)
+	return fmt.Sprintf(`<%d>1 %s %s %s %d %s [%s uuid="%s" ip="%s" hostname="%s" outcome="%s"] %s`,
+		syslogFacilityAuthPriv*8+severity, event.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(localHost), AuditAppName, procID, syslogHeaderField(event.Type), AuditSDID,
+		escapeSDParam(event.UUID), escapeSDParam(event.IP), escapeSDParam(event.Hostname), escapeSDParam(event.Outcome), msg)
+}
+
+/*
+AuditSink sends audit events to a remote syslog collector over TCP and TLS (RFC 5425) in the background. Events that
+cannot be delivered are appended to a buffer file, which is sent again periodically and before newer events, so that
+the collector receives events in order.
+All functions are safe for concurrent usage, and a nil AuditSink discards all events.
+*/
+type AuditSink struct {
+	Address    string      // Address is the host:port of syslog collector
+	BufferFile string      // BufferFile stores undelivered messages, one per line
+	TLSConfig  *tls.Config // TLSConfig verifies syslog collector and optionally presents a client certificate
+	Log        *sys.Logger // Log is the logger of delivery failures
+	localHost  string
+	queue      chan string
+	conn       net.Conn
+	bufferLock *sync.Mutex
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// NewAuditSink returns an audit sink and starts delivering events in the background.
+func NewAuditSink(addr, bufferFile string, tlsConfig *tls.Config, logger *sys.Logger) *AuditSink {
+	localHost, _ := os.Hostname()
+	sink := &AuditSink{
+		Address:    addr,
+		BufferFile: bufferFile,
+		TLSConfig:  tlsConfig,
+		Log:        logger,
+		localHost:  localHost,
+		queue:      make(chan string, AUDIT_QUEUE_LEN),
+		bufferLock: new(sync.Mutex),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+// newAuditTLSConfig returns TLS configuration for connecting to syslog collector according to server configuration.
+func newAuditTLSConfig(conf CryptServiceConfig) (*tls.Config, error) {
+	tlsConfig := new(tls.Config)
+	if conf.AuditSyslogCAPEM != "" {
+		caPEM, err := ioutil.ReadFile(conf.AuditSyslogCAPEM)
+		if err != nil {
+			return nil, fmt.Errorf("newAuditTLSConfig: failed to read CA file \"%s\" - %v", conf.AuditSyslogCAPEM, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("newAuditTLSConfig: failed to load CA certificates from \"%s\"", conf.AuditSyslogCAPEM)
+		}
+	}
+	if conf.AuditSyslogCertPEM != "" {
+		cert, err := tls.LoadX509KeyPair(conf.AuditSyslogCertPEM, conf.AuditSyslogKeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("newAuditTLSConfig: failed to load client certificate/key - %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Record queues an event for delivery. It does not block caller.
+func (sink *AuditSink) Record(event AuditEvent) {
+	if sink == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	msg := event.FormatRFC5424(sink.localHost, os.Getpid())
+	select {
+	case sink.queue <- msg:
+	default:
+		// The collector is too slow or unreachable, let the disk take the overflow.
+		sink.buffer(msg)
+	}
+}
+
+// Close delivers or buffers the events that are still queued, and then stops the background delivery.
+func (sink *AuditSink) Close() {
+	if sink == nil {
+		return
+	}
+	close(sink.done)
+	<-sink.stopped
+}
+
+// run delivers queued events and retries undelivered events until the sink is closed.
+func (sink *AuditSink) run() {
+	defer close(sink.stopped)
+	retry := time.NewTicker(AUDIT_RETRY_SEC * time.Second)
+	defer retry.Stop()
+	for {
+		select {
+		case msg := <-sink.queue:
+			sink.deliver(msg)
+		case <-retry.C:
+			sink.flushBuffer()
+		case <-sink.done:
+			for {
+				select {
+				case msg := <-sink.queue:
+					sink.deliver(msg)
+				default:
+					if sink.conn != nil {
+						sink.conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends a message after the buffered ones, or buffers it if the collector cannot be reached.
+func (sink *AuditSink) deliver(msg string) {
+	if !sink.flushBuffer() {
+		sink.buffer(msg)
+		return
+	}
+	if err := sink.send(msg); err != nil {
+		sink.Log.Warning("AuditSink.deliver: failed to send audit event, it will be sent again later", "server", sink.Address, "error", err)
+		sink.buffer(msg)
+	}
+}
+
+// send writes a message to the collector using octet-counting framing, the connection is made if necessary.
+func (sink *AuditSink) send(msg string) error {
+	if sink.conn == nil {
+		dialer := &net.Dialer{Timeout: RPC_DIAL_TIMEOUT_SEC * time.Second}
+		conn, err := tls.DialWithDialer(dialer, "tcp", sink.Address, sink.TLSConfig)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(RPC_DIAL_TIMEOUT_SEC * time.Second))
+	if _, err := fmt.Fprintf(sink.conn, "%d %s", len(msg), msg); err != nil {
+		sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	return nil
+}
+
+// buffer appends a message to the buffer file, unless the file has grown too large.
+func (sink *AuditSink) buffer(msg string) {
+	sink.bufferLock.Lock()
+	defer sink.bufferLock.Unlock()
+	if info, err := os.Stat(sink.BufferFile); err == nil && info.Size() > AUDIT_BUFFER_MAX_BYTES {
+		sink.Log.Error("AuditSink.buffer: too many undelivered audit events, dropping event", "file", sink.BufferFile, "event", msg)
+		return
+	}
+	file, err := os.OpenFile(sink.BufferFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		sink.Log.Error("AuditSink.buffer: failed to open buffer file, dropping event", "file", sink.BufferFile, "event", msg, "error", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.WriteString(msg + "\n"); err != nil {
+		sink.Log.Error("AuditSink.buffer: failed to write buffer file, dropping event", "file", sink.BufferFile, "event", msg, "error", err)
+	}
+}
+
+/*
+flushBuffer sends the messages in buffer file, those that could not be sent stay in the file.
+Return true only if the buffer is empty afterwards.
+*/
+func (sink *AuditSink) flushBuffer() bool {
+	sink.bufferLock.Lock()
+	defer sink.bufferLock.Unlock()
+	content, err := ioutil.ReadFile(sink.BufferFile)
+	if os.IsNotExist(err) || err == nil && len(content) == 0 {
+		return true
+	} else if err != nil {
+		sink.Log.Error("AuditSink.flushBuffer: failed to read buffer file", "file", sink.BufferFile, "error", err)
+		return false
+	}
+	var remaining bytes.Buffer
+	var sendErr error
+	sent := 0
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), AUDIT_BUFFER_MAX_BYTES)
+	for scanner.Scan() {
+		if sendErr == nil {
+			if sendErr = sink.send(scanner.Text()); sendErr == nil {
+				sent++
+				continue
+			}
+		}
+		remaining.WriteString(scanner.Text() + "\n")
+	}
+	if sendErr != nil {
+		sink.Log.Warning("AuditSink.flushBuffer: failed to send buffered audit events, they will be sent again later", "server", sink.Address, "error", sendErr)
+	}
+	if sent > 0 {
+		sink.Log.Info("AuditSink.flushBuffer: sent buffered audit events", "server", sink.Address, "count", sent)
+	}
+	if remaining.Len() == 0 {
+		if err := os.Remove(sink.BufferFile); err != nil {
+			sink.Log.Error("AuditSink.flushBuffer: failed to remove buffer file", "file", sink.BufferFile, "error", err)
+		}
+		return true
+	}
+	if sent > 0 {
+		if err := ioutil.WriteFile(sink.BufferFile, remaining.Bytes(), 0600); err != nil {
+			sink.Log.Error("AuditSink.flushBuffer: failed to rewrite buffer file", "file", sink.BufferFile, "error", err)
+		}
+	}
+	return false
+}
+
+// audit reports an event that concerns the client of this connection to the audit sink.
+func (rpcConn *CryptServiceConn) audit(eventType, outcome, uuid, hostname, message string) {
+	rpcConn.Svc.Audit.Record(AuditEvent{
+		Type:     eventType,
+		Outcome:  outcome,
+		UUID:     uuid,
+		IP:       rpcConn.RemoteHost,
+		Hostname: hostname,
+		Message:  message,
+	})
+}
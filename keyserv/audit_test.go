@@ -0,0 +1,120 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditEventFormat(t *testing.T) {
+	event := AuditEvent{
+		Time:     time.Date(2017, 1, 2, 3, 4, 5, 6000, time.UTC),
+		Type:     AuditKeyRetrieval,
+		Outcome:  AuditOutcomeFailure,
+		UUID:     "aaa",
+		IP:       "1.2.3.4",
+		Hostname: `a"b]c\`,
+		Message:  "line1\nline2",
+	}
+	expected := `<84>1 2017-01-02T03:04:05.000006Z myhost cryptctl 123 key-retrieval [cryptctl@32473 uuid="aaa" ip="1.2.3.4" hostname="a\"b\]c\\" outcome="failure"] line1 line2`
+	if msg := event.FormatRFC5424("myhost", 123); msg != expected {
+		t.Fatal(msg)
+	}
+	event.Outcome = AuditOutcomeSuccess
+	if msg := event.FormatRFC5424("", 123); !strings.HasPrefix(msg, "<85>1 2017-01-02T03:04:05.000006Z - cryptctl") {
+		t.Fatal(msg)
+	}
+}
+
+// readSyslogFrame reads an octet-counted syslog message.
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	var length int
+	if _, err := fmt.Fscanf(reader, "%d ", &length); err != nil {
+		return "", err
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+func TestAuditSink(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-audittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	bufferFile := path.Join(tmpDir, "buffer")
+	// Find a free port and leave the collector down for now
+	cert, err := tls.LoadX509KeyPair(path.Join(PkgInGopath, "keyserv", "rpc_test.crt"), path.Join(PkgInGopath, "keyserv", "rpc_test.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	sink := NewAuditSink(addr, bufferFile, &tls.Config{InsecureSkipVerify: true}, nil)
+	sink.Record(AuditEvent{Type: AuditLoginFailure, Outcome: AuditOutcomeFailure, IP: "1.1.1.1"})
+	// The undelivered event goes to disk
+	for i := 0; ; i++ {
+		if content, _ := ioutil.ReadFile(bufferFile); strings.Contains(string(content), `ip="1.1.1.1"`) {
+			break
+		} else if i > 100 {
+			t.Fatal("event was not buffered")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Once the collector is up, buffered event is delivered before the new one
+	if listener, err = tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			msg, err := readSyslogFrame(reader)
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	sink.Record(AuditEvent{Type: AuditKeyCreation, Outcome: AuditOutcomeSuccess, UUID: "aaa", IP: "2.2.2.2"})
+	for _, expected := range []string{`ip="1.1.1.1"`, `uuid="aaa" ip="2.2.2.2"`} {
+		select {
+		case msg := <-received:
+			if !strings.Contains(msg, expected) {
+				t.Fatal(msg)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	sink.Close()
+	if _, err := os.Stat(bufferFile); !os.IsNotExist(err) {
+		t.Fatal("buffer file should be gone", err)
+	}
+	// Nil sink discards events
+	var nilSink *AuditSink
+	nilSink.Record(AuditEvent{})
+	nilSink.Close()
+}
@@ -0,0 +1,258 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	CAValidity        = 20 * 365 * 24 * time.Hour // CAValidity is the life span of a root certificate made by the built-in CA.
+	LeafCertValidity  = 5 * 365 * 24 * time.Hour  // LeafCertValidity is the life span of server and client certificates issued by the built-in CA.
+	CAOrganisation    = "cryptctl"                // CAOrganisation is the organisation name written into all certificates made by the built-in CA.
+	LenCertSerialBits = 128                       // LenCertSerialBits is the length of random serial number of a newly issued certificate.
+	PEMTypeCert       = "CERTIFICATE"
+	PEMTypePrivateKey = "PRIVATE KEY"
+)
+
+/*
+CertAuthority is a minimal certificate authority that issues TLS certificates for key server and its clients.
+It replaces the self-signed certificate previously made by openssl, so that certificates do not silently expire.
+*/
+type CertAuthority struct {
+	Cert    *x509.Certificate // Cert is the root certificate of the authority.
+	CertPEM []byte            // CertPEM is the PEM-encoded root certificate, to be distributed to client computers.
+	Key     crypto.Signer     // Key is the private key that signs issued certificates.
+}
+
+// newCertSerial returns a random positive serial number for a new certificate.
+func newCertSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), LenCertSerialBits))
+	if err != nil {
+		return nil, fmt.Errorf("newCertSerial: failed to read from random source - %v", err)
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+// subjectKeyID computes a key identifier from the public key, using method 1 of RFC 5280 section 4.2.1.2.
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(der)
+	return sum[:], nil
+}
+
+// encodePrivateKeyPEM serialises a private key into PKCS#8 PEM block.
+func encodePrivateKeyPEM(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypePrivateKey, Bytes: der}), nil
+}
+
+// writeNewFile writes content into a file that must not yet exist.
+func writeNewFile(filePath string, content []byte, mode os.FileMode) error {
+	fh, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(content); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// NewCertAuthority generates a new key pair and a long-lived self-signed root certificate.
+func NewCertAuthority(commonName string) (*CertAuthority, error) {
+	if commonName == "" {
+		return nil, errors.New("NewCertAuthority: common name must not be empty")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("NewCertAuthority: failed to generate key - %v", err)
+	}
+	serial, err := newCertSerial()
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := subjectKeyID(key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("NewCertAuthority: failed to compute key ID - %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{CAOrganisation}},
+		NotBefore:             now.Add(-1 * time.Hour), // tolerate small clock difference among computers
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          keyID,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("NewCertAuthority: failed to create certificate - %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("NewCertAuthority: failed to parse the new certificate - %v", err)
+	}
+	return &CertAuthority{
+		Cert:    cert,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: PEMTypeCert, Bytes: der}),
+		Key:     key,
+	}, nil
+}
+
+// LoadCertAuthority reads root certificate and its private key from PEM files.
+func LoadCertAuthority(certPath, keyPath string) (*CertAuthority, error) {
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to read certificate \"%s\" - %v", certPath, err)
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != PEMTypeCert {
+		return nil, fmt.Errorf("LoadCertAuthority: \"%s\" does not contain a PEM-encoded certificate", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to parse certificate \"%s\" - %v", certPath, err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("LoadCertAuthority: certificate \"%s\" is not a certificate authority", certPath)
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to read key \"%s\" - %v", keyPath, err)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("LoadCertAuthority: \"%s\" does not contain a PEM-encoded key", keyPath)
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCertAuthority: failed to parse key \"%s\" - %v", keyPath, err)
+	}
+	key, ok := parsedKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("LoadCertAuthority: key \"%s\" cannot be used for signing", keyPath)
+	}
+	return &CertAuthority{Cert: cert, CertPEM: pem.EncodeToMemory(certBlock), Key: key}, nil
+}
+
+// Save writes root certificate and its private key into files. Existing files will not be overwritten.
+func (ca *CertAuthority) Save(certPath, keyPath string) error {
+	keyPEM, err := encodePrivateKeyPEM(ca.Key)
+	if err != nil {
+		return fmt.Errorf("CertAuthority.Save: failed to encode key - %v", err)
+	}
+	if err := writeNewFile(certPath, ca.CertPEM, 0644); err != nil {
+		return fmt.Errorf("CertAuthority.Save: failed to write certificate - %v", err)
+	}
+	if err := writeNewFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("CertAuthority.Save: failed to write key - %v", err)
+	}
+	return nil
+}
+
+// sign issues a certificate for the public key, the certificate is returned in PEM encoding.
+func (ca *CertAuthority) sign(pub crypto.PublicKey, commonName string, hosts []string, extUsage x509.ExtKeyUsage) ([]byte, error) {
+	if commonName == "" {
+		return nil, errors.New("CertAuthority.sign: common name must not be empty")
+	}
+	serial, err := newCertSerial()
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := subjectKeyID(pub)
+	if err != nil {
+		return nil, fmt.Errorf("CertAuthority.sign: failed to compute key ID - %v", err)
+	}
+	now := time.Now()
+	notAfter := now.Add(LeafCertValidity)
+	if notAfter.After(ca.Cert.NotAfter) {
+		// A certificate cannot outlive its issuer
+		notAfter = ca.Cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{CAOrganisation}},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{extUsage},
+		BasicConstraintsValid: true,
+		SubjectKeyId:          keyID,
+		AuthorityKeyId:        ca.Cert.SubjectKeyId,
+	}
+	// Subject alternative names are mandatory for server certificates, as Go no longer looks at common name.
+	for _, host := range append([]string{commonName}, hosts...) {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, pub, ca.Key)
+	if err != nil {
+		return nil, fmt.Errorf("CertAuthority.sign: failed to create certificate - %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: PEMTypeCert, Bytes: der}), nil
+}
+
+// issue generates a new key pair and a certificate signed by this authority, then writes both into files.
+func (ca *CertAuthority) issue(commonName string, hosts []string, extUsage x509.ExtKeyUsage, certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("CertAuthority.issue: failed to generate key - %v", err)
+	}
+	certPEM, err := ca.sign(key.Public(), commonName, hosts, extUsage)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodePrivateKeyPEM(key)
+	if err != nil {
+		return fmt.Errorf("CertAuthority.issue: failed to encode key - %v", err)
+	}
+	// The certificate file is followed by CA certificate so that it makes a complete chain
+	if err := writeNewFile(certPath, append(certPEM, ca.CertPEM...), 0644); err != nil {
+		return fmt.Errorf("CertAuthority.issue: failed to write certificate - %v", err)
+	}
+	if err := writeNewFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("CertAuthority.issue: failed to write key - %v", err)
+	}
+	return nil
+}
+
+/*
+IssueServerCert makes a key pair and certificate for key server. The common name and additional host names or IP
+addresses all go into subject alternative names.
+*/
+func (ca *CertAuthority) IssueServerCert(commonName string, hosts []string, certPath, keyPath string) error {
+	return ca.issue(commonName, hosts, x509.ExtKeyUsageServerAuth, certPath, keyPath)
+}
+
+// IssueClientCert makes a key pair and certificate that identifies a client computer to key server.
+func (ca *CertAuthority) IssueClientCert(commonName, certPath, keyPath string) error {
+	return ca.issue(commonName, nil, x509.ExtKeyUsageClientAuth, certPath, keyPath)
+}
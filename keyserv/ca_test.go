@@ -0,0 +1,98 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCertAuthority(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-catest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if _, err := NewCertAuthority(""); err == nil {
+		t.Fatal("did not error")
+	}
+	ca, err := NewCertAuthority("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Cert.IsCA || ca.Cert.NotAfter.Before(time.Now().Add(CAValidity-24*time.Hour)) {
+		t.Fatal(ca.Cert.IsCA, ca.Cert.NotAfter)
+	}
+	caCertPath := path.Join(tmpDir, "ca.crt")
+	caKeyPath := path.Join(tmpDir, "ca.key")
+	if err := ca.Save(caCertPath, caKeyPath); err != nil {
+		t.Fatal(err)
+	}
+	// Existing files must not be overwritten
+	if err := ca.Save(caCertPath, caKeyPath); err == nil {
+		t.Fatal("did not error")
+	}
+	loadedCA, err := LoadCertAuthority(caCertPath, caKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loadedCA.Cert.Equal(ca.Cert) {
+		t.Fatal("loaded a different certificate")
+	}
+	// Issue a server certificate and verify its host names
+	srvCertPath := path.Join(tmpDir, "srv.crt")
+	srvKeyPath := path.Join(tmpDir, "srv.key")
+	if err := loadedCA.IssueServerCert("", nil, srvCertPath, srvKeyPath); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := loadedCA.IssueServerCert("keyserver.example.com", []string{"10.0.0.1"}, srvCertPath, srvKeyPath); err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	srvPair, err := tls.LoadX509KeyPair(srvCertPath, srvKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvCert, err := x509.ParseCertificate(srvPair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"keyserver.example.com", "10.0.0.1"} {
+		if _, err := srvCert.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+	if _, err := srvCert.Verify(x509.VerifyOptions{DNSName: "other.example.com", Roots: roots}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Issue a client certificate and verify its usage
+	cliCertPath := path.Join(tmpDir, "cli.crt")
+	cliKeyPath := path.Join(tmpDir, "cli.key")
+	if err := loadedCA.IssueClientCert("client.example.com", cliCertPath, cliKeyPath); err != nil {
+		t.Fatal(err)
+	}
+	cliPair, err := tls.LoadX509KeyPair(cliCertPath, cliKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cliCert, err := x509.ParseCertificate(cliPair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cliCert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cliCert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}); err == nil {
+		t.Fatal("did not error")
+	}
+	// A leaf certificate cannot act as authority
+	if _, err := LoadCertAuthority(cliCertPath, cliKeyPath); err == nil {
+		t.Fatal("did not error")
+	}
+}
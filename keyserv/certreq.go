@@ -0,0 +1,287 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl/sys"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	LenCertRequestID       = 16                 // LenCertRequestID is the number of random bytes in a certificate request ID.
+	CertRequestValidity    = 7 * 24 * time.Hour // CertRequestValidity is the period of time a certificate request stays in the queue.
+	MaxPendingCertRequests = 1000               // MaxPendingCertRequests is the upper limit of certificate requests waiting for approval.
+	PEMTypeCertRequest     = "CERTIFICATE REQUEST"
+	CertRequestDirSuffix   = "-certreq" // CertRequestDirSuffix is appended to key database directory to make directory name of the queue.
+)
+
+/*
+NewClientCertRequest generates a new key pair for a client computer, and a certificate signing request that carries the
+common name. Both key and request are returned in PEM encoding.
+*/
+func NewClientCertRequest(commonName string) (keyPEM, csrPEM []byte, err error) {
+	if commonName == "" {
+		return nil, nil, errors.New("NewClientCertRequest: common name must not be empty")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("NewClientCertRequest: failed to generate key - %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("NewClientCertRequest: failed to create request - %v", err)
+	}
+	if keyPEM, err = encodePrivateKeyPEM(key); err != nil {
+		return nil, nil, fmt.Errorf("NewClientCertRequest: failed to encode key - %v", err)
+	}
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: PEMTypeCertRequest, Bytes: der})
+	return
+}
+
+// ParseCertRequest decodes a PEM-encoded certificate signing request and verifies its signature.
+func ParseCertRequest(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != PEMTypeCertRequest {
+		return nil, errors.New("ParseCertRequest: input does not contain a PEM-encoded certificate request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ParseCertRequest: failed to parse request - %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("ParseCertRequest: request signature is invalid - %v", err)
+	}
+	if csr.Subject.CommonName == "" {
+		return nil, errors.New("ParseCertRequest: request does not carry a common name")
+	}
+	return csr, nil
+}
+
+// SignClientCertRequest issues a client certificate for the request, return the certificate chain in PEM encoding.
+func (ca *CertAuthority) SignClientCertRequest(csr *x509.CertificateRequest) ([]byte, error) {
+	certPEM, err := ca.sign(csr.PublicKey, csr.Subject.CommonName, nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	return append(certPEM, ca.CertPEM...), nil
+}
+
+// ClientCertRequest is a certificate signing request submitted by a client computer.
+type ClientCertRequest struct {
+	ID          string    // ID is a random string that identifies the request, it is known only to the client and administrator.
+	CommonName  string    // CommonName is the host name that the client wishes to carry in its certificate.
+	IP          string    // IP is the client computer's IP as seen by cryptctl server.
+	Hostname    string    // Hostname is the host name reported by client computer itself.
+	CSRPEM      []byte    // CSRPEM is the PEM-encoded certificate signing request.
+	SubmittedAt time.Time // SubmittedAt is the moment the request arrived at cryptctl server.
+	ApprovedAt  time.Time // ApprovedAt is the moment the request was approved by administrator, it is zero for pending requests.
+	CertPEM     []byte    // CertPEM is the signed certificate chain, it becomes available after approval.
+}
+
+// IsApproved returns true only if administrator has approved the request.
+func (req *ClientCertRequest) IsApproved() bool {
+	return !req.ApprovedAt.IsZero()
+}
+
+// IsExpired returns true if the request stayed in the queue for too long.
+func (req *ClientCertRequest) IsExpired() bool {
+	return req.SubmittedAt.Add(CertRequestValidity).Before(time.Now())
+}
+
+/*
+CertRequestQueue keeps client certificate requests waiting for administrator's approval. Each request is serialised into
+a file in the queue directory, so that pending requests survive server restart.
+All exported functions are safe for concurrent usage.
+*/
+type CertRequestQueue struct {
+	Dir      string
+	Requests map[string]ClientCertRequest // key is request ID
+	Lock     *sync.Mutex
+}
+
+// OpenCertRequestQueue opens a queue directory and reads all requests into memory, expired requests are removed.
+func OpenCertRequestQueue(dir string) (*CertRequestQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("OpenCertRequestQueue: failed to make directory \"%s\" - %v", dir, err)
+	}
+	queue := &CertRequestQueue{Dir: dir, Requests: make(map[string]ClientCertRequest), Lock: new(sync.Mutex)}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("OpenCertRequestQueue: failed to read directory \"%s\" - %v", dir, err)
+	}
+	for _, fileInfo := range files {
+		content, err := ioutil.ReadFile(path.Join(dir, fileInfo.Name()))
+		if err != nil {
+			sys.NewLogger().Warning("OpenCertRequestQueue: non-fatal failure occured when reading request", "file", fileInfo.Name(), "error", err)
+			continue
+		}
+		var req ClientCertRequest
+		if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&req); err != nil {
+			sys.NewLogger().Warning("OpenCertRequestQueue: non-fatal failure occured when decoding request", "file", fileInfo.Name(), "error", err)
+			continue
+		}
+		queue.Requests[req.ID] = req
+	}
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	return queue, nil
+}
+
+// save persists a request into its file. Caller must hold the lock.
+func (queue *CertRequestQueue) save(req ClientCertRequest) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(req); err != nil {
+		return fmt.Errorf("CertRequestQueue.save: failed to encode request %s - %v", req.ID, err)
+	}
+	if err := ioutil.WriteFile(path.Join(queue.Dir, req.ID), buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("CertRequestQueue.save: failed to write request %s - %v", req.ID, err)
+	}
+	queue.Requests[req.ID] = req
+	return nil
+}
+
+// remove deletes a request from both memory and disk. Caller must hold the lock.
+func (queue *CertRequestQueue) remove(id string) {
+	delete(queue.Requests, id)
+	if err := os.Remove(path.Join(queue.Dir, id)); err != nil && !os.IsNotExist(err) {
+		sys.NewLogger().Warning("CertRequestQueue.remove: failed to delete request", "cert_request_id", id, "error", err)
+	}
+}
+
+// removeExpired deletes all requests that stayed in the queue for too long. Caller must hold the lock.
+func (queue *CertRequestQueue) removeExpired() {
+	for id, req := range queue.Requests {
+		if req.IsExpired() {
+			queue.remove(id)
+		}
+	}
+}
+
+/*
+Submit places a new certificate request into the queue and returns its ID.
+An older request made by the same IP for the same common name is replaced.
+*/
+func (queue *CertRequestQueue) Submit(csrPEM []byte, ip, hostname string) (string, error) {
+	csr, err := ParseCertRequest(csrPEM)
+	if err != nil {
+		return "", err
+	}
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	for id, req := range queue.Requests {
+		if req.IP == ip && req.CommonName == csr.Subject.CommonName && !req.IsApproved() {
+			queue.remove(id)
+		}
+	}
+	if len(queue.Requests) >= MaxPendingCertRequests {
+		return "", errors.New("CertRequestQueue.Submit: there are too many certificate requests waiting for approval")
+	}
+	idBytes := make([]byte, LenCertRequestID)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("CertRequestQueue.Submit: failed to read from random source - %v", err)
+	}
+	req := ClientCertRequest{
+		ID:          hex.EncodeToString(idBytes),
+		CommonName:  csr.Subject.CommonName,
+		IP:          ip,
+		Hostname:    hostname,
+		CSRPEM:      csrPEM,
+		SubmittedAt: time.Now(),
+	}
+	if err := queue.save(req); err != nil {
+		return "", err
+	}
+	return req.ID, nil
+}
+
+// Get retrieves a request by its ID.
+func (queue *CertRequestQueue) Get(id string) (req ClientCertRequest, found bool) {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	req, found = queue.Requests[id]
+	return
+}
+
+// List returns all requests sorted by submission time, the oldest request comes first.
+func (queue *CertRequestQueue) List() []ClientCertRequest {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	ret := make([]ClientCertRequest, 0, len(queue.Requests))
+	for _, req := range queue.Requests {
+		ret = append(ret, req)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].SubmittedAt.Before(ret[j].SubmittedAt)
+	})
+	return ret
+}
+
+// Approve signs a pending request using the certificate authority. The signed certificate waits for client to collect.
+func (queue *CertRequestQueue) Approve(id string, ca *CertAuthority) (ClientCertRequest, error) {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	req, found := queue.Requests[id]
+	if !found || req.IsExpired() {
+		return req, fmt.Errorf("CertRequestQueue.Approve: cannot find request %s", id)
+	}
+	if req.IsApproved() {
+		return req, fmt.Errorf("CertRequestQueue.Approve: request %s has already been approved", id)
+	}
+	csr, err := ParseCertRequest(req.CSRPEM)
+	if err != nil {
+		return req, err
+	}
+	if req.CertPEM, err = ca.SignClientCertRequest(csr); err != nil {
+		return req, err
+	}
+	req.ApprovedAt = time.Now()
+	return req, queue.save(req)
+}
+
+// Reject removes a pending request from the queue.
+func (queue *CertRequestQueue) Reject(id string) error {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	if _, found := queue.Requests[id]; !found {
+		return fmt.Errorf("CertRequestQueue.Reject: cannot find request %s", id)
+	}
+	queue.remove(id)
+	return nil
+}
+
+// Collect hands out the signed certificate of an approved request, and then removes the request from queue.
+func (queue *CertRequestQueue) Collect(id, ip string) (req ClientCertRequest, err error) {
+	queue.Lock.Lock()
+	defer queue.Lock.Unlock()
+	queue.removeExpired()
+	req, found := queue.Requests[id]
+	if !found || req.IP != ip {
+		return req, errors.New("CertRequestQueue.Collect: the request does not exist, it may have been rejected or expired")
+	}
+	if req.IsApproved() {
+		queue.remove(id)
+	}
+	return req, nil
+}
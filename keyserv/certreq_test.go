@@ -0,0 +1,227 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCertRequestQueue(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-certreqtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ca, err := NewCertAuthority("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := OpenCertRequestQueue(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Submit([]byte("junk"), "1.1.1.1", "host1"); err == nil {
+		t.Fatal("did not error")
+	}
+	keyPEM, csrPEM, err := NewClientCertRequest("host1.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id1, err := queue.Submit(csrPEM, "1.1.1.1", "host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Submitting again from the same IP replaces the older request
+	id2, err := queue.Submit(csrPEM, "1.1.1.1", "host1")
+	if err != nil || id1 == id2 {
+		t.Fatal(err, id1, id2)
+	}
+	if _, found := queue.Get(id1); found {
+		t.Fatal("older request is still there")
+	}
+	// Another IP may request the same name
+	id3, err := queue.Submit(csrPEM, "2.2.2.2", "host2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqs := queue.List(); len(reqs) != 2 || reqs[0].ID != id2 || reqs[1].ID != id3 {
+		t.Fatalf("%+v", reqs)
+	}
+	// Pending requests survive reopening the queue
+	queue, err = OpenCertRequestQueue(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req, found := queue.Get(id2); !found || req.CommonName != "host1.example.com" || req.IP != "1.1.1.1" || req.IsApproved() {
+		t.Fatalf("%+v", req)
+	}
+	// Collect a pending request
+	if _, err := queue.Collect(id2, "2.2.2.2"); err == nil {
+		t.Fatal("did not error")
+	}
+	if req, err := queue.Collect(id2, "1.1.1.1"); err != nil || req.IsApproved() || len(req.CertPEM) != 0 {
+		t.Fatal(err, req)
+	}
+	// Approve and collect
+	if _, err := queue.Approve("does-not-exist", ca); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := queue.Approve(id2, ca); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Approve(id2, ca); err == nil {
+		t.Fatal("did not error")
+	}
+	req, err := queue.Collect(id2, "1.1.1.1")
+	if err != nil || !req.IsApproved() {
+		t.Fatal(err, req)
+	}
+	if _, err := tls.X509KeyPair(req.CertPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(req.CertPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatal(err)
+	}
+	// Collected request disappears
+	if _, err := queue.Collect(id2, "1.1.1.1"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Reject
+	if err := queue.Reject(id3); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Reject(id3); err == nil {
+		t.Fatal("did not error")
+	}
+	// Expired requests are removed
+	id4, err := queue.Submit(csrPEM, "3.3.3.3", "host3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := queue.Requests[id4]
+	expired.SubmittedAt = time.Now().Add(-CertRequestValidity - time.Minute)
+	queue.Requests[id4] = expired
+	if len(queue.List()) != 0 {
+		t.Fatal("expired request is still there")
+	}
+}
+
+func TestCertRequestRPC(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	tmpDir, err := ioutil.TempDir("", "cryptctl-certreqtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keyPEM, csrPEM, err := NewClientCertRequest("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := client.SubmitCertRequest(SubmitCertRequestReq{Hostname: "localhost", CSRPEM: csrPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.CollectClientCert(CollectClientCertReq{ID: id}); err != nil || resp.Approved {
+		t.Fatal(err, resp)
+	}
+	if _, err := client.ListCertRequests(ListCertRequestsReq{PlainPassword: "wrong password"}); err == nil {
+		t.Fatal("did not error")
+	}
+	reqs, err := client.ListCertRequests(ListCertRequestsReq{PlainPassword: TEST_RPC_PASS})
+	if err != nil || len(reqs) != 1 || reqs[0].ID != id || reqs[0].IP != "127.0.0.1" {
+		t.Fatal(err, reqs)
+	}
+	// Server cannot sign without the built-in CA
+	if err := client.ApproveCertRequest(ApproveCertRequestReq{PlainPassword: TEST_RPC_PASS, ID: id}); err == nil {
+		t.Fatal("did not error")
+	}
+	ca, err := NewCertAuthority("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.CertAuthorityPEM = path.Join(tmpDir, "ca.crt")
+	srv.Config.CertAuthorityKeyPEM = path.Join(tmpDir, "ca.key")
+	if err := ca.Save(srv.Config.CertAuthorityPEM, srv.Config.CertAuthorityKeyPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ApproveCertRequest(ApproveCertRequestReq{PlainPassword: "wrong password", ID: id}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.ApproveCertRequest(ApproveCertRequestReq{PlainPassword: TEST_RPC_PASS, ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.CollectClientCert(CollectClientCertReq{ID: id})
+	if err != nil || !resp.Approved {
+		t.Fatal(err, resp)
+	}
+	if _, err := tls.X509KeyPair(resp.CertPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	// Demand client certificates, clients without certificate cannot even enrol.
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	srv.TLSConfig.ClientCAs = roots
+	srv.Config.ValidateClientCert = true
+	srv.TLSConfig.ClientAuth = srv.Config.ClientAuth()
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := client.SubmitCertRequest(SubmitCertRequestReq{Hostname: "localhost", CSRPEM: csrPEM}); err == nil {
+		t.Fatal("did not error")
+	}
+	// With enrolment enabled, clients without certificate may only enrol.
+	srv.Config.AllowCertEnrolment = true
+	srv.TLSConfig.ClientAuth = srv.Config.ClientAuth()
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("did not error")
+	}
+	certPath := path.Join(tmpDir, "client.crt")
+	keyPath := path.Join(tmpDir, "client.key")
+	if err := ioutil.WriteFile(certPath, resp.CertPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	certClient, err := NewCryptClient("tcp", "localhost:3737", nil, certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certClient.tlsConfig.InsecureSkipVerify = true
+	if err := certClient.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	// Reject another request
+	id, err = client.SubmitCertRequest(SubmitCertRequestReq{Hostname: "localhost", CSRPEM: csrPEM})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ApproveCertRequest(ApproveCertRequestReq{PlainPassword: TEST_RPC_PASS, ID: id, Reject: true}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := certClient.ApproveCertRequest(ApproveCertRequestReq{PlainPassword: TEST_RPC_PASS, ID: id, Reject: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CollectClientCert(CollectClientCertReq{ID: id}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Let tear down routine use the original client
+	srv.TLSConfig.ClientAuth = tls.NoClientCert
+	srv.Config.ValidateClientCert = false
+	srv.Config.AllowCertEnrolment = false
+}
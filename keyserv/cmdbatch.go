@@ -0,0 +1,302 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"cryptctl/sys"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	SRV_CONF_HOST_GROUP_NAME_FMT  = "HOST_GROUP_%d_NAME"  // SRV_CONF_HOST_GROUP_NAME_FMT makes the sysconfig key of the name of Nth host group.
+	SRV_CONF_HOST_GROUP_HOSTS_FMT = "HOST_GROUP_%d_HOSTS" // SRV_CONF_HOST_GROUP_HOSTS_FMT makes the sysconfig key of the computer IPs of Nth host group.
+	MaxHostGroups                 = 99                    // MaxHostGroups is the number of host groups that can be configured, they are numbered from 1.
+)
+
+// readHostGroupsFromSysconfig reads the numbered host groups into name - computer IPs pairs, those without a name are skipped.
+func readHostGroupsFromSysconfig(sysconf *sys.Sysconfig) map[string][]string {
+	groups := make(map[string][]string)
+	for i := 1; i <= MaxHostGroups; i++ {
+		name := sysconf.GetString(fmt.Sprintf(SRV_CONF_HOST_GROUP_NAME_FMT, i), "")
+		if name == "" {
+			continue
+		}
+		groups[name] = append(groups[name], sysconf.GetStringArray(fmt.Sprintf(SRV_CONF_HOST_GROUP_HOSTS_FMT, i), []string{})...)
+	}
+	return groups
+}
+
+// validateHostGroups makes sure that each host group consists of valid computer IPs.
+func validateHostGroups(groups map[string][]string) error {
+	for name, ips := range groups {
+		if len(ips) == 0 {
+			return fmt.Errorf("host group \"%s\" does not have any computer", name)
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("host group \"%s\" has malformed IP address \"%s\"", name, ip)
+			}
+		}
+	}
+	return nil
+}
+
+// hostGroup returns the computer IPs of a host group that is currently configured.
+func (srv *CryptServer) hostGroup(name string) (ips []string, found bool) {
+	srv.reloadLock.RLock()
+	defer srv.reloadLock.RUnlock()
+	ips, found = srv.Config.HostGroups[name]
+	return
+}
+
+/*
+CommandSelector chooses the disks and computers that receive a command. The command is sent to each of the chosen
+computers for each of the chosen disks.
+*/
+type CommandSelector struct {
+	UUID       string            // UUID chooses a single disk
+	Labels     map[string]string // Labels choose the disks whose records carry all of the labels, if UUID is empty
+	IP         string            // IP chooses a single computer
+	HostGroup  string            // HostGroup chooses the computers of a host group defined in server settings, if IP is empty
+	AliveHosts bool              // AliveHosts chooses the computers currently holding the key of each disk, if IP and HostGroup are empty
+}
+
+// Make sure that the selector chooses exactly one way of finding disks and one way of finding computers.
+func (sel CommandSelector) Validate() error {
+	if (sel.UUID == "") == (len(sel.Labels) == 0) {
+		return errors.New("Either a disk UUID or labels must be given")
+	}
+	computerChoices := 0
+	for _, chosen := range []bool{sel.IP != "", sel.HostGroup != "", sel.AliveHosts} {
+		if chosen {
+			computerChoices++
+		}
+	}
+	if computerChoices != 1 {
+		return errors.New("Exactly one of computer IP, host group, or alive hosts must be given")
+	}
+	return nil
+}
+
+// CommandTarget is a computer and disk that has received a command.
+type CommandTarget struct {
+	UUID      string // UUID of the disk
+	IP        string // IP of the computer
+	CommandID string // ID of the pending command placed for the computer and disk, it is empty until the command is placed
+}
+
+// selectTargets finds the disk and computer pairs chosen by the selector, in the order of records and then IPs.
+func (rpcConn *CryptServiceConn) selectTargets(sel CommandSelector) ([]CommandTarget, error) {
+	var records []keydb.Record
+	if sel.UUID != "" {
+		rec, found := rpcConn.Svc.KeyDB.GetByUUID(sel.UUID)
+		if !found {
+			return nil, fmt.Errorf("%w - %s", keydb.ErrRecordNotFound, sel.UUID)
+		}
+		records = []keydb.Record{rec}
+	} else {
+		for _, rec := range rpcConn.Svc.KeyDB.List() {
+			if rec.MatchLabels(sel.Labels) {
+				records = append(records, rec)
+			}
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("%w - no record carries labels %v", keydb.ErrRecordNotFound, sel.Labels)
+		}
+	}
+	var groupIPs []string
+	if sel.HostGroup != "" {
+		var found bool
+		if groupIPs, found = rpcConn.Svc.hostGroup(sel.HostGroup); !found {
+			return nil, fmt.Errorf("%w - host group \"%s\" is not defined in server settings", ErrInvalidRequest, sel.HostGroup)
+		}
+	}
+	targets := make([]CommandTarget, 0, len(records))
+	for _, rec := range records {
+		ips := []string{sel.IP}
+		if sel.HostGroup != "" {
+			ips = groupIPs
+		} else if sel.AliveHosts {
+			ips = rec.AliveHostIPs()
+		}
+		for _, ip := range ips {
+			targets = append(targets, CommandTarget{UUID: rec.UUID, IP: ip})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%w - none of the chosen disks is currently used by any computer", ErrInvalidRequest)
+	}
+	return targets, nil
+}
+
+// SendCommandBatchReq asks server to store a pending command for each of the disks and computers chosen by the selector.
+type SendCommandBatchReq struct {
+	PlainPassword string            // access is granted only after the correct password is given
+	Password      HashedPassword    // access is granted only after the correct password is given
+	Selector      CommandSelector   // Selector chooses the disks and computers that receive the command
+	Kind          string            // kind of command, one of CommandTypes
+	Params        map[string]string // parameters specific to the kind of command (optional)
+	Secret        []byte            // recovery passphrase of CommandAddRecoveryKeyslot, it is only handed to the computers along with the key
+	ValidFrom     time.Time         // the commands are handed to the computers from this moment on, zero for immediately
+	Validity      time.Duration     // the commands and their results expire after this duration from ValidFrom
+}
+
+// SendCommandBatchResp identifies the batch of commands and tells where they have been sent.
+type SendCommandBatchResp struct {
+	BatchID string          // BatchID is shared by all of the commands, it is used to look up their results
+	Targets []CommandTarget // Targets are the disks and computers that have received the command
+}
+
+/*
+SendCommandBatch sends the same command to many computers or disks at once, such as to umount a disk everywhere it is
+in use, or to umount every disk on a rack. Each computer and disk pair receives its own pending command, and the
+commands share a batch ID.
+*/
+func (rpcConn *CryptServiceConn) SendCommandBatch(req SendCommandBatchReq, resp *SendCommandBatchResp) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	if err := req.Selector.Validate(); err != nil {
+		return fmt.Errorf("CryptServiceConn.SendCommandBatch: %w - %v", ErrInvalidRequest, err)
+	}
+	targets, err := rpcConn.selectTargets(req.Selector)
+	if err != nil {
+		return fmt.Errorf("CryptServiceConn.SendCommandBatch: %w", err)
+	}
+	// Validate all commands before placing any of them
+	cmdReqs := make([]SendCommandReq, 0, len(targets))
+	rotatedUUIDs := make(map[string]bool)
+	for _, target := range targets {
+		cmdReq := SendCommandReq{UUID: target.UUID, IP: target.IP, Kind: req.Kind, Params: req.Params, Secret: req.Secret,
+			ValidFrom: req.ValidFrom, Validity: req.Validity}
+		if err := cmdReq.Validate(); err != nil {
+			return fmt.Errorf("CryptServiceConn.SendCommandBatch: %w - %v", ErrInvalidRequest, err)
+		}
+		if req.Kind == CommandRotateKey {
+			// Each computer would otherwise replace the key with a different new key
+			if rotatedUUIDs[target.UUID] {
+				return fmt.Errorf("CryptServiceConn.SendCommandBatch: %w - key of disk %s can only be rotated by one computer", ErrInvalidRequest, target.UUID)
+			}
+			rotatedUUIDs[target.UUID] = true
+		}
+		cmdReqs = append(cmdReqs, cmdReq)
+	}
+	batchID, err := keydb.NewCommandID()
+	if err != nil {
+		return err
+	}
+	resp.BatchID = batchID
+	resp.Targets = make([]CommandTarget, 0, len(targets))
+	for i, cmdReq := range cmdReqs {
+		cmd, err := rpcConn.placeCommand(cmdReq, batchID)
+		if err != nil {
+			rpcConn.Log.Warning("CryptServiceConn.SendCommandBatch: failed to place command", "batch_id", batchID,
+				"placed", len(resp.Targets), "total", len(targets), "error", err)
+			return fmt.Errorf("CryptServiceConn.SendCommandBatch: only %d out of %d commands of batch %s have been placed - %v",
+				len(resp.Targets), len(targets), batchID, err)
+		}
+		targets[i].CommandID = cmd.ID
+		resp.Targets = append(resp.Targets, targets[i])
+	}
+	rpcConn.Log.Info("CryptServiceConn.SendCommandBatch: client has sent command to many computers", "command", req.Kind,
+		"batch_id", batchID, "commands", len(resp.Targets))
+	return nil
+}
+
+// GetCommandBatchReq asks for the commands of a batch and their results.
+type GetCommandBatchReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+	BatchID       string         // ID of the batch
+}
+
+// DiskCommand is a pending command along with the disk it acts on.
+type DiskCommand struct {
+	UUID       string               // UUID of the disk
+	MountPoint string               // mount point of the disk
+	Command    keydb.PendingCommand // the command and its result
+}
+
+// CommandBatch is the commands that have been sent together, along with their results.
+type CommandBatch struct {
+	ID       string        // ID of the batch
+	Commands []DiskCommand // Commands are sorted by disk UUID, computer IP, and command ID
+}
+
+// Tally returns the number of commands in each state.
+func (batch CommandBatch) Tally() map[string]int {
+	tally := make(map[string]int)
+	for _, cmd := range batch.Commands {
+		tally[cmd.Command.State()]++
+	}
+	return tally
+}
+
+// GetCommandBatch returns all commands of a batch and their results, commands disappear some time after they expire.
+func (rpcConn *CryptServiceConn) GetCommandBatch(req GetCommandBatchReq, resp *CommandBatch) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	if req.BatchID == "" {
+		return fmt.Errorf("CryptServiceConn.GetCommandBatch: %w - batch ID must not be empty", ErrInvalidRequest)
+	}
+	resp.ID = req.BatchID
+	resp.Commands = collectCommands(rpcConn.Svc.KeyDB.List(), func(cmd keydb.PendingCommand) bool {
+		return cmd.BatchID == req.BatchID
+	})
+	if len(resp.Commands) == 0 {
+		return fmt.Errorf("CryptServiceConn.GetCommandBatch: %w - batch \"%s\" does not exist or has expired", ErrInvalidRequest, req.BatchID)
+	}
+	return nil
+}
+
+// collectCommands returns the pending commands of the records that satisfy the filter, sorted by disk UUID, computer IP, and command ID.
+func collectCommands(records []keydb.Record, filter func(keydb.PendingCommand) bool) []DiskCommand {
+	ret := make([]DiskCommand, 0)
+	for _, rec := range records {
+		for _, cmds := range rec.PendingCommands {
+			for _, cmd := range cmds {
+				if filter(cmd) {
+					ret = append(ret, DiskCommand{UUID: rec.UUID, MountPoint: rec.MountPoint, Command: cmd})
+				}
+			}
+		}
+	}
+	// Records and their computers come in no particular order
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].UUID != ret[j].UUID {
+			return ret[i].UUID < ret[j].UUID
+		} else if ret[i].Command.IP != ret[j].Command.IP {
+			return ret[i].Command.IP < ret[j].Command.IP
+		}
+		return ret[i].Command.ID < ret[j].Command.ID
+	})
+	return ret
+}
+
+// ListCommandsReq asks for the pending commands of all records.
+type ListCommandsReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+}
+
+/*
+ListCommands returns the scheduled, delivered, and completed commands of all records, sorted by the moment they are
+handed to the computers. Commands disappear some time after they expire.
+*/
+func (rpcConn *CryptServiceConn) ListCommands(req ListCommandsReq, resp *[]DiskCommand) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	cmds := collectCommands(rpcConn.Svc.KeyDB.List(), func(keydb.PendingCommand) bool { return true })
+	sort.SliceStable(cmds, func(i, j int) bool {
+		return cmds[i].Command.ValidFrom.Before(cmds[j].Command.ValidFrom)
+	})
+	*resp = cmds
+	return nil
+}
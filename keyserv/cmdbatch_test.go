@@ -0,0 +1,121 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadHostGroupsFromSysconfig(t *testing.T) {
+	sysconf := GetDefaultKeySvcConf()
+	if groups := readHostGroupsFromSysconfig(sysconf); len(groups) != 0 {
+		t.Fatal(groups)
+	}
+	sysconf.Set("HOST_GROUP_3_NAME", "rack1")
+	sysconf.Set("HOST_GROUP_3_HOSTS", "10.0.0.1 10.0.0.2")
+	groups := readHostGroupsFromSysconfig(sysconf)
+	if !reflect.DeepEqual(groups, map[string][]string{"rack1": {"10.0.0.1", "10.0.0.2"}}) {
+		t.Fatal(groups)
+	}
+	if err := validateHostGroups(groups); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateHostGroups(map[string][]string{"rack1": {}}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := validateHostGroups(map[string][]string{"rack1": {"10.0.0.300"}}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestSendCommandBatch(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.HostGroups = map[string][]string{"rack1": {"127.0.0.1", "10.0.0.2"}}
+	now := time.Now().Unix()
+	for _, rec := range []keydb.Record{
+		{UUID: "batch-a", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/a", AliveIntervalSec: 1, AliveCount: 4,
+			Labels: map[string]string{"rack": "r1", "env": "prod"},
+			AliveMessages: map[string][]keydb.AliveMessage{
+				"127.0.0.1": {{IP: "127.0.0.1", Timestamp: now}},
+				"10.0.0.9":  {{IP: "10.0.0.9", Timestamp: now}},
+				"10.0.0.8":  {{IP: "10.0.0.8", Timestamp: now - 100}},
+			}},
+		{UUID: "batch-b", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/b", AliveIntervalSec: 1, AliveCount: 4,
+			Labels: map[string]string{"rack": "r1"}},
+		{UUID: "batch-c", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/c", AliveIntervalSec: 1, AliveCount: 4,
+			Labels: map[string]string{"rack": "r2"}},
+	} {
+		if _, err := srv.KeyDB.Upsert(nil, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Malformed selections are refused
+	for _, sel := range []CommandSelector{
+		{IP: "127.0.0.1"},
+		{UUID: "batch-a", Labels: map[string]string{"rack": "r1"}, IP: "127.0.0.1"},
+		{UUID: "batch-a"},
+		{UUID: "batch-a", IP: "127.0.0.1", AliveHosts: true},
+		{UUID: "does-not-exist", IP: "127.0.0.1"},
+		{Labels: map[string]string{"rack": "r3"}, IP: "127.0.0.1"},
+		{UUID: "batch-a", HostGroup: "does-not-exist"},
+		{UUID: "batch-b", AliveHosts: true},
+	} {
+		if _, err := client.SendCommandBatch(SendCommandBatchReq{PlainPassword: TEST_RPC_PASS, Selector: sel, Kind: CommandUmount, Validity: time.Hour}); err == nil {
+			t.Fatal("did not error", sel)
+		}
+	}
+	// Key rotation is carried out by one computer per disk
+	if _, err := client.SendCommandBatch(SendCommandBatchReq{PlainPassword: TEST_RPC_PASS, Kind: CommandRotateKey, Validity: time.Hour,
+		Selector: CommandSelector{UUID: "batch-a", AliveHosts: true}}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Every computer currently holding the key
+	resp, err := client.SendCommandBatch(SendCommandBatchReq{PlainPassword: TEST_RPC_PASS, Kind: CommandStatus, Validity: time.Hour,
+		Selector: CommandSelector{UUID: "batch-a", AliveHosts: true}})
+	if err != nil || len(resp.Targets) != 2 || resp.Targets[0].IP != "10.0.0.9" || resp.Targets[1].IP != "127.0.0.1" {
+		t.Fatal(resp, err)
+	}
+	// Every computer of a host group, for every disk carrying the labels
+	resp, err = client.SendCommandBatch(SendCommandBatchReq{PlainPassword: TEST_RPC_PASS, Kind: CommandUmount, Validity: time.Hour,
+		Selector: CommandSelector{Labels: map[string]string{"rack": "r1"}, HostGroup: "rack1"}})
+	if err != nil || len(resp.BatchID) != 2*keydb.LenCommandID || len(resp.Targets) != 4 {
+		t.Fatal(resp, err)
+	}
+	for _, target := range resp.Targets {
+		if target.UUID == "batch-c" || target.CommandID == "" {
+			t.Fatal(resp.Targets)
+		}
+	}
+	// This computer receives the umount command of both disks, after the status command of the first disk
+	polled, err := client.PollCommand(PollCommandReq{UUIDs: []string{"batch-a", "batch-b", "batch-c"}})
+	if err != nil || polled.Commands["batch-a"][0].Kind != CommandStatus || len(polled.Commands["batch-b"]) != 1 || len(polled.Commands["batch-c"]) != 0 {
+		t.Fatal(polled, err)
+	}
+	for _, cmd := range polled.Commands["batch-b"] {
+		if err := client.SaveCommandResult(SaveCommandResultReq{UUID: "batch-b", CommandID: cmd.ID, Result: "Success", Success: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if polled, err = client.PollCommand(PollCommandReq{UUIDs: []string{"batch-a"}}); err != nil || polled.Commands["batch-a"][0].Kind != CommandUmount {
+		t.Fatal(polled, err)
+	}
+	// Results are aggregated in one view
+	batch, err := client.GetCommandBatch(GetCommandBatchReq{PlainPassword: TEST_RPC_PASS, BatchID: resp.BatchID})
+	if err != nil || len(batch.Commands) != 4 || batch.Commands[0].UUID != "batch-a" || batch.Commands[0].MountPoint != "/a" ||
+		batch.Commands[0].Command.IP != "10.0.0.2" || batch.Commands[0].Command.Kind != CommandUmount {
+		t.Fatalf("%+v %v", batch, err)
+	}
+	if tally := batch.Tally(); !reflect.DeepEqual(tally, map[string]int{keydb.CommandStatePending: 2, keydb.CommandStateDelivered: 1, keydb.CommandStateSucceeded: 1}) {
+		t.Fatal(tally)
+	}
+	if _, err := client.GetCommandBatch(GetCommandBatchReq{PlainPassword: TEST_RPC_PASS, BatchID: "does-not-exist"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := client.GetCommandBatch(GetCommandBatchReq{PlainPassword: "wrong", BatchID: resp.BatchID}); err == nil {
+		t.Fatal("did not error")
+	}
+}
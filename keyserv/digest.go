@@ -0,0 +1,236 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_MAIL_DIGEST_INTERVAL = "EMAIL_DIGEST_INTERVAL_MIN"
+	SRV_CONF_MAIL_DIGEST_DAILY_AT = "EMAIL_DIGEST_DAILY_AT"
+	SRV_CONF_MAIL_DIGEST_BYPASS   = "EMAIL_DIGEST_BYPASS_CRITICAL"
+
+	NotifyDigest         = "digest"       // NotifyDigest is the event type of a mail that summarises the notifications collected in digest.
+	MailDigestFileSuffix = "-mail-digest" // MailDigestFileSuffix is appended to key database directory to make file name of the digest queue.
+	DIGEST_CHECK_SEC     = 60             // DIGEST_CHECK_SEC is the interval at which the server checks whether a digest is due.
+	digestTempPostfix    = ".tmp"
+)
+
+// DigestEnabled returns true only if notifications should be collected and mailed in a digest.
+func (mail *Mailer) DigestEnabled() bool {
+	return mail.DigestIntervalMin > 0 || mail.DigestDailyAt != ""
+}
+
+// parseDigestDailyAt returns the offset since midnight of the daily digest time given in 24-hour "HH:MM" format.
+func parseDigestDailyAt(dailyAt string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", dailyAt)
+	if err != nil {
+		return 0, fmt.Errorf("Digest time of day \"%s\" must be in HH:MM format", dailyAt)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+/*
+NextDigest returns the moment at which the digest following the previous one is due. A daily digest is due at the
+configured time of day in local time zone, otherwise the digest is due after the configured number of minutes.
+*/
+func (mail *Mailer) NextDigest(previous time.Time) time.Time {
+	if mail.DigestDailyAt != "" {
+		offset, err := parseDigestDailyAt(mail.DigestDailyAt)
+		if err != nil {
+			// ValidateConfig has already reported the malformed time, send the digest once a day anyway.
+			return previous.Add(24 * time.Hour)
+		}
+		midnight := time.Date(previous.Year(), previous.Month(), previous.Day(), 0, 0, 0, 0, previous.Location())
+		next := midnight.Add(offset)
+		if !next.After(previous) {
+			next = time.Date(previous.Year(), previous.Month(), previous.Day()+1, 0, 0, 0, 0, previous.Location()).Add(offset)
+		}
+		return next
+	}
+	return previous.Add(time.Duration(mail.DigestIntervalMin) * time.Minute)
+}
+
+/*
+MailDigest is a persistent queue of notifications waiting to be mailed in a digest. The queue survives server restart.
+All exported functions are safe for concurrent usage.
+*/
+type MailDigest struct {
+	FilePath string
+	Events   []NotifyEvent // Events are the notifications collected since the previous digest, oldest first.
+	LastSent time.Time     // LastSent is the moment the previous digest was sent, or the moment the server started.
+	lock     *sync.Mutex
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+// OpenMailDigest reads the digest queue from file. If the file does not yet exist, the queue is empty.
+func OpenMailDigest(filePath string) (*MailDigest, error) {
+	digest := &MailDigest{
+		FilePath: filePath,
+		Events:   []NotifyEvent{},
+		LastSent: time.Now(),
+		lock:     new(sync.Mutex),
+		stop:     make(chan struct{}),
+		stopOnce: new(sync.Once),
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return digest, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("OpenMailDigest: failed to read \"%s\" - %v", filePath, err)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&digest.Events); err != nil {
+		return nil, fmt.Errorf("OpenMailDigest: failed to decode \"%s\" - %v", filePath, err)
+	}
+	return digest, nil
+}
+
+// save writes all events into the file. Caller must hold the lock.
+func (digest *MailDigest) save() error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(digest.Events); err != nil {
+		return fmt.Errorf("MailDigest.save: failed to encode events - %v", err)
+	}
+	// Write into a temporary file first so that a crash does not leave a damaged queue behind
+	tmpPath := digest.FilePath + digestTempPostfix
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("MailDigest.save: failed to write \"%s\" - %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, digest.FilePath); err != nil {
+		return fmt.Errorf("MailDigest.save: failed to rename \"%s\" - %v", tmpPath, err)
+	}
+	return nil
+}
+
+// Add appends an event to the queue.
+func (digest *MailDigest) Add(event NotifyEvent) error {
+	digest.lock.Lock()
+	defer digest.lock.Unlock()
+	digest.Events = append(digest.Events, event)
+	return digest.save()
+}
+
+/*
+Pending returns a copy of the queued events if a digest is due at the moment, or nil if otherwise. If the mailer no
+longer collects digests, the remaining events are due right away.
+*/
+func (digest *MailDigest) Pending(mailer *Mailer, now time.Time) (since time.Time, events []NotifyEvent) {
+	digest.lock.Lock()
+	defer digest.lock.Unlock()
+	if len(digest.Events) == 0 || mailer.DigestEnabled() && now.Before(mailer.NextDigest(digest.LastSent)) {
+		return digest.LastSent, nil
+	}
+	events = make([]NotifyEvent, len(digest.Events))
+	copy(events, digest.Events)
+	return digest.LastSent, events
+}
+
+// Sent removes the oldest events that have been mailed, and remembers the moment for scheduling the next digest.
+func (digest *MailDigest) Sent(count int, now time.Time) error {
+	digest.lock.Lock()
+	defer digest.lock.Unlock()
+	if count > len(digest.Events) {
+		count = len(digest.Events)
+	}
+	digest.Events = digest.Events[count:]
+	digest.LastSent = now
+	return digest.save()
+}
+
+// Close stops the server routine that sends digests. The queued events stay on disk.
+func (digest *MailDigest) Close() {
+	if digest == nil {
+		return
+	}
+	digest.stopOnce.Do(func() {
+		close(digest.stop)
+	})
+}
+
+// mailDigestNotifier collects mail notifications in digest, critical events may bypass the digest.
+type mailDigestNotifier struct {
+	mailer *Mailer
+	digest *MailDigest
+}
+
+// Kind returns NotifierKindMail.
+func (notifier *mailDigestNotifier) Kind() string {
+	return NotifierKindMail
+}
+
+// Accepts returns true only if the event type is among the events that should be mailed.
+func (notifier *mailDigestNotifier) Accepts(eventType string) bool {
+	return notifier.mailer.Accepts(eventType)
+}
+
+// Notify mails critical events right away if configured so, and collects all other events in digest.
+func (notifier *mailDigestNotifier) Notify(event NotifyEvent) error {
+	if event.Critical && notifier.mailer.DigestBypassCritical {
+		return notifier.mailer.Notify(event)
+	}
+	return notifier.digest.Add(event)
+}
+
+// composeDigest makes a digest event that lists the subject and text of each event.
+func composeDigest(since, now time.Time, events []NotifyEvent) NotifyEvent {
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "The following %d notification(s) have been collected since %s:\r\n",
+		len(events), since.Format(time.RFC1123Z))
+	for _, event := range events {
+		fmt.Fprintf(&text, "\r\n%s - %s\r\n%s\r\n", event.Time.Format(time.RFC1123Z), event.Subject, event.Text)
+	}
+	return NotifyEvent{
+		Type:    NotifyDigest,
+		Time:    now,
+		Subject: fmt.Sprintf("Digest of %d notification(s) from cryptctl key server", len(events)),
+		Text:    text.String(),
+		Digest:  events,
+	}
+}
+
+// sendMailDigest mails the queued notifications in a digest if the digest is due.
+func (srv *CryptServer) sendMailDigest(now time.Time) {
+	srv.reloadLock.RLock()
+	mailer := srv.Mailer
+	srv.reloadLock.RUnlock()
+	if mailer.ValidateConfig() != nil {
+		// Keep the events until mail settings are corrected
+		return
+	}
+	since, events := srv.MailDigest.Pending(mailer, now)
+	if len(events) == 0 {
+		return
+	}
+	if err := mailer.Notify(composeDigest(since, now, events)); err != nil {
+		// The events stay in queue and will be sent at the next check
+		srv.Metrics.CountNotifyFailure(NotifierKindMail)
+		srv.Log.Error("CryptServer.sendMailDigest: failed to mail digest", "events", len(events), "error", err)
+		return
+	}
+	srv.Log.Info("CryptServer.sendMailDigest: mailed digest", "events", len(events))
+	if err := srv.MailDigest.Sent(len(events), now); err != nil {
+		srv.Log.Error("CryptServer.sendMailDigest: failed to update digest queue", "error", err)
+	}
+}
+
+// RunMailDigest checks periodically whether a digest is due, until the digest queue is closed by server shutdown.
+func (srv *CryptServer) RunMailDigest() {
+	ticker := time.NewTicker(DIGEST_CHECK_SEC * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.MailDigest.stop:
+			return
+		case now := <-ticker.C:
+			srv.sendMailDigest(now)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMailerNextDigest(t *testing.T) {
+	previous := time.Date(2017, 1, 2, 7, 0, 0, 0, time.Local)
+	m := Mailer{DigestIntervalMin: 30}
+	if !m.DigestEnabled() || !m.NextDigest(previous).Equal(previous.Add(30*time.Minute)) {
+		t.Fatal(m.NextDigest(previous))
+	}
+	m.DigestDailyAt = "08:00"
+	if next := m.NextDigest(previous); !next.Equal(time.Date(2017, 1, 2, 8, 0, 0, 0, time.Local)) {
+		t.Fatal(next)
+	}
+	if next := m.NextDigest(previous.Add(time.Hour)); !next.Equal(time.Date(2017, 1, 3, 8, 0, 0, 0, time.Local)) {
+		t.Fatal(next)
+	}
+	if (&Mailer{}).DigestEnabled() {
+		t.Fatal("should not be enabled")
+	}
+	m = Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: "a.example:25", DigestDailyAt: "25:00"}
+	if err := m.ValidateConfig(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestMailDigest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-digesttest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	digestFile := path.Join(tmpDir, "digest")
+	digest, err := OpenMailDigest(digestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []string{"a", "b"} {
+		if err := digest.Add(NotifyEvent{Type: NotifyKeyRetrieval, Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := &Mailer{DigestIntervalMin: 10}
+	if _, events := digest.Pending(m, digest.LastSent.Add(5*time.Minute)); events != nil {
+		t.Fatal(events)
+	}
+	now := digest.LastSent.Add(11 * time.Minute)
+	since, events := digest.Pending(m, now)
+	if len(events) != 2 || events[0].Subject != "a" || !since.Equal(digest.LastSent) {
+		t.Fatal(since, events)
+	}
+	// Events that arrive while the digest is being sent are kept for the next one
+	if err := digest.Add(NotifyEvent{Type: NotifyKeyRetrieval, Subject: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := digest.Sent(len(events), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, events := digest.Pending(m, now.Add(time.Minute)); events != nil {
+		t.Fatal(events)
+	}
+	// The queue survives restart, and it is due right away once digest is turned off
+	digest.Close()
+	if digest, err = OpenMailDigest(digestFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, events := digest.Pending(&Mailer{}, time.Now()); len(events) != 1 || events[0].Subject != "c" {
+		t.Fatal(events)
+	}
+	var nilDigest *MailDigest
+	nilDigest.Close()
+}
+
+func TestMailDigestNotify(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, false, received)
+		}
+	}()
+	_, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	defer os.Remove(srv.Config.MailDigestFile())
+	defer srv.MailDigest.Close()
+	srv.Mailer = &Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: listener.Addr().String(),
+		DigestIntervalMin: 10, DigestBypassCritical: true}
+	// Ordinary events are collected in digest
+	srv.newServiceConn("1.2.3.4").notify(NotifyEvent{Type: NotifyKeyRetrieval, Subject: "retrieval 1", Text: "aaa"})
+	srv.newServiceConn("1.2.3.5").notify(NotifyEvent{Type: NotifyKeyRetrieval, Subject: "retrieval 2", Text: "bbb"})
+	// Critical events are mailed right away
+	srv.newServiceConn("1.2.3.6").notify(NotifyEvent{Type: NotifyKeyErasure, Subject: "erasure", Critical: true})
+	select {
+	case msg := <-received:
+		if !strings.Contains(msg, "Subject: erasure\r\n") {
+			t.Fatal(msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	for i := 0; ; i++ {
+		if _, events := srv.MailDigest.Pending(&Mailer{}, time.Now()); len(events) == 2 {
+			break
+		} else if i > 100 {
+			t.Fatal(events)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Digest is not sent before it is due
+	srv.sendMailDigest(time.Now())
+	select {
+	case msg := <-received:
+		t.Fatal(msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+	srv.sendMailDigest(time.Now().Add(11 * time.Minute))
+	select {
+	case msg := <-received:
+		if !strings.Contains(msg, "Digest of 2 notification(s)") || !strings.Contains(msg, "retrieval 1\r\naaa") ||
+			!strings.Contains(msg, "retrieval 2\r\nbbb") {
+			t.Fatal(msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	if _, events := srv.MailDigest.Pending(&Mailer{}, time.Now()); len(events) != 0 {
+		t.Fatal(events)
+	}
+}
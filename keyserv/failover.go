@@ -0,0 +1,142 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/sys"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RPC_SERVER_BACKOFF_SEC     = 30  // RPC_SERVER_BACKOFF_SEC is for how long an unreachable key server is skipped after its first failure.
+	RPC_SERVER_MAX_BACKOFF_SEC = 600 // RPC_SERVER_MAX_BACKOFF_SEC is the longest time an unreachable key server is skipped.
+	RPC_SRV_REFRESH_SEC        = 300 // RPC_SRV_REFRESH_SEC is the interval at which key server addresses are resolved from DNS SRV records again.
+	RPC_SRV_SERVICE            = "cryptctl"
+)
+
+// lookupSRV resolves DNS SRV records, test cases may replace it.
+var lookupSRV = net.LookupSRV
+
+// serverHealth remembers consecutive failures of a key server and the time until which it should be skipped.
+type serverHealth struct {
+	failures  int
+	downUntil time.Time
+}
+
+/*
+serverPool keeps the ordered list of key server addresses used by a client for failover, and tracks their health.
+All functions are safe for concurrent usage.
+*/
+type serverPool struct {
+	addrs         []string // addrs are the statically configured addresses in the order of preference
+	srvDomain     string   // srvDomain is the DNS domain in which SRV records of key servers are looked up, empty to disable.
+	srvAddrs      []string
+	srvResolvedAt time.Time
+	health        map[string]*serverHealth
+	lock          *sync.Mutex
+}
+
+func newServerPool(addrs []string, srvDomain string) *serverPool {
+	return &serverPool{
+		addrs:     addrs,
+		srvDomain: srvDomain,
+		health:    make(map[string]*serverHealth),
+		lock:      new(sync.Mutex),
+	}
+}
+
+// resolveSRV returns key server addresses from DNS SRV records in the order of priority, and caches them for a while.
+func (pool *serverPool) resolveSRV() []string {
+	if pool.srvDomain == "" || time.Since(pool.srvResolvedAt) < RPC_SRV_REFRESH_SEC*time.Second {
+		return pool.srvAddrs
+	}
+	_, records, err := lookupSRV(RPC_SRV_SERVICE, "tcp", pool.srvDomain)
+	if err != nil {
+		// Keep using the addresses resolved last time
+		sys.NewLogger().Warning("serverPool.resolveSRV: failed to look up SRV records of key servers", "domain", pool.srvDomain, "error", err)
+		return pool.srvAddrs
+	}
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), fmt.Sprint(record.Port)))
+	}
+	pool.srvAddrs = addrs
+	pool.srvResolvedAt = time.Now()
+	return pool.srvAddrs
+}
+
+/*
+Candidates returns the addresses to try in order. Healthy servers come first in the order of preference, followed by
+servers that are currently considered down, so that a call is still attempted when all servers appear to be down.
+*/
+func (pool *serverPool) Candidates() []string {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	all := make([]string, 0, len(pool.addrs)+len(pool.srvAddrs))
+	seen := make(map[string]bool)
+	for _, addr := range append(append([]string{}, pool.addrs...), pool.resolveSRV()...) {
+		if !seen[addr] {
+			seen[addr] = true
+			all = append(all, addr)
+		}
+	}
+	healthy := make([]string, 0, len(all))
+	down := make([]string, 0, len(all))
+	now := time.Now()
+	for _, addr := range all {
+		if health, found := pool.health[addr]; found && now.Before(health.downUntil) {
+			down = append(down, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// Succeed marks the server healthy.
+func (pool *serverPool) Succeed(addr string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	delete(pool.health, addr)
+}
+
+// Fail records a failure of the server, and skips it for a period of time that doubles on each consecutive failure.
+func (pool *serverPool) Fail(addr string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	health, found := pool.health[addr]
+	if !found {
+		health = new(serverHealth)
+		pool.health[addr] = health
+	}
+	health.failures++
+	backoff := RPC_SERVER_BACKOFF_SEC * time.Second
+	for i := 1; i < health.failures && backoff < RPC_SERVER_MAX_BACKOFF_SEC*time.Second; i++ {
+		backoff *= 2
+	}
+	if backoff > RPC_SERVER_MAX_BACKOFF_SEC*time.Second {
+		backoff = RPC_SERVER_MAX_BACKOFF_SEC * time.Second
+	}
+	health.downUntil = time.Now().Add(backoff)
+	sys.NewLogger().Warning("serverPool.Fail: key server is considered down", "server", addr, "backoff_sec", int(backoff.Seconds()), "failures", health.failures)
+}
+
+/*
+ParseServerAddrs splits a space or comma separated list of key server host names into addresses. Host names without
+a port number use the default port.
+*/
+func ParseServerAddrs(hosts string, defaultPort int) []string {
+	addrs := make([]string, 0)
+	for _, host := range strings.FieldsFunc(hosts, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			addrs = append(addrs, host)
+		} else {
+			addrs = append(addrs, net.JoinHostPort(strings.Trim(host, "[]"), fmt.Sprint(defaultPort)))
+		}
+	}
+	return addrs
+}
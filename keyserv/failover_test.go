@@ -0,0 +1,101 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseServerAddrs(t *testing.T) {
+	addrs := ParseServerAddrs(" a, b:123 [::1] [::1]:456 ", 3737)
+	if !reflect.DeepEqual(addrs, []string{"a:3737", "b:123", "[::1]:3737", "[::1]:456"}) {
+		t.Fatal(addrs)
+	}
+	if addrs := ParseServerAddrs("", 3737); len(addrs) != 0 {
+		t.Fatal(addrs)
+	}
+}
+
+func TestServerPool(t *testing.T) {
+	oldLookupSRV := lookupSRV
+	defer func() {
+		lookupSRV = oldLookupSRV
+	}()
+	lookups := 0
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		lookups++
+		if service != RPC_SRV_SERVICE || proto != "tcp" || name != "example.com" {
+			t.Fatal(service, proto, name)
+		}
+		if lookups > 1 {
+			return "", nil, errors.New("DNS is down")
+		}
+		return "", []*net.SRV{{Target: "c.example.com.", Port: 3737}, {Target: "a", Port: 3737}}, nil
+	}
+	pool := newServerPool([]string{"a:3737", "b:3737"}, "example.com")
+	if addrs := pool.Candidates(); !reflect.DeepEqual(addrs, []string{"a:3737", "b:3737", "c.example.com:3737"}) {
+		t.Fatal(addrs)
+	}
+	// Servers that are down come last
+	pool.Fail("a:3737")
+	if addrs := pool.Candidates(); !reflect.DeepEqual(addrs, []string{"b:3737", "c.example.com:3737", "a:3737"}) {
+		t.Fatal(addrs)
+	}
+	pool.Succeed("a:3737")
+	if addrs := pool.Candidates(); !reflect.DeepEqual(addrs, []string{"a:3737", "b:3737", "c.example.com:3737"}) {
+		t.Fatal(addrs)
+	}
+	// Back off doubles on consecutive failures up to a limit
+	for i := 0; i < 10; i++ {
+		pool.Fail("b:3737")
+	}
+	if until := time.Until(pool.health["b:3737"].downUntil); until < RPC_SERVER_MAX_BACKOFF_SEC*time.Second-time.Second || until > RPC_SERVER_MAX_BACKOFF_SEC*time.Second {
+		t.Fatal(until)
+	}
+	// SRV records resolved earlier are kept if DNS fails
+	pool.srvResolvedAt = time.Time{}
+	if addrs := pool.Candidates(); lookups != 2 || !reflect.DeepEqual(addrs, []string{"a:3737", "c.example.com:3737", "b:3737"}) {
+		t.Fatal(lookups, addrs)
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	client, _, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	// The primary server is unreachable
+	failoverClient, err := NewCryptClient("tcp", "localhost:1", nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failoverClient.tlsConfig = client.tlsConfig
+	failoverClient.SetFallbackServers([]string{"localhost:3737"}, "")
+	if err := failoverClient.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := failoverClient.servers.Candidates(); !reflect.DeepEqual(addrs, []string{"localhost:3737", "localhost:1"}) {
+		t.Fatal(addrs)
+	}
+	// Server errors do not cause failover
+	if err := failoverClient.Ping(PingRequest{PlainPassword: "wrong"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if failoverClient.servers.health["localhost:3737"] != nil {
+		t.Fatal("server should be healthy")
+	}
+	// Keys are only created on the primary server
+	if _, err := failoverClient.CreateKey(CreateKeyReq{
+		PlainPassword:    TEST_RPC_PASS,
+		Hostname:         "localhost",
+		UUID:             "aaa",
+		MountPoint:       "/a",
+		MaxActive:        1,
+		AliveIntervalSec: 1,
+		AliveCount:       4,
+	}); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,179 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	/*
+		ProtocolVersion identifies the revision of RPC request and response structures. It must be incremented whenever
+		a change to those structures breaks compatibility with older clients or servers.
+	*/
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest protocol version of a peer that this program is still able to talk to.
+	MinProtocolVersion = 1
+
+	CommandMount              = "mount"                // CommandMount is the kind of pending command that tells client computer to mount a disk.
+	CommandUmount             = "umount"               // CommandUmount is the kind of pending command that tells client computer to umount a disk.
+	CommandErase              = "erase"                // CommandErase tells client computer to umount a disk and erase its encryption header.
+	CommandStatus             = "status"               // CommandStatus tells client computer to report the status of a disk.
+	CommandVerifyKey          = "verify-key"           // CommandVerifyKey tells client computer to verify that the key on server unlocks the disk.
+	CommandAddRecoveryKeyslot = "add-recovery-keyslot" // CommandAddRecoveryKeyslot tells client computer to add a recovery passphrase to the disk.
+	CommandRotateKey          = "rotate-key"           // CommandRotateKey tells client computer to replace the disk's key with a new one.
+
+	AuthMethodPlainPassword  = "plain-password"  // AuthMethodPlainPassword means the server accepts password in plain text.
+	AuthMethodHashedPassword = "hashed-password" // AuthMethodHashedPassword means the server accepts salted password hash.
+	AuthMethodClientCert     = "client-cert"     // AuthMethodClientCert means the server demands a certificate from client.
+)
+
+// Version is the program version reported to RPC peers. Packagers set it via: go build -ldflags "-X cryptctl/keyserv.Version=x.y"
+var Version = "devel"
+
+// CommandTypes are the kinds of pending command understood by client computers.
+var CommandTypes = []string{CommandMount, CommandUmount, CommandErase, CommandStatus, CommandVerifyKey, CommandAddRecoveryKeyslot, CommandRotateKey}
+
+// ErrIncompatible is returned when client and server cannot talk to each other due to a version difference.
+var ErrIncompatible = errors.New("client and server versions are incompatible")
+
+// A request to learn about server's version and capabilities. The request does not require a password.
+type HelloReq struct {
+	ClientVersion   string // ClientVersion is the program version of client (for logging only).
+	ProtocolVersion int    // ProtocolVersion is the protocol version spoken by client.
+}
+
+// HelloResp describes the version and capabilities of a server.
+type HelloResp struct {
+	ServerVersion      string   // ServerVersion is the program version of server.
+	ProtocolVersion    int      // ProtocolVersion is the protocol version spoken by server.
+	MinProtocolVersion int      // MinProtocolVersion is the oldest client protocol version the server still supports.
+	Functions          []string // Functions are the names of RPC functions available to the client on this connection.
+	CommandTypes       []string // CommandTypes are the kinds of pending command the server accepts.
+	AuthMethods        []string // AuthMethods are the authentication methods accepted by server.
+	RESTPort           int      // RESTPort is the port number of REST API, or 0 if REST API is not available.
+	ApprovalRequired   []string // ApprovalRequired are the operations that must be approved by a second administrator.
+}
+
+// Supports returns true only if the server offers the RPC function.
+func (resp HelloResp) Supports(funcName string) bool {
+	for _, name := range resp.Functions {
+		if name == funcName {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiresApproval returns true only if the operation must be approved by a second administrator.
+func (resp HelloResp) RequiresApproval(operation string) bool {
+	for _, name := range resp.ApprovalRequired {
+		if name == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// rpcFunctionNames returns the sorted names of RPC functions offered by an RPC receiver.
+func rpcFunctionNames(rcvr interface{}) []string {
+	rcvrType := reflect.TypeOf(rcvr)
+	names := make([]string, 0, rcvrType.NumMethod())
+	for i := 0; i < rcvrType.NumMethod(); i++ {
+		// Every exported method of an RPC receiver is an RPC function
+		names = append(names, rcvrType.Method(i).Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hello answers a Hello request on behalf of an RPC receiver.
+func (srv *CryptServer) hello(remoteHost string, req HelloReq, rcvr interface{}, resp *HelloResp) error {
+	if req.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("Hello: %w - client %s speaks protocol version %d (program version \"%s\"), but server %s requires at least %d",
+			ErrIncompatible, remoteHost, req.ProtocolVersion, req.ClientVersion, Version, MinProtocolVersion)
+	}
+	authMethods := []string{AuthMethodPlainPassword}
+	if srv.Config.AllowHashAuth {
+		authMethods = append(authMethods, AuthMethodHashedPassword)
+	}
+	if srv.Config.ValidateClientCert {
+		authMethods = append(authMethods, AuthMethodClientCert)
+	}
+	*resp = HelloResp{
+		ServerVersion:      Version,
+		ProtocolVersion:    ProtocolVersion,
+		MinProtocolVersion: MinProtocolVersion,
+		Functions:          rpcFunctionNames(rcvr),
+		CommandTypes:       CommandTypes,
+		AuthMethods:        authMethods,
+		RESTPort:           srv.Config.RESTPort,
+		ApprovalRequired:   srv.Config.ApprovalOperations,
+	}
+	return nil
+}
+
+// Hello tells client about server's version and capabilities.
+func (rpcConn *CryptServiceConn) Hello(req HelloReq, resp *HelloResp) error {
+	return rpcConn.Svc.hello(rpcConn.RemoteHost, req, rpcConn, resp)
+}
+
+// Hello tells client about server's version and the functions available for enrolment.
+func (enrolConn *CryptEnrolmentConn) Hello(req HelloReq, resp *HelloResp) error {
+	return enrolConn.conn.Svc.hello(enrolConn.conn.RemoteHost, req, enrolConn, resp)
+}
+
+/*
+Hello asks server for its version and capabilities, and remembers the answer for subsequent calls.
+Return an error if server's protocol version is incompatible with this client.
+*/
+func (client *CryptClient) Hello() (resp HelloResp, err error) {
+	client.helloLock.Lock()
+	defer client.helloLock.Unlock()
+	if client.hello != nil {
+		return *client.hello, nil
+	}
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "Hello"), HelloReq{ClientVersion: Version, ProtocolVersion: ProtocolVersion}, &resp)
+	})
+	if err != nil {
+		return
+	}
+	if resp.ProtocolVersion < MinProtocolVersion {
+		err = fmt.Errorf("CryptClient.Hello: %w - server %s speaks protocol version %d (program version \"%s\"), but this client requires at least %d, please upgrade the server",
+			ErrIncompatible, client.Address, resp.ProtocolVersion, resp.ServerVersion, MinProtocolVersion)
+		return
+	} else if resp.MinProtocolVersion > ProtocolVersion {
+		err = fmt.Errorf("CryptClient.Hello: %w - server %s (program version \"%s\") requires protocol version %d, but this client speaks %d, please upgrade this computer",
+			ErrIncompatible, client.Address, resp.ServerVersion, resp.MinProtocolVersion, ProtocolVersion)
+		return
+	}
+	client.hello = &resp
+	return
+}
+
+/*
+explainMissingFunction turns the cryptic error of calling a function that server does not have into an explanation
+that tells user which side should be upgraded.
+*/
+func (client *CryptClient) explainMissingFunction(callErr error) error {
+	funcName := callErr.Error()[strings.LastIndex(callErr.Error(), ".")+1:]
+	if funcName == "Hello" {
+		return fmt.Errorf("%w - server %s predates version negotiation, please upgrade the server", ErrIncompatible, client.Address)
+	}
+	hello, err := client.Hello()
+	if err != nil {
+		return fmt.Errorf("%w - server %s does not support function \"%s\" - %v", ErrIncompatible, client.Address, funcName, err)
+	}
+	if !hello.Supports("Ping") {
+		// The server only offers enrolment functions to a client without certificate
+		return fmt.Errorf("server %s requires a client certificate for function \"%s\", please request one first", client.Address, funcName)
+	}
+	return fmt.Errorf("%w - server %s (version \"%s\") does not support function \"%s\", please upgrade the server",
+		ErrIncompatible, client.Address, hello.ServerVersion, funcName)
+}
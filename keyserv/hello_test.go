@@ -0,0 +1,61 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRPCFunctionNames(t *testing.T) {
+	if names := rpcFunctionNames(&CryptEnrolmentConn{}); !reflect.DeepEqual(names, []string{"CollectClientCert", "Hello", "SubmitCertRequest"}) {
+		t.Fatal(names)
+	}
+	names := rpcFunctionNames(&CryptServiceConn{})
+	for _, restFunc := range RESTFunctions {
+		if !(HelloResp{Functions: names}).Supports(restFunc) {
+			t.Fatal(restFunc, names)
+		}
+	}
+}
+
+func TestHello(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.RESTPort = 3738
+	hello, err := client.Hello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerVersion != Version || hello.ProtocolVersion != ProtocolVersion || hello.MinProtocolVersion != MinProtocolVersion ||
+		!hello.Supports("Ping") || !hello.Supports("SendCommand") || hello.Supports("authenticate") ||
+		!reflect.DeepEqual(hello.CommandTypes, CommandTypes) || hello.RESTPort != 3738 ||
+		!reflect.DeepEqual(hello.AuthMethods, []string{AuthMethodPlainPassword}) {
+		t.Fatalf("%+v", hello)
+	}
+	// The answer is remembered
+	srv.Config.RESTPort = 0
+	if hello, err = client.Hello(); err != nil || hello.RESTPort != 3738 {
+		t.Fatal(err, hello)
+	}
+	// Client speaking an obsolete protocol is refused
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		var resp HelloResp
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "Hello"), HelloReq{ClientVersion: "old"}, &resp)
+	})
+	if err == nil || !strings.Contains(err.Error(), ErrIncompatible.Error()) {
+		t.Fatal(err)
+	}
+	// Calling a function that server does not have results in an explanation
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "DoesNotExist"), PingRequest{}, &dummy)
+	})
+	if !errors.Is(err, ErrIncompatible) || !strings.Contains(err.Error(), `does not support function "DoesNotExist"`) {
+		t.Fatal(err)
+	}
+}
@@ -6,14 +6,15 @@ import (
 	"bytes"
 	"cryptctl/kmip/structure"
 	"cryptctl/kmip/ttlv"
+	"cryptctl/sys"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"reflect"
+	"strings"
 	"time"
 )
 
@@ -37,6 +38,15 @@ type KMIPClient struct {
 	ServerAddrs        []string
 	Username, Password string
 	TLSConfig          *tls.Config
+	Metrics            *Metrics    // Metrics optionally collects request latency and errors
+	Log                *sys.Logger // Log is the logger of requests, its fields identify the RPC request that led to the KMIP request.
+}
+
+// WithLogger returns a copy of the client that logs KMIP requests using the logger.
+func (client *KMIPClient) WithLogger(logger *sys.Logger) *KMIPClient {
+	clientCopy := *client
+	clientCopy.Log = logger
+	return &clientCopy
 }
 
 /*
@@ -118,18 +128,18 @@ func (client *KMIPClient) ConverseWithRetry(request structure.SerialisedItem) (t
 		var conn *tls.Conn
 		conn, err = tls.Dial("tcp", addr, client.TLSConfig)
 		if err != nil {
-			log.Printf("KMIPClient.ConverseWithRetry: IO failure occured with KMIP server %s", addr)
+			client.Log.Warning("KMIPClient.ConverseWithRetry: IO failure occured with KMIP server", "server", addr, "error", err)
 			continue
 		}
 		if _, err = conn.Write(encodedRequest); err != nil {
-			log.Printf("KMIPClient.ConverseWithRetry: IO failure occured with KMIP server %s", addr)
+			client.Log.Warning("KMIPClient.ConverseWithRetry: IO failure occured with KMIP server", "server", addr, "error", err)
 			conn.Close()
 			continue
 		}
 		var ttlvResp ttlv.Item
 		ttlvResp, err = ReadFullTTLV(conn)
 		if err != nil {
-			log.Printf("KMIPClient.ConverseWithRetry: IO failure occured with KMIP server %s", addr)
+			client.Log.Warning("KMIPClient.ConverseWithRetry: IO failure occured with KMIP server", "server", addr, "error", err)
 			conn.Close()
 			continue
 		}
@@ -144,7 +154,12 @@ Establish a TLS connection to server, send exactly one request and expect exactl
 TLS handshake is way more expensive than KMIP operations, so consider using the connection for more requests in the future.
 */
 func (client *KMIPClient) MakeRequest(request structure.SerialisedItem) (structure.SerialisedItem, error) {
+	start := time.Now()
 	ttlvResp, err := client.ConverseWithRetry(request)
+	// Operation name looks like "Create", "Get", and "Destroy"
+	operation := strings.TrimSuffix(strings.TrimPrefix(reflect.TypeOf(request).Elem().Name(), "S"), "Request")
+	client.Metrics.ObserveKMIP(operation, time.Since(start), err)
+	client.Log.Debug("KMIPClient.MakeRequest: completed request", "operation", operation, "duration_ms", time.Since(start).Milliseconds(), "error", err)
 	if err != nil {
 		return nil, err
 	}
@@ -201,7 +216,7 @@ func (client *KMIPClient) CreateKey(keyName string) (id string, err error) {
 		// In the unlikely case that a misbehaving server causes client to crash.
 		if r := recover(); r != nil {
 			msg := fmt.Sprintf("KMIPClient.CreateKey: the function crashed due to programming error - %v", r)
-			log.Print(msg)
+			client.Log.Error(msg)
 			err = errors.New(msg)
 		}
 	}()
@@ -266,7 +281,7 @@ func (client *KMIPClient) GetKey(id string) (key []byte, err error) {
 		// In the unlikely case that a misbehaving server causes client to crash.
 		if r := recover(); r != nil {
 			msg := fmt.Sprintf("KMIPClient.GetKey: (ID %s) the function crashed due to programming error - %v", id, r)
-			log.Print(msg)
+			client.Log.Error(msg)
 			err = errors.New(msg)
 		}
 	}()
@@ -299,7 +314,7 @@ func (client *KMIPClient) DestroyKey(id string) (err error) {
 		// In the unlikely case that a misbehaving server causes client to crash.
 		if r := recover(); r != nil {
 			msg := fmt.Sprintf("KMIPClient.DestroyKey: (ID %s) the function crashed due to programming error - %v", id, r)
-			log.Print(msg)
+			client.Log.Error(msg)
 			err = errors.New(msg)
 		}
 	}()
@@ -6,6 +6,7 @@ import (
 	"cryptctl/keydb"
 	"cryptctl/kmip/structure"
 	"cryptctl/kmip/ttlv"
+	"cryptctl/sys"
 	"crypto/rand"
 	"crypto/subtle"
 	"crypto/tls"
@@ -42,12 +43,16 @@ type KMIPServer struct {
 	Listener          net.Listener // listener for client connections
 	TLSConfig         *tls.Config  // TLS certificate chain and private key
 	PasswordChallenge []byte       // a random hex-encoded string secret that must be presented by KMIP client as authentication password
+	conns             *connTracker // conns tracks client connections for graceful shutdown
+	Log               *sys.Logger  // Log is the logger of KMIP server operations
 }
 
 func NewKMIPServer(db *keydb.DB, certFilePath, certKeyPath string) (*KMIPServer, error) {
 	server := &KMIPServer{
 		DB:        db,
+		Log:       sys.NewLogger(),
 		TLSConfig: new(tls.Config),
+		conns:     newConnTracker(),
 	}
 	serverID, err := tls.LoadX509KeyPair(certFilePath, certKeyPath)
 	if err != nil {
@@ -71,7 +76,7 @@ func (srv *KMIPServer) Listen() error {
 	if err != nil {
 		return err
 	}
-	log.Printf("KMIPServer.Listen: listening on 127.0.0.1:%d", srv.GetPort())
+	srv.Log.Info("KMIPServer.Listen: listening", "address", "127.0.0.1", "port", srv.GetPort())
 	return nil
 }
 
@@ -80,10 +85,20 @@ func (srv *KMIPServer) HandleConnections() {
 	for {
 		conn, err := srv.Listener.Accept()
 		if err != nil {
-			log.Printf("KMIPServer.Listen: quit now - %v", err)
+			srv.Log.Info("KMIPServer.Listen: quit now", "error", err)
 			return
 		}
-		go srv.HandleConnection(conn)
+		go func(conn net.Conn) {
+			// Each connection carries exactly one request
+			if !srv.conns.Add(conn) || !srv.conns.BeginRequest() {
+				conn.Close()
+				srv.conns.Remove(conn)
+				return
+			}
+			defer srv.conns.Remove(conn)
+			defer srv.conns.EndRequest()
+			srv.HandleConnection(conn)
+		}(conn)
 	}
 }
 
@@ -112,17 +127,17 @@ func (srv *KMIPServer) HandleConnection(conn net.Conn) {
 		 unexpectedly triggers a buffer handling issue, the error is logged here and then ignored.
 		*/
 		if r := recover(); r != nil {
-			log.Printf("KMIPServer.HandleConnection: panic occured with client %s - %v", conn.RemoteAddr().String(), r)
+			srv.Log.Error("KMIPServer.HandleConnection: panic occured with client", "client", conn.RemoteAddr().String(), "panic", fmt.Sprint(r))
 		}
 	}()
 	defer conn.Close()
 	var err error
 	var successfulDecodeAttempt structure.SerialisedItem
 	decodeAttempts := []structure.SerialisedItem{&structure.SCreateRequest{}, &structure.SGetRequest{}, &structure.SDestroyRequest{}}
-	log.Printf("KMIPServer.HandleConnection: connected from %s", conn.RemoteAddr().String())
+	srv.Log.Debug("KMIPServer.HandleConnection: client connected", "client", conn.RemoteAddr().String())
 	ttlvItem, err := ReadFullTTLV(conn)
 	if err != nil {
-		log.Printf("KMIPServer.HandleConnection: IO failure occured with client %s - %v", conn.RemoteAddr().String(), err)
+		srv.Log.Warning("KMIPServer.HandleConnection: IO failure occured with client", "client", conn.RemoteAddr().String(), "error", err)
 		return
 	}
 	// Try decoding request into request structures and see which one succeeds
@@ -141,7 +156,7 @@ func (srv *KMIPServer) HandleConnection(conn net.Conn) {
 	}
 	return
 Error:
-	log.Printf("KMIPServer.HandleConnection: error occured with client %s - %v", conn.RemoteAddr().String(), err)
+	srv.Log.Warning("KMIPServer.HandleConnection: error occured with client", "client", conn.RemoteAddr().String(), "error", err)
 }
 
 // Try to match KMIP request's password with server's challenge. If there is a mismatch, return an error.
@@ -184,7 +199,7 @@ func (srv *KMIPServer) HandleRequest(req structure.SerialisedItem, conn net.Conn
 	default:
 		err = fmt.Errorf("KMIPServer.HandleRequest: unknown request type %s", reflect.TypeOf(req).String())
 	}
-	log.Printf("KMIPServer.HandleRequest: handled request type %s from %s, err is %v", reflect.TypeOf(req).String(), conn.RemoteAddr().String(), err)
+	srv.Log.Debug("KMIPServer.HandleRequest: handled request", "type", reflect.TypeOf(req).String(), "client", conn.RemoteAddr().String(), "error", err)
 	if err == nil {
 		conn.SetWriteDeadline(time.Now().Add(KMIPTimeoutSec * time.Second))
 		_, err = conn.Write(ttlv.EncodeAny(resp.SerialiseToTTLV()))
@@ -205,7 +220,7 @@ func (srv *KMIPServer) HandleCreateRequest(req *structure.SCreateRequest) (*stru
 		RPC server will then fill up the stored record with client computer details, such as its host name and disk UUID.
 	*/
 	creationTime := time.Now()
-	kmipID, err := srv.DB.Upsert(keydb.Record{
+	kmipID, err := srv.DB.Upsert(srv.Log, keydb.Record{
 		/*
 			Name prefix explains key's origin to make it more visible when stored in an external KMIP appliance.
 			But key database only recognises UUID, there's no need for a prefix to be stored in key database.
@@ -214,7 +229,7 @@ func (srv *KMIPServer) HandleCreateRequest(req *structure.SCreateRequest) (*stru
 		CreationTime: creationTime,
 		Key:          GetNewDiskEncryptionKeyBits(),
 	})
-	log.Printf("KMIPServer.HandleCreateRequest: just created a key named \"%s\" ID \"%s\"", keyName, kmipID)
+	srv.Log.Info("KMIPServer.HandleCreateRequest: just created a key", "name", keyName, "kmip_id", kmipID)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,122 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"errors"
+	"fmt"
+)
+
+const (
+	SRV_CONF_APPROVE_NEW_HOSTS = "APPROVE_NEW_HOSTS"
+
+	NotifyHostApproval = "host-approval" // NotifyHostApproval is the event of an unknown computer waiting for approval to retrieve a key.
+	AuditHostApproval  = "host-approval" // AuditHostApproval is the event type of an unknown computer approved or refused by an administrator.
+)
+
+// errHostIsKnown stops the update of a record whose known hosts already include the requester.
+var errHostIsKnown = errors.New("the host is known")
+
+/*
+holdUnknownHosts sorts the requested disk UUIDs into those the requester may retrieve the key for, and those that await
+administrator's approval because the requester is not among the known hosts of the record. An unknown requester is
+remembered as a pending host of the record, administrators are notified when it first shows up.
+*/
+func (rpcConn *CryptServiceConn) holdUnknownHosts(requester keydb.AliveMessage, uuids []string) (allowed, pending []string) {
+	allowed = make([]string, 0, len(uuids))
+	pending = make([]string, 0, 0)
+	if !rpcConn.Svc.Config.ApproveNewHosts {
+		return uuids, pending
+	}
+	newlyPending := make([]keydb.Record, 0, 0)
+	for _, uuid := range uuids {
+		var isNew bool
+		var rec keydb.Record
+		err := rpcConn.Svc.KeyDB.Update(rpcConn.Log, uuid, func(record *keydb.Record) error {
+			if record.IsKnownHost(requester.IP) {
+				return errHostIsKnown
+			}
+			isNew = record.AddPendingHost(requester)
+			rec = *record
+			return nil
+		})
+		if err != nil {
+			// The host is known, or the record is missing and Select will tell so
+			allowed = append(allowed, uuid)
+			continue
+		}
+		pending = append(pending, uuid)
+		if isNew {
+			rec.Key = nil
+			newlyPending = append(newlyPending, rec)
+		}
+	}
+	if len(pending) > 0 {
+		rpcConn.Log.Warning("CryptServiceConn.holdUnknownHosts: unknown computer awaits approval", "hostname", requester.Hostname, "uuids", pending)
+	}
+	if len(newlyPending) == 0 {
+		return
+	}
+	text := fmt.Sprintf("Computer %s %s has asked for the encryption keys of the following file systems, but it is not among "+
+		"the computers known to use them:\r\n\r\n", rpcConn.RemoteHost, requester.Hostname)
+	newUUIDs := make([]string, 0, len(newlyPending))
+	for _, rec := range newlyPending {
+		newUUIDs = append(newUUIDs, rec.UUID)
+		text += fmt.Sprintf("%s - %s\r\n", rec.UUID, rec.MountPoint)
+		rpcConn.audit(AuditKeyRetrieval, AuditOutcomeFailure, rec.UUID, requester.Hostname, "unknown computer awaits approval for key of "+rec.MountPoint)
+	}
+	text += "\r\nThe keys are withheld until an administrator runs \"cryptctl approve-host\" on the key server to approve the computer.\r\n"
+	// Send optional notifications in background
+	rpcConn.notify(NotifyEvent{
+		Type:     NotifyHostApproval,
+		Hostname: requester.Hostname,
+		UUIDs:    newUUIDs,
+		Subject:  fmt.Sprintf("An unknown computer has asked for encryption keys - %s %s", rpcConn.RemoteHost, requester.Hostname),
+		Text:     text,
+		Critical: true,
+		Records:  newlyPending,
+	})
+	return
+}
+
+// ApproveHostReq approves a computer to retrieve the key of a disk without password, or refuses the computer.
+type ApproveHostReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+	UUID          string         // UUID of the disk
+	IP            string         // IP of the computer
+	Reject        bool           // Reject removes the computer from both pending and known hosts instead of approving it
+}
+
+// ApproveHost adds a computer to the known hosts of a record, or removes it from both pending and known hosts.
+func (rpcConn *CryptServiceConn) ApproveHost(req ApproveHostReq, _ *DummyAttr) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	if req.IP == "" {
+		return fmt.Errorf("CryptServiceConn.ApproveHost: %w - IP must not be empty", ErrInvalidRequest)
+	}
+	var hostname string
+	err := rpcConn.Svc.KeyDB.Update(rpcConn.Log, req.UUID, func(rec *keydb.Record) error {
+		hostname = rec.PendingHosts[req.IP].Hostname
+		if req.Reject {
+			delete(rec.PendingHosts, req.IP)
+			rec.RemoveKnownHost(req.IP)
+		} else {
+			rec.AddKnownHost(req.IP)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if req.Reject {
+		rpcConn.Log.Info("CryptServiceConn.ApproveHost: client has refused computer", "uuid", req.UUID, "host_ip", req.IP)
+		rpcConn.audit(AuditHostApproval, AuditOutcomeFailure, req.UUID, hostname, fmt.Sprintf("computer %s has been refused", req.IP))
+	} else {
+		rpcConn.Log.Info("CryptServiceConn.ApproveHost: client has approved computer", "uuid", req.UUID, "host_ip", req.IP)
+		rpcConn.audit(AuditHostApproval, AuditOutcomeSuccess, req.UUID, hostname, fmt.Sprintf("computer %s has been approved", req.IP))
+	}
+	return nil
+}
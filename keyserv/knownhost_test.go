@@ -0,0 +1,106 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApproveHost(t *testing.T) {
+	received := make(chan NotifyEvent, 10)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NotifyEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer httpServer.Close()
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.Webhooks = []WebhookNotifier{{URL: httpServer.URL, Events: EventFilter{NotifyHostApproval}}}
+	srv.Config.ApproveNewHosts = true
+	rec := keydb.Record{UUID: "knownhost-test", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/a", AliveIntervalSec: 1, AliveCount: 4,
+		KnownHosts: []string{"1.1.1.1"}}
+	if _, err := srv.KeyDB.Upsert(nil, rec); err != nil {
+		t.Fatal(err)
+	}
+	// The key is withheld from an unknown computer, administrators are notified only upon the first attempt
+	for i := 0; i < 2; i++ {
+		resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{rec.UUID}, Hostname: "stranger"})
+		if err != nil || len(resp.Granted) != 0 || len(resp.PendingApproval) != 1 || resp.PendingApproval[0] != rec.UUID {
+			t.Fatal(resp, err)
+		}
+	}
+	select {
+	case event := <-received:
+		if event.Type != NotifyHostApproval || event.IP != "127.0.0.1" || event.Hostname != "stranger" || !event.Critical {
+			t.Fatalf("%+v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	select {
+	case event := <-received:
+		t.Fatalf("%+v", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if rec, _ := srv.KeyDB.GetByUUID(rec.UUID); rec.PendingHosts["127.0.0.1"].Hostname != "stranger" || len(rec.AliveMessages) != 0 {
+		t.Fatalf("%+v", rec)
+	}
+	// Approved computer retrieves the key
+	if err := client.ApproveHost(ApproveHostReq{PlainPassword: TEST_RPC_PASS, UUID: rec.UUID, IP: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{rec.UUID}, Hostname: "stranger"})
+	if err != nil || len(resp.Granted) != 1 || len(resp.PendingApproval) != 0 {
+		t.Fatal(resp, err)
+	}
+	// Refused computer no longer retrieves the key
+	if err := client.ApproveHost(ApproveHostReq{PlainPassword: TEST_RPC_PASS, UUID: rec.UUID, IP: "127.0.0.1", Reject: true}); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := srv.KeyDB.GetByUUID(rec.UUID); rec.IsKnownHost("127.0.0.1") || len(rec.PendingHosts) != 0 {
+		t.Fatalf("%+v", rec)
+	}
+	if err := client.ApproveHost(ApproveHostReq{PlainPassword: TEST_RPC_PASS, UUID: "doesnotexist", IP: "127.0.0.1"}); err == nil {
+		t.Fatal("did not error")
+	}
+	// The check may be turned off
+	srv.Config.ApproveNewHosts = false
+	if resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{rec.UUID}}); err != nil || len(resp.Granted) != 1 {
+		t.Fatal(resp, err)
+	}
+}
+
+func TestApproveHostUpgradedRecord(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.ApproveNewHosts = true
+	// Computers that used the key of a record created by an earlier version continue to retrieve it
+	retrieved := keydb.Record{ID: "upgrade-1", Version: 2, UUID: "upgrade-retrieved", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/a",
+		AliveIntervalSec: 1, AliveCount: 4, LastRetrieval: keydb.AliveMessage{IP: "127.0.0.1"}}
+	alive := keydb.Record{ID: "upgrade-2", Version: 2, UUID: "upgrade-alive", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/b",
+		AliveIntervalSec: 1, AliveCount: 4, AliveMessages: map[string][]keydb.AliveMessage{"127.0.0.1": {{IP: "127.0.0.1"}}}}
+	stranger := keydb.Record{ID: "upgrade-3", Version: 2, UUID: "upgrade-stranger", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/c",
+		AliveIntervalSec: 1, AliveCount: 4, LastRetrieval: keydb.AliveMessage{IP: "1.1.1.1"}}
+	for _, rec := range []keydb.Record{retrieved, alive, stranger} {
+		if _, err := srv.KeyDB.Upsert(nil, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.KeyDB.ReloadDB(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{retrieved.UUID, alive.UUID, stranger.UUID}, Hostname: "localhost"})
+	if err != nil || len(resp.Granted) != 2 || len(resp.PendingApproval) != 1 || resp.PendingApproval[0] != stranger.UUID {
+		t.Fatal(resp, err)
+	}
+}
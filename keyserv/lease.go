@@ -0,0 +1,49 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	LenLeaseID      = 16            // LenLeaseID is the number of random bytes in a lease ID.
+	AuditKeyRelease = "key-release" // AuditKeyRelease is the event type of a key released by a client.
+)
+
+// newLeaseID returns a random lease ID given to a computer upon key retrieval.
+func newLeaseID() (string, error) {
+	idBytes := make([]byte, LenLeaseID)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("newLeaseID: failed to read from random source - %v", err)
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// ReleaseKeyReq tells server that the computer no longer holds the keys, such as when the disks have been unmounted.
+type ReleaseKeyReq struct {
+	Hostname string   // client's host name (for logging only)
+	UUIDs    []string // UUID of disks that are no longer held
+	LeaseID  string   // the lease given upon key retrieval, empty to release the keys regardless of lease
+}
+
+/*
+ReleaseKey frees the MaxActive slots held by the requester right away, instead of waiting for the requester to miss
+its alive reports. No password required, as the requester may only release its own leases.
+Respond with UUID of keys that have been released.
+*/
+func (rpcConn *CryptServiceConn) ReleaseKey(req ReleaseKeyReq, releasedUUIDs *[]string) error {
+	*releasedUUIDs = rpcConn.Svc.KeyDB.ReleaseLease(rpcConn.Log, rpcConn.RemoteHost, req.LeaseID, req.UUIDs...)
+	for _, uuid := range *releasedUUIDs {
+		rpcConn.Svc.Liveness.Forget(uuid, rpcConn.RemoteHost)
+		rpcConn.audit(AuditKeyRelease, AuditOutcomeSuccess, uuid, req.Hostname, "client has released key")
+	}
+	if len(*releasedUUIDs) > 0 {
+		rpcConn.Log.Info("CryptServiceConn.ReleaseKey: client has released keys", "hostname", req.Hostname,
+			"uuids", strings.Join(*releasedUUIDs, ","))
+	}
+	return nil
+}
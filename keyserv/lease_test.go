@@ -0,0 +1,56 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"testing"
+)
+
+func TestReleaseKey(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	rec := keydb.Record{UUID: "lease-test", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/a", MaxActive: 1,
+		AliveIntervalSec: 1, AliveCount: 4, KnownHosts: []string{"127.0.0.1"}}
+	if _, err := srv.KeyDB.Upsert(nil, rec); err != nil {
+		t.Fatal(err)
+	}
+	first, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{rec.UUID}, Hostname: "host"})
+	if err != nil || len(first.Granted) != 1 || len(first.LeaseID) != 2*LenLeaseID {
+		t.Fatal(first, err)
+	}
+	// Alive reports renew the lease
+	if rejected, err := client.ReportAlive(ReportAliveReq{UUIDs: []string{rec.UUID}, LeaseID: first.LeaseID}); err != nil || len(rejected) != 0 {
+		t.Fatal(rejected, err)
+	}
+	if released, err := client.ReleaseKey(ReleaseKeyReq{UUIDs: []string{rec.UUID}, LeaseID: "wrong"}); err != nil || len(released) != 0 {
+		t.Fatal(released, err)
+	}
+	// The only MaxActive slot is occupied until the lease is released
+	if resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{rec.UUID}, Hostname: "host"}); err != nil || len(resp.Rejected) != 1 {
+		t.Fatal(resp, err)
+	}
+	if released, err := client.ReleaseKey(ReleaseKeyReq{UUIDs: []string{rec.UUID, "doesnotexist"}, LeaseID: first.LeaseID}); err != nil ||
+		len(released) != 1 || released[0] != rec.UUID {
+		t.Fatal(released, err)
+	}
+	if rec, _ := srv.KeyDB.GetByUUID(rec.UUID); len(rec.AliveMessages) != 0 {
+		t.Fatal(rec.AliveMessages)
+	}
+	// The released lease can no longer be renewed
+	if rejected, err := client.ReportAlive(ReportAliveReq{UUIDs: []string{rec.UUID}, LeaseID: first.LeaseID}); err != nil || len(rejected) != 1 {
+		t.Fatal(rejected, err)
+	}
+	// Release without lease frees whichever lease the computer holds
+	second, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{rec.UUID}, Hostname: "host"})
+	if err != nil || len(second.Granted) != 1 || second.LeaseID == first.LeaseID {
+		t.Fatal(second, err)
+	}
+	if released, err := client.ReleaseKey(ReleaseKeyReq{UUIDs: []string{rec.UUID}}); err != nil || len(released) != 1 {
+		t.Fatal(released, err)
+	}
+	// Keys that are not granted come without a lease
+	if resp, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"doesnotexist"}}); err != nil || resp.LeaseID != "" {
+		t.Fatal(resp, err)
+	}
+}
@@ -0,0 +1,199 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	SRV_CONF_LIVENESS_SCAN_SEC = "LIVENESS_SCAN_SEC"
+
+	NotifyHostDead      = "host-dead"      // NotifyHostDead is the event of a key holder that stopped sending alive reports.
+	NotifyHostRecovered = "host-recovered" // NotifyHostRecovered is the event of a dead key holder that has come back.
+
+	AuditHostDead      = "host-dead"      // AuditHostDead is the event type of a key holder that stopped sending alive reports.
+	AuditHostRecovered = "host-recovered" // AuditHostRecovered is the event type of a dead key holder that has come back.
+)
+
+// livenessKey identifies a host that holds the key of a disk.
+type livenessKey struct {
+	UUID, IP string
+}
+
+// LivenessChange describes a key holder that has stopped sending alive reports, or has come back.
+type LivenessChange struct {
+	Record       keydb.Record       // Record is the key record held by the host, without encryption key.
+	IP           string             // IP of the host.
+	FinalMessage keydb.AliveMessage // FinalMessage is the most recent alive report of the host.
+	Recovered    bool               // Recovered is true if the host has come back, false if it has gone dead.
+}
+
+/*
+LivenessScanner remembers the hosts that were alive or dead at the previous scan, and tells which of them have crossed
+the timeout of alive reports since. Hosts that were already dead when the scanner first ran are not reported, as the
+key server itself might have been offline for a while. All exported functions are safe for concurrent usage.
+*/
+type LivenessScanner struct {
+	alive    map[livenessKey]keydb.AliveMessage // alive hosts and their latest alive report as of previous scan
+	dead     map[livenessKey]keydb.AliveMessage // hosts reported dead and their final alive report
+	lock     *sync.Mutex
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+// NewLivenessScanner returns an initialised scanner that has not yet made a scan.
+func NewLivenessScanner() *LivenessScanner {
+	return &LivenessScanner{
+		alive:    make(map[livenessKey]keydb.AliveMessage),
+		dead:     make(map[livenessKey]keydb.AliveMessage),
+		lock:     new(sync.Mutex),
+		stop:     make(chan struct{}),
+		stopOnce: new(sync.Once),
+	}
+}
+
+/*
+Scan compares the alive reports of all records against the previous scan, and returns the hosts that have stopped
+sending alive reports and those that have come back. A host that disappears from alive report history, such as when
+key retrieval removes dead hosts, is considered dead too.
+*/
+func (scanner *LivenessScanner) Scan(records []keydb.Record) (changes []LivenessChange) {
+	scanner.lock.Lock()
+	defer scanner.lock.Unlock()
+	changes = make([]LivenessChange, 0, 0)
+	alive := make(map[livenessKey]keydb.AliveMessage)
+	recordsByUUID := make(map[string]keydb.Record)
+	for _, rec := range records {
+		rec.Key = nil
+		recordsByUUID[rec.UUID] = rec
+		for ip := range rec.AliveMessages {
+			key := livenessKey{UUID: rec.UUID, IP: ip}
+			isAlive, finalMessage := rec.IsHostAlive(ip)
+			if isAlive {
+				alive[key] = finalMessage
+				if _, wasDead := scanner.dead[key]; wasDead {
+					delete(scanner.dead, key)
+					changes = append(changes, LivenessChange{Record: rec, IP: ip, FinalMessage: finalMessage, Recovered: true})
+				}
+			} else if _, wasAlive := scanner.alive[key]; wasAlive {
+				scanner.dead[key] = finalMessage
+				changes = append(changes, LivenessChange{Record: rec, IP: ip, FinalMessage: finalMessage})
+			}
+		}
+	}
+	for key, finalMessage := range scanner.alive {
+		rec, recordExists := recordsByUUID[key.UUID]
+		if _, stillAlive := alive[key]; stillAlive || !recordExists {
+			continue
+		}
+		if _, inHistory := rec.AliveMessages[key.IP]; !inHistory {
+			// The host was removed from history before the scanner could see it go dead
+			scanner.dead[key] = finalMessage
+			changes = append(changes, LivenessChange{Record: rec, IP: key.IP, FinalMessage: finalMessage})
+		}
+	}
+	// Forget about the dead hosts of erased records
+	for key := range scanner.dead {
+		if _, recordExists := recordsByUUID[key.UUID]; !recordExists {
+			delete(scanner.dead, key)
+		}
+	}
+	scanner.alive = alive
+	return
+}
+
+// Forget makes the scanner lose track of a host that has released the key, so that it is not reported dead.
+func (scanner *LivenessScanner) Forget(uuid, ip string) {
+	scanner.lock.Lock()
+	defer scanner.lock.Unlock()
+	delete(scanner.alive, livenessKey{UUID: uuid, IP: ip})
+	delete(scanner.dead, livenessKey{UUID: uuid, IP: ip})
+}
+
+// Close stops the server routine that scans for dead hosts.
+func (scanner *LivenessScanner) Close() {
+	if scanner == nil {
+		return
+	}
+	scanner.stopOnce.Do(func() {
+		close(scanner.stop)
+	})
+}
+
+// livenessEvent makes the notification of a liveness change.
+func livenessEvent(change LivenessChange) NotifyEvent {
+	rec := change.Record
+	lastSeen := time.Unix(change.FinalMessage.Timestamp, 0).Format(time.RFC1123Z)
+	event := NotifyEvent{
+		IP:       change.IP,
+		Hostname: change.FinalMessage.Hostname,
+		UUIDs:    []string{rec.UUID},
+		Records:  []keydb.Record{rec},
+	}
+	if change.Recovered {
+		event.Type = NotifyHostRecovered
+		event.Subject = fmt.Sprintf("A key holder has come back - %s %s", change.IP, change.FinalMessage.Hostname)
+		event.Text = fmt.Sprintf("Computer %s %s is sending alive reports again for the following file system:\r\n\r\n%s - %s\r\n",
+			change.IP, change.FinalMessage.Hostname, rec.UUID, rec.MountPoint)
+	} else {
+		event.Type = NotifyHostDead
+		event.Critical = true
+		event.Subject = fmt.Sprintf("A key holder has stopped sending alive reports - %s %s", change.IP, change.FinalMessage.Hostname)
+		event.Text = fmt.Sprintf("Computer %s %s has not sent an alive report since %s, it is expected every %d seconds and "+
+			"no more than %d reports may be missed. The computer may have gone offline or been rebooted elsewhere. "+
+			"It held the encryption key of the following file system:\r\n\r\n%s - %s\r\n",
+			change.IP, change.FinalMessage.Hostname, lastSeen, rec.AliveIntervalSec, rec.AliveCount, rec.UUID, rec.MountPoint)
+	}
+	return event
+}
+
+// scanLiveness looks for key holders that have stopped sending alive reports or have come back, and reports them.
+func (srv *CryptServer) scanLiveness() {
+	for _, change := range srv.Liveness.Scan(srv.KeyDB.List()) {
+		event := livenessEvent(change)
+		auditEvent := AuditEvent{
+			UUID:     change.Record.UUID,
+			IP:       change.IP,
+			Hostname: change.FinalMessage.Hostname,
+			Message:  event.Subject,
+		}
+		if change.Recovered {
+			srv.Log.Info("CryptServer.scanLiveness: key holder has come back",
+				"uuid", change.Record.UUID, "client_ip", change.IP, "hostname", change.FinalMessage.Hostname)
+			auditEvent.Type = AuditHostRecovered
+			auditEvent.Outcome = AuditOutcomeSuccess
+		} else {
+			srv.Log.Warning("CryptServer.scanLiveness: key holder has stopped sending alive reports",
+				"uuid", change.Record.UUID, "client_ip", change.IP, "hostname", change.FinalMessage.Hostname,
+				"last_seen", change.FinalMessage.Timestamp)
+			auditEvent.Type = AuditHostDead
+			auditEvent.Outcome = AuditOutcomeFailure
+		}
+		srv.Audit.Record(auditEvent)
+		srv.notify(event, srv.Log)
+	}
+}
+
+/*
+RunLivenessScan scans for dead hosts at the configured interval, until the scanner is closed by server shutdown. It
+returns right away if the scan is turned off.
+*/
+func (srv *CryptServer) RunLivenessScan() {
+	if srv.Config.LivenessScanSec <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(srv.Config.LivenessScanSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-srv.Liveness.stop:
+			return
+		case <-ticker.C:
+			srv.scanLiveness()
+		}
+	}
+}
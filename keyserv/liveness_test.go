@@ -0,0 +1,115 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// livenessTestRecord returns a record held by hosts that sent their latest alive reports the given seconds ago.
+func livenessTestRecord(uuid string, secondsAgo map[string]int64) keydb.Record {
+	rec := keydb.Record{UUID: uuid, MountPoint: "/" + uuid, AliveIntervalSec: 1, AliveCount: 4,
+		AliveMessages: map[string][]keydb.AliveMessage{}}
+	for ip, ago := range secondsAgo {
+		rec.AliveMessages[ip] = []keydb.AliveMessage{{IP: ip, Hostname: "host-" + ip, Timestamp: time.Now().Unix() - ago}}
+	}
+	return rec
+}
+
+func TestLivenessScanner(t *testing.T) {
+	scanner := NewLivenessScanner()
+	// Hosts that are already dead upon the first scan are not reported
+	if changes := scanner.Scan([]keydb.Record{
+		livenessTestRecord("aaa", map[string]int64{"1.1.1.1": 0, "2.2.2.2": 100}),
+		livenessTestRecord("bbb", map[string]int64{"3.3.3.3": 0}),
+	}); len(changes) != 0 {
+		t.Fatal(changes)
+	}
+	// 1.1.1.1 goes dead, 3.3.3.3 disappears from history, 2.2.2.2 comes back without having been reported
+	changes := scanner.Scan([]keydb.Record{
+		livenessTestRecord("aaa", map[string]int64{"1.1.1.1": 100, "2.2.2.2": 0}),
+		livenessTestRecord("bbb", map[string]int64{}),
+	})
+	if len(changes) != 2 {
+		t.Fatal(changes)
+	}
+	for _, change := range changes {
+		if change.Recovered || !(change.Record.UUID == "aaa" && change.IP == "1.1.1.1" || change.Record.UUID == "bbb" && change.IP == "3.3.3.3") ||
+			change.FinalMessage.Hostname != "host-"+change.IP {
+			t.Fatalf("%+v", change)
+		}
+	}
+	// Dead hosts are reported only once
+	if changes := scanner.Scan([]keydb.Record{
+		livenessTestRecord("aaa", map[string]int64{"1.1.1.1": 100, "2.2.2.2": 0}),
+		livenessTestRecord("bbb", map[string]int64{}),
+	}); len(changes) != 0 {
+		t.Fatal(changes)
+	}
+	// 1.1.1.1 comes back, the record of 3.3.3.3 is erased
+	changes = scanner.Scan([]keydb.Record{
+		livenessTestRecord("aaa", map[string]int64{"1.1.1.1": 0, "2.2.2.2": 0}),
+	})
+	if len(changes) != 1 || !changes[0].Recovered || changes[0].IP != "1.1.1.1" || changes[0].Record.UUID != "aaa" {
+		t.Fatal(changes)
+	}
+	if len(scanner.dead) != 0 || len(scanner.alive) != 2 {
+		t.Fatal(scanner.dead, scanner.alive)
+	}
+	var nilScanner *LivenessScanner
+	nilScanner.Close()
+}
+
+func TestScanLiveness(t *testing.T) {
+	received := make(chan NotifyEvent, 10)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NotifyEvent
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		received <- event
+	}))
+	defer httpServer.Close()
+	_, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.Webhooks = []WebhookNotifier{{URL: httpServer.URL, Events: EventFilter{NotifyHostDead}}}
+	rec := livenessTestRecord("liveness-test", map[string]int64{"1.1.1.1": 0})
+	if _, err := srv.KeyDB.Upsert(nil, rec); err != nil {
+		t.Fatal(err)
+	}
+	srv.scanLiveness()
+	if err := srv.KeyDB.Update(nil, rec.UUID, func(rec *keydb.Record) error {
+		rec.AliveMessages["1.1.1.1"][0].Timestamp -= 100
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	srv.scanLiveness()
+	select {
+	case event := <-received:
+		if event.Type != NotifyHostDead || event.IP != "1.1.1.1" || event.Hostname != "host-1.1.1.1" ||
+			len(event.UUIDs) != 1 || event.UUIDs[0] != rec.UUID || !event.Critical {
+			t.Fatalf("%+v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+}
+
+func TestLivenessScanner_Forget(t *testing.T) {
+	scanner := NewLivenessScanner()
+	scanner.Scan([]keydb.Record{livenessTestRecord("aaa", map[string]int64{"1.1.1.1": 0, "2.2.2.2": 0})})
+	// A host that has released the key is not reported dead once it disappears from history
+	scanner.Forget("aaa", "1.1.1.1")
+	changes := scanner.Scan([]keydb.Record{livenessTestRecord("aaa", map[string]int64{})})
+	if len(changes) != 1 || changes[0].IP != "2.2.2.2" || changes[0].Recovered {
+		t.Fatal(changes)
+	}
+}
@@ -0,0 +1,55 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"time"
+)
+
+const (
+	MaxWaitCommandSec = 300 // MaxWaitCommandSec is the longest time a WaitCommand request may wait for pending commands.
+)
+
+// WaitCommandReq asks server to respond as soon as there is an unseen pending command associated with requested UUIDs.
+type WaitCommandReq struct {
+	UUIDs      []string // UUIDs is an array of UUID to poll commands from.
+	TimeoutSec int      // TimeoutSec is how long to wait for a command, it is capped by MaxWaitCommandSec.
+}
+
+/*
+WaitCommand works like PollCommand, but if there is no pending command at the moment, it waits until a command is sent
+to the requester, a scheduled command becomes due, or the timeout elapses, whichever comes first. The response carries no command in case of timeout.
+*/
+func (rpcConn *CryptServiceConn) WaitCommand(req WaitCommandReq, resp *PollCommandResp) error {
+	timeoutSec := req.TimeoutSec
+	if timeoutSec <= 0 || timeoutSec > MaxWaitCommandSec {
+		timeoutSec = MaxWaitCommandSec
+	}
+	timeout := time.NewTimer(time.Duration(timeoutSec) * time.Second)
+	defer timeout.Stop()
+	for {
+		// Get hold of the notification before polling, so that a command sent in between is not missed.
+		notification := rpcConn.Svc.KeyDB.CommandNotification(rpcConn.RemoteHost)
+		var nextDue time.Time
+		if *resp, nextDue = rpcConn.pollCommands(req.UUIDs); len(resp.Commands) > 0 {
+			return nil
+		}
+		// Wake up when a scheduled command becomes due
+		if nextDue.IsZero() || nextDue.After(time.Now().Add(time.Duration(timeoutSec)*time.Second)) {
+			nextDue = time.Now().Add(time.Duration(timeoutSec) * time.Second)
+		}
+		due := time.NewTimer(time.Until(nextDue))
+		select {
+		case <-notification:
+		case <-due.C:
+		case <-timeout.C:
+			due.Stop()
+			return nil
+		case <-rpcConn.Svc.conns.DrainBegin():
+			// Let server shut down without waiting for the timeout, client will come back after restart.
+			due.Stop()
+			return nil
+		}
+		due.Stop()
+	}
+}
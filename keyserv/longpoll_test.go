@@ -0,0 +1,104 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"testing"
+	"time"
+)
+
+func TestWaitCommand(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	if hello, err := client.Hello(); err != nil || !hello.Supports("WaitCommand") {
+		t.Fatal(hello, err)
+	}
+	if _, err := srv.KeyDB.Upsert(nil, keydb.Record{UUID: "longpoll-test", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	// Wait gives up after the timeout
+	start := time.Now()
+	if resp, err := client.WaitCommand(WaitCommandReq{UUIDs: []string{"longpoll-test"}, TimeoutSec: 1}); err != nil || len(resp.Commands) != 0 {
+		t.Fatal(resp, err)
+	} else if time.Since(start) < time.Second {
+		t.Fatal("did not wait")
+	}
+	// Command sent during the wait arrives right away
+	received := make(chan PollCommandResp, 1)
+	go func() {
+		resp, err := client.WaitCommand(WaitCommandReq{UUIDs: []string{"longpoll-test"}, TimeoutSec: 60})
+		if err != nil {
+			t.Error(err)
+		}
+		received <- resp
+	}()
+	time.Sleep(200 * time.Millisecond)
+	// A command for another computer does not end the wait
+	for _, ip := range []string{"1.1.1.1", "127.0.0.1"} {
+		if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: "longpoll-test", IP: ip,
+			Content: CommandUmount, Validity: time.Hour}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case resp := <-received:
+		if cmds := resp.Commands["longpoll-test"]; len(cmds) != 1 || cmds[0].Content != CommandUmount || cmds[0].IP != "127.0.0.1" {
+			t.Fatal(resp)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	// The command has been seen, hence it is not delivered again
+	if resp, err := client.WaitCommand(WaitCommandReq{UUIDs: []string{"longpoll-test"}, TimeoutSec: 1}); err != nil || len(resp.Commands) != 0 {
+		t.Fatal(resp, err)
+	}
+}
+
+// Run with -race to make sure that a waiting computer does not read the record while commands are being added to it.
+func TestWaitCommandWhileSending(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	if _, err := srv.KeyDB.Upsert(nil, keydb.Record{UUID: "longpoll-race", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	const numCommands = 20
+	received := make(chan []string, 1)
+	go func() {
+		ids := make([]string, 0, numCommands)
+		for len(ids) < numCommands {
+			resp, err := client.WaitCommand(WaitCommandReq{UUIDs: []string{"longpoll-race"}, TimeoutSec: 5})
+			if err != nil {
+				t.Error(err)
+				break
+			} else if len(resp.Commands) == 0 {
+				break
+			}
+			for _, cmd := range resp.Commands["longpoll-race"] {
+				ids = append(ids, cmd.ID)
+			}
+		}
+		received <- ids
+	}()
+	for i := 0; i < numCommands; i++ {
+		for _, ip := range []string{"1.1.1.1", "127.0.0.1"} {
+			if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: "longpoll-race", IP: ip,
+				Kind: CommandStatus, Validity: time.Hour}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	select {
+	case ids := <-received:
+		// Every command is delivered exactly once
+		unique := make(map[string]bool)
+		for _, id := range ids {
+			unique[id] = true
+		}
+		if len(ids) != numCommands || len(unique) != numCommands {
+			t.Fatal(ids)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout")
+	}
+}
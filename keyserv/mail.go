@@ -3,12 +3,23 @@
 package keyserv
 
 import (
+	"bytes"
 	"cryptctl/sys"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
 	"net/smtp"
+	"os"
+	"path"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 )
 
 const (
@@ -17,8 +28,24 @@ const (
 	SRV_CONF_MAIL_AGENT_AND_PORT = "EMAIL_AGENT_AND_PORT"
 	SRV_CONF_MAIL_AGENT_USERNAME = "EMAIL_AGENT_USERNAME"
 	SRV_CONF_MAIL_AGENT_PASSWORD = "EMAIL_AGENT_PASSWORD"
+	SRV_CONF_MAIL_AGENT_TLS      = "EMAIL_AGENT_TLS"
+	SRV_CONF_MAIL_AGENT_CA       = "EMAIL_AGENT_CA_PEM"
+	SRV_CONF_MAIL_TEMPLATE_DIR   = "EMAIL_TEMPLATE_DIR"
+
+	MailTLSOpportunistic = "opportunistic" // MailTLSOpportunistic uses STARTTLS if mail agent offers it, this is the default.
+	MailTLSStartTLS      = "starttls"      // MailTLSStartTLS refuses to send mails unless mail agent offers STARTTLS.
+	MailTLSImplicit      = "implicit"      // MailTLSImplicit makes TLS connection to mail agent right away, usually on port 465.
+
+	MailTemplateSuffix = ".tmpl" // MailTemplateSuffix is appended to event type to make the file name of mail template.
+	MAIL_TIMEOUT_SEC   = 30      // MAIL_TIMEOUT_SEC is the timeout of the conversation with mail agent.
 )
 
+/*
+defaultMailTemplate is used for all event types unless template directory has a template for the event type. A custom
+template may redefine "subject", "body", or both.
+*/
+const defaultMailTemplate = `{{define "subject"}}{{.Subject}}{{end}}{{define "body"}}{{.Text}}{{end}}`
+
 // Return true only if both at-sign and full-stop are in the string.
 func IsMailAddressComplete(addr string) bool {
 	return strings.Contains(addr, "@")
@@ -26,11 +53,19 @@ func IsMailAddressComplete(addr string) bool {
 
 // Parameters for sending notification emails.
 type Mailer struct {
-	Recipients       []string // List of Email addresses that receive notifications
-	FromAddress      string   // FROM address of the notifications
-	AgentAddressPort string   // Address and port number of mail transportation agent for sending notifications
-	AuthUsername     string   // (Optional) Username for plain authentication, if the SMTP server requires it.
-	AuthPassword     string   // (Optional) Password for plain authentication, if the SMTP server requires it.
+	Recipients       []string    // List of Email addresses that receive notifications
+	FromAddress      string      // FROM address of the notifications
+	AgentAddressPort string      // Address and port number of mail transportation agent for sending notifications
+	AuthUsername     string      // (Optional) Username for plain authentication, if the SMTP server requires it.
+	AuthPassword     string      // (Optional) Password for plain authentication, if the SMTP server requires it.
+	Events           EventFilter // (Optional) Types of events that are mailed, empty to mail all events.
+	TLSMode          string      // (Optional) One of MailTLSOpportunistic (default if empty), MailTLSStartTLS, MailTLSImplicit.
+	CertAuthorityPEM string      // (Optional) Path to PEM-encoded CA certificate that verifies mail agent.
+	TemplateDir      string      // (Optional) Directory of templates named after event types, such as "key-creation.tmpl".
+
+	DigestIntervalMin    int    // (Optional) Collect notifications and mail them in a digest every so many minutes, 0 to mail each event.
+	DigestDailyAt        string // (Optional) Collect notifications and mail them in a digest once a day at "HH:MM", overrides the interval.
+	DigestBypassCritical bool   // (Optional) Mail critical events right away even if notifications are collected in digest.
 }
 
 // Return true only if all mail parameters are present.
@@ -63,25 +98,174 @@ func (mail *Mailer) ValidateConfig() error {
 			errs = append(errs, fmt.Errorf("Failed to parse integer from port number from \"%s\"", mail.FromAddress))
 		}
 	}
+	if err := mail.Events.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	// Validate TLS and templates
+	switch mail.TLSMode {
+	case "", MailTLSOpportunistic, MailTLSStartTLS, MailTLSImplicit:
+	default:
+		errs = append(errs, fmt.Errorf("Mail agent TLS mode \"%s\" must be one of %s, %s, %s", mail.TLSMode,
+			MailTLSOpportunistic, MailTLSStartTLS, MailTLSImplicit))
+	}
+	if mail.CertAuthorityPEM != "" {
+		if _, _, err := loadClientCAs(mail.CertAuthorityPEM); err != nil {
+			errs = append(errs, fmt.Errorf("Mail agent CA - %v", err))
+		}
+	}
+	if mail.DigestIntervalMin < 0 {
+		errs = append(errs, fmt.Errorf("Digest interval %d must not be negative", mail.DigestIntervalMin))
+	}
+	if mail.DigestDailyAt != "" {
+		if _, err := parseDigestDailyAt(mail.DigestDailyAt); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, eventType := range append(NotifyEventTypes, NotifyDigest) {
+		if _, err := mail.loadTemplate(eventType); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if len(errs) == 0 {
 		return nil
 	}
 	return fmt.Errorf("%v", errs)
 }
 
+// loadTemplate returns the mail template of the event type, it is the default template unless template directory has one.
+func (mail *Mailer) loadTemplate(eventType string) (*template.Template, error) {
+	tmpl := template.Must(template.New(eventType).Parse(defaultMailTemplate))
+	if mail.TemplateDir == "" {
+		return tmpl, nil
+	}
+	fileName := path.Join(mail.TemplateDir, eventType+MailTemplateSuffix)
+	content, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return tmpl, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read mail template \"%s\" - %v", fileName, err)
+	}
+	if _, err := tmpl.Parse(string(content)); err != nil {
+		return nil, fmt.Errorf("Failed to parse mail template \"%s\" - %v", fileName, err)
+	}
+	return tmpl, nil
+}
+
+// Render returns the mail subject and text of an event according to the template of the event type.
+func (mail *Mailer) Render(event NotifyEvent) (subject, text string, err error) {
+	tmpl, err := mail.loadTemplate(event.Type)
+	if err != nil {
+		return
+	}
+	var subjectBuf, textBuf bytes.Buffer
+	if err = tmpl.ExecuteTemplate(&subjectBuf, "subject", event); err != nil {
+		return "", "", fmt.Errorf("Mailer.Render: failed to render subject of %s - %v", event.Type, err)
+	}
+	if err = tmpl.ExecuteTemplate(&textBuf, "body", event); err != nil {
+		return "", "", fmt.Errorf("Mailer.Render: failed to render body of %s - %v", event.Type, err)
+	}
+	// Subject is a single line
+	return strings.Join(strings.Fields(subjectBuf.String()), " "), textBuf.String(), nil
+}
+
+// FormatMessage returns a complete RFC 5322 message with headers, line breaks in text are converted to CRLF.
+func (mail *Mailer) FormatMessage(subject, text string, date time.Time) []byte {
+	msgID := make([]byte, 16)
+	if _, err := rand.Read(msgID); err != nil {
+		panic(fmt.Errorf("Mailer.FormatMessage: failed to read from random source - %v", err))
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(mail.FromAddress, "@"); at != -1 {
+		domain = mail.FromAddress[at+1:]
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(msgID), domain)
+	fmt.Fprintf(&msg, "From: %s\r\n", mail.FromAddress)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(mail.Recipients, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return msg.Bytes()
+}
+
+// dial connects to mail agent and establishes TLS according to the TLS mode.
+func (mail *Mailer) dial() (*smtp.Client, error) {
+	host, _, err := net.SplitHostPort(mail.AgentAddressPort)
+	if err != nil {
+		return nil, fmt.Errorf("Mailer.dial: malformed mail agent address \"%s\" - %v", mail.AgentAddressPort, err)
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+	if mail.CertAuthorityPEM != "" {
+		if tlsConfig.RootCAs, _, err = loadClientCAs(mail.CertAuthorityPEM); err != nil {
+			return nil, fmt.Errorf("Mailer.dial: %v", err)
+		}
+	}
+	dialer := &net.Dialer{Timeout: MAIL_TIMEOUT_SEC * time.Second}
+	var conn net.Conn
+	if mail.TLSMode == MailTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", mail.AgentAddressPort, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", mail.AgentAddressPort)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Mailer.dial: failed to connect to %s - %v", mail.AgentAddressPort, err)
+	}
+	conn.SetDeadline(time.Now().Add(MAIL_TIMEOUT_SEC * time.Second))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Mailer.dial: failed to start conversation with %s - %v", mail.AgentAddressPort, err)
+	}
+	if mail.TLSMode != MailTLSImplicit {
+		if hasTLS, _ := client.Extension("STARTTLS"); hasTLS {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("Mailer.dial: STARTTLS with %s failed - %v", mail.AgentAddressPort, err)
+			}
+		} else if mail.TLSMode == MailTLSStartTLS {
+			client.Close()
+			return nil, fmt.Errorf("Mailer.dial: mail agent %s does not offer STARTTLS", mail.AgentAddressPort)
+		}
+	}
+	return client, nil
+}
+
 // Deliver an email to all recipients.
 func (mail *Mailer) Send(subject, text string) error {
 	if mail.Recipients == nil || len(mail.Recipients) == 0 {
 		return fmt.Errorf("No recipient specified for mail \"%s\"", subject)
 	}
-	var auth smtp.Auth
+	client, err := mail.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
 	if mail.AuthUsername != "" {
-		auth = smtp.PlainAuth("", mail.AuthUsername, mail.AuthPassword, mail.AgentAddressPort)
+		host, _, _ := net.SplitHostPort(mail.AgentAddressPort)
+		if err := client.Auth(smtp.PlainAuth("", mail.AuthUsername, mail.AuthPassword, host)); err != nil {
+			return fmt.Errorf("Mailer.Send: authentication failed - %v", err)
+		}
+	}
+	if err := client.Mail(mail.FromAddress); err != nil {
+		return fmt.Errorf("Mailer.Send: mail agent refused sender - %v", err)
+	}
+	for _, recipient := range mail.Recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("Mailer.Send: mail agent refused recipient %s - %v", recipient, err)
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("Mailer.Send: mail agent refused data - %v", err)
+	}
+	if _, err := writer.Write(mail.FormatMessage(subject, text, time.Now())); err != nil {
+		return fmt.Errorf("Mailer.Send: failed to write message - %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("Mailer.Send: mail agent refused message - %v", err)
 	}
-	// Construct appropriate mail headers
-	mailBody := fmt.Sprintf("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
-		mail.FromAddress, strings.Join(mail.Recipients, ", "), subject, text)
-	return smtp.SendMail(mail.AgentAddressPort, auth, mail.FromAddress, mail.Recipients, []byte(mailBody))
+	return client.Quit()
 }
 
 // Read mail settings from keys in sysconfig file.
@@ -91,4 +275,11 @@ func (mail *Mailer) ReadFromSysconfig(sysconf *sys.Sysconfig) {
 	mail.AgentAddressPort = sysconf.GetString(SRV_CONF_MAIL_AGENT_AND_PORT, "")
 	mail.AuthUsername = sysconf.GetString(SRV_CONF_MAIL_AGENT_USERNAME, "")
 	mail.AuthPassword = sysconf.GetString(SRV_CONF_MAIL_AGENT_PASSWORD, "")
+	mail.Events = sysconf.GetStringArray(SRV_CONF_MAIL_EVENTS, []string{})
+	mail.TLSMode = sysconf.GetString(SRV_CONF_MAIL_AGENT_TLS, MailTLSOpportunistic)
+	mail.CertAuthorityPEM = sysconf.GetString(SRV_CONF_MAIL_AGENT_CA, "")
+	mail.TemplateDir = sysconf.GetString(SRV_CONF_MAIL_TEMPLATE_DIR, "")
+	mail.DigestIntervalMin = sysconf.GetInt(SRV_CONF_MAIL_DIGEST_INTERVAL, 0)
+	mail.DigestDailyAt = sysconf.GetString(SRV_CONF_MAIL_DIGEST_DAILY_AT, "")
+	mail.DigestBypassCritical = sysconf.GetBool(SRV_CONF_MAIL_DIGEST_BYPASS, true)
 }
@@ -3,8 +3,16 @@
 package keyserv
 
 import (
+	"bufio"
+	"cryptctl/keydb"
+	"crypto/tls"
+	"io/ioutil"
 	"net"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMailerValidateConfig(t *testing.T) {
@@ -67,3 +75,182 @@ func TestMailerReadFromSysconfig(t *testing.T) {
 		t.Fatal(m)
 	}
 }
+
+func TestMailerRender(t *testing.T) {
+	event := NotifyEvent{Type: NotifyKeyCreation, IP: "1.2.3.4", Subject: "subj", Text: "text",
+		Records: []keydb.Record{{UUID: "aaa", MountPoint: "/a"}}}
+	m := Mailer{}
+	if subject, text, err := m.Render(event); err != nil || subject != "subj" || text != "text" {
+		t.Fatal(subject, text, err)
+	}
+	tmplDir, err := ioutil.TempDir("", "cryptctl-mailtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmplDir)
+	// Custom template may redefine the body alone
+	tmpl := `{{define "body"}}{{.IP}} saved:{{range .Records}} {{.UUID}} at {{.MountPoint}}{{end}}{{end}}`
+	if err := ioutil.WriteFile(path.Join(tmplDir, NotifyKeyCreation+MailTemplateSuffix), []byte(tmpl), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m.TemplateDir = tmplDir
+	if subject, text, err := m.Render(event); err != nil || subject != "subj" || text != "1.2.3.4 saved: aaa at /a" {
+		t.Fatal(subject, text, err)
+	}
+	// Other event types use the default template
+	event.Type = NotifyLockout
+	if subject, text, err := m.Render(event); err != nil || subject != "subj" || text != "text" {
+		t.Fatal(subject, text, err)
+	}
+	// Broken template fails validation
+	if err := ioutil.WriteFile(path.Join(tmplDir, NotifyLockout+MailTemplateSuffix), []byte("{{.Broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m = Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: "a.example:25", TemplateDir: tmplDir}
+	if err := m.ValidateConfig(); err == nil || !strings.Contains(err.Error(), "lockout.tmpl") {
+		t.Fatal(err)
+	}
+}
+
+func TestMailerFormatMessage(t *testing.T) {
+	m := Mailer{Recipients: []string{"a@b.c", "d@e.f"}, FromAddress: "me@a.example"}
+	msg := string(m.FormatMessage("Schlüssel abgerufen", "line1\nline2\r\n", time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)))
+	for _, expected := range []string{
+		"Date: Mon, 02 Jan 2017 03:04:05 +0000\r\n",
+		"@a.example>\r\n",
+		"From: me@a.example\r\n",
+		"To: a@b.c, d@e.f\r\n",
+		"Subject: =?utf-8?q?Schl=C3=BCssel_abgerufen?=\r\n",
+		"\r\n\r\nline1\r\nline2\r\n",
+	} {
+		if !strings.Contains(msg, expected) {
+			t.Fatal(expected, msg)
+		}
+	}
+	if !strings.HasPrefix(strings.SplitN(msg, "\r\n", 3)[1], "Message-ID: <") {
+		t.Fatal(msg)
+	}
+}
+
+// serveFakeSMTP answers an SMTP conversation on the connection and sends the received message to the channel.
+func serveFakeSMTP(conn net.Conn, offerSTARTTLS bool, received chan<- string) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("220 localhost ESMTP\r\n"))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO":
+			if offerSTARTTLS {
+				conn.Write([]byte("250-localhost\r\n250 STARTTLS\r\n"))
+			} else {
+				conn.Write([]byte("250 localhost\r\n"))
+			}
+		case "DATA":
+			conn.Write([]byte("354 go ahead\r\n"))
+			var msg strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil || dataLine == ".\r\n" {
+					break
+				}
+				msg.WriteString(dataLine)
+			}
+			received <- msg.String()
+			conn.Write([]byte("250 ok\r\n"))
+		case "QUIT":
+			conn.Write([]byte("221 bye\r\n"))
+			return
+		default:
+			conn.Write([]byte("250 ok\r\n"))
+		}
+	}
+}
+
+func TestMailerTLS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-mailtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ca, err := NewCertAuthority("mail test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPath, certPath, keyPath := path.Join(tmpDir, "ca.crt"), path.Join(tmpDir, "mta.crt"), path.Join(tmpDir, "mta.key")
+	if err := ioutil.WriteFile(caPath, ca.CertPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.IssueServerCert("localhost", []string{"127.0.0.1"}, certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 10)
+	// Implicit TLS
+	tlsListener, err := tls.Listen("tcp", "localhost:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsListener.Close()
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, false, received)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(tlsListener.Addr().String())
+	m := Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: "localhost:" + port,
+		TLSMode: MailTLSImplicit, CertAuthorityPEM: caPath}
+	if err := m.ValidateConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send("subj", "text"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; !strings.Contains(msg, "Subject: subj\r\n") || !strings.HasSuffix(msg, "\r\n\r\ntext\r\n") {
+		t.Fatal(msg)
+	}
+	// Without the custom CA the mail agent is not trusted
+	m.CertAuthorityPEM = ""
+	if err := m.Send("subj", "text"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Plain mail agent that does not offer STARTTLS
+	plainListener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainListener.Close()
+	go func() {
+		for {
+			conn, err := plainListener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSMTP(conn, false, received)
+		}
+	}()
+	_, port, _ = net.SplitHostPort(plainListener.Addr().String())
+	m = Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: "localhost:" + port, TLSMode: MailTLSStartTLS}
+	if err := m.Send("subj", "text"); err == nil || !strings.Contains(err.Error(), "does not offer STARTTLS") {
+		t.Fatal(err)
+	}
+	m.TLSMode = MailTLSOpportunistic
+	if err := m.Send("subj", "text"); err != nil {
+		t.Fatal(err)
+	}
+	<-received
+	m.TLSMode = "sometimes"
+	if err := m.ValidateConfig(); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,262 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MetricsURLPath       = "/metrics"        // MetricsURLPath is the HTTP path at which metrics are served.
+	MetricsUnknownMethod = "unknown"         // MetricsUnknownMethod is the method label of RPC requests that call non-existent functions.
+	rpcCantFindErrPrefix = "rpc: can't find" // rpcCantFindErrPrefix begins the error message of net/rpc when a requested function does not exist.
+)
+
+// MetricsLatencyBuckets are the upper bounds (in seconds) of latency histogram buckets.
+var MetricsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// latencyHistogram counts observations that fall into each of MetricsLatencyBuckets.
+type latencyHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{buckets: make([]uint64, len(MetricsLatencyBuckets))}
+}
+
+func (hist *latencyHistogram) observe(duration time.Duration) {
+	sec := duration.Seconds()
+	for i, upperBound := range MetricsLatencyBuckets {
+		if sec <= upperBound {
+			hist.buckets[i]++
+		}
+	}
+	hist.count++
+	hist.sum += sec
+}
+
+// write prints the histogram in Prometheus text format, labels look like `name="value"`.
+func (hist *latencyHistogram) write(out io.Writer, name, labels string) {
+	for i, upperBound := range MetricsLatencyBuckets {
+		fmt.Fprintf(out, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, upperBound, hist.buckets[i])
+	}
+	fmt.Fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, hist.count)
+	fmt.Fprintf(out, "%s_sum{%s} %g\n", name, labels, hist.sum)
+	fmt.Fprintf(out, "%s_count{%s} %d\n", name, labels, hist.count)
+}
+
+// escapeLabel escapes a label value for Prometheus text format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// sortedKeys returns the keys of a histogram map in sorted order.
+func sortedKeys(hists map[string]*latencyHistogram) []string {
+	keys := make([]string, 0, len(hists))
+	for key := range hists {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Metrics collects statistics of RPC requests, key retrieval, KMIP requests, and mail notifications, and presents them
+in Prometheus text format.
+All functions are safe for concurrent usage, and a nil Metrics quietly discards all observations.
+*/
+type Metrics struct {
+	rpcLatency   map[string]*latencyHistogram
+	rpcErrors    map[string]uint64
+	keysGranted  uint64
+	keysRejected uint64
+	keysMissing  uint64
+	kmipLatency  map[string]*latencyHistogram
+	kmipErrors   map[string]uint64
+	notifyErrors map[string]uint64 // notifyErrors counts failed notifications by notifier kind
+	lock         *sync.Mutex
+}
+
+// NewMetrics returns an initialised metrics collector with all counters at zero.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		rpcLatency:   make(map[string]*latencyHistogram),
+		rpcErrors:    make(map[string]uint64),
+		kmipLatency:  make(map[string]*latencyHistogram),
+		kmipErrors:   make(map[string]uint64),
+		notifyErrors: make(map[string]uint64),
+		lock:         new(sync.Mutex),
+	}
+}
+
+/*
+ObserveRPC records the duration and outcome of an RPC request. errMsg is the error message sent to client, or empty
+if the request was successful.
+*/
+func (metrics *Metrics) ObserveRPC(method string, duration time.Duration, errMsg string) {
+	if metrics == nil {
+		return
+	}
+	if strings.HasPrefix(errMsg, rpcCantFindErrPrefix) {
+		// Do not let clients create arbitrary labels
+		method = MetricsUnknownMethod
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	hist, found := metrics.rpcLatency[method]
+	if !found {
+		hist = newLatencyHistogram()
+		metrics.rpcLatency[method] = hist
+		metrics.rpcErrors[method] = 0
+	}
+	hist.observe(duration)
+	if errMsg != "" {
+		metrics.rpcErrors[method]++
+	}
+}
+
+// CountKeyRetrieval records the number of keys granted, rejected, and missing in an automated key retrieval.
+func (metrics *Metrics) CountKeyRetrieval(granted, rejected, missing int) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.keysGranted += uint64(granted)
+	metrics.keysRejected += uint64(rejected)
+	metrics.keysMissing += uint64(missing)
+}
+
+// ObserveKMIP records the duration and outcome of a request made by KMIP client.
+func (metrics *Metrics) ObserveKMIP(operation string, duration time.Duration, err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	hist, found := metrics.kmipLatency[operation]
+	if !found {
+		hist = newLatencyHistogram()
+		metrics.kmipLatency[operation] = hist
+		metrics.kmipErrors[operation] = 0
+	}
+	hist.observe(duration)
+	if err != nil {
+		metrics.kmipErrors[operation]++
+	}
+}
+
+// CountMailFailure records a notification email that could not be sent.
+func (metrics *Metrics) CountMailFailure() {
+	metrics.CountNotifyFailure(NotifierKindMail)
+}
+
+// CountNotifyFailure records a notification that could not be delivered by a notifier of the kind.
+func (metrics *Metrics) CountNotifyFailure(kind string) {
+	if metrics == nil {
+		return
+	}
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.notifyErrors[kind]++
+}
+
+// WriteText prints all metrics in Prometheus text format.
+func (metrics *Metrics) WriteText(out io.Writer) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	fmt.Fprintln(out, "# HELP cryptctl_rpc_duration_seconds Duration of RPC requests handled by key server.")
+	fmt.Fprintln(out, "# TYPE cryptctl_rpc_duration_seconds histogram")
+	for _, method := range sortedKeys(metrics.rpcLatency) {
+		metrics.rpcLatency[method].write(out, "cryptctl_rpc_duration_seconds", fmt.Sprintf(`method="%s"`, escapeLabel(method)))
+	}
+	fmt.Fprintln(out, "# HELP cryptctl_rpc_errors_total Number of RPC requests that were answered with an error.")
+	fmt.Fprintln(out, "# TYPE cryptctl_rpc_errors_total counter")
+	for _, method := range sortedKeys(metrics.rpcLatency) {
+		fmt.Fprintf(out, "cryptctl_rpc_errors_total{method=\"%s\"} %d\n", escapeLabel(method), metrics.rpcErrors[method])
+	}
+	fmt.Fprintln(out, "# HELP cryptctl_auto_retrieve_keys_total Number of keys requested by automated key retrieval, by outcome.")
+	fmt.Fprintln(out, "# TYPE cryptctl_auto_retrieve_keys_total counter")
+	fmt.Fprintf(out, "cryptctl_auto_retrieve_keys_total{result=\"granted\"} %d\n", metrics.keysGranted)
+	fmt.Fprintf(out, "cryptctl_auto_retrieve_keys_total{result=\"rejected\"} %d\n", metrics.keysRejected)
+	fmt.Fprintf(out, "cryptctl_auto_retrieve_keys_total{result=\"missing\"} %d\n", metrics.keysMissing)
+	fmt.Fprintln(out, "# HELP cryptctl_kmip_duration_seconds Duration of requests made to KMIP server.")
+	fmt.Fprintln(out, "# TYPE cryptctl_kmip_duration_seconds histogram")
+	for _, operation := range sortedKeys(metrics.kmipLatency) {
+		metrics.kmipLatency[operation].write(out, "cryptctl_kmip_duration_seconds", fmt.Sprintf(`operation="%s"`, escapeLabel(operation)))
+	}
+	fmt.Fprintln(out, "# HELP cryptctl_kmip_errors_total Number of failed requests made to KMIP server.")
+	fmt.Fprintln(out, "# TYPE cryptctl_kmip_errors_total counter")
+	for _, operation := range sortedKeys(metrics.kmipLatency) {
+		fmt.Fprintf(out, "cryptctl_kmip_errors_total{operation=\"%s\"} %d\n", escapeLabel(operation), metrics.kmipErrors[operation])
+	}
+	fmt.Fprintln(out, "# HELP cryptctl_mail_failures_total Number of notification emails that could not be sent.")
+	fmt.Fprintln(out, "# TYPE cryptctl_mail_failures_total counter")
+	fmt.Fprintf(out, "cryptctl_mail_failures_total %d\n", metrics.notifyErrors[NotifierKindMail])
+	fmt.Fprintln(out, "# HELP cryptctl_notification_failures_total Number of notifications that could not be delivered.")
+	fmt.Fprintln(out, "# TYPE cryptctl_notification_failures_total counter")
+	for _, kind := range NotifierKinds {
+		fmt.Fprintf(out, "cryptctl_notification_failures_total{notifier=\"%s\"} %d\n", kind, metrics.notifyErrors[kind])
+	}
+}
+
+// ListenMetrics starts an HTTP listener for metrics if a metrics listen address is configured.
+func (srv *CryptServer) ListenMetrics() (err error) {
+	if srv.Config.MetricsAddress == "" {
+		return nil
+	}
+	if srv.MetricsListener, err = net.Listen("tcp", srv.Config.MetricsAddress); err != nil {
+		return fmt.Errorf("CryptServer.ListenMetrics: failed to listen on %s - %v", srv.Config.MetricsAddress, err)
+	}
+	srv.Log.Info("CryptServer.ListenMetrics: serving metrics", "url", "http://"+srv.MetricsListener.Addr().String()+MetricsURLPath)
+	return nil
+}
+
+/*
+HandleMetricsConnections serves metrics to HTTP clients in a continuous loop.
+Blocks caller until the listener closes.
+*/
+func (srv *CryptServer) HandleMetricsConnections() {
+	mux := http.NewServeMux()
+	mux.HandleFunc(MetricsURLPath, srv.ServeMetrics)
+	err := http.Serve(srv.MetricsListener, mux)
+	srv.Log.Info("CryptServer.HandleMetricsConnections: quit now", "error", err)
+}
+
+// ServeMetrics responds to an HTTP request with server metrics and the number of active hosts of each key record.
+func (srv *CryptServer) ServeMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	srv.Metrics.WriteText(w)
+	fmt.Fprintln(w, "# HELP cryptctl_record_active_hosts Number of computers that are actively using an encryption key.")
+	fmt.Fprintln(w, "# TYPE cryptctl_record_active_hosts gauge")
+	records := srv.KeyDB.List()
+	for _, rec := range records {
+		var active int
+		for hostIP := range rec.AliveMessages {
+			if alive, _ := rec.IsHostAlive(hostIP); alive {
+				active++
+			}
+		}
+		fmt.Fprintf(w, "cryptctl_record_active_hosts{uuid=\"%s\",mount_point=\"%s\"} %d\n",
+			escapeLabel(rec.UUID), escapeLabel(rec.MountPoint), active)
+	}
+	fmt.Fprintln(w, "# HELP cryptctl_record_max_active_hosts Maximum number of computers allowed to use an encryption key, 0 means unlimited.")
+	fmt.Fprintln(w, "# TYPE cryptctl_record_max_active_hosts gauge")
+	for _, rec := range records {
+		maxActive := rec.MaxActive
+		if maxActive < 0 {
+			maxActive = 0
+		}
+		fmt.Fprintf(w, "cryptctl_record_max_active_hosts{uuid=\"%s\",mount_point=\"%s\"} %d\n",
+			escapeLabel(rec.UUID), escapeLabel(rec.MountPoint), maxActive)
+	}
+}
@@ -0,0 +1,93 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	// Nil metrics discards observations
+	var nilMetrics *Metrics
+	nilMetrics.ObserveRPC("a", time.Second, "")
+	nilMetrics.CountKeyRetrieval(1, 2, 3)
+	nilMetrics.ObserveKMIP("Get", time.Second, nil)
+	nilMetrics.CountMailFailure()
+
+	metrics := NewMetrics()
+	metrics.ObserveRPC("CryptServiceConn.Ping", 20*time.Millisecond, "")
+	metrics.ObserveRPC("CryptServiceConn.Ping", 2*time.Second, ErrIncorrectPassword.Error())
+	metrics.ObserveRPC("CryptServiceConn.DoesNotExist", time.Millisecond, "rpc: can't find method CryptServiceConn.DoesNotExist")
+	metrics.CountKeyRetrieval(1, 2, 3)
+	metrics.CountKeyRetrieval(1, 0, 0)
+	metrics.ObserveKMIP("Get", time.Millisecond, errors.New("test"))
+	metrics.CountMailFailure()
+	var out bytes.Buffer
+	metrics.WriteText(&out)
+	text := out.String()
+	for _, line := range []string{
+		`cryptctl_rpc_duration_seconds_bucket{method="CryptServiceConn.Ping",le="0.01"} 0`,
+		`cryptctl_rpc_duration_seconds_bucket{method="CryptServiceConn.Ping",le="0.025"} 1`,
+		`cryptctl_rpc_duration_seconds_bucket{method="CryptServiceConn.Ping",le="+Inf"} 2`,
+		`cryptctl_rpc_duration_seconds_count{method="CryptServiceConn.Ping"} 2`,
+		`cryptctl_rpc_errors_total{method="CryptServiceConn.Ping"} 1`,
+		`cryptctl_rpc_errors_total{method="unknown"} 1`,
+		`cryptctl_auto_retrieve_keys_total{result="granted"} 2`,
+		`cryptctl_auto_retrieve_keys_total{result="rejected"} 2`,
+		`cryptctl_auto_retrieve_keys_total{result="missing"} 3`,
+		`cryptctl_kmip_duration_seconds_count{operation="Get"} 1`,
+		`cryptctl_kmip_errors_total{operation="Get"} 1`,
+		`cryptctl_mail_failures_total 1`,
+		`cryptctl_notification_failures_total{notifier="mail"} 1`,
+		`cryptctl_notification_failures_total{notifier="webhook"} 0`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatal(line, text)
+		}
+	}
+	if strings.Contains(text, "DoesNotExist") {
+		t.Fatal(text)
+	}
+	if escaped := escapeLabel("a\"b\\c\nd"); escaped != `a\"b\\c\nd` {
+		t.Fatal(escaped)
+	}
+}
+
+func TestMetricsHTTP(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.MetricsAddress = "127.0.0.1:0"
+	if err := srv.ListenMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.MetricsListener.Close()
+	go srv.HandleMetricsConnections()
+	if _, err := client.AutoRetrieveKey(AutoRetrieveKeyReq{UUIDs: []string{"does-not-exist"}, Hostname: "localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + srv.MetricsListener.Addr().String() + MetricsURLPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+	for _, line := range []string{
+		`cryptctl_rpc_duration_seconds_count{method="CryptServiceConn.AutoRetrieveKey"} 1`,
+		`cryptctl_auto_retrieve_keys_total{result="missing"} 1`,
+		`# TYPE cryptctl_record_active_hosts gauge`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatal(line, text)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl/keydb"
+	"cryptctl/sys"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	SRV_CONF_MAIL_EVENTS        = "EMAIL_EVENTS"
+	SRV_CONF_WEBHOOK_URL_FMT    = "WEBHOOK_%d_URL"    // SRV_CONF_WEBHOOK_URL_FMT makes the sysconfig key of the URL of Nth webhook.
+	SRV_CONF_WEBHOOK_SECRET_FMT = "WEBHOOK_%d_SECRET" // SRV_CONF_WEBHOOK_SECRET_FMT makes the sysconfig key of the HMAC secret of Nth webhook.
+	SRV_CONF_WEBHOOK_EVENTS_FMT = "WEBHOOK_%d_EVENTS" // SRV_CONF_WEBHOOK_EVENTS_FMT makes the sysconfig key of the event filter of Nth webhook.
+	MaxWebhooks                 = 9                   // MaxWebhooks is the number of webhooks that can be configured, they are numbered from 1.
+
+	WebhookSignatureHeader = "X-Cryptctl-Signature" // WebhookSignatureHeader carries "sha256=" followed by hex-encoded HMAC-SHA256 of request body.
+	WebhookEventHeader     = "X-Cryptctl-Event"     // WebhookEventHeader carries the event type.
+	WEBHOOK_TIMEOUT_SEC    = 10                     // WEBHOOK_TIMEOUT_SEC is the timeout of a webhook request.
+
+	NotifierKindMail    = "mail"
+	NotifierKindWebhook = "webhook"
+
+	NotifyKeyCreation  = "key-creation"  // NotifyKeyCreation is the event of a new key saved by a client.
+	NotifyKeyRetrieval = "key-retrieval" // NotifyKeyRetrieval is the event of keys granted to a client.
+	NotifyLockout      = "lockout"       // NotifyLockout is the event of a client locked out after too many incorrect passwords.
+	NotifyCertRequest  = "cert-request"  // NotifyCertRequest is the event of a client certificate request waiting for approval.
+	NotifyKeyRejection = "key-rejection" // NotifyKeyRejection is the event of keys refused to a client.
+	NotifyKeyErasure   = "key-erasure"   // NotifyKeyErasure is the event of a key erased by a client.
+	// NotifyHostDead and NotifyHostRecovered are defined along with liveness scanner.
+)
+
+// NotifierKinds are the kinds of all notifiers.
+var NotifierKinds = []string{NotifierKindMail, NotifierKindWebhook}
+
+// NotifyEventTypes are the types of all events that can be notified.
+var NotifyEventTypes = []string{NotifyKeyCreation, NotifyKeyRetrieval, NotifyLockout, NotifyCertRequest, NotifyKeyRejection, NotifyKeyErasure,
+	NotifyHostDead, NotifyHostRecovered, NotifyApprovalRequest, NotifyHostApproval}
+
+// NotifyEvent describes an event that is worth notifying administrators about. Webhooks receive it in JSON.
+type NotifyEvent struct {
+	Type     string    // Type is one of NotifyEventTypes.
+	Time     time.Time // Time at which the event occurred.
+	IP       string    // IP of the client computer.
+	Hostname string    // Hostname of the client computer as reported by the client, empty if unknown.
+	UUIDs    []string  // UUIDs of the disks the event is about, empty if not applicable.
+	Subject  string    // Subject summarises the event in a line of text.
+	Text     string    // Text describes the event in detail.
+	Critical bool      // Critical events, such as manual key retrieval, may bypass mail digest.
+	// Records are the key records the event is about, without encryption keys. They are available to mail templates.
+	Records []keydb.Record `json:"-"`
+	// Digest are the events summarised by a digest mail, it is only used by event type NotifyDigest.
+	Digest []NotifyEvent `json:"-"`
+}
+
+// Notifier delivers event notifications via a channel such as email or webhook.
+type Notifier interface {
+	Kind() string                   // Kind is one of NotifierKinds.
+	Accepts(eventType string) bool  // Accepts returns true only if the notifier is interested in the event type.
+	Notify(event NotifyEvent) error // Notify delivers the notification.
+}
+
+// EventFilter is a list of event types a notifier is interested in, an empty filter accepts all events.
+type EventFilter []string
+
+// Accepts returns true only if the event type is in the filter, or the filter is empty.
+func (filter EventFilter) Accepts(eventType string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, accepted := range filter {
+		if accepted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if the filter contains an unknown event type.
+func (filter EventFilter) Validate() error {
+	for _, eventType := range filter {
+		if !(EventFilter(NotifyEventTypes)).Accepts(eventType) {
+			return fmt.Errorf("EventFilter.Validate: unknown event type \"%s\", it should be one of %v", eventType, NotifyEventTypes)
+		}
+	}
+	return nil
+}
+
+// Kind returns NotifierKindMail.
+func (mail *Mailer) Kind() string {
+	return NotifierKindMail
+}
+
+// Accepts returns true only if the event type is among the events that should be mailed.
+func (mail *Mailer) Accepts(eventType string) bool {
+	return mail.Events.Accepts(eventType)
+}
+
+// Notify mails the event to all recipients, the mail is rendered from the template of the event type.
+func (mail *Mailer) Notify(event NotifyEvent) error {
+	subject, text, err := mail.Render(event)
+	if err != nil {
+		return err
+	}
+	return mail.Send(subject, text)
+}
+
+// WebhookNotifier posts event notifications in JSON to an HTTP(S) URL.
+type WebhookNotifier struct {
+	URL    string      // URL receives POST requests
+	Secret string      // Secret is the HMAC key that signs request body, the signature is omitted if it is empty.
+	Events EventFilter // Events are the event types that are posted
+}
+
+// Kind returns NotifierKindWebhook.
+func (hook *WebhookNotifier) Kind() string {
+	return NotifierKindWebhook
+}
+
+// Accepts returns true only if the event type is among the events that should be posted.
+func (hook *WebhookNotifier) Accepts(eventType string) bool {
+	return hook.Events.Accepts(eventType)
+}
+
+// Validate returns an error if the URL is not HTTP(S) or the event filter is invalid.
+func (hook *WebhookNotifier) Validate() error {
+	parsed, err := url.Parse(hook.URL)
+	if err != nil {
+		return fmt.Errorf("WebhookNotifier.Validate: malformed URL \"%s\" - %v", hook.URL, err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return fmt.Errorf("WebhookNotifier.Validate: URL \"%s\" should begin with http:// or https://", hook.URL)
+	}
+	return hook.Events.Validate()
+}
+
+// SignWebhookPayload returns the signature header value of a webhook request body.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify posts the event in JSON, the response status must indicate success.
+func (hook *WebhookNotifier) Notify(event NotifyEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("WebhookNotifier.Notify: failed to encode event - %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("WebhookNotifier.Notify: failed to make request - %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, event.Type)
+	if hook.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(hook.Secret, payload))
+	}
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT_SEC * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("WebhookNotifier.Notify: failed to post to %s - %v", req.URL.Redacted(), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("WebhookNotifier.Notify: %s responded with status %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+// readWebhooksFromSysconfig reads the settings of numbered webhooks, those without a URL are skipped.
+func readWebhooksFromSysconfig(sysconf *sys.Sysconfig) []WebhookNotifier {
+	hooks := make([]WebhookNotifier, 0)
+	for i := 1; i <= MaxWebhooks; i++ {
+		hookURL := sysconf.GetString(fmt.Sprintf(SRV_CONF_WEBHOOK_URL_FMT, i), "")
+		if hookURL == "" {
+			continue
+		}
+		hooks = append(hooks, WebhookNotifier{
+			URL:    hookURL,
+			Secret: sysconf.GetString(fmt.Sprintf(SRV_CONF_WEBHOOK_SECRET_FMT, i), ""),
+			Events: sysconf.GetStringArray(fmt.Sprintf(SRV_CONF_WEBHOOK_EVENTS_FMT, i), []string{}),
+		})
+	}
+	return hooks
+}
+
+// notifiers returns the notifiers that are currently configured.
+func (srv *CryptServer) notifiers() []Notifier {
+	srv.reloadLock.RLock()
+	defer srv.reloadLock.RUnlock()
+	ret := make([]Notifier, 0, 1+len(srv.Config.Webhooks))
+	if srv.Mailer.ValidateConfig() == nil {
+		if srv.Mailer.DigestEnabled() {
+			ret = append(ret, &mailDigestNotifier{mailer: srv.Mailer, digest: srv.MailDigest})
+		} else {
+			ret = append(ret, srv.Mailer)
+		}
+	}
+	for i := range srv.Config.Webhooks {
+		ret = append(ret, &srv.Config.Webhooks[i])
+	}
+	return ret
+}
+
+// notify delivers the event to all interested notifiers in background, delivery failures are logged by the logger.
+func (srv *CryptServer) notify(event NotifyEvent, logger *sys.Logger) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, notifier := range srv.notifiers() {
+		if !notifier.Accepts(event.Type) {
+			continue
+		}
+		go func(notifier Notifier) {
+			if err := notifier.Notify(event); err != nil {
+				srv.Metrics.CountNotifyFailure(notifier.Kind())
+				logger.Error("CryptServer.notify: failed to deliver notification",
+					"notifier", notifier.Kind(), "event", event.Type, "client_ip", event.IP, "hostname", event.Hostname, "error", err)
+			}
+		}(notifier)
+	}
+}
+
+// notify delivers the event about the client of this connection to all interested notifiers in background.
+func (rpcConn *CryptServiceConn) notify(event NotifyEvent) {
+	event.IP = rpcConn.RemoteHost
+	rpcConn.Svc.notify(event, rpcConn.Log)
+}
@@ -0,0 +1,94 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventFilter(t *testing.T) {
+	if !(EventFilter{}).Accepts(NotifyLockout) || !(EventFilter{NotifyLockout}).Accepts(NotifyLockout) ||
+		(EventFilter{NotifyKeyCreation}).Accepts(NotifyLockout) {
+		t.Fatal("wrong filter")
+	}
+	if err := (EventFilter{NotifyKeyCreation, NotifyCertRequest}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (EventFilter{"reboot"}).Validate(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := (&WebhookNotifier{URL: "ftp://example.com"}).Validate(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := (&Mailer{Recipients: []string{"a@b.c"}, FromAddress: "me@a.example", AgentAddressPort: "a.example:25", Events: EventFilter{"reboot"}}).ValidateConfig(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestReadWebhooksFromSysconfig(t *testing.T) {
+	sysconf := GetDefaultKeySvcConf()
+	if hooks := readWebhooksFromSysconfig(sysconf); len(hooks) != 0 {
+		t.Fatal(hooks)
+	}
+	sysconf.Set("WEBHOOK_2_URL", "https://example.com/hook")
+	sysconf.Set("WEBHOOK_2_SECRET", "abc")
+	sysconf.Set("WEBHOOK_2_EVENTS", "key-creation lockout")
+	hooks := readWebhooksFromSysconfig(sysconf)
+	if !reflect.DeepEqual(hooks, []WebhookNotifier{{URL: "https://example.com/hook", Secret: "abc", Events: EventFilter{NotifyKeyCreation, NotifyLockout}}}) {
+		t.Fatal(hooks)
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	received := make(chan NotifyEvent, 10)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if r.Method != http.MethodPost || r.Header.Get(WebhookSignatureHeader) != SignWebhookPayload("secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event NotifyEvent
+		if err := json.Unmarshal(body, &event); err != nil || r.Header.Get(WebhookEventHeader) != event.Type {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer httpServer.Close()
+	// Incorrect signature is refused by the receiver
+	hook := &WebhookNotifier{URL: httpServer.URL, Secret: "wrong"}
+	if err := hook.Notify(NotifyEvent{Type: NotifyLockout}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Server delivers events to the interested webhooks
+	_, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.Webhooks = []WebhookNotifier{
+		{URL: httpServer.URL, Secret: "secret", Events: EventFilter{NotifyCertRequest}},
+		{URL: httpServer.URL + "/not-interested", Secret: "wrong", Events: EventFilter{NotifyKeyCreation}},
+	}
+	srv.newServiceConn("1.2.3.4").notify(NotifyEvent{Type: NotifyCertRequest, Hostname: "host", Subject: "subj", Text: "text"})
+	select {
+	case event := <-received:
+		if event.Type != NotifyCertRequest || event.IP != "1.2.3.4" || event.Hostname != "host" || event.Subject != "subj" ||
+			event.Text != "text" || event.Time.IsZero() {
+			t.Fatalf("%+v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout")
+	}
+	// The webhook that is not interested in the event does not fail
+	time.Sleep(100 * time.Millisecond)
+	if srv.Metrics.notifyErrors[NotifierKindWebhook] != 0 {
+		t.Fatal(srv.Metrics.notifyErrors)
+	}
+}
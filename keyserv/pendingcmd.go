@@ -0,0 +1,122 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"fmt"
+)
+
+const (
+	CommandParamNewKMIPID = "new-kmip-id"  // CommandParamNewKMIPID is the KMIP ID of the new key of a key rotation command, if the key is stored on an external KMIP server.
+	AuditKeyRotation      = "key-rotation" // AuditKeyRotation is the event type of a key replaced by a new one.
+)
+
+// isCommandType returns true only if the kind of pending command is among CommandTypes.
+func isCommandType(kind string) bool {
+	for _, cmdType := range CommandTypes {
+		if cmdType == kind {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+newRotationKey prepares the new key of a key rotation command. The built-in key storage generates the key right away and
+keeps it as the command's secret, with the same protection as the record's key, until the computer reports the result;
+an external KMIP server creates the key, whose ID is remembered among the command parameters.
+*/
+func (rpcConn *CryptServiceConn) newRotationKey(uuid string, params map[string]string) (newParams map[string]string, secret []byte, err error) {
+	newParams = make(map[string]string)
+	for name, value := range params {
+		newParams[name] = value
+	}
+	if rpcConn.Svc.BuiltInKMIPServer != nil {
+		return newParams, GetNewDiskEncryptionKeyBits(), nil
+	}
+	newKMIPID, err := rpcConn.kmipClient().CreateKey(KeyNamePrefix + uuid)
+	if err != nil {
+		return nil, nil, fmt.Errorf("CryptServiceConn.newRotationKey: KMIP client refused to create the key - %v", err)
+	}
+	newParams[CommandParamNewKMIPID] = newKMIPID
+	return newParams, nil, nil
+}
+
+/*
+finishKeyRotation replaces the key of the record with the new one if the computer has put the new key to use, otherwise
+the new key is discarded and the record keeps the old key.
+*/
+func (rpcConn *CryptServiceConn) finishKeyRotation(rec keydb.Record, cmd keydb.PendingCommand, success bool) {
+	newKMIPID := cmd.Params[CommandParamNewKMIPID]
+	newKey := rec.CommandSecrets[cmd.ID]
+	if !success {
+		if newKMIPID != "" {
+			if err := rpcConn.kmipClient().DestroyKey(newKMIPID); err != nil {
+				rpcConn.Log.Warning("CryptServiceConn.finishKeyRotation: failed to discard the unused new key", "uuid", rec.UUID, "kmip_id", newKMIPID, "error", err)
+			}
+		}
+		rpcConn.audit(AuditKeyRotation, AuditOutcomeFailure, rec.UUID, "", "client has failed to rotate key of "+rec.MountPoint)
+		return
+	}
+	if newKMIPID == "" && len(newKey) == 0 {
+		return
+	}
+	oldKMIPID, err := rpcConn.Svc.KeyDB.ReplaceKey(rpcConn.Log, rec.UUID, cmd.ID, newKMIPID, newKey)
+	if err != nil {
+		rpcConn.Log.Error("CryptServiceConn.finishKeyRotation: failed to save the new key", "uuid", rec.UUID, "error", err)
+		return
+	}
+	if newKMIPID != "" {
+		if err := rpcConn.kmipClient().DestroyKey(oldKMIPID); err != nil {
+			rpcConn.Log.Warning("CryptServiceConn.finishKeyRotation: failed to erase the old key", "uuid", rec.UUID, "kmip_id", oldKMIPID, "error", err)
+		}
+	}
+	rpcConn.Log.Info("CryptServiceConn.finishKeyRotation: the new key has taken effect", "uuid", rec.UUID, "command_id", cmd.ID)
+	rpcConn.audit(AuditKeyRotation, AuditOutcomeSuccess, rec.UUID, "", "client has rotated key of "+rec.MountPoint)
+}
+
+// RetrieveCommandKeyReq asks for the key material needed to execute a pending command.
+type RetrieveCommandKeyReq struct {
+	Hostname  string // client's host name (for logging only)
+	UUID      string // UUID of the disk
+	CommandID string // ID of the pending command
+}
+
+// RetrieveCommandKeyResp carries the key material needed to execute a pending command.
+type RetrieveCommandKeyResp struct {
+	Key    []byte // the current disk encryption key
+	NewKey []byte // the recovery passphrase or the new key, depending on the kind of command
+}
+
+/*
+RetrieveCommandKey hands out the key material to the computer that is executing a command to verify the key, add a
+recovery keyslot, or rotate the key. No password required, as the pending command itself authorises the computer.
+*/
+func (rpcConn *CryptServiceConn) RetrieveCommandKey(req RetrieveCommandKeyReq, resp *RetrieveCommandKeyResp) error {
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		return fmt.Errorf("CryptServiceConn.RetrieveCommandKey: %w - %s", keydb.ErrRecordNotFound, req.UUID)
+	}
+	cmd, found := rec.GetPendingCommand(rpcConn.RemoteHost, req.CommandID)
+	if !found || !cmd.IsValid() || !cmd.IsDue() || cmd.ClientResult != "" ||
+		cmd.Kind != CommandVerifyKey && cmd.Kind != CommandAddRecoveryKeyslot && cmd.Kind != CommandRotateKey {
+		rpcConn.audit(AuditKeyRetrieval, AuditOutcomeFailure, req.UUID, req.Hostname, "client does not have a command that needs the key")
+		return fmt.Errorf("CryptServiceConn.RetrieveCommandKey: %w - there is no unfinished command \"%s\" that needs the key", ErrInvalidRequest, req.CommandID)
+	}
+	var err error
+	if resp.Key, err = rpcConn.askForKeyContent(rec.ID); err != nil {
+		return err
+	}
+	if newKMIPID := cmd.Params[CommandParamNewKMIPID]; cmd.Kind == CommandRotateKey && newKMIPID != "" {
+		if resp.NewKey, err = rpcConn.askForKeyContent(newKMIPID); err != nil {
+			return err
+		}
+	} else if cmd.Kind != CommandVerifyKey {
+		resp.NewKey = rec.CommandSecrets[cmd.ID]
+	}
+	rpcConn.Log.Info("CryptServiceConn.RetrieveCommandKey: client has been granted key for command", "hostname", req.Hostname,
+		"uuid", req.UUID, "command", cmd.Kind, "command_id", cmd.ID)
+	rpcConn.audit(AuditKeyRetrieval, AuditOutcomeSuccess, req.UUID, req.Hostname, fmt.Sprintf("client has been granted key of %s for command %s", rec.MountPoint, cmd.Kind))
+	return nil
+}
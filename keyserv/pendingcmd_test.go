@@ -0,0 +1,218 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl/keydb"
+	"io/ioutil"
+	"path"
+	"testing"
+	"time"
+)
+
+// pollOneCommand polls the commands of a disk and expects exactly one of them.
+func pollOneCommand(t *testing.T, client *CryptClient, uuid string) keydb.PendingCommand {
+	resp, err := client.PollCommand(PollCommandReq{UUIDs: []string{uuid}})
+	if err != nil || len(resp.Commands[uuid]) != 1 {
+		t.Fatal(resp, err)
+	}
+	return resp.Commands[uuid][0]
+}
+
+// storedCommandSecrets returns the command secrets found in the record file of a disk.
+func storedCommandSecrets(t *testing.T, srv *CryptServer, uuid string) map[string][]byte {
+	content, err := ioutil.ReadFile(path.Join(srv.KeyDB.Dir, uuid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec keydb.Record
+	if err := rec.Deserialise(content); err != nil {
+		t.Fatal(err)
+	}
+	return rec.CommandSecrets
+}
+
+func TestTypedCommands(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	if _, err := client.CreateKey(CreateKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "localhost", UUID: "cmd-test", MountPoint: "/a",
+		MountOptions: []string{}, MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := srv.KeyDB.GetByUUID("cmd-test")
+	// Malformed commands are refused
+	for _, req := range []SendCommandReq{
+		{UUID: "cmd-test", IP: "127.0.0.1", Kind: "dance", Validity: time.Hour},
+		{UUID: "cmd-test", IP: "127.0.0.1", Kind: CommandAddRecoveryKeyslot, Validity: time.Hour},
+		{UUID: "cmd-test", IP: "127.0.0.1", Kind: CommandVerifyKey, Secret: []byte("secret"), Validity: time.Hour},
+		{UUID: "does-not-exist", IP: "127.0.0.1", Kind: CommandStatus, Validity: time.Hour},
+	} {
+		req.PlainPassword = TEST_RPC_PASS
+		if err := client.SendCommand(req); err == nil {
+			t.Fatal("did not error", req)
+		}
+	}
+	// Recovery passphrase is handed out only to the computer executing the command
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: "cmd-test", IP: "127.0.0.1",
+		Kind: CommandAddRecoveryKeyslot, Secret: []byte("recovery"), Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := client.GetRecord(GetRecordReq{PlainPassword: TEST_RPC_PASS, UUID: "cmd-test"}); err != nil || len(got.CommandSecrets) != 0 {
+		t.Fatal(got, err)
+	}
+	cmd := pollOneCommand(t, client, "cmd-test")
+	if cmd.Kind != CommandAddRecoveryKeyslot || cmd.Content != nil || len(cmd.ID) != 2*keydb.LenCommandID {
+		t.Fatalf("%+v", cmd)
+	}
+	if _, err := client.RetrieveCommandKey(RetrieveCommandKeyReq{UUID: "cmd-test", CommandID: "does-not-exist"}); err == nil {
+		t.Fatal("did not error")
+	}
+	keys, err := client.RetrieveCommandKey(RetrieveCommandKeyReq{UUID: "cmd-test", CommandID: cmd.ID})
+	if err != nil || !bytes.Equal(keys.Key, rec.Key) || string(keys.NewKey) != "recovery" {
+		t.Fatal(keys, err)
+	}
+	// Once the command is finished, neither the key nor the passphrase is handed out
+	if err := client.SaveCommandResult(SaveCommandResultReq{UUID: "cmd-test", CommandID: cmd.ID, Result: "Success", Success: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RetrieveCommandKey(RetrieveCommandKeyReq{UUID: "cmd-test", CommandID: cmd.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	if got, _ := srv.KeyDB.GetByUUID("cmd-test"); len(got.CommandSecrets) != 0 {
+		t.Fatal(got.CommandSecrets)
+	}
+	if secrets := storedCommandSecrets(t, srv, "cmd-test"); len(secrets) != 0 {
+		t.Fatal(secrets)
+	}
+	// Status command does not need the key
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: "cmd-test", IP: "127.0.0.1",
+		Kind: CommandStatus, Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	cmd = pollOneCommand(t, client, "cmd-test")
+	if _, err := client.RetrieveCommandKey(RetrieveCommandKeyReq{UUID: "cmd-test", CommandID: cmd.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Failed key rotation keeps the old key
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: "cmd-test", IP: "127.0.0.1",
+		Kind: CommandRotateKey, Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	cmd = pollOneCommand(t, client, "cmd-test")
+	if keys, err = client.RetrieveCommandKey(RetrieveCommandKeyReq{UUID: "cmd-test", CommandID: cmd.ID}); err != nil ||
+		!bytes.Equal(keys.Key, rec.Key) || len(keys.NewKey) == 0 || bytes.Equal(keys.NewKey, rec.Key) {
+		t.Fatal(keys, err)
+	}
+	if err := client.SaveCommandResult(SaveCommandResultReq{UUID: "cmd-test", CommandID: cmd.ID, Result: "failed"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := srv.KeyDB.GetByUUID("cmd-test"); !bytes.Equal(got.Key, rec.Key) {
+		t.Fatal("key has changed")
+	}
+	if secrets := storedCommandSecrets(t, srv, "cmd-test"); len(secrets) != 0 {
+		t.Fatal(secrets)
+	}
+	// Successful key rotation replaces the key, later results do not change it again
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: "cmd-test", IP: "127.0.0.1",
+		Kind: CommandRotateKey, Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	cmd = pollOneCommand(t, client, "cmd-test")
+	if keys, err = client.RetrieveCommandKey(RetrieveCommandKeyReq{UUID: "cmd-test", CommandID: cmd.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if secrets := storedCommandSecrets(t, srv, "cmd-test"); !bytes.Equal(secrets[cmd.ID], keys.NewKey) {
+		t.Fatal(secrets)
+	}
+	for _, success := range []bool{true, false} {
+		if err := client.SaveCommandResult(SaveCommandResultReq{UUID: "cmd-test", CommandID: cmd.ID, Result: "done", Success: success}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := srv.KeyDB.GetByUUID("cmd-test"); !bytes.Equal(got.Key, keys.NewKey) || got.ID != rec.ID {
+			t.Fatalf("%+v", got)
+		}
+		if secrets := storedCommandSecrets(t, srv, "cmd-test"); len(secrets) != 0 {
+			t.Fatal(secrets)
+		}
+	}
+}
+
+func TestScheduledCommands(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	rec := keydb.Record{UUID: "schedule-test", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/a", AliveIntervalSec: 1, AliveCount: 4}
+	if _, err := srv.KeyDB.Upsert(nil, rec); err != nil {
+		t.Fatal(err)
+	}
+	// A command cannot be scheduled to expire in the past
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: rec.UUID, IP: "127.0.0.1", Kind: CommandStatus,
+		ValidFrom: time.Now().Add(-2 * time.Hour), Validity: time.Hour}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Neither the command nor its key is handed out before the scheduled time
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: rec.UUID, IP: "127.0.0.1", Kind: CommandVerifyKey,
+		ValidFrom: time.Now().Add(time.Hour), Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: rec.UUID, IP: "127.0.0.1", Kind: CommandStatus,
+		ValidFrom: time.Now().Add(time.Second), Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if polled, err := client.PollCommand(PollCommandReq{UUIDs: []string{rec.UUID}}); err != nil || len(polled.Commands) != 0 {
+		t.Fatal(polled, err)
+	}
+	cmds, err := client.ListCommands(ListCommandsReq{PlainPassword: TEST_RPC_PASS})
+	if err != nil || len(cmds) != 2 || cmds[0].Command.Kind != CommandStatus || cmds[0].Command.State() != keydb.CommandStateScheduled ||
+		cmds[1].Command.Kind != CommandVerifyKey || cmds[0].UUID != rec.UUID || cmds[0].MountPoint != "/a" {
+		t.Fatalf("%+v %v", cmds, err)
+	}
+	if _, err := client.RetrieveCommandKey(RetrieveCommandKeyReq{UUID: rec.UUID, CommandID: cmds[1].Command.ID}); err == nil {
+		t.Fatal("did not error")
+	}
+	// A waiting computer receives the command as soon as it becomes due
+	start := time.Now()
+	polled, err := client.WaitCommand(WaitCommandReq{UUIDs: []string{rec.UUID}, TimeoutSec: 10})
+	if err != nil || len(polled.Commands[rec.UUID]) != 1 || polled.Commands[rec.UUID][0].Kind != CommandStatus || time.Since(start) > 5*time.Second {
+		t.Fatal(polled, err, time.Since(start))
+	}
+	if cmds, err = client.ListCommands(ListCommandsReq{PlainPassword: TEST_RPC_PASS}); err != nil || cmds[0].Command.State() != keydb.CommandStateDelivered {
+		t.Fatalf("%+v %v", cmds, err)
+	}
+	if _, err := client.ListCommands(ListCommandsReq{PlainPassword: "wrong"}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestSaveLegacyCommandResult(t *testing.T) {
+	_, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	// Slices cannot be compared by ==, they are matched by their content nonetheless.
+	now := time.Now()
+	if _, err := srv.KeyDB.Upsert(nil, keydb.Record{UUID: "legacy-result", Key: make([]byte, KMIPAESKeySizeBits/8), MountPoint: "/a",
+		PendingCommands: map[string][]keydb.PendingCommand{"127.0.0.1": {
+			{ID: "1", Content: []string{"umount"}, ValidFrom: now, Validity: time.Hour, IP: "127.0.0.1", SeenByClient: true, ClientResult: "done"},
+			{ID: "2", Content: []string{"umount"}, ValidFrom: now, Validity: time.Hour, IP: "127.0.0.1", SeenByClient: true},
+		}}}); err != nil {
+		t.Fatal(err)
+	}
+	var dummy DummyAttr
+	// The command that already has a result is skipped
+	if err := srv.newServiceConn("127.0.0.1").SaveCommandResult(SaveCommandResultReq{UUID: "legacy-result",
+		CommandContent: []string{"umount"}, Result: "Success"}, &dummy); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ := srv.KeyDB.GetByUUID("legacy-result")
+	if cmds := rec.PendingCommands["127.0.0.1"]; cmds[0].ClientResult != "done" || cmds[1].ClientResult != "Success" || !cmds[1].Result.Success {
+		t.Fatalf("%+v", cmds)
+	}
+	// There are no more commands without result
+	if err := srv.newServiceConn("127.0.0.1").SaveCommandResult(SaveCommandResultReq{UUID: "legacy-result",
+		CommandContent: []string{"umount"}, Result: "again"}, &dummy); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ = srv.KeyDB.GetByUUID("legacy-result")
+	if cmds := rec.PendingCommands["127.0.0.1"]; cmds[0].ClientResult != "done" || cmds[1].ClientResult != "Success" {
+		t.Fatalf("%+v", cmds)
+	}
+}
@@ -0,0 +1,180 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	MaxTrackedHosts = 100000 // MaxTrackedHosts is the upper limit of hosts tracked by rate limiter and lockout, idle hosts are forgotten beyond the limit.
+)
+
+// tokenBucket holds the remaining tokens of a host.
+type tokenBucket struct {
+	tokens   float64
+	lastFill time.Time
+}
+
+/*
+RateLimiter is a token-bucket rate limiter that keeps a bucket for each host. A host may make a burst of requests,
+then the bucket refills at a constant rate.
+All exported functions are safe for concurrent usage.
+*/
+type RateLimiter struct {
+	PerMinute int // PerMinute is the number of tokens added to each bucket every minute. 0 disables the limiter.
+	Burst     int // Burst is the capacity of each bucket.
+	buckets   map[string]*tokenBucket
+	lock      *sync.Mutex
+}
+
+// NewRateLimiter returns an initialised rate limiter. If perMinute is 0, the limiter allows all requests.
+func NewRateLimiter(perMinute, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		PerMinute: perMinute,
+		Burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		lock:      new(sync.Mutex),
+	}
+}
+
+// refill adds tokens accumulated since the last refill to the bucket.
+func (limiter *RateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.lastFill).Minutes() * float64(limiter.PerMinute)
+	if bucket.tokens > float64(limiter.Burst) {
+		bucket.tokens = float64(limiter.Burst)
+	}
+	bucket.lastFill = now
+}
+
+// Allow takes a token from the host's bucket, return false if the bucket is empty.
+func (limiter *RateLimiter) Allow(host string) bool {
+	if limiter.PerMinute <= 0 {
+		return true
+	}
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	bucket, found := limiter.buckets[host]
+	if !found {
+		if len(limiter.buckets) >= MaxTrackedHosts {
+			limiter.forgetIdle(now)
+		}
+		bucket = &tokenBucket{tokens: float64(limiter.Burst), lastFill: now}
+		limiter.buckets[host] = bucket
+	}
+	limiter.refill(bucket, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// forgetIdle removes buckets that are full again, they do not hold any information. Caller must hold the lock.
+func (limiter *RateLimiter) forgetIdle(now time.Time) {
+	for host, bucket := range limiter.buckets {
+		if limiter.refill(bucket, now); bucket.tokens >= float64(limiter.Burst) {
+			delete(limiter.buckets, host)
+		}
+	}
+}
+
+// authFailures records consecutive authentication failures of a host.
+type authFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+/*
+AuthLockout locks a host out of password-protected functions after repeated authentication failures. The lockout
+duration doubles with each further failure, up to a maximum.
+All exported functions are safe for concurrent usage.
+*/
+type AuthLockout struct {
+	Threshold   int           // Threshold is the number of consecutive failures that triggers lockout. 0 disables lockout.
+	BaseLockout time.Duration // BaseLockout is the duration of the first lockout.
+	MaxLockout  time.Duration // MaxLockout is the upper limit of lockout duration.
+	failures    map[string]*authFailures
+	lock        *sync.Mutex
+}
+
+// NewAuthLockout returns an initialised lockout tracker. If threshold is 0, hosts are never locked out.
+func NewAuthLockout(threshold int, baseLockout, maxLockout time.Duration) *AuthLockout {
+	if maxLockout < baseLockout {
+		maxLockout = baseLockout
+	}
+	return &AuthLockout{
+		Threshold:   threshold,
+		BaseLockout: baseLockout,
+		MaxLockout:  maxLockout,
+		failures:    make(map[string]*authFailures),
+		lock:        new(sync.Mutex),
+	}
+}
+
+// LockedFor returns the remaining lockout duration of a host, or 0 if the host is not locked out.
+func (lockout *AuthLockout) LockedFor(host string) time.Duration {
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+	if failures, found := lockout.failures[host]; found {
+		if remaining := time.Until(failures.lockedUntil); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+/*
+Fail records an authentication failure of a host. If the host has failed too many times, return the lockout duration
+that begins now, otherwise return 0.
+*/
+func (lockout *AuthLockout) Fail(host string) (lockedFor time.Duration, consecutiveFailures int) {
+	if lockout.Threshold <= 0 {
+		return 0, 0
+	}
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+	failures, found := lockout.failures[host]
+	if !found {
+		if len(lockout.failures) >= MaxTrackedHosts {
+			lockout.forgetExpired()
+		}
+		failures = new(authFailures)
+		lockout.failures[host] = failures
+	}
+	failures.count++
+	if failures.count < lockout.Threshold {
+		return 0, failures.count
+	}
+	lockedFor = lockout.BaseLockout
+	for i := lockout.Threshold; i < failures.count && lockedFor < lockout.MaxLockout; i++ {
+		lockedFor *= 2
+	}
+	if lockedFor > lockout.MaxLockout {
+		lockedFor = lockout.MaxLockout
+	}
+	failures.lockedUntil = time.Now().Add(lockedFor)
+	return lockedFor, failures.count
+}
+
+// Succeed clears authentication failures of a host.
+func (lockout *AuthLockout) Succeed(host string) {
+	lockout.lock.Lock()
+	defer lockout.lock.Unlock()
+	delete(lockout.failures, host)
+}
+
+// forgetExpired removes hosts that are not locked out at the moment. Caller must hold the lock.
+func (lockout *AuthLockout) forgetExpired() {
+	now := time.Now()
+	for host, failures := range lockout.failures {
+		if failures.lockedUntil.Before(now) {
+			delete(lockout.failures, host)
+		}
+	}
+}
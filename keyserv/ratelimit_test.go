@@ -0,0 +1,120 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	unlimited := NewRateLimiter(0, 0)
+	for i := 0; i < 1000; i++ {
+		if !unlimited.Allow("1.1.1.1") {
+			t.Fatal("limited")
+		}
+	}
+	limiter := NewRateLimiter(60, 3)
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("1.1.1.1") {
+			t.Fatal("limited", i)
+		}
+	}
+	if limiter.Allow("1.1.1.1") {
+		t.Fatal("not limited")
+	}
+	// Each host has its own bucket
+	if !limiter.Allow("2.2.2.2") {
+		t.Fatal("limited")
+	}
+	// A token is added every second
+	limiter.buckets["1.1.1.1"].lastFill = time.Now().Add(-1100 * time.Millisecond)
+	if !limiter.Allow("1.1.1.1") {
+		t.Fatal("limited")
+	}
+	if limiter.Allow("1.1.1.1") {
+		t.Fatal("not limited")
+	}
+	// Buckets never hold more than burst
+	limiter.buckets["1.1.1.1"].lastFill = time.Now().Add(-time.Hour)
+	limiter.forgetIdle(time.Now())
+	if _, found := limiter.buckets["1.1.1.1"]; found {
+		t.Fatal("did not forget full bucket")
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	lockout := NewAuthLockout(3, time.Minute, 5*time.Minute)
+	for i := 1; i < 3; i++ {
+		if lockedFor, failures := lockout.Fail("1.1.1.1"); lockedFor != 0 || failures != i {
+			t.Fatal(lockedFor, failures)
+		}
+	}
+	if lockout.LockedFor("1.1.1.1") != 0 {
+		t.Fatal("locked out too early")
+	}
+	// Lockout doubles on each further failure up to the maximum
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if lockedFor, _ := lockout.Fail("1.1.1.1"); lockedFor != expected {
+			t.Fatal(lockedFor, expected)
+		}
+	}
+	if remaining := lockout.LockedFor("1.1.1.1"); remaining < 4*time.Minute || remaining > 5*time.Minute {
+		t.Fatal(remaining)
+	}
+	if lockout.LockedFor("2.2.2.2") != 0 {
+		t.Fatal("wrong host is locked out")
+	}
+	lockout.Succeed("1.1.1.1")
+	if lockout.LockedFor("1.1.1.1") != 0 {
+		t.Fatal("still locked out")
+	}
+	// Threshold 0 disables lockout
+	disabled := NewAuthLockout(0, time.Minute, time.Minute)
+	for i := 0; i < 100; i++ {
+		if lockedFor, _ := disabled.Fail("1.1.1.1"); lockedFor != 0 {
+			t.Fatal(lockedFor)
+		}
+	}
+}
+
+func TestRPCRateLimitAndLockout(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	// Lock out after two incorrect passwords
+	srv.AuthLockout = NewAuthLockout(2, time.Hour, time.Hour)
+	if err := client.Ping(PingRequest{PlainPassword: "wrong password"}); err == nil || !strings.Contains(err.Error(), ErrIncorrectPassword.Error()) {
+		t.Fatal(err)
+	}
+	if err := client.Ping(PingRequest{PlainPassword: "wrong password"}); err == nil || !strings.Contains(err.Error(), ErrIncorrectPassword.Error()) {
+		t.Fatal(err)
+	}
+	// Even the correct password is refused
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil || !strings.Contains(err.Error(), ErrLockedOut.Error()) {
+		t.Fatal(err)
+	}
+	// Functions that do not need password are unaffected
+	if _, err := client.ReportAlive(ReportAliveReq{Hostname: "localhost"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.AuthLockout.Succeed("127.0.0.1")
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	// Limit the number of requests
+	srv.RateLimiter = NewRateLimiter(1, 2)
+	for i := 0; i < 2; i++ {
+		if _, err := client.ReportAlive(ReportAliveReq{Hostname: "localhost"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := client.ReportAlive(ReportAliveReq{Hostname: "localhost"}); err == nil || !strings.Contains(err.Error(), ErrRateLimited.Error()) {
+		t.Fatal(err)
+	}
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil || !strings.Contains(err.Error(), ErrRateLimited.Error()) {
+		t.Fatal(err)
+	}
+	// Let tear down routine reach the server
+	srv.RateLimiter = NewRateLimiter(0, 0)
+}
@@ -0,0 +1,238 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sync"
+)
+
+/*
+CertStore holds the TLS certificate presented by a server. The certificate can be reloaded from its files at any time,
+connections established afterwards will be presented with the new certificate.
+*/
+type CertStore struct {
+	CertPath, KeyPath string
+	cert              *tls.Certificate
+	lock              *sync.RWMutex
+}
+
+// NewCertStore loads certificate and key from PEM files.
+func NewCertStore(certPath, keyPath string) (*CertStore, error) {
+	store := &CertStore{lock: new(sync.RWMutex)}
+	if _, err := store.Reload(certPath, keyPath); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+/*
+Reload reads certificate and key from PEM files, return true if the certificate is different from the previous one.
+If the files cannot be loaded, the previous certificate stays in use.
+*/
+func (store *CertStore) Reload(certPath, keyPath string) (changed bool, err error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return false, fmt.Errorf("CertStore.Reload: failed to load certificate \"%s\" and key \"%s\" - %v", certPath, keyPath, err)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	changed = store.cert == nil || !reflect.DeepEqual(store.cert.Certificate, cert.Certificate)
+	if changed {
+		store.cert = &cert
+	}
+	store.CertPath = certPath
+	store.KeyPath = keyPath
+	return
+}
+
+// GetCertificate returns the current certificate, it is used by TLS configuration.
+func (store *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return store.cert, nil
+}
+
+// loadClientCAs reads a PEM file that contains one or more CA certificates.
+func loadClientCAs(caPath string) (*x509.CertPool, []byte, error) {
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPEM) {
+		return nil, nil, fmt.Errorf("loadClientCAs: failed to load CA certificates from \"%s\"", caPath)
+	}
+	return caPool, caPEM, nil
+}
+
+// getConfigForClient hands a snapshot of TLS configuration to each new connection, so that reload does not disturb handshakes.
+func (srv *CryptServer) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	srv.reloadLock.RLock()
+	defer srv.reloadLock.RUnlock()
+	conf := srv.TLSConfig.Clone()
+	conf.GetConfigForClient = nil
+	return conf, nil
+}
+
+/*
+currentConfig returns a snapshot of server settings, so that the settings changed by a reload are read consistently
+with each other.
+*/
+func (srv *CryptServer) currentConfig() CryptServiceConfig {
+	srv.reloadLock.RLock()
+	defer srv.reloadLock.RUnlock()
+	return srv.Config
+}
+
+// currentKMIPClient returns the KMIP client that is currently configured, a reload may replace it.
+func (srv *CryptServer) currentKMIPClient() *KMIPClient {
+	srv.reloadLock.RLock()
+	defer srv.reloadLock.RUnlock()
+	return srv.KMIPClient
+}
+
+/*
+Reload applies those settings that can safely change while the server is running: TLS certificate, client CA, mail
+notification settings, webhooks, and external KMIP server connectivity. Other settings require a restart to take effect.
+Return descriptions of the settings that have changed.
+*/
+func (srv *CryptServer) Reload(config CryptServiceConfig, mailer Mailer) (changes []string, err error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	srv.reloadLock.Lock()
+	defer srv.reloadLock.Unlock()
+	changes = make([]string, 0, 8)
+	// TLS certificate
+	if changed, err := srv.CertStore.Reload(config.CertPEM, config.KeyPEM); err != nil {
+		return changes, err
+	} else if changed {
+		changes = append(changes, fmt.Sprintf("TLS certificate is now \"%s\"", config.CertPEM))
+	}
+	srv.Config.CertPEM = config.CertPEM
+	srv.Config.KeyPEM = config.KeyPEM
+	// Client CA
+	if config.ValidateClientCert != srv.Config.ValidateClientCert || config.AllowCertEnrolment != srv.Config.AllowCertEnrolment {
+		srv.Log.Warning("CryptServer.Reload: client certificate validation and enrolment cannot be turned on or off without a restart")
+	} else if config.ValidateClientCert {
+		caPool, caPEM, err := loadClientCAs(config.CertAuthorityPEM)
+		if err != nil {
+			return changes, err
+		}
+		if config.CertAuthorityPEM != srv.Config.CertAuthorityPEM || !bytes.Equal(caPEM, srv.clientCAPEM) {
+			srv.TLSConfig.ClientCAs = caPool
+			srv.clientCAPEM = caPEM
+			changes = append(changes, fmt.Sprintf("client CA is now \"%s\"", config.CertAuthorityPEM))
+		}
+	}
+	if config.CertAuthorityPEM != srv.Config.CertAuthorityPEM || config.CertAuthorityKeyPEM != srv.Config.CertAuthorityKeyPEM {
+		srv.Config.CertAuthorityPEM = config.CertAuthorityPEM
+		srv.Config.CertAuthorityKeyPEM = config.CertAuthorityKeyPEM
+		changes = append(changes, "built-in certificate authority location")
+	}
+	// Mail notifications
+	if !reflect.DeepEqual(mailer, *srv.Mailer) {
+		srv.Mailer = &mailer
+		changes = append(changes, fmt.Sprintf("mail notifications are sent from %s to %v via %s",
+			mailer.FromAddress, mailer.Recipients, mailer.AgentAddressPort))
+	}
+	if !reflect.DeepEqual(config.Webhooks, srv.Config.Webhooks) {
+		srv.Config.Webhooks = config.Webhooks
+		changes = append(changes, fmt.Sprintf("%d webhook(s) receive notifications", len(config.Webhooks)))
+	}
+	if !reflect.DeepEqual(config.HostGroups, srv.Config.HostGroups) {
+		srv.Config.HostGroups = config.HostGroups
+		changes = append(changes, fmt.Sprintf("%d host group(s) may receive commands", len(config.HostGroups)))
+	}
+	if config.KeyCreationSubject != srv.Config.KeyCreationSubject || config.KeyCreationGreeting != srv.Config.KeyCreationGreeting ||
+		config.KeyRetrievalSubject != srv.Config.KeyRetrievalSubject || config.KeyRetrievalGreeting != srv.Config.KeyRetrievalGreeting {
+		srv.Config.KeyCreationSubject = config.KeyCreationSubject
+		srv.Config.KeyCreationGreeting = config.KeyCreationGreeting
+		srv.Config.KeyRetrievalSubject = config.KeyRetrievalSubject
+		srv.Config.KeyRetrievalGreeting = config.KeyRetrievalGreeting
+		changes = append(changes, "mail subject and greeting text")
+	}
+	// External KMIP server
+	if (len(config.KMIPAddresses) == 0) != (len(srv.Config.KMIPAddresses) == 0) {
+		srv.Log.Warning("CryptServer.Reload: switching between built-in and external KMIP server requires a restart")
+	} else if len(config.KMIPAddresses) > 0 && !kmipSettingsEqual(config, srv.Config) {
+		kmipClient, err := newExternalKMIPClient(config)
+		if err != nil {
+			return changes, err
+		}
+		kmipClient.Metrics = srv.Metrics
+		srv.KMIPClient = kmipClient
+		srv.Config.KMIPAddresses = config.KMIPAddresses
+		srv.Config.KMIPUser = config.KMIPUser
+		srv.Config.KMIPPass = config.KMIPPass
+		srv.Config.KMIPCertAuthorityPEM = config.KMIPCertAuthorityPEM
+		srv.Config.KMIPTLSDoVerify = config.KMIPTLSDoVerify
+		srv.Config.KMIPCertPEM = config.KMIPCertPEM
+		srv.Config.KMIPKeyPEM = config.KMIPKeyPEM
+		changes = append(changes, fmt.Sprintf("KMIP servers are now %v", config.KMIPAddresses))
+	}
+	// Report settings that will not take effect
+	if config.Address != srv.Config.Address || config.Port != srv.Config.Port {
+		srv.Log.Warning("CryptServer.Reload: listen address and port cannot be changed without a restart")
+	}
+	if config.AuditSyslogAddress != srv.Config.AuditSyslogAddress || config.AuditSyslogCAPEM != srv.Config.AuditSyslogCAPEM ||
+		config.AuditSyslogCertPEM != srv.Config.AuditSyslogCertPEM || config.AuditSyslogKeyPEM != srv.Config.AuditSyslogKeyPEM {
+		srv.Log.Warning("CryptServer.Reload: audit syslog settings cannot be changed without a restart")
+	}
+	if config.LivenessScanSec != srv.Config.LivenessScanSec {
+		srv.Log.Warning("CryptServer.Reload: liveness scan interval cannot be changed without a restart")
+	}
+	if !reflect.DeepEqual(config.ApprovalOperations, srv.Config.ApprovalOperations) ||
+		config.ApprovalTimeoutSec != srv.Config.ApprovalTimeoutSec {
+		srv.Log.Warning("CryptServer.Reload: approval settings cannot be changed without a restart")
+	}
+	if config.ApproveNewHosts != srv.Config.ApproveNewHosts {
+		srv.Log.Warning("CryptServer.Reload: approval of new hosts cannot be turned on or off without a restart")
+	}
+	if config.KeyDBDir != srv.Config.KeyDBDir {
+		srv.Log.Warning("CryptServer.Reload: key database directory cannot be changed without a restart")
+	}
+	if config.PasswordHash != srv.Config.PasswordHash || config.PasswordSalt != srv.Config.PasswordSalt ||
+		config.AllowHashAuth != srv.Config.AllowHashAuth {
+		srv.Log.Warning("CryptServer.Reload: access password and authentication settings cannot be changed without a restart")
+	}
+	return changes, nil
+}
+
+// kmipSettingsEqual returns true only if both configurations use the same KMIP server connectivity settings.
+func kmipSettingsEqual(a, b CryptServiceConfig) bool {
+	return reflect.DeepEqual(a.KMIPAddresses, b.KMIPAddresses) && a.KMIPUser == b.KMIPUser && a.KMIPPass == b.KMIPPass &&
+		a.KMIPCertAuthorityPEM == b.KMIPCertAuthorityPEM && a.KMIPTLSDoVerify == b.KMIPTLSDoVerify &&
+		a.KMIPCertPEM == b.KMIPCertPEM && a.KMIPKeyPEM == b.KMIPKeyPEM
+}
+
+// newExternalKMIPClient initialises a KMIP client that talks to external KMIP servers.
+func newExternalKMIPClient(config CryptServiceConfig) (*KMIPClient, error) {
+	if len(config.KMIPAddresses) == 0 {
+		return nil, errors.New("newExternalKMIPClient: KMIP server addresses are empty")
+	}
+	var caCert []byte
+	if config.KMIPCertAuthorityPEM != "" {
+		var err error
+		if caCert, err = ioutil.ReadFile(config.KMIPCertAuthorityPEM); err != nil {
+			return nil, err
+		}
+	}
+	client, err := NewKMIPClient(config.KMIPAddresses, config.KMIPUser, config.KMIPPass,
+		caCert, config.KMIPCertPEM, config.KMIPKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !config.KMIPTLSDoVerify {
+		client.Log.Warning("newExternalKMIPClient: KMIP client will not verify KMIP server's identity, as instructed by configuration")
+		client.TLSConfig.InsecureSkipVerify = true
+	}
+	return client, nil
+}
@@ -0,0 +1,169 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCertStore(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-reloadtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ca, err := NewCertAuthority("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := ca.IssueServerCert(name+".example.com", nil, path.Join(tmpDir, name+".crt"), path.Join(tmpDir, name+".key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewCertStore(path.Join(tmpDir, "c.crt"), path.Join(tmpDir, "c.key")); err == nil {
+		t.Fatal("did not error")
+	}
+	store, err := NewCertStore(path.Join(tmpDir, "a.crt"), path.Join(tmpDir, "a.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certA, _ := store.GetCertificate(nil)
+	if changed, err := store.Reload(path.Join(tmpDir, "a.crt"), path.Join(tmpDir, "a.key")); err != nil || changed {
+		t.Fatal(changed, err)
+	}
+	// Failed reload keeps the previous certificate
+	if _, err := store.Reload(path.Join(tmpDir, "a.crt"), path.Join(tmpDir, "b.key")); err == nil {
+		t.Fatal("did not error")
+	}
+	if cert, _ := store.GetCertificate(nil); cert != certA {
+		t.Fatal("certificate has changed")
+	}
+	if changed, err := store.Reload(path.Join(tmpDir, "b.crt"), path.Join(tmpDir, "b.key")); err != nil || !changed {
+		t.Fatal(changed, err)
+	}
+	if cert, _ := store.GetCertificate(nil); cert == certA || store.CertPath != path.Join(tmpDir, "b.crt") {
+		t.Fatal("certificate did not change")
+	}
+}
+
+func TestCryptServerReload(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	tmpDir, err := ioutil.TempDir("", "cryptctl-reloadtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ca, err := NewCertAuthority("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing changes if the configuration stays the same
+	if changes, err := srv.Reload(srv.Config, *srv.Mailer); err != nil || len(changes) != 0 {
+		t.Fatal(changes, err)
+	}
+	// Renew certificate and change mail settings
+	newConf := srv.Config
+	newConf.CertPEM = path.Join(tmpDir, "srv.crt")
+	newConf.KeyPEM = path.Join(tmpDir, "srv.key")
+	newConf.KeyCreationSubject = "new subject"
+	newConf.Port = 1234
+	if err := ca.IssueServerCert("reloaded.example.com", []string{"localhost"}, newConf.CertPEM, newConf.KeyPEM); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := srv.Reload(newConf, Mailer{Recipients: []string{"root@localhost"}, FromAddress: "root@localhost", AgentAddressPort: "localhost:25"})
+	if err != nil || len(changes) != 3 {
+		t.Fatal(changes, err)
+	}
+	if srv.Config.KeyCreationSubject != "new subject" || srv.Mailer.AgentAddressPort != "localhost:25" || srv.Config.Port != SRV_DEFAULT_PORT {
+		t.Fatalf("%+v %+v", srv.Config, srv.Mailer)
+	}
+	// New connections are presented with the new certificate
+	conn, err := tls.Dial("tcp", "localhost:3737", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "reloaded.example.com" {
+		t.Fatal(cn)
+	}
+	conn.Close()
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	// Bad certificate is not applied
+	newConf.KeyPEM = path.Join(tmpDir, "does-not-exist")
+	if _, err := srv.Reload(newConf, *srv.Mailer); err == nil || !strings.Contains(err.Error(), "does-not-exist") {
+		t.Fatal(err)
+	}
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Run with -race to make sure that reloaded settings are not read while they are being changed.
+func TestCryptServerReloadDuringRPC(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	tmpDir, err := ioutil.TempDir("", "cryptctl-reloadtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// Alternate between two sets of mail texts and built-in CAs
+	confs := []CryptServiceConfig{srv.Config, srv.Config}
+	for i := range confs {
+		ca, err := NewCertAuthority(fmt.Sprintf("test CA %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		confs[i].CertAuthorityPEM = path.Join(tmpDir, fmt.Sprintf("ca%d.crt", i))
+		confs[i].CertAuthorityKeyPEM = path.Join(tmpDir, fmt.Sprintf("ca%d.key", i))
+		if err := ca.Save(confs[i].CertAuthorityPEM, confs[i].CertAuthorityKeyPEM); err != nil {
+			t.Fatal(err)
+		}
+		confs[i].KeyCreationSubject = fmt.Sprintf("creation %d", i)
+		confs[i].KeyRetrievalSubject = fmt.Sprintf("retrieval %d", i)
+	}
+	done := make(chan struct{})
+	reloads := new(sync.WaitGroup)
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := srv.Reload(confs[i%2], *srv.Mailer); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		uuid := fmt.Sprintf("reload-%d", i)
+		if _, err := client.CreateKey(CreateKeyReq{PlainPassword: TEST_RPC_PASS, Hostname: "localhost", UUID: uuid, MountPoint: "/a",
+			MaxActive: 1, AliveIntervalSec: 1, AliveCount: 4}); err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := client.ManualRetrieveKey(ManualRetrieveKeyReq{PlainPassword: TEST_RPC_PASS, UUIDs: []string{uuid}, Hostname: "localhost"}); err != nil ||
+			len(resp.Granted) != 1 {
+			t.Fatal(resp, err)
+		}
+		// The CA is loaded before the request turns out to be missing
+		if err := client.ApproveCertRequest(ApproveCertRequestReq{PlainPassword: TEST_RPC_PASS, ID: "does-not-exist"}); err == nil {
+			t.Fatal("did not error")
+		}
+	}
+	close(done)
+	reloads.Wait()
+}
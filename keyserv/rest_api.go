@@ -0,0 +1,183 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"cryptctl/keydb"
+	"cryptctl/sys"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	RESTURLPrefix       = "/v1/"  // RESTURLPrefix is followed by the function name in URL path of REST API requests.
+	RESTMaxRequestBytes = 1048576 // RESTMaxRequestBytes is the maximum size of a REST API request body.
+)
+
+/*
+RESTFunctions are the RPC functions that are also available via REST API. A REST client calls a function by sending
+POST request to path RESTURLPrefix + function name, e.g. "/v1/Ping", with the function's request structure encoded in
+JSON. The response structure is encoded in JSON as well.
+*/
+var RESTFunctions = []string{
+	"Hello", "Ping", "CreateKey", "AutoRetrieveKey", "ManualRetrieveKey", "ReportAlive", "EraseKey", "PollCommand",
+	"SaveCommandResult", "ListRecords", "GetRecord", "UpdateRecord", "SendCommand", "ListCertRequests", "ListRevocations",
+	"RequestApproval", "GetApproval", "ListApprovals", "ApproveHost", "ReleaseKey", "WaitCommand",
+	"RetrieveCommandKey", "SendCommandBatch", "GetCommandBatch", "ListCommands",
+}
+
+// isRESTFunction returns true only if the RPC function is available via REST API.
+func isRESTFunction(funcName string) bool {
+	for _, name := range RESTFunctions {
+		if name == funcName {
+			return true
+		}
+	}
+	return false
+}
+
+// RESTError is the JSON response body of a failed REST API request.
+type RESTError struct {
+	Error string
+}
+
+// RESTStatusCode returns the HTTP status code that corresponds to an error returned by RPC function.
+func RESTStatusCode(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrIncorrectPassword), errors.Is(err, ErrNoAuthMethod):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrLockedOut), errors.Is(err, ErrRateLimited):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrApprovalRequired), errors.Is(err, ErrSameAdmin):
+		return http.StatusForbidden
+	case errors.Is(err, keydb.ErrRecordNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ListenREST starts a TLS listener for REST API if REST API port is configured. The listener uses the RPC server's TLS settings.
+func (srv *CryptServer) ListenREST() (err error) {
+	if srv.Config.RESTPort == 0 {
+		return nil
+	}
+	addr := fmt.Sprintf("%s:%d", srv.Config.Address, srv.Config.RESTPort)
+	if srv.RESTListener, err = tls.Listen("tcp", addr, srv.TLSConfig); err != nil {
+		return fmt.Errorf("CryptServer.ListenREST: failed to listen on %s - %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(RESTURLPrefix, srv.ServeREST)
+	srv.restServer = &http.Server{Handler: mux, ReadTimeout: RPC_DIAL_TIMEOUT_SEC * time.Second}
+	srv.Log.Info("CryptServer.ListenREST: serving REST API", "url", "https://"+addr+RESTURLPrefix)
+	return nil
+}
+
+/*
+HandleRESTConnections serves REST API requests in a continuous loop.
+Blocks caller until the listener closes.
+*/
+func (srv *CryptServer) HandleRESTConnections() {
+	err := srv.restServer.Serve(srv.RESTListener)
+	srv.Log.Info("CryptServer.HandleRESTConnections: quit now", "error", err)
+}
+
+// writeRESTResponse responds to REST API client with a JSON document.
+func writeRESTResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		sys.NewLogger().Warning("writeRESTResponse: failed to write response", "error", err)
+	}
+}
+
+/*
+ServeREST calls an RPC function on behalf of a REST API client. The client is subject to the same authentication, rate
+limit, and revocation checks as RPC clients.
+*/
+func (srv *CryptServer) ServeREST(w http.ResponseWriter, r *http.Request) {
+	funcName := strings.TrimPrefix(r.URL.Path, RESTURLPrefix)
+	start := time.Now()
+	r.Body = http.MaxBytesReader(w, r.Body, RESTMaxRequestBytes)
+	status, resp, err := srv.callREST(funcName, r)
+	if err != nil {
+		resp = RESTError{Error: err.Error()}
+		if status == http.StatusOK {
+			status = RESTStatusCode(err)
+		}
+	}
+	writeRESTResponse(w, status, resp)
+	// Do not let clients create arbitrary metrics labels
+	metricsName := "REST." + funcName
+	if !isRESTFunction(funcName) {
+		metricsName = MetricsUnknownMethod
+	}
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+	}
+	srv.Metrics.ObserveRPC(metricsName, time.Since(start), errMsg)
+}
+
+// callREST checks the request and calls the RPC function. Return the HTTP status code if the request was refused, otherwise return http.StatusOK.
+func (srv *CryptServer) callREST(funcName string, r *http.Request) (status int, resp interface{}, err error) {
+	if !srv.conns.BeginRequest() {
+		return http.StatusServiceUnavailable, nil, errors.New("the server is shutting down")
+	}
+	defer srv.conns.EndRequest()
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return http.StatusBadRequest, nil, fmt.Errorf("malformed client address - %v", err)
+	}
+	if remoteHost == "::1" {
+		remoteHost = "127.0.0.1"
+	}
+	if denied := srv.Revocations.IsHostDenied(remoteHost); denied != nil {
+		srv.Log.Warning("CryptServer.ServeREST: refuse request from denied host", "client_ip", remoteHost, "reason", denied.Reason)
+		return http.StatusForbidden, nil, errors.New("the host has been denied access")
+	}
+	if srv.Config.ValidateClientCert && (r.TLS == nil || len(r.TLS.PeerCertificates) == 0) {
+		return http.StatusForbidden, nil, errors.New("the server requires a client certificate")
+	}
+	if !srv.RateLimiter.Allow(remoteHost) {
+		srv.Log.Warning("CryptServer.ServeREST: client has exceeded rate limit", "client_ip", remoteHost, "method", funcName)
+		return http.StatusTooManyRequests, nil, ErrRateLimited
+	}
+	rpcConn := srv.newServiceConn(remoteHost)
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		rpcConn.PeerCommonName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	method, found := reflect.TypeOf(rpcConn).MethodByName(funcName)
+	if !found || !isRESTFunction(funcName) {
+		return http.StatusNotFound, nil, fmt.Errorf("function \"%s\" does not exist", funcName)
+	}
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, nil, errors.New("the request must use POST method")
+	}
+	// Call the function in the same way as net/rpc: func (rcvr) Name(req ReqType, resp *RespType) error
+	req := reflect.New(method.Type.In(1))
+	if err := json.NewDecoder(r.Body).Decode(req.Interface()); err != nil {
+		return http.StatusBadRequest, nil, fmt.Errorf("%w - failed to decode JSON - %v", ErrInvalidRequest, err)
+	}
+	respValue := reflect.New(method.Type.In(2).Elem())
+	ret := method.Func.Call([]reflect.Value{reflect.ValueOf(rpcConn), req.Elem(), respValue})
+	if errInter := ret[0].Interface(); errInter != nil {
+		return http.StatusOK, nil, errInter.(error)
+	}
+	if _, isDummy := respValue.Interface().(*DummyAttr); isDummy {
+		// The function does not have a meaningful response
+		return http.StatusOK, struct{}{}, nil
+	}
+	return http.StatusOK, respValue.Interface(), nil
+}
@@ -0,0 +1,103 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"cryptctl/keydb"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestRESTStatusCode(t *testing.T) {
+	for err, status := range map[error]int{
+		nil: http.StatusOK,
+		fmt.Errorf("a: %w", ErrIncorrectPassword): http.StatusUnauthorized,
+		ErrNoAuthMethod:                   http.StatusUnauthorized,
+		fmt.Errorf("b: %w", ErrLockedOut): http.StatusTooManyRequests,
+		ErrRateLimited:                    http.StatusTooManyRequests,
+		ErrInvalidRequest:                 http.StatusBadRequest,
+		errors.New("KMIP is down"):        http.StatusInternalServerError,
+	} {
+		if actual := RESTStatusCode(err); actual != status {
+			t.Fatal(err, actual, status)
+		}
+	}
+}
+
+func TestRESTAPI(t *testing.T) {
+	_, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	srv.Config.RESTPort = 3738
+	if err := srv.ListenREST(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.RESTListener.Close()
+	go srv.HandleRESTConnections()
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	call := func(method, funcName, body string) (int, []byte) {
+		req, err := http.NewRequest(method, "https://localhost:3738"+RESTURLPrefix+funcName, bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		respBody, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, respBody
+	}
+	if status, body := call("POST", "Ping", `{"PlainPassword": "`+TEST_RPC_PASS+`"}`); status != http.StatusOK || string(body) != "{}\n" {
+		t.Fatal(status, string(body))
+	}
+	if status, body := call("POST", "Ping", `{"PlainPassword": "wrong"}`); status != http.StatusUnauthorized {
+		t.Fatal(status, string(body))
+	}
+	if status, body := call("POST", "Ping", `not json`); status != http.StatusBadRequest {
+		t.Fatal(status, string(body))
+	}
+	if status, body := call("GET", "Ping", ""); status != http.StatusMethodNotAllowed {
+		t.Fatal(status, string(body))
+	}
+	// Functions that are not exposed are not found
+	if status, body := call("POST", "Shutdown", "{}"); status != http.StatusNotFound {
+		t.Fatal(status, string(body))
+	}
+	if status, body := call("POST", "CreateKey", `{"PlainPassword": "`+TEST_RPC_PASS+`", "UUID": "aaa"}`); status != http.StatusBadRequest {
+		t.Fatal(status, string(body))
+	}
+	// Create a key, retrieve it, and list it
+	status, body := call("POST", "CreateKey", `{"PlainPassword": "`+TEST_RPC_PASS+`", "Hostname": "localhost", "UUID": "aaa", "MountPoint": "/a", "MaxActive": 1, "AliveIntervalSec": 1, "AliveCount": 4}`)
+	if status != http.StatusOK {
+		t.Fatal(status, string(body))
+	}
+	var createResp CreateKeyResp
+	if err := json.Unmarshal(body, &createResp); err != nil || len(createResp.KeyContent) == 0 {
+		t.Fatal(err, string(body))
+	}
+	status, body = call("POST", "AutoRetrieveKey", `{"Hostname": "localhost", "UUIDs": ["aaa", "bbb"]}`)
+	var retrieveResp AutoRetrieveKeyResp
+	if err := json.Unmarshal(body, &retrieveResp); err != nil || status != http.StatusOK {
+		t.Fatal(err, status, string(body))
+	}
+	if !bytes.Equal(retrieveResp.Granted["aaa"].Key, createResp.KeyContent) || len(retrieveResp.Missing) != 1 {
+		t.Fatalf("%+v", retrieveResp)
+	}
+	status, body = call("POST", "ListRecords", `{"PlainPassword": "`+TEST_RPC_PASS+`"}`)
+	var records []keydb.Record
+	if err := json.Unmarshal(body, &records); err != nil || status != http.StatusOK {
+		t.Fatal(err, status, string(body))
+	}
+	if len(records) != 1 || records[0].UUID != "aaa" || records[0].MountPoint != "/a" || len(records[0].Key) != 0 {
+		t.Fatalf("%+v", records)
+	}
+}
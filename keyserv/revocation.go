@@ -0,0 +1,203 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RevokeSerial          = "serial"      // RevokeSerial revokes a client certificate by its serial number.
+	RevokeFingerprint     = "fingerprint" // RevokeFingerprint revokes a client certificate by its SHA-256 fingerprint.
+	RevokeHost            = "host"        // RevokeHost denies all connections from an IP, and certificates that carry the host name.
+	RevocationFileSuffix  = "-revocation" // RevocationFileSuffix is appended to key database directory to make file name of the revocation list.
+	revocationTempPostfix = ".tmp"
+)
+
+// CertSerial returns the serial number of a certificate in lower case hex string, as it is stored in revocation list.
+func CertSerial(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of a certificate in lower case hex string.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Revocation is an entry of revocation list.
+type Revocation struct {
+	Kind      string    // Kind is one of RevokeSerial, RevokeFingerprint, or RevokeHost.
+	Value     string    // Value is the serial number, fingerprint, or host IP/name, in normalised form.
+	Reason    string    // Reason is a human readable text recorded by administrator.
+	RevokedAt time.Time // RevokedAt is the moment the entry was made.
+}
+
+// NormaliseRevocationValue turns user input into the form stored in revocation list.
+func NormaliseRevocationValue(kind, value string) (string, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch kind {
+	case RevokeSerial, RevokeFingerprint:
+		// Tolerate colon-separated notation printed by openssl and others
+		value = strings.Replace(value, ":", "", -1)
+		if value == "" || strings.Trim(value, "0123456789abcdef") != "" {
+			return "", fmt.Errorf("NormaliseRevocationValue: \"%s\" is not a hex string", value)
+		}
+		if kind == RevokeSerial {
+			// Serial numbers are compared as integers
+			if value = strings.TrimLeft(value, "0"); value == "" {
+				value = "0"
+			}
+		} else if len(value) != sha256.Size*2 {
+			return "", fmt.Errorf("NormaliseRevocationValue: \"%s\" is not a SHA-256 fingerprint", value)
+		}
+	case RevokeHost:
+		if value == "" {
+			return "", fmt.Errorf("NormaliseRevocationValue: host must not be empty")
+		}
+	default:
+		return "", fmt.Errorf("NormaliseRevocationValue: unknown revocation kind \"%s\"", kind)
+	}
+	return value, nil
+}
+
+/*
+RevocationList is a list of revoked client certificates and denied hosts. The list is persisted in a single file.
+All exported functions are safe for concurrent usage.
+*/
+type RevocationList struct {
+	FilePath string
+	Entries  []Revocation
+	Lock     *sync.RWMutex
+}
+
+// OpenRevocationList reads revocation list from file. If the file does not yet exist, the list is empty.
+func OpenRevocationList(filePath string) (*RevocationList, error) {
+	list := &RevocationList{FilePath: filePath, Entries: []Revocation{}, Lock: new(sync.RWMutex)}
+	content, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return list, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("OpenRevocationList: failed to read \"%s\" - %v", filePath, err)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&list.Entries); err != nil {
+		return nil, fmt.Errorf("OpenRevocationList: failed to decode \"%s\" - %v", filePath, err)
+	}
+	return list, nil
+}
+
+// save writes all entries into the file. Caller must hold the lock.
+func (list *RevocationList) save() error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(list.Entries); err != nil {
+		return fmt.Errorf("RevocationList.save: failed to encode entries - %v", err)
+	}
+	// Write into a temporary file first so that a crash does not leave a damaged list behind
+	tmpPath := list.FilePath + revocationTempPostfix
+	if err := ioutil.WriteFile(tmpPath, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("RevocationList.save: failed to write \"%s\" - %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, list.FilePath); err != nil {
+		return fmt.Errorf("RevocationList.save: failed to rename \"%s\" - %v", tmpPath, err)
+	}
+	return nil
+}
+
+// find returns index of the entry, or -1 if not found. Caller must hold the lock.
+func (list *RevocationList) find(kind, value string) int {
+	for i, entry := range list.Entries {
+		if entry.Kind == kind && entry.Value == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// Revoke adds an entry into the list. Revoking an already revoked value only updates the reason.
+func (list *RevocationList) Revoke(kind, value, reason string) error {
+	value, err := NormaliseRevocationValue(kind, value)
+	if err != nil {
+		return err
+	}
+	list.Lock.Lock()
+	defer list.Lock.Unlock()
+	entry := Revocation{Kind: kind, Value: value, Reason: reason, RevokedAt: time.Now()}
+	if i := list.find(kind, value); i == -1 {
+		list.Entries = append(list.Entries, entry)
+	} else {
+		list.Entries[i] = entry
+	}
+	return list.save()
+}
+
+// Lift removes an entry from the list.
+func (list *RevocationList) Lift(kind, value string) error {
+	value, err := NormaliseRevocationValue(kind, value)
+	if err != nil {
+		return err
+	}
+	list.Lock.Lock()
+	defer list.Lock.Unlock()
+	i := list.find(kind, value)
+	if i == -1 {
+		return fmt.Errorf("RevocationList.Lift: %s \"%s\" is not revoked", kind, value)
+	}
+	list.Entries = append(list.Entries[:i], list.Entries[i+1:]...)
+	return list.save()
+}
+
+// List returns a copy of all entries in the order they were made.
+func (list *RevocationList) List() []Revocation {
+	list.Lock.RLock()
+	defer list.Lock.RUnlock()
+	ret := make([]Revocation, len(list.Entries))
+	copy(ret, list.Entries)
+	return ret
+}
+
+// IsHostDenied returns the revocation entry that denies the host IP or name, or nil if the host is not denied.
+func (list *RevocationList) IsHostDenied(host string) *Revocation {
+	host = strings.ToLower(host)
+	list.Lock.RLock()
+	defer list.Lock.RUnlock()
+	if i := list.find(RevokeHost, host); i != -1 {
+		entry := list.Entries[i]
+		return &entry
+	}
+	return nil
+}
+
+// CheckCert returns an error if the certificate is revoked, or it carries a denied host name.
+func (list *RevocationList) CheckCert(cert *x509.Certificate) error {
+	list.Lock.RLock()
+	defer list.Lock.RUnlock()
+	if i := list.find(RevokeSerial, CertSerial(cert)); i != -1 {
+		return fmt.Errorf("RevocationList.CheckCert: certificate serial %s of \"%s\" has been revoked - %s",
+			list.Entries[i].Value, cert.Subject.CommonName, list.Entries[i].Reason)
+	}
+	if i := list.find(RevokeFingerprint, CertFingerprint(cert)); i != -1 {
+		return fmt.Errorf("RevocationList.CheckCert: certificate fingerprint %s of \"%s\" has been revoked - %s",
+			list.Entries[i].Value, cert.Subject.CommonName, list.Entries[i].Reason)
+	}
+	for _, name := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+		if i := list.find(RevokeHost, strings.ToLower(name)); i != -1 {
+			return fmt.Errorf("RevocationList.CheckCert: certificate host \"%s\" has been denied - %s", name, list.Entries[i].Reason)
+		}
+	}
+	for _, ip := range cert.IPAddresses {
+		if i := list.find(RevokeHost, ip.String()); i != -1 {
+			return fmt.Errorf("RevocationList.CheckCert: certificate host \"%s\" has been denied - %s", ip.String(), list.Entries[i].Reason)
+		}
+	}
+	return nil
+}
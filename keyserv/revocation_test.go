@@ -0,0 +1,176 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRevocationList(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cryptctl-revoketest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	listPath := path.Join(tmpDir, "revocation")
+	list, err := OpenRevocationList(listPath)
+	if err != nil || len(list.List()) != 0 {
+		t.Fatal(err, list)
+	}
+	// Normalise input values
+	if _, err := NormaliseRevocationValue(RevokeSerial, "xyz"); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := NormaliseRevocationValue(RevokeFingerprint, "abcd"); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := NormaliseRevocationValue("junk", "abcd"); err == nil {
+		t.Fatal("did not error")
+	}
+	if val, err := NormaliseRevocationValue(RevokeSerial, " 00:0A:bc "); err != nil || val != "abc" {
+		t.Fatal(val, err)
+	}
+	// Issue a certificate and revoke it in several ways
+	ca, err := NewCertAuthority("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := path.Join(tmpDir, "cli.crt")
+	if err := ca.IssueClientCert("client.example.com", certPath, path.Join(tmpDir, "cli.key")); err != nil {
+		t.Fatal(err)
+	}
+	cert := readTestLeafCert(t, certPath)
+	if err := list.CheckCert(cert); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []Revocation{
+		{Kind: RevokeSerial, Value: CertSerial(cert)},
+		{Kind: RevokeFingerprint, Value: CertFingerprint(cert)},
+		{Kind: RevokeHost, Value: "Client.Example.com"},
+	} {
+		if err := list.Revoke(entry.Kind, entry.Value, "test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := list.CheckCert(cert); err == nil {
+			t.Fatal("did not error", entry)
+		}
+		if err := list.Lift(entry.Kind, entry.Value); err != nil {
+			t.Fatal(err)
+		}
+		if err := list.CheckCert(cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := list.Lift(RevokeHost, "client.example.com"); err == nil {
+		t.Fatal("did not error")
+	}
+	// Deny a host and reopen the list
+	if err := list.Revoke(RevokeHost, "10.0.0.1", "decommissioned"); err != nil {
+		t.Fatal(err)
+	}
+	if err := list.Revoke(RevokeHost, "10.0.0.1", "compromised"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err = OpenRevocationList(listPath); err != nil {
+		t.Fatal(err)
+	}
+	if entries := list.List(); len(entries) != 1 || entries[0].Reason != "compromised" {
+		t.Fatal(entries)
+	}
+	if denied := list.IsHostDenied("10.0.0.1"); denied == nil || denied.Reason != "compromised" {
+		t.Fatal(denied)
+	}
+	if denied := list.IsHostDenied("10.0.0.2"); denied != nil {
+		t.Fatal(denied)
+	}
+}
+
+func readTestLeafCert(t *testing.T, certPath string) *x509.Certificate {
+	pair, err := tls.LoadX509KeyPair(certPath, certPath[:len(certPath)-len(".crt")]+".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestRevokeClientRPC(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	tmpDir, err := ioutil.TempDir("", "cryptctl-revoketest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// Let server accept client certificates issued by a test CA
+	ca, err := NewCertAuthority("test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	srv.TLSConfig.ClientCAs = roots
+	srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	defer func() {
+		srv.TLSConfig.ClientAuth = tls.NoClientCert
+	}()
+	certPath := path.Join(tmpDir, "cli.crt")
+	keyPath := path.Join(tmpDir, "cli.key")
+	if err := ca.IssueClientCert("localhost", certPath, keyPath); err != nil {
+		t.Fatal(err)
+	}
+	cert := readTestLeafCert(t, certPath)
+	certClient, err := NewCryptClient("tcp", "localhost:3737", nil, certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certClient.tlsConfig.InsecureSkipVerify = true
+	if err := certClient.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	// Revoke the certificate
+	revokeReq := RevokeClientReq{PlainPassword: "wrong password", Kind: RevokeSerial, Value: CertSerial(cert), Reason: "test"}
+	if err := client.RevokeClient(revokeReq); err == nil {
+		t.Fatal("did not error")
+	}
+	revokeReq.PlainPassword = TEST_RPC_PASS
+	if err := client.RevokeClient(revokeReq); err != nil {
+		t.Fatal(err)
+	}
+	if revocations, err := client.ListRevocations(ListRevocationsReq{PlainPassword: TEST_RPC_PASS}); err != nil || len(revocations) != 1 {
+		t.Fatal(err, revocations)
+	}
+	if err := certClient.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Clients without certificate are unaffected
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	revokeReq.Lift = true
+	if err := client.RevokeClient(revokeReq); err != nil {
+		t.Fatal(err)
+	}
+	if err := certClient.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	// Deny the host
+	if err := client.RevokeClient(RevokeClientReq{PlainPassword: TEST_RPC_PASS, Kind: RevokeHost, Value: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("did not error")
+	}
+	// Lift it directly so that tear down routine can reach the server
+	if err := srv.Revocations.Lift(RevokeHost, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,6 +3,7 @@
 package keyserv
 
 import (
+	"cryptctl/keydb"
 	"cryptctl/sys"
 	"crypto/tls"
 	"crypto/x509"
@@ -14,27 +15,40 @@ import (
 	"net/rpc"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 const (
 	RPC_DIAL_TIMEOUT_SEC = 10
+	RPC_KEEPALIVE_SEC    = 30 // RPC_KEEPALIVE_SEC is the TCP keep-alive interval of persistent client connections.
 	CLIENT_CONF_HOST     = "KEY_SERVER_HOST"
 	CLIENT_CONF_PORT     = "KEY_SERVER_PORT"
 	CLIENT_CONF_CA       = "TLS_CA_PEM"
 	CLIENT_CONF_CERT     = "TLS_CERT_PEM"
 	CLIENT_CONF_CERT_KEY = "TLS_CERT_KEY_PEM"
+	CLIENT_CONF_FALLBACK = "KEY_SERVER_FALLBACK_HOSTS"
+	CLIENT_CONF_SRV      = "KEY_SERVER_SRV_DOMAIN"
 	TEST_RPC_PASS        = "pass"
 )
 
 // CryptClient implements an RPC client for CryptServer.
 type CryptClient struct {
-	Address   string // Address is the server address string, IP:port for TCP and file name for domain socket.
-	Type      string // Type is either "tcp" or "unix" depends on the connection address.
-	TLSCert   string // TLSCert is path to TLS certificate that is presented by client to server.
-	TLSKey    string // TLSKey is path to TLS key corresponding to the certificate.
-	tlsConfig *tls.Config
+	Address    string // Address is the primary server address string, IP:port for TCP and file name for domain socket.
+	Type       string // Type is either "tcp" or "unix" depends on the connection address.
+	TLSCert    string // TLSCert is path to TLS certificate that is presented by client to server.
+	TLSKey     string // TLSKey is path to TLS key corresponding to the certificate.
+	Persistent bool   // Persistent shares one connection among all calls (including concurrent ones) and re-establishes it after failure.
+	tlsConfig  *tls.Config
+	hello      *HelloResp // hello is server's answer to Hello request, it is nil until the first Hello call succeeds.
+	helloLock  *sync.Mutex
+	persistent *rpc.Client // persistent is the shared connection in persistent mode, it is nil until the first call.
+	connAddr   string      // connAddr is the server address of the shared connection.
+	connLock   *sync.Mutex
+	servers    *serverPool // servers are the primary and fallback servers in the order of preference.
 }
 
 /*
@@ -46,6 +60,9 @@ func NewCryptClient(connType, address string, caCertPEM []byte, certPath, certKe
 		Type:      connType,
 		Address:   address,
 		tlsConfig: new(tls.Config),
+		helloLock: new(sync.Mutex),
+		connLock:  new(sync.Mutex),
+		servers:   newServerPool([]string{address}, ""),
 	}
 	if caCertPEM != nil && len(caCertPEM) > 0 {
 		// Use custom CA
@@ -85,39 +102,162 @@ func NewCryptClientFromSysconfig(sysconf *sys.Sysconfig) (*CryptClient, error) {
 			return nil, fmt.Errorf("NewCryptClientFromSysconfig: failed to read CA PEM file at \"%s\" - %v", ca, err)
 		}
 	}
-	return NewCryptClient("tcp", fmt.Sprintf("%s:%d", host, port), caCertPEM, sysconf.GetString(CLIENT_CONF_CERT, ""), sysconf.GetString(CLIENT_CONF_CERT_KEY, ""))
+	client, err := NewCryptClient("tcp", net.JoinHostPort(host, strconv.Itoa(port)), caCertPEM, sysconf.GetString(CLIENT_CONF_CERT, ""), sysconf.GetString(CLIENT_CONF_CERT_KEY, ""))
+	if err != nil {
+		return nil, err
+	}
+	client.SetFallbackServers(ParseServerAddrs(sysconf.GetString(CLIENT_CONF_FALLBACK, ""), port), sysconf.GetString(CLIENT_CONF_SRV, ""))
+	return client, nil
 }
 
-/*
-Establish a new TLS connection to RPC server and then invoke an RPC on the connection.
-The function deliberately establishes a new connection on each RPC call, in order to reduce complexity in managing
-the client connections, especially in the area of keep-alive. The client is not expected to make high volume of calls
-hence there is absolutely no performance concern.
-*/
-func (client *CryptClient) DoRPC(fun func(*rpc.Client) error) (err error) {
+// dial establishes a new connection to RPC server at the address.
+func (client *CryptClient) dial(addr string) (*rpc.Client, error) {
 	var conn net.Conn
+	var err error
 	if client.Type == "tcp" {
 		conn, err = tls.DialWithDialer(
-			&net.Dialer{Timeout: RPC_DIAL_TIMEOUT_SEC * time.Second},
-			"tcp", client.Address, client.tlsConfig)
+			&net.Dialer{Timeout: RPC_DIAL_TIMEOUT_SEC * time.Second, KeepAlive: RPC_KEEPALIVE_SEC * time.Second},
+			"tcp", addr, client.tlsConfig)
 	} else if client.Type == "unix" {
 		// TLS is not involved in domain socket communication
-		conn, err = net.Dial("unix", client.Address)
+		conn, err = net.Dial("unix", addr)
 	} else {
-		return fmt.Errorf("DoRPC: invalid client type \"%s\"", client.Type)
+		return nil, fmt.Errorf("invalid client type \"%s\"", client.Type)
 	}
 	if err != nil {
-		return fmt.Errorf("DoRPC: failed to connect to %s via %s - %v", client.Address, client.Type, err)
+		return nil, fmt.Errorf("failed to connect to %s via %s - %v", addr, client.Type, err)
+	}
+	// Closing the RPC client also closes the connection
+	return rpc.NewClient(conn), nil
+}
+
+/*
+getPersistent returns the shared connection of persistent mode, and establishes the connection if necessary. If the
+shared connection leads to a different server, it is replaced by a connection to the address.
+*/
+func (client *CryptClient) getPersistent(addr string) (*rpc.Client, error) {
+	client.connLock.Lock()
+	defer client.connLock.Unlock()
+	if client.persistent != nil && client.connAddr != addr {
+		client.persistent.Close()
+		client.persistent = nil
+	}
+	if client.persistent == nil {
+		rpcClient, err := client.dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		client.persistent = rpcClient
+		client.connAddr = addr
+	}
+	return client.persistent, nil
+}
+
+// dropPersistent closes the shared connection of persistent mode, so that the next call establishes a new one.
+func (client *CryptClient) dropPersistent(rpcClient *rpc.Client) {
+	client.connLock.Lock()
+	defer client.connLock.Unlock()
+	if client.persistent == rpcClient {
+		client.persistent = nil
+	}
+	rpcClient.Close()
+}
+
+// Close releases the shared connection of persistent mode. The client remains usable afterwards.
+func (client *CryptClient) Close() error {
+	client.connLock.Lock()
+	defer client.connLock.Unlock()
+	if client.persistent == nil {
+		return nil
+	}
+	err := client.persistent.Close()
+	client.persistent = nil
+	return err
+}
+
+// doPersistentRPC invokes an RPC on the shared connection, and re-establishes the connection if it has broken.
+func (client *CryptClient) doPersistentRPC(addr string, fun func(*rpc.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		rpcClient, err := client.getPersistent(addr)
+		if err != nil {
+			return err
+		}
+		err = fun(rpcClient)
+		if _, isServerErr := err.(rpc.ServerError); err == nil || isServerErr {
+			// The connection remains healthy after server responds with an error
+			return err
+		}
+		client.dropPersistent(rpcClient)
+		// ErrShutdown means the request was not sent, hence it is safe to try again on a new connection.
+		if err != rpc.ErrShutdown || attempt > 0 {
+			return err
+		}
+	}
+}
+
+// doRPCOn invokes an RPC on the server at the address, using either the shared connection or a new connection.
+func (client *CryptClient) doRPCOn(addr string, fun func(*rpc.Client) error) error {
+	if client.Persistent {
+		return client.doPersistentRPC(addr, fun)
+	}
+	rpcClient, err := client.dial(addr)
+	if err != nil {
+		return err
 	}
-	defer conn.Close()
-	rpcClient := rpc.NewClient(conn)
 	defer rpcClient.Close()
-	if err := fun(rpcClient); err != nil {
+	return fun(rpcClient)
+}
+
+/*
+doRPCAmong invokes an RPC on the first server among the addresses that can be reached. A server that responds, even
+with an error, is considered healthy; a server that cannot be reached is skipped for a while in subsequent calls.
+*/
+func (client *CryptClient) doRPCAmong(addrs []string, fun func(*rpc.Client) error) (err error) {
+	for _, addr := range addrs {
+		err = client.doRPCOn(addr, fun)
+		if _, isServerErr := err.(rpc.ServerError); err == nil || isServerErr {
+			client.servers.Succeed(addr)
+			break
+		}
+		if len(addrs) > 1 {
+			sys.NewLogger().Warning("CryptClient.doRPCAmong: failing over to the next key server", "server", addr, "error", err)
+		}
+		client.servers.Fail(addr)
+	}
+	if err != nil {
+		if strings.HasPrefix(err.Error(), rpcCantFindErrPrefix) {
+			return fmt.Errorf("DoRPC: call failed - %w", client.explainMissingFunction(err))
+		}
 		return fmt.Errorf("DoRPC: call failed - %v", err)
 	}
 	return nil
 }
 
+/*
+Invoke an RPC on a connection to RPC server. If fallback servers are configured, the call fails over to them in order
+when the preferred servers cannot be reached.
+By default the function establishes a new connection on each RPC call, in order to reduce complexity in managing
+the client connections. Long running client routines that make calls frequently should turn on Persistent mode to
+avoid paying for TLS handshake on each call.
+*/
+func (client *CryptClient) DoRPC(fun func(*rpc.Client) error) error {
+	return client.doRPCAmong(client.servers.Candidates(), fun)
+}
+
+// DoRPCOnPrimary invokes an RPC on the primary server (Address) only, without failing over to fallback servers.
+func (client *CryptClient) DoRPCOnPrimary(fun func(*rpc.Client) error) error {
+	return client.doRPCAmong([]string{client.Address}, fun)
+}
+
+/*
+SetFallbackServers configures the servers to fail over to when the primary server cannot be reached. The addresses
+are tried in order, followed by servers resolved from DNS SRV records "_cryptctl._tcp" of the domain, unless the
+domain is empty.
+*/
+func (client *CryptClient) SetFallbackServers(addrs []string, srvDomain string) {
+	client.servers = newServerPool(append([]string{client.Address}, addrs...), srvDomain)
+}
+
 // Retrieve the salt that was used to hash server's access password.
 func (client *CryptClient) GetSalt() (salt PasswordSalt, err error) {
 	err = client.DoRPC(func(rpcClient *rpc.Client) error {
@@ -137,7 +277,8 @@ func (client *CryptClient) Ping(req PingRequest) error {
 
 // Create a new key record.
 func (client *CryptClient) CreateKey(req CreateKeyReq) (resp CreateKeyResp, err error) {
-	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+	// New keys are only registered on the primary server
+	err = client.DoRPCOnPrimary(func(rpcClient *rpc.Client) error {
 		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "CreateKey"), req, &resp)
 	})
 	return
@@ -170,6 +311,14 @@ func (client *CryptClient) ReportAlive(req ReportAliveReq) (rejectedUUIDs []stri
 	return
 }
 
+// ReleaseKey tells server that this computer no longer holds the keys. Return UUID of keys that have been released.
+func (client *CryptClient) ReleaseKey(req ReleaseKeyReq) (releasedUUIDs []string, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ReleaseKey"), req, &releasedUUIDs)
+	})
+	return
+}
+
 // Tell server to delete an encryption key.
 func (client *CryptClient) EraseKey(req EraseKeyReq) error {
 	return client.DoRPC(func(rpcClient *rpc.Client) error {
@@ -201,6 +350,14 @@ func (client *CryptClient) PollCommand(req PollCommandReq) (resp PollCommandResp
 	return
 }
 
+// WaitCommand waits for pending commands of those UUIDs, it returns no command if none arrives within the timeout.
+func (client *CryptClient) WaitCommand(req WaitCommandReq) (resp PollCommandResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "WaitCommand"), req, &resp)
+	})
+	return
+}
+
 func (client *CryptClient) SaveCommandResult(req SaveCommandResultReq) error {
 	return client.DoRPC(func(rpcClient *rpc.Client) error {
 		var dummy DummyAttr
@@ -208,6 +365,158 @@ func (client *CryptClient) SaveCommandResult(req SaveCommandResultReq) error {
 	})
 }
 
+// RetrieveCommandKey retrieves the key material needed to execute a pending command.
+func (client *CryptClient) RetrieveCommandKey(req RetrieveCommandKeyReq) (resp RetrieveCommandKeyResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "RetrieveCommandKey"), req, &resp)
+	})
+	return
+}
+
+// SubmitCertRequest sends a client certificate request to server, return the request ID.
+func (client *CryptClient) SubmitCertRequest(req SubmitCertRequestReq) (id string, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "SubmitCertRequest"), req, &id)
+	})
+	return
+}
+
+// CollectClientCert asks server for the signed certificate of a previously submitted request.
+func (client *CryptClient) CollectClientCert(req CollectClientCertReq) (resp CollectClientCertResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "CollectClientCert"), req, &resp)
+	})
+	return
+}
+
+// ListCertRequests retrieves all client certificate requests from server.
+func (client *CryptClient) ListCertRequests(req ListCertRequestsReq) (reqs []ClientCertRequest, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListCertRequests"), req, &reqs)
+	})
+	return
+}
+
+// ApproveCertRequest tells server to approve or reject a client certificate request.
+func (client *CryptClient) ApproveCertRequest(req ApproveCertRequestReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ApproveCertRequest"), req, &dummy)
+	})
+}
+
+// ApproveHost approves a computer to retrieve the key of a disk without password, or refuses the computer.
+func (client *CryptClient) ApproveHost(req ApproveHostReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ApproveHost"), req, &dummy)
+	})
+}
+
+// RequestApproval submits an operation for approval by another administrator.
+func (client *CryptClient) RequestApproval(req RequestApprovalReq) (approval PendingApproval, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "RequestApproval"), req, &approval)
+	})
+	return
+}
+
+// GetApproval retrieves an operation submitted for approval, it fails if the operation was rejected or has expired.
+func (client *CryptClient) GetApproval(req GetApprovalReq) (approval PendingApproval, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetApproval"), req, &approval)
+	})
+	return
+}
+
+// ListApprovals returns all operations waiting for approval or execution, the oldest operation comes first.
+func (client *CryptClient) ListApprovals(req ListApprovalsReq) (approvals []PendingApproval, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListApprovals"), req, &approvals)
+	})
+	return
+}
+
+// ApproveOperation approves or rejects an operation submitted by another administrator.
+func (client *CryptClient) ApproveOperation(req ApproveOperationReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ApproveOperation"), req, &dummy)
+	})
+}
+
+// RevokeClient tells server to revoke a client certificate or deny a host, or lift an earlier revocation.
+func (client *CryptClient) RevokeClient(req RevokeClientReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "RevokeClient"), req, &dummy)
+	})
+}
+
+// ListRevocations retrieves all revoked client certificates and denied hosts from server.
+func (client *CryptClient) ListRevocations(req ListRevocationsReq) (revocations []Revocation, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListRevocations"), req, &revocations)
+	})
+	return
+}
+
+// ListRecords retrieves all key records (without key content) from server.
+func (client *CryptClient) ListRecords(req ListRecordsReq) (records []keydb.Record, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListRecords"), req, &records)
+	})
+	return
+}
+
+// GetRecord retrieves the details (without key content) of a key record from server.
+func (client *CryptClient) GetRecord(req GetRecordReq) (record keydb.Record, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetRecord"), req, &record)
+	})
+	return
+}
+
+// UpdateRecord changes the mount and key usage settings of a key record on server.
+func (client *CryptClient) UpdateRecord(req UpdateRecordReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "UpdateRecord"), req, &dummy)
+	})
+}
+
+// SendCommand stores a pending command on server for a computer to poll.
+func (client *CryptClient) SendCommand(req SendCommandReq) error {
+	return client.DoRPC(func(rpcClient *rpc.Client) error {
+		var dummy DummyAttr
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "SendCommand"), req, &dummy)
+	})
+}
+
+// SendCommandBatch stores a pending command on server for each of the disks and computers chosen by the selector.
+func (client *CryptClient) SendCommandBatch(req SendCommandBatchReq) (resp SendCommandBatchResp, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "SendCommandBatch"), req, &resp)
+	})
+	return
+}
+
+// GetCommandBatch returns the commands of a batch and their results.
+func (client *CryptClient) GetCommandBatch(req GetCommandBatchReq) (batch CommandBatch, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "GetCommandBatch"), req, &batch)
+	})
+	return
+}
+
+// ListCommands returns the pending commands of all records sorted by the moment they are handed to the computers.
+func (client *CryptClient) ListCommands(req ListCommandsReq) (cmds []DiskCommand, err error) {
+	err = client.DoRPC(func(rpcClient *rpc.Client) error {
+		return rpcClient.Call(fmt.Sprintf(RPCObjNameFmt, "ListCommands"), req, &cmds)
+	})
+	return
+}
+
 // Start an RPC server in a testing configuration, return a client connected to the server and a teardown function.
 func StartTestServer(tb testing.TB) (*CryptClient, *CryptServer, func(testing.TB)) {
 	keydbDir, err := ioutil.TempDir("", "cryptctl-rpctest")
@@ -224,6 +533,8 @@ func StartTestServer(tb testing.TB) (*CryptClient, *CryptServer, func(testing.TB
 	sysconf.Set(SRV_CONF_TLS_KEY, path.Join(PkgInGopath, "keyserv", "rpc_test.key"))
 	sysconf.Set(SRV_CONF_PASS_SALT, hex.EncodeToString(salt[:]))
 	sysconf.Set(SRV_CONF_PASS_HASH, hex.EncodeToString(passHash[:]))
+	// Test cases and benchmarks make a lot of requests in a short time
+	sysconf.Set(SRV_CONF_RATE_LIMIT_PER_MIN, 0)
 	// Start server
 	srvConf := CryptServiceConfig{}
 	srvConf.ReadFromSysconfig(sysconf)
@@ -261,6 +572,9 @@ func StartTestServer(tb testing.TB) (*CryptClient, *CryptServer, func(testing.TB
 		return nil, nil, nil
 	}
 	tearDown := func(t testing.TB) {
+		// Connection established before shutdown would still be served
+		client.Persistent = false
+		client.Close()
 		if err := client.Shutdown(ShutdownReq{Challenge: srv.AdminChallenge}); err != nil {
 			t.Fatal(err)
 			return
@@ -273,6 +587,14 @@ func StartTestServer(tb testing.TB) (*CryptClient, *CryptServer, func(testing.TB
 			t.Fatal(err)
 			return
 		}
+		if err := os.RemoveAll(srv.Config.CertRequestDir()); err != nil {
+			t.Fatal(err)
+			return
+		}
+		if err := os.RemoveAll(srv.Config.RevocationFile()); err != nil {
+			t.Fatal(err)
+			return
+		}
 	}
 	return client, srv, tearDown
 }
@@ -9,7 +9,7 @@ func BenchmarkSaveKey(b *testing.B) {
 	client, _, tearDown := StartTestServer(b)
 	defer tearDown(b)
 	// Retrieve server's password salt
-	salt, err := client.GetSalt()
+	_, err := client.GetSalt()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -37,10 +37,20 @@ func BenchmarkSaveKey(b *testing.B) {
 }
 
 func BenchmarkAutoRetrieveKey(b *testing.B) {
+	benchmarkAutoRetrieveKey(b, false)
+}
+
+func BenchmarkAutoRetrieveKeyPersistent(b *testing.B) {
+	benchmarkAutoRetrieveKey(b, true)
+}
+
+func benchmarkAutoRetrieveKey(b *testing.B, persistent bool) {
 	client, _, tearDown := StartTestServer(b)
 	defer tearDown(b)
+	client.Persistent = persistent
+	defer client.Close()
 	// Retrieve server's password salt
-	salt, err := client.GetSalt()
+	_, err := client.GetSalt()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -77,7 +87,7 @@ func BenchmarkManualRetrieveKey(b *testing.B) {
 	client, _, tearDown := StartTestServer(b)
 	defer tearDown(b)
 	// Retrieve server's password salt
-	salt, err := client.GetSalt()
+	_, err := client.GetSalt()
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -112,10 +122,20 @@ func BenchmarkManualRetrieveKey(b *testing.B) {
 }
 
 func BenchmarkReportAlive(b *testing.B) {
+	benchmarkReportAlive(b, false)
+}
+
+func BenchmarkReportAlivePersistent(b *testing.B) {
+	benchmarkReportAlive(b, true)
+}
+
+func benchmarkReportAlive(b *testing.B, persistent bool) {
 	client, _, tearDown := StartTestServer(b)
 	defer tearDown(b)
+	client.Persistent = persistent
+	defer client.Close()
 	// Retrieve server's password salt
-	salt, err := client.GetSalt()
+	_, err := client.GetSalt()
 	if err != nil {
 		b.Fatal(err)
 	}
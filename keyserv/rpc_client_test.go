@@ -10,6 +10,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -36,7 +37,7 @@ func TestCreateKeyReq_Validate(t *testing.T) {
 func TestRPCCalls(t *testing.T) {
 	client, _, tearDown := StartTestServer(t)
 	defer tearDown(t)
-	if err := client.Ping(PingRequest{PlainPassword: "wrong password")); err == nil {
+	if err := client.Ping(PingRequest{PlainPassword: "wrong password"}); err == nil {
 		t.Fatal("did not error")
 	}
 	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
@@ -241,8 +242,11 @@ func TestPendingCommands(t *testing.T) {
 	}
 	// Save four pending commands - first command is still valid and unseen
 	rec, _ := server.KeyDB.GetByUUID("a-a-a-a")
+	// Gob does not transmit the monotonic clock reading, hence the rounding.
 	cmd1 := keydb.PendingCommand{
-		ValidFrom: time.Now(),
+		ID:        "1",
+		Kind:      CommandUmount,
+		ValidFrom: time.Now().Round(0),
 		Validity:  10 * time.Hour,
 		IP:        "127.0.0.1",
 		Content:   "1",
@@ -250,6 +254,8 @@ func TestPendingCommands(t *testing.T) {
 	rec.AddPendingCommand("127.0.0.1", cmd1)
 	// Second command is expired
 	rec.AddPendingCommand("127.0.0.1", keydb.PendingCommand{
+		ID:        "2",
+		Kind:      CommandUmount,
 		ValidFrom: time.Now().Add(-1 * time.Hour),
 		Validity:  1 * time.Minute,
 		IP:        "127.0.0.1",
@@ -257,20 +263,23 @@ func TestPendingCommands(t *testing.T) {
 	})
 	// Third command is valid but already seen
 	rec.AddPendingCommand("127.0.0.1", keydb.PendingCommand{
+		ID:           "3",
+		Kind:         CommandStatus,
 		ValidFrom:    time.Now(),
 		Validity:     10 * time.Hour,
 		IP:           "127.0.0.1",
-		Content:      "3",
 		SeenByClient: true,
 	})
 	// Fouth command has nothing to do with this computer
 	rec.AddPendingCommand("another-computer", keydb.PendingCommand{
+		ID:        "4",
+		Kind:      CommandUmount,
 		ValidFrom: time.Now(),
 		Validity:  10 * time.Hour,
 		IP:        "another-computer",
 		Content:   "4",
 	})
-	if _, err := server.KeyDB.Upsert(rec); err != nil {
+	if _, err := server.KeyDB.Upsert(nil, rec); err != nil {
 		t.Fatal(err)
 	}
 	// Poll action should only receive the first command - valid yet unseen
@@ -295,7 +304,7 @@ func TestPendingCommands(t *testing.T) {
 	if err != nil || len(cmds.Commands) > 0 {
 		t.Fatal(err, cmds.Commands)
 	}
-	// Record a result for a still valid command
+	// Record a result for a still valid command, identified by its content as computers did before typed commands
 	if err := client.SaveCommandResult(SaveCommandResultReq{
 		UUID:           "a-a-a-a",
 		CommandContent: "1",
@@ -304,9 +313,23 @@ func TestPendingCommands(t *testing.T) {
 		t.Fatal(err)
 	}
 	rec, _ = server.KeyDB.GetByUUID("a-a-a-a")
-	if cmd1 := rec.PendingCommands["127.0.0.1"][0]; !cmd1.SeenByClient || cmd1.ClientResult != "result 1" {
+	if cmd1 := rec.PendingCommands["127.0.0.1"][0]; !cmd1.SeenByClient || cmd1.ClientResult != "result 1" || cmd1.Result.Success {
 		t.Fatal(cmd1)
 	}
+	// Record a result for a command identified by its ID
+	if err := client.SaveCommandResult(SaveCommandResultReq{
+		UUID:      "a-a-a-a",
+		CommandID: "3",
+		Result:    "Success",
+		Success:   true,
+		Details:   map[string]string{"unlocked": "true"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rec, _ = server.KeyDB.GetByUUID("a-a-a-a")
+	if cmd3 := rec.PendingCommands["127.0.0.1"][1]; cmd3.ClientResult != "Success" || !cmd3.Result.Success || cmd3.Result.Details["unlocked"] != "true" {
+		t.Fatal(cmd3)
+	}
 	// Saving result for a non-existent command should not crash anything
 	if err := client.SaveCommandResult(SaveCommandResultReq{
 		UUID:           "a-a-a-a",
@@ -320,3 +343,112 @@ func TestPendingCommands(t *testing.T) {
 		t.Fatal(rec.PendingCommands)
 	}
 }
+
+func TestRecordAdministration(t *testing.T) {
+	client, _, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	if _, err := client.CreateKey(CreateKeyReq{
+		PlainPassword:    TEST_RPC_PASS,
+		Hostname:         "localhost",
+		UUID:             "a-a-a-a",
+		MountPoint:       "/a",
+		MountOptions:     []string{"ro"},
+		MaxActive:        1,
+		AliveIntervalSec: 1,
+		AliveCount:       4,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Password is required
+	if _, err := client.ListRecords(ListRecordsReq{PlainPassword: "wrong"}); err == nil {
+		t.Fatal("did not error")
+	}
+	records, err := client.ListRecords(ListRecordsReq{PlainPassword: TEST_RPC_PASS})
+	if err != nil || len(records) != 1 || records[0].UUID != "a-a-a-a" || len(records[0].Key) != 0 {
+		t.Fatal(err, records)
+	}
+	if _, err := client.GetRecord(GetRecordReq{PlainPassword: TEST_RPC_PASS, UUID: "does-not-exist"}); err == nil ||
+		!strings.Contains(err.Error(), keydb.ErrRecordNotFound.Error()) {
+		t.Fatal(err)
+	}
+	// Update mount settings
+	if err := client.UpdateRecord(UpdateRecordReq{PlainPassword: TEST_RPC_PASS, UUID: "a-a-a-a", MountPoint: ""}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.UpdateRecord(UpdateRecordReq{
+		PlainPassword:    TEST_RPC_PASS,
+		UUID:             "a-a-a-a",
+		MountPoint:       "/b",
+		MountOptions:     []string{"rw"},
+		MaxActive:        2,
+		AliveIntervalSec: 1,
+		AliveCount:       10,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := client.GetRecord(GetRecordReq{PlainPassword: TEST_RPC_PASS, UUID: "a-a-a-a"})
+	if err != nil || rec.MountPoint != "/b" || !reflect.DeepEqual(rec.MountOptions, []string{"rw"}) ||
+		rec.MaxActive != 2 || rec.AliveCount != 10 || len(rec.Key) != 0 {
+		t.Fatal(err, rec)
+	}
+	// Send a command and poll it
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: "a-a-a-a", IP: "not an IP", Content: "umount", Validity: time.Hour}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := client.SendCommand(SendCommandReq{PlainPassword: TEST_RPC_PASS, UUID: "a-a-a-a", IP: "127.0.0.1", Content: "umount", Validity: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := client.PollCommand(PollCommandReq{UUIDs: []string{"a-a-a-a"}})
+	if err != nil || len(cmds.Commands["a-a-a-a"]) != 1 || cmds.Commands["a-a-a-a"][0].Content != "umount" {
+		t.Fatal(err, cmds)
+	}
+}
+
+func TestPersistentConnection(t *testing.T) {
+	client, srv, tearDown := StartTestServer(t)
+	defer tearDown(t)
+	client.Persistent = true
+	defer client.Close()
+	// Concurrent calls share the same connection
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.conns.lock.Lock()
+	numConns := len(srv.conns.conns)
+	srv.conns.lock.Unlock()
+	if numConns != 1 {
+		t.Fatal(numConns)
+	}
+	conn := client.persistent
+	// Error from server does not break the connection
+	if err := client.Ping(PingRequest{PlainPassword: "wrong"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if client.persistent != conn {
+		t.Fatal("connection was dropped")
+	}
+	// Client reconnects after the connection breaks
+	conn.Close()
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err != nil {
+		t.Fatal(err)
+	}
+	if client.persistent == conn || client.persistent == nil {
+		t.Fatal("did not reconnect")
+	}
+	if err := client.Close(); err != nil || client.persistent != nil {
+		t.Fatal(err)
+	}
+}
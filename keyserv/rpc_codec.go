@@ -0,0 +1,129 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"bufio"
+	"cryptctl/sys"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	RPCRateLimitSvcName = "RPCRateLimit" // RPCRateLimitSvcName is the name of the RPC service that answers requests exceeding rate limit.
+)
+
+// rateLimitSvc answers requests that exceeded rate limit with an error.
+type rateLimitSvc struct{}
+
+// Reject responds to the request with ErrRateLimited.
+func (*rateLimitSvc) Reject(_ DummyAttr, _ *DummyAttr) error {
+	return ErrRateLimited
+}
+
+/*
+rpcServerCodec is a gob codec for RPC server, it works in the same way as the default codec of net/rpc, additionally it
+diverts requests that exceed rate limit to rateLimitSvc, counts requests in progress for graceful shutdown, and
+measures request latency.
+*/
+type rpcServerCodec struct {
+	rwc         io.ReadWriteCloser
+	dec         *gob.Decoder
+	enc         *gob.Encoder
+	encBuf      *bufio.Writer
+	closed      bool
+	remoteHost  string
+	log         *sys.Logger  // log carries the request ID of the connection
+	limiter     *RateLimiter // limiter is nil if requests are not subject to rate limit
+	tracker     *connTracker // tracker is nil if requests are not counted
+	metrics     *Metrics     // metrics is nil if latency is not measured
+	discardBody bool
+	started     map[uint64]time.Time // started is the time at which each request (by sequence number) was read
+	startedLock *sync.Mutex
+}
+
+func newRPCServerCodec(conn io.ReadWriteCloser, remoteHost string, logger *sys.Logger, limiter *RateLimiter, tracker *connTracker, metrics *Metrics) *rpcServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &rpcServerCodec{
+		rwc:         conn,
+		dec:         gob.NewDecoder(conn),
+		enc:         gob.NewEncoder(buf),
+		encBuf:      buf,
+		remoteHost:  remoteHost,
+		log:         logger,
+		limiter:     limiter,
+		tracker:     tracker,
+		metrics:     metrics,
+		started:     make(map[uint64]time.Time),
+		startedLock: new(sync.Mutex),
+	}
+}
+
+func (codec *rpcServerCodec) ReadRequestHeader(req *rpc.Request) error {
+	if err := codec.dec.Decode(req); err != nil {
+		return err
+	}
+	if codec.tracker != nil && !codec.tracker.BeginRequest() {
+		// The server is shutting down, the connection closes without answering the request.
+		return io.EOF
+	}
+	codec.startedLock.Lock()
+	codec.started[req.Seq] = time.Now()
+	codec.startedLock.Unlock()
+	if codec.limiter != nil && !codec.limiter.Allow(codec.remoteHost) {
+		codec.log.Warning("rpcServerCodec.ReadRequestHeader: client has exceeded rate limit", "method", req.ServiceMethod)
+		req.ServiceMethod = RPCRateLimitSvcName + ".Reject"
+		codec.discardBody = true
+	}
+	return nil
+}
+
+func (codec *rpcServerCodec) ReadRequestBody(body interface{}) error {
+	if codec.discardBody {
+		// The original request parameter does not fit the rejection function, gob discards the value if body is nil.
+		codec.discardBody = false
+		body = nil
+	}
+	return codec.dec.Decode(body)
+}
+
+func (codec *rpcServerCodec) WriteResponse(resp *rpc.Response, body interface{}) (err error) {
+	// Each request that has been read is answered exactly once
+	if codec.tracker != nil {
+		defer codec.tracker.EndRequest()
+	}
+	codec.startedLock.Lock()
+	start, found := codec.started[resp.Seq]
+	delete(codec.started, resp.Seq)
+	codec.startedLock.Unlock()
+	if found {
+		codec.metrics.ObserveRPC(resp.ServiceMethod, time.Since(start), resp.Error)
+	}
+	if err = codec.enc.Encode(resp); err != nil {
+		if codec.encBuf.Flush() == nil {
+			// Gob failed to encode the header, close the connection because it is out of sync.
+			codec.log.Error("rpcServerCodec.WriteResponse: failed to encode response header", "method", resp.ServiceMethod, "error", err)
+			codec.Close()
+		}
+		return
+	}
+	if err = codec.enc.Encode(body); err != nil {
+		if codec.encBuf.Flush() == nil {
+			codec.log.Error("rpcServerCodec.WriteResponse: failed to encode response body", "method", resp.ServiceMethod, "error", err)
+			codec.Close()
+		}
+		return
+	}
+	return codec.encBuf.Flush()
+}
+
+func (codec *rpcServerCodec) Close() error {
+	if codec.closed {
+		return nil
+	}
+	codec.closed = true
+	return codec.rwc.Close()
+}
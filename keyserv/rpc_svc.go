@@ -14,15 +14,18 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"os/user"
 	"path"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -34,9 +37,11 @@ const (
 	SRV_CONF_PASS_HASH           = "AUTH_PASSWORD_HASH"
 	SRV_CONF_PASS_SALT           = "AUTH_PASSWORD_SALT"
 	SRV_CONF_TLS_CA              = "TLS_CA_PEM"
+	SRV_CONF_TLS_CA_KEY          = "TLS_CA_KEY_PEM"
 	SRV_CONF_TLS_CERT            = "TLS_CERT_PEM"
 	SRV_CONF_TLS_KEY             = "TLS_CERT_KEY_PEM"
 	SRV_CONF_TLS_VALIDATE_CLIENT = "TLS_VALIDATE_CLIENT"
+	SRV_CONF_TLS_CERT_ENROLMENT  = "TLS_CLIENT_CERT_ENROLMENT"
 	SRV_CONF_LISTEN_ADDR         = "LISTEN_ADDRESS"
 	SRV_CONF_LISTEN_PORT         = "LISTEN_PORT"
 	SRV_CONF_KEYDB_DIR           = "KEY_DB_DIR"
@@ -45,6 +50,14 @@ const (
 	SRV_CONF_MAIL_RETRIEVAL_SUBJ = "EMAIL_KEY_RETRIEVAL_SUBJECT"
 	SRV_CONF_MAIL_RETRIEVAL_TEXT = "EMAIL_KEY_RETRIEVAL_GREETING"
 	SRV_CONF_ALLOW_HASH_AUTH     = "ALLOW_HASH_AUTH"
+	SRV_CONF_RATE_LIMIT_PER_MIN  = "RATE_LIMIT_PER_MINUTE"
+	SRV_CONF_RATE_LIMIT_BURST    = "RATE_LIMIT_BURST"
+	SRV_CONF_AUTH_FAIL_THRESHOLD = "AUTH_FAILURE_THRESHOLD"
+	SRV_CONF_AUTH_LOCKOUT_SEC    = "AUTH_LOCKOUT_SEC"
+	SRV_CONF_AUTH_LOCKOUT_MAX    = "AUTH_LOCKOUT_MAX_SEC"
+	SRV_CONF_SHUTDOWN_TIMEOUT    = "SHUTDOWN_TIMEOUT_SEC"
+	SRV_CONF_METRICS_ADDR        = "METRICS_LISTEN_ADDRESS"
+	SRV_CONF_REST_PORT           = "REST_API_PORT"
 
 	SRV_CONF_KMIP_SERVER_ADDRS    = "KMIP_SERVER_ADDRESSES"
 	SRV_CONF_KMIP_SERVER_USER     = "KMIP_SERVER_USER"
@@ -59,6 +72,14 @@ const (
 	DomainSocketFile = "/var/run/cryptctl-domainsocket" // DomainSocketFile is the file name of unix domain socket server
 )
 
+var (
+	ErrIncorrectPassword = errors.New("password is incorrect")                         // ErrIncorrectPassword is returned when client presents an incorrect password.
+	ErrNoAuthMethod      = errors.New("No valid authentication method.")               // ErrNoAuthMethod is returned when client presents a hashed password but server does not accept it.
+	ErrLockedOut         = errors.New("too many incorrect passwords, try again later") // ErrLockedOut is returned when client has presented too many incorrect passwords.
+	ErrRateLimited       = errors.New("too many requests, try again later")            // ErrRateLimited is returned when client has made too many requests in a short time.
+	ErrInvalidRequest    = errors.New("request is invalid")                            // ErrInvalidRequest is returned when request parameters do not make sense.
+)
+
 var PkgInGopath = path.Join(path.Join(os.Getenv("GOPATH"), "/src/cryptctl")) // this package in gopath
 
 func GetDefaultKeySvcConf() *sys.Sysconfig {
@@ -96,7 +117,9 @@ type CryptServiceConfig struct {
 	PasswordHash         [sha512.Size]byte   // password hash (salted) that authenticates incoming requests
 	PasswordSalt         [LEN_PASS_SALT]byte // password hash salt
 	CertAuthorityPEM     string              // path to PEM-encoded CA certificate
+	CertAuthorityKeyPEM  string              // path to PEM-encoded key of the built-in CA, if the CA was generated by init-server
 	ValidateClientCert   bool                // whether the server will authenticate its client before accepting RPC request
+	AllowCertEnrolment   bool                // whether clients without certificate may connect to request one while ValidateClientCert is on
 	CertPEM              string              // path to PEM-encoded TLS certificate
 	KeyPEM               string              // path to PEM-encoded TLS certificate key
 	Address              string              // address of the network interface to listen on
@@ -114,6 +137,24 @@ type CryptServiceConfig struct {
 	KMIPTLSDoVerify      bool                // Enable verification on KMIP server's TLS certificate
 	KMIPCertPEM          string              // optional KMIP client certificate
 	KMIPKeyPEM           string              // optional KMIP client certificate key
+	RateLimitPerMinute   int                 // number of requests a client IP may make every minute, 0 means unlimited
+	RateLimitBurst       int                 // number of requests a client IP may make in a burst
+	AuthFailureThreshold int                 // number of consecutive incorrect passwords that locks out a client IP, 0 disables lockout
+	AuthLockoutSec       int                 // duration of the first lockout, it doubles on each further incorrect password
+	AuthLockoutMaxSec    int                 // upper limit of lockout duration
+	ShutdownTimeoutSec   int                 // how long shutdown waits for requests in progress to complete
+	MetricsAddress       string              // optional address:port of HTTP listener that serves Prometheus metrics
+	RESTPort             int                 // optional port of REST API listener, 0 turns off REST API
+	AuditSyslogAddress   string              // optional host:port of syslog collector that receives audit events over TLS
+	AuditSyslogCAPEM     string              // optional CA certificate that verifies syslog collector
+	AuditSyslogCertPEM   string              // optional client certificate presented to syslog collector
+	AuditSyslogKeyPEM    string              // optional client certificate key presented to syslog collector
+	Webhooks             []WebhookNotifier   // optional webhooks that receive event notifications
+	LivenessScanSec      int                 // interval of scanning for key holders that stopped sending alive reports, 0 turns off the scan
+	ApprovalOperations   []string            // operations that must be approved by a second administrator, empty to require no approval
+	ApprovalTimeoutSec   int                 // how long an operation waits for approval, and how long an approved operation stays valid
+	ApproveNewHosts      bool                // withhold keys from computers that are not known to use them until an administrator approves
+	HostGroups           map[string][]string // optional named groups of computer IPs that commands may be sent to at once
 }
 
 // Preliminarily validate configuration and report error.
@@ -128,10 +169,59 @@ func (conf *CryptServiceConfig) Validate() error {
 		return errors.New("Validate: network port to listen on is not specified")
 	} else if !strings.HasPrefix(conf.KeyDBDir, "/") {
 		return fmt.Errorf("Validate: key database directory \"%s\" should be an absolute path", conf.KeyDBDir)
+	} else if conf.LivenessScanSec < 0 {
+		return fmt.Errorf("Validate: liveness scan interval %d must not be negative", conf.LivenessScanSec)
+	} else if len(conf.ApprovalOperations) > 0 && conf.ApprovalTimeoutSec < 1 {
+		return fmt.Errorf("Validate: approval timeout %d must be positive", conf.ApprovalTimeoutSec)
+	}
+	for _, operation := range conf.ApprovalOperations {
+		if !EventFilter(ApprovalOperations).Accepts(operation) {
+			return fmt.Errorf("Validate: unknown operation \"%s\" requires approval, it should be one of %v", operation, ApprovalOperations)
+		}
+	}
+	for _, hook := range conf.Webhooks {
+		if err := hook.Validate(); err != nil {
+			return fmt.Errorf("Validate: webhook - %v", err)
+		}
+	}
+	if err := validateHostGroups(conf.HostGroups); err != nil {
+		return fmt.Errorf("Validate: %v", err)
 	}
 	return nil
 }
 
+// CertRequestDir returns the directory that stores client certificate requests, it sits next to key database directory.
+func (conf *CryptServiceConfig) CertRequestDir() string {
+	return path.Clean(conf.KeyDBDir) + CertRequestDirSuffix
+}
+
+// RevocationFile returns the file that stores revoked client certificates and denied hosts, it sits next to key database directory.
+func (conf *CryptServiceConfig) RevocationFile() string {
+	return path.Clean(conf.KeyDBDir) + RevocationFileSuffix
+}
+
+// AuditBufferFile returns the file that stores audit events not yet delivered to syslog collector, it sits next to key database directory.
+func (conf *CryptServiceConfig) AuditBufferFile() string {
+	return path.Clean(conf.KeyDBDir) + AuditBufferFileSuffix
+}
+
+// MailDigestFile returns the file that stores notifications waiting to be mailed in a digest, it sits next to key database directory.
+func (conf *CryptServiceConfig) MailDigestFile() string {
+	return path.Clean(conf.KeyDBDir) + MailDigestFileSuffix
+}
+
+/*
+ClientAuth returns the TLS client authentication policy of a server that validates client certificates. Clients without
+a certificate may connect only if certificate enrolment is enabled, and ServeConn restricts such connections to the
+enrolment functions.
+*/
+func (conf *CryptServiceConfig) ClientAuth() tls.ClientAuthType {
+	if conf.AllowCertEnrolment {
+		return tls.VerifyClientCertIfGiven
+	}
+	return tls.RequireAndVerifyClientCert
+}
+
 // Read key server configuration from a sysconfig file.
 func (conf *CryptServiceConfig) ReadFromSysconfig(sysconf *sys.Sysconfig) error {
 	passwordHash, err := hex.DecodeString(sysconf.GetString(SRV_CONF_PASS_HASH, ""))
@@ -146,7 +236,9 @@ func (conf *CryptServiceConfig) ReadFromSysconfig(sysconf *sys.Sysconfig) error
 	copy(conf.PasswordSalt[:], passwordSalt)
 
 	conf.CertAuthorityPEM = sysconf.GetString(SRV_CONF_TLS_CA, "")
+	conf.CertAuthorityKeyPEM = sysconf.GetString(SRV_CONF_TLS_CA_KEY, "")
 	conf.ValidateClientCert = sysconf.GetBool(SRV_CONF_TLS_VALIDATE_CLIENT, false)
+	conf.AllowCertEnrolment = sysconf.GetBool(SRV_CONF_TLS_CERT_ENROLMENT, false)
 	conf.CertPEM = sysconf.GetString(SRV_CONF_TLS_CERT, "")
 	conf.KeyPEM = sysconf.GetString(SRV_CONF_TLS_KEY, "")
 	conf.Address = sysconf.GetString(SRV_CONF_LISTEN_ADDR, "0.0.0.0")
@@ -167,6 +259,25 @@ func (conf *CryptServiceConfig) ReadFromSysconfig(sysconf *sys.Sysconfig) error
 	conf.KMIPTLSDoVerify = sysconf.GetBool(SRV_CONF_KMIP_TLS_DO_VERIFY, true)
 	conf.KMIPCertPEM = sysconf.GetString(SRV_CONF_KMIP_SERVER_TLS_CERT, "")
 	conf.KMIPKeyPEM = sysconf.GetString(SRV_CONF_KMIP_SERVER_TLS_KEY, "")
+
+	conf.RateLimitPerMinute = sysconf.GetInt(SRV_CONF_RATE_LIMIT_PER_MIN, 300)
+	conf.RateLimitBurst = sysconf.GetInt(SRV_CONF_RATE_LIMIT_BURST, 100)
+	conf.AuthFailureThreshold = sysconf.GetInt(SRV_CONF_AUTH_FAIL_THRESHOLD, 5)
+	conf.AuthLockoutSec = sysconf.GetInt(SRV_CONF_AUTH_LOCKOUT_SEC, 60)
+	conf.AuthLockoutMaxSec = sysconf.GetInt(SRV_CONF_AUTH_LOCKOUT_MAX, 3600)
+	conf.ShutdownTimeoutSec = sysconf.GetInt(SRV_CONF_SHUTDOWN_TIMEOUT, 30)
+	conf.MetricsAddress = sysconf.GetString(SRV_CONF_METRICS_ADDR, "")
+	conf.RESTPort = sysconf.GetInt(SRV_CONF_REST_PORT, 0)
+	conf.AuditSyslogAddress = sysconf.GetString(SRV_CONF_AUDIT_SYSLOG_ADDR, "")
+	conf.AuditSyslogCAPEM = sysconf.GetString(SRV_CONF_AUDIT_SYSLOG_CA, "")
+	conf.AuditSyslogCertPEM = sysconf.GetString(SRV_CONF_AUDIT_SYSLOG_CERT, "")
+	conf.AuditSyslogKeyPEM = sysconf.GetString(SRV_CONF_AUDIT_SYSLOG_KEY, "")
+	conf.Webhooks = readWebhooksFromSysconfig(sysconf)
+	conf.LivenessScanSec = sysconf.GetInt(SRV_CONF_LIVENESS_SCAN_SEC, 60)
+	conf.ApprovalOperations = sysconf.GetStringArray(SRV_CONF_APPROVAL_OPERATIONS, []string{})
+	conf.ApprovalTimeoutSec = sysconf.GetInt(SRV_CONF_APPROVAL_TIMEOUT, 900)
+	conf.ApproveNewHosts = sysconf.GetBool(SRV_CONF_APPROVE_NEW_HOSTS, false)
+	conf.HostGroups = readHostGroupsFromSysconfig(sysconf)
 	return conf.Validate()
 }
 
@@ -175,12 +286,29 @@ type CryptServer struct {
 	Config            CryptServiceConfig // service configuration
 	Mailer            *Mailer            // mail notification sender
 	KeyDB             *keydb.DB          // encryption key database
+	CertRequests      *CertRequestQueue  // client certificate requests waiting for administrator's approval
+	Revocations       *RevocationList    // revoked client certificates and denied hosts
+	RateLimiter       *RateLimiter       // RateLimiter limits the number of requests made by each client IP via TCP
+	AuthLockout       *AuthLockout       // AuthLockout locks out client IPs that present too many incorrect passwords
+	Metrics           *Metrics           // Metrics collects statistics that are served to Prometheus
+	Audit             *AuditSink         // Audit forwards security events to remote syslog collector, it is nil if not configured
+	MailDigest        *MailDigest        // MailDigest holds notifications waiting to be mailed in a digest
+	Liveness          *LivenessScanner   // Liveness finds key holders that have stopped sending alive reports
+	Approvals         *ApprovalQueue     // Approvals holds operations waiting for approval by a second administrator
 	TLSConfig         *tls.Config        // TLS certificate chain and private key
+	CertStore         *CertStore         // CertStore holds the TLS certificate that can be reloaded while server is running
 	TCPListener       net.Listener       // TCPListener is the TCP server that serves all RPC functions
 	UnixListener      net.Listener       // UnixListener is the Unix domain socket that serves all RPC functions
+	MetricsListener   net.Listener       // MetricsListener is the optional HTTP server that serves metrics
+	RESTListener      net.Listener       // RESTListener is the optional TLS server that serves REST API
 	BuiltInKMIPServer *KMIPServer        // Built-in KMIP server in case there's no external server
 	KMIPClient        *KMIPClient        // KMIP client connected to either built-in KMIP server or external server
 	AdminChallenge    []byte             // a random secret that must be verified for incoming shutdown/reload requests
+	clientCAPEM       []byte             // content of client CA file that is currently in use
+	reloadLock        *sync.RWMutex      // reloadLock protects TLS configuration and settings that can be reloaded
+	Log               *sys.Logger        // Log is the logger of server operations that are not made on behalf of a client
+	conns             *connTracker       // conns tracks RPC connections and requests in progress for graceful shutdown
+	restServer        *http.Server       // restServer serves REST API requests on RESTListener
 }
 
 // Initialise an RPC server from sysconfig file text.
@@ -189,31 +317,60 @@ func NewCryptServer(config CryptServiceConfig, mailer Mailer) (srv *CryptServer,
 		return nil, err
 	}
 	srv = &CryptServer{
-		Config:    config,
-		Mailer:    &mailer,
-		TLSConfig: new(tls.Config),
+		Config:      config,
+		Log:         sys.NewLogger(),
+		Mailer:      &mailer,
+		TLSConfig:   new(tls.Config),
+		reloadLock:  new(sync.RWMutex),
+		conns:       newConnTracker(),
+		Metrics:     NewMetrics(),
+		Liveness:    NewLivenessScanner(),
+		Approvals:   NewApprovalQueue(),
+		RateLimiter: NewRateLimiter(config.RateLimitPerMinute, config.RateLimitBurst),
+		AuthLockout: NewAuthLockout(config.AuthFailureThreshold,
+			time.Duration(config.AuthLockoutSec)*time.Second, time.Duration(config.AuthLockoutMaxSec)*time.Second),
 	}
 	srv.KeyDB, err = keydb.OpenDB(config.KeyDBDir)
 	if err != nil {
 		return nil, err
 	}
+	srv.KeyDB.Log = srv.Log
+	srv.CertRequests, err = OpenCertRequestQueue(config.CertRequestDir())
+	if err != nil {
+		return nil, err
+	}
+	srv.Revocations, err = OpenRevocationList(config.RevocationFile())
+	if err != nil {
+		return nil, err
+	}
+	srv.MailDigest, err = OpenMailDigest(config.MailDigestFile())
+	if err != nil {
+		return nil, err
+	}
+	if config.AuditSyslogAddress != "" {
+		auditTLSConfig, err := newAuditTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		srv.Audit = NewAuditSink(config.AuditSyslogAddress, config.AuditBufferFile(), auditTLSConfig, srv.Log)
+	}
 	/*
 	 The author of TLS related libraries in Go has an opinion about CRL
 	*/
-	srv.TLSConfig.Certificates = make([]tls.Certificate, 1)
-	srv.TLSConfig.Certificates[0], err = tls.LoadX509KeyPair(config.CertPEM, config.KeyPEM)
+	if srv.CertStore, err = NewCertStore(config.CertPEM, config.KeyPEM); err != nil {
+		return nil, err
+	}
+	srv.TLSConfig.GetCertificate = srv.CertStore.GetCertificate
 	// Configure client authentication upon request
 	if config.ValidateClientCert {
-		caPEM, err := ioutil.ReadFile(config.CertAuthorityPEM)
-		if err != nil {
+		if srv.TLSConfig.ClientCAs, srv.clientCAPEM, err = loadClientCAs(config.CertAuthorityPEM); err != nil {
 			return nil, err
 		}
-		caPool := x509.NewCertPool()
-		caPool.AppendCertsFromPEM(caPEM)
-		srv.TLSConfig.ClientCAs = caPool
-		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		srv.TLSConfig.ClientAuth = config.ClientAuth()
 	}
-	srv.TLSConfig.BuildNameToCertificate()
+	srv.TLSConfig.VerifyPeerCertificate = srv.verifyPeerCertificate
+	// Each connection receives a snapshot of TLS configuration, which may be reloaded at any time
+	srv.TLSConfig.GetConfigForClient = srv.getConfigForClient
 	// Admin challenge is an array of random bytes
 	srv.AdminChallenge = make([]byte, LenAdminChallenge)
 	if _, err = rand.Read(srv.AdminChallenge); err != nil {
@@ -248,29 +405,16 @@ func (srv *CryptServer) ListenTCP() error {
 		srv.KMIPClient.TLSConfig.InsecureSkipVerify = true
 	} else {
 		// No need to start built-in KMIP server, so only initialise the client.
-		var caCert []byte
-		if srv.Config.KMIPCertAuthorityPEM != "" {
-			caCert, err = ioutil.ReadFile(srv.Config.KMIPCertAuthorityPEM)
-			if err != nil {
-				return err
-			}
-		}
-		if srv.KMIPClient, err = NewKMIPClient(
-			srv.Config.KMIPAddresses,
-			srv.Config.KMIPUser, srv.Config.KMIPPass,
-			caCert, srv.Config.KMIPCertPEM, srv.Config.KMIPKeyPEM); err != nil {
+		if srv.KMIPClient, err = newExternalKMIPClient(srv.Config); err != nil {
 			return err
 		}
-		if !srv.Config.KMIPTLSDoVerify {
-			log.Printf("CryptServer.ListenTCP: KMIP client will not verify KMIP server's identity, as instructed by configuration.")
-			srv.KMIPClient.TLSConfig.InsecureSkipVerify = !srv.Config.KMIPTLSDoVerify
-		}
 	}
+	srv.KMIPClient.Metrics = srv.Metrics
 	// Start ordinary RPC server
 	if srv.TCPListener, err = tls.Listen("tcp", fmt.Sprintf("%s:%d", srv.Config.Address, srv.Config.Port), srv.TLSConfig); err != nil {
 		return fmt.Errorf("CryptServer.ListenTCP: failed to listen on %s:%d - %v", srv.Config.Address, srv.Config.Port, err)
 	}
-	log.Printf("CryptServer.ListenTCP: listening on %s:%d using TLS certficate \"%s\"", srv.Config.Address, srv.Config.Port, srv.Config.CertPEM)
+	srv.Log.Info("CryptServer.ListenTCP: listening", "address", srv.Config.Address, "port", srv.Config.Port, "certificate", srv.Config.CertPEM)
 	return nil
 }
 
@@ -280,7 +424,7 @@ func (srv *CryptServer) ListenUnix() (err error) {
 		return
 	}
 	srv.UnixListener, err = net.Listen("unix", DomainSocketFile)
-	log.Printf("CryptServer.ListenUnix: listening on %s", DomainSocketFile)
+	srv.Log.Info("CryptServer.ListenUnix: listening", "socket", DomainSocketFile)
 	return
 }
 
@@ -292,7 +436,7 @@ func (srv *CryptServer) HandleTCPConnections() {
 	for {
 		incoming, err := srv.TCPListener.Accept()
 		if err != nil {
-			log.Printf("CryptServer.HandleTCPConnections: quit now - %v", err)
+			srv.Log.Info("CryptServer.HandleTCPConnections: quit now", "error", err)
 			return
 		}
 		// The connection is served by a dedicated RPC server instance
@@ -311,7 +455,7 @@ func (srv *CryptServer) HandleUnixConnections() {
 	for {
 		incoming, err := srv.UnixListener.Accept()
 		if err != nil {
-			log.Printf("CryptServer.HandleUnixConnections: quit now - %v", err)
+			srv.Log.Info("CryptServer.HandleUnixConnections: quit now", "error", err)
 			return
 		}
 		go func(conn net.Conn) {
@@ -332,6 +476,8 @@ func (srv *CryptServer) Shutdown() {
 	if kmipServer := srv.BuiltInKMIPServer; kmipServer != nil {
 		kmipServer.Shutdown()
 	}
+	srv.MailDigest.Close()
+	srv.Liveness.Close()
 }
 
 /*
@@ -367,7 +513,7 @@ func (srv *CryptServer) ValidatePlainPassword(password string) error {
 		return err
 	}
 	if subtle.ConstantTimeCompare(pass[:], srv.Config.PasswordHash[:]) != 1 {
-		return errors.New("ValidatePlainPassword: password is incorrect")
+		return fmt.Errorf("ValidatePlainPassword: %w", ErrIncorrectPassword)
 	}
 	return nil
 }
@@ -379,38 +525,180 @@ func (srv *CryptServer) ValidatePassword(pass HashedPassword) error {
 		return err
 	}
 	if subtle.ConstantTimeCompare(pass[:], srv.Config.PasswordHash[:]) != 1 {
-		return errors.New("ValidatePassword: password is incorrect")
+		return fmt.Errorf("ValidatePassword: %w", ErrIncorrectPassword)
+	}
+	return nil
+}
+
+// verifyPeerCertificate is called during TLS handshake to refuse client certificates that have been revoked.
+func (srv *CryptServer) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("CryptServer.verifyPeerCertificate: failed to parse client certificate - %v", err)
+	}
+	if err := srv.Revocations.CheckCert(leaf); err != nil {
+		srv.Log.Warning("CryptServer.verifyPeerCertificate: refuse client", "subject", leaf.Subject.CommonName, "error", err)
+		return err
 	}
 	return nil
 }
 
 // Create an RPC service object that handles requests from an incoming connection.
 func (srv *CryptServer) ServeConn(incoming net.Conn) {
-	rpcSvc := rpc.NewServer()
-	remoteHost, _, err := net.SplitHostPort(incoming.RemoteAddr().String())
-	if err != nil {
-		log.Printf("CryptServer.ServeConn: failed to parse weird looking address - %v", err)
+	if !srv.conns.Add(incoming) {
+		// The server is shutting down
 		return
 	}
+	defer srv.conns.Remove(incoming)
+	rpcSvc := rpc.NewServer()
+	var remoteHost, peerUser string
+	if unixConn, isUnix := incoming.(*net.UnixConn); isUnix {
+		// Domain socket peers do not have an address, they are always on this computer.
+		remoteHost = "127.0.0.1"
+		var err error
+		if peerUser, err = unixPeerUser(unixConn); err != nil {
+			srv.Log.Warning("CryptServer.ServeConn: failed to identify the user on domain socket", "error", err)
+		}
+	} else {
+		var err error
+		remoteHost, _, err = net.SplitHostPort(incoming.RemoteAddr().String())
+		if err != nil {
+			srv.Log.Warning("CryptServer.ServeConn: failed to parse weird looking address", "address", incoming.RemoteAddr().String(), "error", err)
+			return
+		}
+	}
 	// Turn IPv6 localhost address into IPv4 address to aid in several test cases that rely on 127.0.0.1 being localhost
 	if remoteHost == "::1" {
 		remoteHost = "127.0.0.1"
 	}
-	if err := rpcSvc.Register(&CryptServiceConn{RemoteHost: remoteHost, Svc: srv}); err != nil {
+	if _, isTLS := incoming.(*tls.Conn); isTLS {
+		if denied := srv.Revocations.IsHostDenied(remoteHost); denied != nil {
+			srv.Log.Warning("CryptServer.ServeConn: refuse connection from denied host", "client_ip", remoteHost, "reason", denied.Reason)
+			return
+		}
+	}
+	rpcConn := srv.newServiceConn(remoteHost)
+	rpcConn.PeerUser = peerUser
+	rpcConn.Log.Debug("CryptServer.ServeConn: serving connection")
+	var rcvr interface{} = rpcConn
+	var limiter *RateLimiter
+	tlsConn, isTLS := incoming.(*tls.Conn)
+	if isTLS {
+		// Administrators on domain socket are not subject to rate limit
+		limiter = srv.RateLimiter
+	}
+	if isTLS && srv.Config.ValidateClientCert {
+		if err := tlsConn.Handshake(); err != nil {
+			srv.Log.Warning("CryptServer.ServeConn: TLS handshake failed", "client_ip", remoteHost, "error", err)
+			return
+		}
+		if peerCerts := tlsConn.ConnectionState().PeerCertificates; len(peerCerts) == 0 {
+			// A client without certificate may only ask for one
+			rcvr = &CryptEnrolmentConn{conn: rpcConn}
+		} else {
+			rpcConn.PeerCommonName = peerCerts[0].Subject.CommonName
+		}
+	}
+	if err := rpcSvc.RegisterName(reflect.TypeOf(CryptServiceConn{}).Name(), rcvr); err != nil {
 		log.Panicf("ServeConn: failed to register RPC service - %v", err)
 	}
-	rpcSvc.ServeConn(incoming)
+	if err := rpcSvc.RegisterName(RPCRateLimitSvcName, &rateLimitSvc{}); err != nil {
+		log.Panicf("ServeConn: failed to register RPC service - %v", err)
+	}
+	rpcSvc.ServeCodec(newRPCServerCodec(incoming, remoteHost, rpcConn.Log, limiter, srv.conns, srv.Metrics))
 	return
 }
 
+// unixPeerUser returns the name of the user who runs the process on the other end of domain socket connection.
+func unixPeerUser(conn *net.UnixConn) (string, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return "", fmt.Errorf("unixPeerUser: failed to get raw connection - %v", err)
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return "", fmt.Errorf("unixPeerUser: failed to control connection - %v", err)
+	} else if credErr != nil {
+		return "", fmt.Errorf("unixPeerUser: failed to get peer credentials - %v", credErr)
+	}
+	uid := strconv.Itoa(int(cred.Uid))
+	if peer, err := user.LookupId(uid); err == nil {
+		return peer.Username, nil
+	}
+	return "uid " + uid, nil
+}
+
 // Serve RPC routines for key creation/retrieval services.
 type CryptServiceConn struct {
-	RemoteHost string
-	Svc        *CryptServer
+	RemoteHost     string
+	PeerCommonName string // PeerCommonName is the common name of client certificate, it is empty if client did not present one.
+	PeerUser       string // PeerUser is the name of the local user connected over domain socket, it is empty for network clients.
+	Svc            *CryptServer
+	Log            *sys.Logger // Log attaches the request ID and client IP to messages logged on behalf of this connection.
+}
+
+// newServiceConn returns an RPC service object for a client, its log messages carry a new request ID.
+func (srv *CryptServer) newServiceConn(remoteHost string) *CryptServiceConn {
+	return &CryptServiceConn{
+		RemoteHost: remoteHost,
+		Svc:        srv,
+		Log:        srv.Log.With(sys.LogKeyRequestID, sys.NewRequestID(), "client_ip", remoteHost),
+	}
+}
+
+// kmipClient returns the KMIP client that logs requests made on behalf of this connection.
+func (rpcConn *CryptServiceConn) kmipClient() *KMIPClient {
+	return rpcConn.Svc.currentKMIPClient().WithLogger(rpcConn.Log)
 }
 
 var RPCObjNameFmt = reflect.TypeOf(CryptServiceConn{}).Name() + ".%s" // for constructing RPC function name in RPC call
 
+/*
+authenticate validates the password presented by client, either in plain text or hashed. A client IP that presented
+too many incorrect passwords is locked out for a while, during which even the correct password is refused.
+*/
+func (rpcConn *CryptServiceConn) authenticate(plainPassword string, password HashedPassword) error {
+	lockout := rpcConn.Svc.AuthLockout
+	if remaining := lockout.LockedFor(rpcConn.RemoteHost); remaining > 0 {
+		return fmt.Errorf("CryptServiceConn.authenticate: %w (%d seconds remaining)", ErrLockedOut, int(remaining.Seconds())+1)
+	}
+	var err error
+	if plainPassword != "" {
+		err = rpcConn.Svc.ValidatePlainPassword(plainPassword)
+	} else if rpcConn.Svc.Config.AllowHashAuth {
+		err = rpcConn.Svc.ValidatePassword(password)
+	} else {
+		return ErrNoAuthMethod
+	}
+	if err == nil {
+		lockout.Succeed(rpcConn.RemoteHost)
+		return nil
+	} else if !errors.Is(err, ErrIncorrectPassword) {
+		return err
+	}
+	lockedFor, failures := lockout.Fail(rpcConn.RemoteHost)
+	rpcConn.Log.Warning("CryptServiceConn.authenticate: client has presented an incorrect password", "failures", failures)
+	rpcConn.audit(AuditLoginFailure, AuditOutcomeFailure, "", "", fmt.Sprintf("incorrect password (%d consecutive failures)", failures))
+	if lockedFor > 0 {
+		rpcConn.Log.Warning("CryptServiceConn.authenticate: client is locked out", "lockout_sec", int(lockedFor.Seconds()))
+		// Send optional notifications in background
+		rpcConn.notify(NotifyEvent{
+			Type:     NotifyLockout,
+			Critical: true,
+			Subject:  fmt.Sprintf("Repeated incorrect passwords - %s", rpcConn.RemoteHost),
+			Text: fmt.Sprintf("Computer %s has presented %d incorrect passwords in a row, it is now locked out for %d seconds.\r\n",
+				rpcConn.RemoteHost, failures, int(lockedFor.Seconds())),
+		})
+	}
+	return err
+}
+
 // A request to ping server and test its readiness for key operations.
 type PingRequest struct {
 	PlainPassword string         // access is granted only after the correct password is given
@@ -419,16 +707,8 @@ type PingRequest struct {
 
 // If the server is ready to manage encryption keys, return nothing successfully. Return an error if otherwise.
 func (rpcConn *CryptServiceConn) Ping(req PingRequest, _ *DummyAttr) error {
-	if req.PlainPassword != "" {
-		if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
-			return err
-		}
-	} else if rpcConn.Svc.Config.AllowHashAuth {
-		if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
-			return err
-		}
-	} else {
-		return errors.New("No valid authentication method.")
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
 	}
 	if err := rpcConn.Svc.CheckInitialSetup(); err != nil {
 		return fmt.Errorf("Ping: the server is not ready to manage encryption keys - %v", err)
@@ -468,19 +748,11 @@ type CreateKeyResp struct {
 
 // Save a new key record.
 func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp) error {
-	if req.PlainPassword != "" {
-		if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
-			return err
-		}
-	} else if rpcConn.Svc.Config.AllowHashAuth {
-		if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
-			return err
-		}
-	} else {
-		return errors.New("No valid authentication method.")
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
 	}
 	if err := req.Validate(); err != nil {
-		return err
+		return fmt.Errorf("CryptServiceConn.CreateKey: %w - %v", ErrInvalidRequest, err)
 	}
 	/*
 		No matter key is located in built-in KMIP server or external KMIP server, the KMIP client needs to create the key.
@@ -489,7 +761,7 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 		If KMIP server is the built-in one, the server will remove the prefix string before storing record UUID in built-in key database.
 		But key database only recognises UUID, there's no need for a prefix to be stored in key database.
 	*/
-	kmipKeyID, err := rpcConn.Svc.KMIPClient.CreateKey(KeyNamePrefix + req.UUID)
+	kmipKeyID, err := rpcConn.kmipClient().CreateKey(KeyNamePrefix + req.UUID)
 	if err != nil {
 		return fmt.Errorf("CryptServiceConn.CreateKey: KMIP client refused to create the key - %v", err)
 	}
@@ -517,7 +789,9 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 	keyRecord.MaxActive = req.MaxActive
 	keyRecord.AliveIntervalSec = req.AliveIntervalSec
 	keyRecord.AliveCount = req.AliveCount
-	if _, err := rpcConn.Svc.KeyDB.Upsert(keyRecord); err != nil {
+	// The computer that encrypts the disk is the first to be trusted with its key
+	keyRecord.KnownHosts = []string{rpcConn.RemoteHost}
+	if _, err := rpcConn.Svc.KeyDB.Upsert(rpcConn.Log, keyRecord); err != nil {
 		return fmt.Errorf("CryptServiceConn.CreateKey: failed to save key tracking record into database - %v", err)
 	}
 	// Ask server for the actual encryption key to formulate RPC response
@@ -529,55 +803,80 @@ func (rpcConn *CryptServiceConn) CreateKey(req CreateKeyReq, resp *CreateKeyResp
 	journalRec := keyRecord
 	journalRec.Key = nil
 	// Always log the event to system journal
-	log.Printf(`CryptServiceConn.CreateKey: %s (%s) has saved new key %s`,
-		rpcConn.RemoteHost, req.Hostname, journalRec.FormatAttrs(" "))
-	// Send optional notification email in background
-	if rpcConn.Svc.Mailer.ValidateConfig() == nil {
-		go func() {
-			// Put IP and mount point in subject and key record details in text
-			subject := fmt.Sprintf("%s - %s (%s) %s", rpcConn.Svc.Config.KeyCreationSubject,
-				rpcConn.RemoteHost, req.Hostname, journalRec.MountPoint)
-			text := fmt.Sprintf("%s\r\n\r\n%s", rpcConn.Svc.Config.KeyCreationGreeting, journalRec.FormatAttrs("\r\n"))
-			if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
-				log.Printf("CryptServiceConn.CreateKey: failed to send email notification after saving %s (%s)'s key of %s - %v",
-					rpcConn.RemoteHost, req.Hostname, journalRec.MountPoint, err)
-			}
-		}()
-	}
-
+	rpcConn.Log.Info("CryptServiceConn.CreateKey: client has saved new key", "hostname", req.Hostname, "uuid", journalRec.UUID,
+		"kmip_id", journalRec.ID, "mount_point", journalRec.MountPoint, "mount_options", journalRec.GetMountOptionStr(),
+		"max_active", journalRec.MaxActive)
+	rpcConn.audit(AuditKeyCreation, AuditOutcomeSuccess, journalRec.UUID, req.Hostname, "client has saved new key for "+journalRec.MountPoint)
+	// Send optional notifications in background, put IP and mount point in subject and key record details in text
+	config := rpcConn.Svc.currentConfig()
+	rpcConn.notify(NotifyEvent{
+		Type:     NotifyKeyCreation,
+		Hostname: req.Hostname,
+		UUIDs:    []string{journalRec.UUID},
+		Records:  []keydb.Record{journalRec},
+		Subject: fmt.Sprintf("%s - %s (%s) %s", config.KeyCreationSubject,
+			rpcConn.RemoteHost, req.Hostname, journalRec.MountPoint),
+		Text: fmt.Sprintf("%s\r\n\r\n%s", config.KeyCreationGreeting, journalRec.FormatAttrs("\r\n")),
+	})
 	return nil
 }
 
-// Log key retrieval event to stderr and send optional notification emails.
-func (rpcConn *CryptServiceConn) logRetrieval(uuids []string, hostname string, granted map[string]keydb.Record, rejected, missing []string) {
+// Log key retrieval event to stderr and send optional notifications.
+func (rpcConn *CryptServiceConn) logRetrieval(uuids []string, hostname string, manual bool, granted map[string]keydb.Record, rejected, missing []string, approvalNote string) {
 	// Always log to system journal
 	retrievedUUIDs := make([]string, 0, len(uuids))
 	for uuid := range granted {
 		retrievedUUIDs = append(retrievedUUIDs, uuid)
 	}
 	if len(granted) > 0 {
-		log.Printf(`CryptServiceConn.logRetrieval: %s (%s) has been granted keys of: %s`,
-			rpcConn.RemoteHost, hostname, strings.Join(retrievedUUIDs, " "))
+		rpcConn.Log.Info("CryptServiceConn.logRetrieval: client has been granted keys", "hostname", hostname, "uuids", retrievedUUIDs)
 	}
 	if len(rejected) > 0 {
-		log.Printf(`CryptServiceConn.logRetrieval: %s (%s) has been rejected keys of: %s`,
-			rpcConn.RemoteHost, hostname, strings.Join(rejected, " "))
+		rpcConn.Log.Warning("CryptServiceConn.logRetrieval: client has been rejected keys", "hostname", hostname, "uuids", rejected)
 	}
 	// There is really no need to log the missing keys
-	// Send optional notification email in background
-	if rpcConn.Svc.Mailer.ValidateConfig() == nil && len(granted) > 0 {
-		go func(granted map[string]keydb.Record) {
-			// Put IP + host name in subject and UUID + mount point in text
-			subject := fmt.Sprintf("%s - %s %s", rpcConn.Svc.Config.KeyRetrievalSubject, rpcConn.RemoteHost, hostname)
-			text := fmt.Sprintf("%s\r\n\r\n", rpcConn.Svc.Config.KeyRetrievalGreeting)
-			for uuid, record := range granted {
-				text += fmt.Sprintf("%s - %s\r\n", uuid, record.MountPoint)
-			}
-			if err := rpcConn.Svc.Mailer.Send(subject, text); err != nil {
-				log.Printf("CryptServiceConn.logRetrieval: failed to send email notification after granting keys to %s (%s) - %v",
-					rpcConn.RemoteHost, hostname, err)
-			}
-		}(granted)
+	for uuid, record := range granted {
+		rpcConn.audit(AuditKeyRetrieval, AuditOutcomeSuccess, uuid, hostname, "client has been granted key for "+record.MountPoint+approvalNote)
+	}
+	for _, uuid := range rejected {
+		rpcConn.audit(AuditKeyRetrieval, AuditOutcomeFailure, uuid, hostname, "client has been rejected key")
+	}
+	// Send optional notifications in background, put IP + host name in subject and UUID + mount point in text
+	if len(granted) > 0 {
+		config := rpcConn.Svc.currentConfig()
+		text := fmt.Sprintf("%s\r\n\r\n", config.KeyRetrievalGreeting)
+		records := make([]keydb.Record, 0, len(granted))
+		for uuid, record := range granted {
+			text += fmt.Sprintf("%s - %s\r\n", uuid, record.MountPoint)
+			record.Key = nil
+			records = append(records, record)
+		}
+		if approvalNote != "" {
+			text += fmt.Sprintf("\r\nThe retrieval was %s.\r\n", strings.TrimPrefix(approvalNote, " - "))
+		}
+		rpcConn.notify(NotifyEvent{
+			Type:     NotifyKeyRetrieval,
+			Hostname: hostname,
+			UUIDs:    retrievedUUIDs,
+			Subject:  fmt.Sprintf("%s - %s %s", config.KeyRetrievalSubject, rpcConn.RemoteHost, hostname),
+			Text:     text,
+			Critical: manual,
+			Records:  records,
+		})
+	}
+	if len(rejected) > 0 {
+		text := fmt.Sprintf("Computer %s %s has been refused the encryption keys of the following file systems:\r\n\r\n", rpcConn.RemoteHost, hostname)
+		for _, uuid := range rejected {
+			text += uuid + "\r\n"
+		}
+		rpcConn.notify(NotifyEvent{
+			Type:     NotifyKeyRejection,
+			Hostname: hostname,
+			UUIDs:    rejected,
+			Subject:  fmt.Sprintf("Encryption keys have been refused - %s %s", rpcConn.RemoteHost, hostname),
+			Text:     text,
+			Critical: true,
+		})
 	}
 }
 
@@ -589,18 +888,20 @@ type AutoRetrieveKeyReq struct {
 
 // A response to key retrieval (without using password) request.
 type AutoRetrieveKeyResp struct {
-	Granted  map[string]keydb.Record // these keys are now granted to the requester
-	Rejected []string                // these keys exist in database but are not allowed to be retrieved at the moment
-	Missing  []string                // these keys cannot be found in database
+	Granted         map[string]keydb.Record // these keys are now granted to the requester
+	Rejected        []string                // these keys exist in database but are not allowed to be retrieved at the moment
+	Missing         []string                // these keys cannot be found in database
+	PendingApproval []string                // these keys are withheld until an administrator approves the requester
+	LeaseID         string                  // the lease on granted keys, it is renewed by alive reports and freed by ReleaseKey
 }
 
 // Retrieve key content by KMIP record ID. Return key content.
 func (rpcConn *CryptServiceConn) askForKeyContent(kmipID string) (key []byte, err error) {
-	key, err = rpcConn.Svc.KMIPClient.GetKey(kmipID)
+	key, err = rpcConn.kmipClient().GetKey(kmipID)
 	if err != nil {
 		// This is severe enough to deserve a server side log message
 		msg := fmt.Sprintf("CryptServiceConn.askForKeyContent: KMIP client failed to answer to key request - %v", err)
-		log.Print(msg)
+		rpcConn.Log.Error("CryptServiceConn.askForKeyContent: KMIP client failed to answer to key request", "kmip_id", kmipID, "error", err)
 		return nil, errors.New(msg)
 	}
 	return
@@ -609,12 +910,20 @@ func (rpcConn *CryptServiceConn) askForKeyContent(kmipID string) (key []byte, er
 // Retrieve encryption keys without using a password. The request is usually sent automatically when disk comes online.
 func (rpcConn *CryptServiceConn) AutoRetrieveKey(req AutoRetrieveKeyReq, resp *AutoRetrieveKeyResp) error {
 	// Retrieve the keys and write down who retrieved it
+	leaseID, err := newLeaseID()
+	if err != nil {
+		return err
+	}
 	requester := keydb.AliveMessage{
 		IP:        rpcConn.RemoteHost,
 		Hostname:  req.Hostname,
 		Timestamp: time.Now().Unix(),
+		LeaseID:   leaseID,
 	}
-	resp.Granted, resp.Rejected, resp.Missing = rpcConn.Svc.KeyDB.Select(requester, true, req.UUIDs...)
+	allowedUUIDs, pendingUUIDs := rpcConn.holdUnknownHosts(requester, req.UUIDs)
+	resp.PendingApproval = pendingUUIDs
+	resp.Granted, resp.Rejected, resp.Missing = rpcConn.Svc.KeyDB.Select(rpcConn.Log, requester, true, allowedUUIDs...)
+	rpcConn.Svc.Metrics.CountKeyRetrieval(len(resp.Granted), len(resp.Rejected)+len(resp.PendingApproval), len(resp.Missing))
 	// Key content of granted records are stored in KMIP
 	for uuid, grantedRecord := range resp.Granted {
 		key, err := rpcConn.askForKeyContent(grantedRecord.ID)
@@ -624,7 +933,10 @@ func (rpcConn *CryptServiceConn) AutoRetrieveKey(req AutoRetrieveKeyReq, resp *A
 		grantedRecord.Key = key
 		resp.Granted[uuid] = grantedRecord
 	}
-	rpcConn.logRetrieval(req.UUIDs, req.Hostname, resp.Granted, resp.Rejected, resp.Missing)
+	if len(resp.Granted) > 0 {
+		resp.LeaseID = leaseID
+	}
+	rpcConn.logRetrieval(req.UUIDs, req.Hostname, false, resp.Granted, resp.Rejected, resp.Missing, "")
 	return nil
 }
 
@@ -634,6 +946,7 @@ type ManualRetrieveKeyReq struct {
 	Password      HashedPassword // access to keys is granted only after the correct password is given.
 	UUIDs         []string       // (locked) file system UUIDs
 	Hostname      string         // client's host name (for logging only)
+	ApprovalID    string         // ID of the approved operation, required only if manual retrieval requires approval.
 }
 
 // A response to forced key retrieval (with password) request.
@@ -644,16 +957,12 @@ type ManualRetrieveKeyResp struct {
 
 // Retrieve encryption keys using a password. All requested keys will be granted regardless of MaxActive restriction.
 func (rpcConn *CryptServiceConn) ManualRetrieveKey(req ManualRetrieveKeyReq, resp *ManualRetrieveKeyResp) error {
-	if req.PlainPassword != "" {
-		if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
-			return err
-		}
-	} else if rpcConn.Svc.Config.AllowHashAuth {
-		if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
-			return err
-		}
-	} else {
-		return errors.New("No valid authentication method.")
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	approvalNote, err := rpcConn.consumeApproval(req.ApprovalID, ApprovalManualRetrieval, req.UUIDs)
+	if err != nil {
+		return err
 	}
 	// Retrieve the keys and write down who retrieved it
 	requester := keydb.AliveMessage{
@@ -661,7 +970,16 @@ func (rpcConn *CryptServiceConn) ManualRetrieveKey(req ManualRetrieveKeyReq, res
 		Hostname:  req.Hostname,
 		Timestamp: time.Now().Unix(),
 	}
-	resp.Granted, _, resp.Missing = rpcConn.Svc.KeyDB.Select(requester, false, req.UUIDs...)
+	resp.Granted, _, resp.Missing = rpcConn.Svc.KeyDB.Select(rpcConn.Log, requester, false, req.UUIDs...)
+	// A computer unlocked by password is trusted to retrieve the keys without password from now on
+	for uuid := range resp.Granted {
+		if err := rpcConn.Svc.KeyDB.Update(rpcConn.Log, uuid, func(rec *keydb.Record) error {
+			rec.AddKnownHost(rpcConn.RemoteHost)
+			return nil
+		}); err != nil {
+			rpcConn.Log.Warning("CryptServiceConn.ManualRetrieveKey: failed to add known host", "uuid", uuid, "error", err)
+		}
+	}
 	// Key content of granted records are stored in KMIP
 	for uuid, grantedRecord := range resp.Granted {
 		key, err := rpcConn.askForKeyContent(grantedRecord.ID)
@@ -671,7 +989,7 @@ func (rpcConn *CryptServiceConn) ManualRetrieveKey(req ManualRetrieveKeyReq, res
 		grantedRecord.Key = key
 		resp.Granted[uuid] = grantedRecord
 	}
-	rpcConn.logRetrieval(req.UUIDs, req.Hostname, resp.Granted, []string{}, resp.Missing)
+	rpcConn.logRetrieval(req.UUIDs, req.Hostname, true, resp.Granted, []string{}, resp.Missing, approvalNote)
 	return nil
 }
 
@@ -679,20 +997,22 @@ func (rpcConn *CryptServiceConn) ManualRetrieveKey(req ManualRetrieveKeyReq, res
 type ReportAliveReq struct {
 	Hostname string   // client's host name (for logging only)
 	UUIDs    []string // UUID of disks that are reportedly alive
+	LeaseID  string   // the lease given upon key retrieval, the report renews it (optional)
 }
 
 /*
 Submit a report that says the requester is still alive and holding the encryption keys. No password required.
 Respond with UUID of keys that are rejected - which means they previously lost contact with the requester and no longer
-consider it eligible to hold the keys.
+consider it eligible to hold the keys, or the lease has been released.
 */
 func (rpcConn *CryptServiceConn) ReportAlive(req ReportAliveReq, rejectedUUIDs *[]string) error {
 	requester := keydb.AliveMessage{
 		IP:        rpcConn.RemoteHost,
 		Hostname:  req.Hostname,
 		Timestamp: time.Now().Unix(),
+		LeaseID:   req.LeaseID,
 	}
-	*rejectedUUIDs = rpcConn.Svc.KeyDB.UpdateAliveMessage(requester, req.UUIDs...)
+	*rejectedUUIDs = rpcConn.Svc.KeyDB.UpdateAliveMessage(rpcConn.Log, requester, req.UUIDs...)
 	return nil
 }
 
@@ -702,27 +1022,39 @@ type EraseKeyReq struct {
 	Password      HashedPassword // access is granted only after the correct password is given
 	Hostname      string         // client's host name (for logging only)
 	UUID          string         // UUID of the disk to delete key for
+	ApprovalID    string         // ID of the approved operation, required only if key erasure requires approval.
 }
 
 func (rpcConn *CryptServiceConn) EraseKey(req EraseKeyReq, _ *DummyAttr) error {
-	if req.PlainPassword != "" {
-		if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
-			return err
-		}
-	} else if rpcConn.Svc.Config.AllowHashAuth {
-		if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
-			return err
-		}
-	} else {
-		return errors.New("No valid authentication method.")
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	approvalNote, err := rpcConn.consumeApproval(req.ApprovalID, ApprovalKeyErasure, []string{req.UUID})
+	if err != nil {
+		return err
 	}
 	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
 	if !found {
 		// No need to return error in case key has already disappeared from key server
 		return nil
 	}
-	kmipErr := rpcConn.Svc.KMIPClient.DestroyKey(rec.ID)
-	dbErr := rpcConn.Svc.KeyDB.Erase(req.UUID)
+	kmipErr := rpcConn.kmipClient().DestroyKey(rec.ID)
+	dbErr := rpcConn.Svc.KeyDB.Erase(rpcConn.Log, req.UUID)
+	if dbErr == nil {
+		rpcConn.audit(AuditKeyErasure, AuditOutcomeSuccess, req.UUID, req.Hostname, "client has erased key for "+rec.MountPoint+approvalNote)
+		rec.Key = nil
+		rpcConn.notify(NotifyEvent{
+			Type:     NotifyKeyErasure,
+			Hostname: req.Hostname,
+			UUIDs:    []string{req.UUID},
+			Subject:  fmt.Sprintf("An encryption key has been erased - %s %s", rpcConn.RemoteHost, req.Hostname),
+			Text:     fmt.Sprintf("The key server no longer has encryption key for the following file system:\r\n\r\n%s - %s\r\n", req.UUID, rec.MountPoint),
+			Critical: true,
+			Records:  []keydb.Record{rec},
+		})
+	} else {
+		rpcConn.audit(AuditKeyErasure, AuditOutcomeFailure, req.UUID, req.Hostname, "client failed to erase key - "+dbErr.Error())
+	}
 	if dbErr == nil && kmipErr != nil {
 		return fmt.Errorf("EraseKey: key tracking record has been erased from database, but KMIP did not erase it - %v", kmipErr)
 	}
@@ -758,23 +1090,205 @@ type ReloadRecordReq struct {
 
 // ReloadRecord causes exactly one database record to be reloaded from disk.
 func (rpcConn *CryptServiceConn) ReloadRecord(req ReloadRecordReq, _ *DummyAttr) error {
-	if req.PlainPassword != "" {
-		if err := rpcConn.Svc.ValidatePlainPassword(req.PlainPassword); err != nil {
-			return err
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	if err := rpcConn.Svc.KeyDB.ReloadRecord(req.UUID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ListRecordsReq asks for all key records.
+type ListRecordsReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+}
+
+// ListRecords returns all key records sorted by latest usage, the records do not carry key content.
+func (rpcConn *CryptServiceConn) ListRecords(req ListRecordsReq, resp *[]keydb.Record) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	*resp = rpcConn.Svc.KeyDB.List()
+	return nil
+}
+
+// GetRecordReq asks for the details of a key record.
+type GetRecordReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+	UUID          string         // UUID of the disk
+}
+
+// GetRecord returns the details of a key record, the record does not carry key content.
+func (rpcConn *CryptServiceConn) GetRecord(req GetRecordReq, resp *keydb.Record) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		return fmt.Errorf("CryptServiceConn.GetRecord: %w - %s", keydb.ErrRecordNotFound, req.UUID)
+	}
+	rec.Key = nil
+	rec.CommandSecrets = nil
+	*resp = rec
+	return nil
+}
+
+// UpdateRecordReq asks server to change the mount and key usage settings of a key record.
+type UpdateRecordReq struct {
+	PlainPassword    string            // access is granted only after the correct password is given
+	Password         HashedPassword    // access is granted only after the correct password is given
+	UUID             string            // UUID of the disk
+	MountPoint       string            // new mount point of the file system
+	MountOptions     []string          // new mount options of the file system
+	MaxActive        int               // new maximum number of active key users (computers), <=0 for unlimited
+	AliveIntervalSec int               // new interval in seconds at which key users must report they're online
+	AliveCount       int               // new number of missed reports after which a key user is considered offline
+	UpdateLabels     bool              // UpdateLabels is true if Labels replace the labels of the record, older programs leave labels alone
+	Labels           map[string]string // new labels of the record
+}
+
+// Make sure that the new settings are sane.
+func (req UpdateRecordReq) Validate() error {
+	if req.MountPoint == "" {
+		return errors.New("Mount point must not be empty")
+	} else if req.AliveIntervalSec < 1 || req.AliveCount < 1 {
+		return errors.New("Alive interval and count must be positive integers")
+	}
+	for name, value := range req.Labels {
+		if !keydb.RegexLabel.MatchString(name) || !keydb.RegexLabel.MatchString(value) {
+			return fmt.Errorf("Label %s=%s may only contain letters, digits, and _.-", name, value)
 		}
-	} else if rpcConn.Svc.Config.AllowHashAuth {
-		if err := rpcConn.Svc.ValidatePassword(req.Password); err != nil {
-			return err
+	}
+	return nil
+}
+
+// UpdateRecord changes the mount and key usage settings of a key record. The change takes effect immediately.
+func (rpcConn *CryptServiceConn) UpdateRecord(req UpdateRecordReq, _ *DummyAttr) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	if err := req.Validate(); err != nil {
+		return fmt.Errorf("CryptServiceConn.UpdateRecord: %w - %v", ErrInvalidRequest, err)
+	}
+	err := rpcConn.Svc.KeyDB.Update(rpcConn.Log, req.UUID, func(rec *keydb.Record) error {
+		rec.MountPoint = req.MountPoint
+		rec.MountOptions = req.MountOptions
+		rec.MaxActive = req.MaxActive
+		rec.AliveIntervalSec = req.AliveIntervalSec
+		rec.AliveCount = req.AliveCount
+		if req.UpdateLabels {
+			rec.Labels = req.Labels
 		}
-	} else {
-		return errors.New("No valid authentication method.")
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	if err := rpcConn.Svc.KeyDB.ReloadRecord(req.UUID); err != nil {
+	rpcConn.Log.Info("CryptServiceConn.UpdateRecord: client has updated record", "uuid", req.UUID, "mount_point", req.MountPoint,
+		"mount_options", strings.Join(req.MountOptions, ","), "max_active", req.MaxActive, "alive_timeout_sec", req.AliveIntervalSec*req.AliveCount)
+	return nil
+}
+
+// SendCommandReq asks server to store a pending command for a computer to poll.
+type SendCommandReq struct {
+	PlainPassword string            // access is granted only after the correct password is given
+	Password      HashedPassword    // access is granted only after the correct password is given
+	UUID          string            // UUID of the disk affected by the command
+	IP            string            // IP of the computer that will receive the command
+	Kind          string            // kind of command, one of CommandTypes
+	Params        map[string]string // parameters specific to the kind of command (optional)
+	Secret        []byte            // recovery passphrase of CommandAddRecoveryKeyslot, it is only handed to the computer along with the key
+	Content       interface{}       // command kind sent by administrators' programs that predate typed commands
+	ValidFrom     time.Time         // the command is handed to the computer from this moment on, zero for immediately
+	Validity      time.Duration     // the command and its result expire after this duration from ValidFrom
+}
+
+// GetKind returns the kind of command, older programs only tell it in the command content.
+func (req SendCommandReq) GetKind() string {
+	if req.Kind == "" {
+		if kind, isString := req.Content.(string); isString {
+			return kind
+		}
+	}
+	return req.Kind
+}
+
+// Make sure that the command is addressed to a computer and does not expire immediately.
+func (req SendCommandReq) Validate() error {
+	if net.ParseIP(req.IP) == nil {
+		return fmt.Errorf("IP address \"%s\" is malformed", req.IP)
+	} else if !isCommandType(req.GetKind()) {
+		return fmt.Errorf("Command kind \"%s\" is not among %s", req.GetKind(), strings.Join(CommandTypes, ", "))
+	} else if req.Validity <= 0 {
+		return errors.New("Command validity must be positive")
+	} else if !req.ValidFrom.IsZero() && req.ValidFrom.Add(req.Validity).Before(time.Now()) {
+		return fmt.Errorf("Command scheduled for %s would have expired already", req.ValidFrom.Format(time.RFC3339))
+	} else if req.GetKind() == CommandAddRecoveryKeyslot && len(req.Secret) == 0 {
+		return errors.New("Recovery passphrase must not be empty")
+	} else if req.GetKind() != CommandAddRecoveryKeyslot && len(req.Secret) > 0 {
+		return fmt.Errorf("Command kind \"%s\" does not take a secret", req.GetKind())
+	}
+	return nil
+}
+
+// SendCommand stores a pending command in a key record, the computer receives it upon its next poll.
+func (rpcConn *CryptServiceConn) SendCommand(req SendCommandReq, _ *DummyAttr) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
 		return err
 	}
+	if err := req.Validate(); err != nil {
+		return fmt.Errorf("CryptServiceConn.SendCommand: %w - %v", ErrInvalidRequest, err)
+	}
+	if _, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID); !found {
+		return fmt.Errorf("CryptServiceConn.SendCommand: %w - %s", keydb.ErrRecordNotFound, req.UUID)
+	}
+	cmd, err := rpcConn.placeCommand(req, "")
+	if err != nil {
+		return err
+	}
+	rpcConn.Log.Info("CryptServiceConn.SendCommand: client has sent command", "command", cmd.Kind, "command_id", cmd.ID, "target_ip", req.IP,
+		"uuid", req.UUID, "valid_from", cmd.ValidFrom)
 	return nil
 }
 
+// placeCommand stores a new pending command made from a validated request, the command may belong to a batch.
+func (rpcConn *CryptServiceConn) placeCommand(req SendCommandReq, batchID string) (keydb.PendingCommand, error) {
+	id, err := keydb.NewCommandID()
+	if err != nil {
+		return keydb.PendingCommand{}, err
+	}
+	validFrom := req.ValidFrom
+	if validFrom.IsZero() {
+		validFrom = time.Now()
+	}
+	cmd := keydb.PendingCommand{
+		ID:        id,
+		Kind:      req.GetKind(),
+		Params:    req.Params,
+		ValidFrom: validFrom,
+		Validity:  req.Validity,
+		IP:        req.IP,
+		BatchID:   batchID,
+	}
+	if cmd.Kind == CommandMount || cmd.Kind == CommandUmount {
+		// Computers that predate typed commands understand these two kinds by command content
+		cmd.Content = cmd.Kind
+	}
+	secret := req.Secret
+	if cmd.Kind == CommandRotateKey {
+		if cmd.Params, secret, err = rpcConn.newRotationKey(req.UUID, cmd.Params); err != nil {
+			return keydb.PendingCommand{}, err
+		}
+	}
+	if err := rpcConn.Svc.KeyDB.AddPendingCommand(rpcConn.Log, req.UUID, req.IP, cmd, secret); err != nil {
+		return keydb.PendingCommand{}, err
+	}
+	return cmd, nil
+}
+
 // PollCommandReq instructs server to return the oldest unseen pending command associated with requested UUIDs.
 type PollCommandReq struct {
 	UUIDs []string // UUIDs is an array of UUID to poll commands from.
@@ -785,11 +1299,20 @@ type PollCommandResp struct {
 	Commands map[string][]keydb.PendingCommand
 }
 
-// PollCommand returns exactly one unseen pending command.
+// PollCommand returns exactly one unseen pending command whose time has come.
 func (rpcConn *CryptServiceConn) PollCommand(req PollCommandReq, resp *PollCommandResp) error {
-	*resp = PollCommandResp{Commands: make(map[string][]keydb.PendingCommand)}
-	counter := 0
-	for _, uuid := range req.UUIDs {
+	*resp, _ = rpcConn.pollCommands(req.UUIDs)
+	return nil
+}
+
+/*
+pollCommands returns the oldest unseen pending command of each record whose time has come, and marks the commands seen
+by client. Also returns the moment at which the earliest of the remaining scheduled commands becomes due, or zero time
+if there is none.
+*/
+func (rpcConn *CryptServiceConn) pollCommands(uuids []string) (resp PollCommandResp, nextDue time.Time) {
+	resp = PollCommandResp{Commands: make(map[string][]keydb.PendingCommand)}
+	for _, uuid := range uuids {
 		rec, found := rpcConn.Svc.KeyDB.GetByUUID(uuid)
 		if !found {
 			// Not-found UUID is not an error condition
@@ -801,31 +1324,234 @@ func (rpcConn *CryptServiceConn) PollCommand(req PollCommandReq, resp *PollComma
 			continue
 		}
 		for _, cmd := range cmds {
-			if cmd.IsValid() && !cmd.SeenByClient {
+			if cmd.IsValid() && !cmd.SeenByClient && !cmd.IsDue() {
+				if nextDue.IsZero() || cmd.ValidFrom.Before(nextDue) {
+					nextDue = cmd.ValidFrom
+				}
+			} else if cmd.IsValid() && !cmd.SeenByClient {
 				if _, found := resp.Commands[uuid]; !found {
 					resp.Commands[uuid] = make([]keydb.PendingCommand, 0, 1)
 				}
 				// Respond with the oldest yet still valid pending command of the record
 				resp.Commands[uuid] = append(resp.Commands[uuid], cmd)
 				// The command is now "seen" by client.
-				rpcConn.Svc.KeyDB.UpdateSeenFlag(uuid, rpcConn.RemoteHost, cmd.Content)
-				counter++
+				rpcConn.Svc.KeyDB.UpdateSeenFlag(rpcConn.Log, uuid, rpcConn.RemoteHost, cmd.ID)
 				break
 			}
 		}
 	}
-	return nil
+	return
 }
 
 // SaveCommandResultReq saves execution result of a pending command that was previously polled by a client.
 type SaveCommandResultReq struct {
-	UUID           string      // UUID is the UUID of record.
-	CommandContent interface{} // CommandContent is the content of pending command as it was originally received.
-	Result         string      // Result is a human readable text representation of execution result
+	UUID           string            // UUID is the UUID of record.
+	CommandID      string            // CommandID is the ID of pending command.
+	CommandContent interface{}       // CommandContent identifies the command for servers that predate typed commands.
+	Result         string            // Result is a human readable text representation of execution result
+	Success        bool              // Success is true only if the command has been carried out.
+	Details        map[string]string // Details are the facts gathered by the command, such as the status of a disk.
 }
 
 // SaveCommandResult saves execution result of a pending command.
 func (rpcConn *CryptServiceConn) SaveCommandResult(req SaveCommandResultReq, _ *DummyAttr) error {
-	rpcConn.Svc.KeyDB.UpdateCommandResult(req.UUID, rpcConn.RemoteHost, req.CommandContent, req.Result)
+	rec, found := rpcConn.Svc.KeyDB.GetByUUID(req.UUID)
+	if !found {
+		return nil
+	}
+	if req.CommandID == "" {
+		// Computers that predate typed commands identify the command by its content, the content may not be comparable by ==.
+		for _, cmd := range rec.PendingCommands[rpcConn.RemoteHost] {
+			if cmd.Content != nil && cmd.ClientResult == "" && reflect.DeepEqual(cmd.Content, req.CommandContent) {
+				req.CommandID = cmd.ID
+				req.Success = req.Result == "Success"
+				break
+			}
+		}
+	}
+	cmd, found := rec.GetPendingCommand(rpcConn.RemoteHost, req.CommandID)
+	if !found {
+		return nil
+	}
+	if cmd.Kind == CommandRotateKey && cmd.ClientResult == "" {
+		// Only the first result of key rotation decides whether the new key takes effect
+		rpcConn.finishKeyRotation(rec, cmd, req.Success)
+	}
+	rpcConn.Svc.KeyDB.UpdateCommandResult(rpcConn.Log, req.UUID, rpcConn.RemoteHost, req.CommandID, req.Result,
+		keydb.CommandResult{Success: req.Success, Details: req.Details})
+	rpcConn.Log.Info("CryptServiceConn.SaveCommandResult: client has executed command", "command", cmd.Kind, "command_id", cmd.ID,
+		"uuid", req.UUID, "success", req.Success, "result", req.Result)
+	return nil
+}
+
+// SubmitCertRequestReq carries a certificate signing request from a client computer that does not yet have a certificate.
+type SubmitCertRequestReq struct {
+	Hostname string // client's host name (for logging only)
+	CSRPEM   []byte // PEM-encoded certificate signing request
+}
+
+// SubmitCertRequest places a client certificate request in the queue for administrator's approval. No password required.
+func (rpcConn *CryptServiceConn) SubmitCertRequest(req SubmitCertRequestReq, id *string) error {
+	reqID, err := rpcConn.Svc.CertRequests.Submit(req.CSRPEM, rpcConn.RemoteHost, req.Hostname)
+	if err != nil {
+		return err
+	}
+	*id = reqID
+	rpcConn.Log.Info("CryptServiceConn.SubmitCertRequest: client has requested a client certificate", "hostname", req.Hostname, "cert_request_id", reqID)
+	// Send optional notifications in background
+	rpcConn.notify(NotifyEvent{
+		Type:     NotifyCertRequest,
+		Hostname: req.Hostname,
+		Subject:  fmt.Sprintf("Client certificate request - %s %s", rpcConn.RemoteHost, req.Hostname),
+		Text: fmt.Sprintf("Computer %s (%s) is waiting for a client certificate. The request ID is %s.\r\n"+
+			"Run \"cryptctl approve-client\" on the key server to approve or reject the request.\r\n",
+			rpcConn.RemoteHost, req.Hostname, reqID),
+	})
+	return nil
+}
+
+// CollectClientCertReq asks for the signed certificate of a previously submitted request.
+type CollectClientCertReq struct {
+	ID string // ID of the certificate request
+}
+
+// CollectClientCertResp tells whether the request has been approved, and carries the signed certificate chain if so.
+type CollectClientCertResp struct {
+	Approved bool   // Approved is true only if administrator has approved the request
+	CertPEM  []byte // CertPEM is the PEM-encoded certificate chain, it is empty if request has not yet been approved.
+}
+
+/*
+CollectClientCert hands out the signed certificate of an approved request. No password required, but the request must
+be collected by the same IP that submitted it. Once collected, the request disappears from the queue.
+*/
+func (rpcConn *CryptServiceConn) CollectClientCert(req CollectClientCertReq, resp *CollectClientCertResp) error {
+	certReq, err := rpcConn.Svc.CertRequests.Collect(req.ID, rpcConn.RemoteHost)
+	if err != nil {
+		return err
+	}
+	resp.Approved = certReq.IsApproved()
+	resp.CertPEM = certReq.CertPEM
+	if resp.Approved {
+		rpcConn.Log.Info("CryptServiceConn.CollectClientCert: client has collected its client certificate", "hostname", certReq.Hostname, "cert_request_id", req.ID)
+	}
+	return nil
+}
+
+// ListCertRequestsReq asks for all client certificate requests.
+type ListCertRequestsReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+}
+
+// ListCertRequests returns all client certificate requests, the oldest request comes first.
+func (rpcConn *CryptServiceConn) ListCertRequests(req ListCertRequestsReq, resp *[]ClientCertRequest) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	*resp = rpcConn.Svc.CertRequests.List()
 	return nil
 }
+
+// ApproveCertRequestReq approves or rejects a client certificate request.
+type ApproveCertRequestReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+	ID            string         // ID of the certificate request
+	Reject        bool           // Reject removes the request from queue instead of approving it
+}
+
+/*
+ApproveCertRequest signs a client certificate request using the built-in certificate authority, or rejects the request.
+The client collects its certificate afterwards.
+*/
+func (rpcConn *CryptServiceConn) ApproveCertRequest(req ApproveCertRequestReq, _ *DummyAttr) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	if req.Reject {
+		if err := rpcConn.Svc.CertRequests.Reject(req.ID); err != nil {
+			return err
+		}
+		rpcConn.Log.Info("CryptServiceConn.ApproveCertRequest: client has rejected certificate request", "cert_request_id", req.ID)
+		return nil
+	}
+	// Read CA certificate and key locations together, a reload may change both of them
+	config := rpcConn.Svc.currentConfig()
+	if config.CertAuthorityPEM == "" || config.CertAuthorityKeyPEM == "" {
+		return errors.New("ApproveCertRequest: the key server does not use the built-in certificate authority, hence it cannot sign certificates")
+	}
+	ca, err := LoadCertAuthority(config.CertAuthorityPEM, config.CertAuthorityKeyPEM)
+	if err != nil {
+		return err
+	}
+	certReq, err := rpcConn.Svc.CertRequests.Approve(req.ID, ca)
+	if err != nil {
+		return err
+	}
+	rpcConn.Log.Info("CryptServiceConn.ApproveCertRequest: client has approved certificate request", "cert_request_id", req.ID,
+		"requester_ip", certReq.IP, "requester_hostname", certReq.Hostname, "common_name", certReq.CommonName)
+	return nil
+}
+
+// RevokeClientReq revokes a client certificate or denies a host, or lifts an earlier revocation.
+type RevokeClientReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+	Kind          string         // Kind is one of RevokeSerial, RevokeFingerprint, or RevokeHost.
+	Value         string         // Value is the certificate serial number, fingerprint, or host IP/name.
+	Reason        string         // Reason is a human readable text recorded along with the revocation.
+	Lift          bool           // Lift removes the revocation instead of making it
+}
+
+// RevokeClient revokes a client certificate or denies a host. The revocation takes effect on the next connection.
+func (rpcConn *CryptServiceConn) RevokeClient(req RevokeClientReq, _ *DummyAttr) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	if req.Lift {
+		if err := rpcConn.Svc.Revocations.Lift(req.Kind, req.Value); err != nil {
+			return err
+		}
+		rpcConn.Log.Info("CryptServiceConn.RevokeClient: client has lifted revocation", "kind", req.Kind, "value", req.Value)
+		return nil
+	}
+	if err := rpcConn.Svc.Revocations.Revoke(req.Kind, req.Value, req.Reason); err != nil {
+		return err
+	}
+	rpcConn.Log.Info("CryptServiceConn.RevokeClient: client has revoked", "kind", req.Kind, "value", req.Value, "reason", req.Reason)
+	return nil
+}
+
+// ListRevocationsReq asks for all revoked client certificates and denied hosts.
+type ListRevocationsReq struct {
+	PlainPassword string         // access is granted only after the correct password is given
+	Password      HashedPassword // access is granted only after the correct password is given
+}
+
+// ListRevocations returns all revoked client certificates and denied hosts.
+func (rpcConn *CryptServiceConn) ListRevocations(req ListRevocationsReq, resp *[]Revocation) error {
+	if err := rpcConn.authenticate(req.PlainPassword, req.Password); err != nil {
+		return err
+	}
+	*resp = rpcConn.Svc.Revocations.List()
+	return nil
+}
+
+/*
+CryptEnrolmentConn serves connections from clients that have not presented a certificate while the server demands one.
+Such clients may only request a certificate and collect it.
+*/
+type CryptEnrolmentConn struct {
+	conn *CryptServiceConn
+}
+
+// SubmitCertRequest places a client certificate request in the queue for administrator's approval.
+func (enrolConn *CryptEnrolmentConn) SubmitCertRequest(req SubmitCertRequestReq, id *string) error {
+	return enrolConn.conn.SubmitCertRequest(req, id)
+}
+
+// CollectClientCert hands out the signed certificate of an approved request.
+func (enrolConn *CryptEnrolmentConn) CollectClientCert(req CollectClientCertReq, resp *CollectClientCertResp) error {
+	return enrolConn.conn.CollectClientCert(req, resp)
+}
@@ -4,6 +4,7 @@ package keyserv
 
 import (
 	"crypto/sha512"
+	"crypto/tls"
 	"encoding/hex"
 	"path"
 	"reflect"
@@ -109,9 +110,35 @@ func TestServiceReadFromSysconfig(t *testing.T) {
 		KeyRetrievalGreeting: "d",
 		KMIPAddresses:        []string{},
 		KMIPTLSDoVerify:      true,
+		RateLimitPerMinute:   300,
+		RateLimitBurst:       100,
+		AuthFailureThreshold: 5,
+		AuthLockoutSec:       60,
+		AuthLockoutMaxSec:    3600,
+		ShutdownTimeoutSec:   30,
+		MetricsAddress:       "",
+		RESTPort:             0,
+		AuditSyslogAddress:   "",
+		Webhooks:             []WebhookNotifier{},
+		LivenessScanSec:      60,
+		ApprovalOperations:   []string{},
+		ApprovalTimeoutSec:   900,
+		ApproveNewHosts:      false,
+		HostGroups:           map[string][]string{},
 	}) {
 		t.Fatalf("%+v", svcConf)
 	}
+	// Clients must present a certificate unless enrolment is enabled
+	if auth := svcConf.ClientAuth(); auth != tls.RequireAndVerifyClientCert {
+		t.Fatal(auth)
+	}
+	sysconf.Set(SRV_CONF_TLS_CERT_ENROLMENT, true)
+	if err := svcConf.ReadFromSysconfig(sysconf); err != nil || !svcConf.AllowCertEnrolment {
+		t.Fatal(err, svcConf.AllowCertEnrolment)
+	}
+	if auth := svcConf.ClientAuth(); auth != tls.VerifyClientCertIfGiven {
+		t.Fatal(auth)
+	}
 }
 
 // RPC functions are tested by CryptClient test cases.
@@ -0,0 +1,165 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DrainPollIntervalMS = 100 // DrainPollIntervalMS is the interval at which draining checks for requests that are still in progress.
+)
+
+/*
+connTracker keeps track of open connections and requests in progress, so that a server may stop taking new requests
+and let the ongoing ones finish before shutting down.
+All functions are safe for concurrent usage.
+*/
+type connTracker struct {
+	conns      map[net.Conn]struct{}
+	inFlight   int
+	draining   bool
+	drainBegin chan struct{} // drainBegin is closed when draining begins
+	lock       *sync.Mutex
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]struct{}), drainBegin: make(chan struct{}), lock: new(sync.Mutex)}
+}
+
+// DrainBegin returns a channel that is closed when draining begins, long running requests should then complete early.
+func (tracker *connTracker) DrainBegin() <-chan struct{} {
+	return tracker.drainBegin
+}
+
+// Add remembers an open connection. Return false if the server is draining, in which case caller should close the connection.
+func (tracker *connTracker) Add(conn net.Conn) bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.draining {
+		return false
+	}
+	tracker.conns[conn] = struct{}{}
+	return true
+}
+
+// Remove forgets a connection that has been closed.
+func (tracker *connTracker) Remove(conn net.Conn) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	delete(tracker.conns, conn)
+}
+
+// BeginRequest counts a request in progress. Return false if the server is draining, in which case caller should not process the request.
+func (tracker *connTracker) BeginRequest() bool {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.draining {
+		return false
+	}
+	tracker.inFlight++
+	return true
+}
+
+// EndRequest counts a request that has completed.
+func (tracker *connTracker) EndRequest() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	tracker.inFlight--
+}
+
+// InFlight returns the number of requests in progress.
+func (tracker *connTracker) InFlight() int {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	return tracker.inFlight
+}
+
+/*
+Drain refuses new connections and requests, waits up to the timeout for requests in progress to complete, and then
+closes all connections. Return false if some requests were still in progress when the timeout was reached.
+*/
+func (tracker *connTracker) Drain(timeout time.Duration) (finished bool) {
+	tracker.lock.Lock()
+	if !tracker.draining {
+		tracker.draining = true
+		close(tracker.drainBegin)
+	}
+	tracker.lock.Unlock()
+	deadline := time.Now().Add(timeout)
+	for {
+		if finished = tracker.InFlight() == 0; finished || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(DrainPollIntervalMS * time.Millisecond)
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	for conn := range tracker.conns {
+		conn.Close()
+	}
+	return
+}
+
+/*
+GracefulShutdown stops accepting connections, waits up to the timeout for RPC requests and then built-in KMIP server
+requests in progress to complete, closes all connections, and removes the domain socket file.
+Return false if some requests had to be interrupted.
+*/
+func (srv *CryptServer) GracefulShutdown(timeout time.Duration) (finished bool) {
+	if srv.TCPListener != nil {
+		srv.TCPListener.Close()
+	}
+	if srv.UnixListener != nil {
+		srv.UnixListener.Close()
+	}
+	if srv.MetricsListener != nil {
+		srv.MetricsListener.Close()
+	}
+	if srv.RESTListener != nil {
+		srv.RESTListener.Close()
+	}
+	start := time.Now()
+	finished = srv.conns.Drain(timeout)
+	if !finished {
+		srv.Log.Warning("CryptServer.GracefulShutdown: RPC requests did not complete in time, connections are closed anyway", "timeout", timeout.String())
+	}
+	if srv.restServer != nil {
+		// REST API requests were counted among RPC requests, close the idle connections.
+		srv.restServer.Close()
+	}
+	// RPC requests may use built-in KMIP server, hence it shuts down afterwards.
+	if kmipServer := srv.BuiltInKMIPServer; kmipServer != nil {
+		remaining := timeout - time.Since(start)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if !kmipServer.GracefulShutdown(remaining) {
+			srv.Log.Warning("CryptServer.GracefulShutdown: KMIP requests did not complete in time, connections are closed anyway")
+			finished = false
+		}
+	}
+	// Audit events of the completed requests are delivered or buffered before the program exits.
+	srv.Audit.Close()
+	// Notifications waiting for digest stay on disk and will be mailed after restart.
+	srv.MailDigest.Close()
+	srv.Liveness.Close()
+	if srv.UnixListener != nil {
+		if err := os.Remove(DomainSocketFile); err != nil && !os.IsNotExist(err) {
+			srv.Log.Warning("CryptServer.GracefulShutdown: failed to remove domain socket file", "error", err)
+		}
+	}
+	return
+}
+
+/*
+GracefulShutdown stops accepting connections, waits up to the timeout for requests in progress to complete, and then
+closes all connections. Return false if some requests had to be interrupted.
+*/
+func (srv *KMIPServer) GracefulShutdown(timeout time.Duration) bool {
+	srv.Shutdown()
+	return srv.conns.Drain(timeout)
+}
@@ -0,0 +1,91 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package keyserv
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnTracker(t *testing.T) {
+	tracker := newConnTracker()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	if !tracker.Add(conn) || !tracker.BeginRequest() || tracker.InFlight() != 1 {
+		t.Fatal("did not track")
+	}
+	// Request in progress does not complete in time
+	if tracker.Drain(200 * time.Millisecond) {
+		t.Fatal("did not time out")
+	}
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Fatal("connection did not close")
+	}
+	// Draining tracker refuses new connections and requests
+	if tracker.Add(conn) || tracker.BeginRequest() {
+		t.Fatal("did not refuse")
+	}
+	tracker.EndRequest()
+	if !tracker.Drain(time.Second) {
+		t.Fatal("did not finish")
+	}
+}
+
+func TestCryptServerGracefulShutdown(t *testing.T) {
+	client, srv, _ := StartTestServer(t)
+	defer func() {
+		os.RemoveAll(srv.Config.KeyDBDir)
+		os.RemoveAll(srv.Config.CertRequestDir())
+		os.RemoveAll(srv.Config.RevocationFile())
+	}()
+	// Background routines are started by the daemon and stop along with the server
+	digestStopped := make(chan struct{})
+	go func() {
+		srv.RunMailDigest()
+		close(digestStopped)
+	}()
+	livenessStopped := make(chan struct{})
+	go func() {
+		srv.RunLivenessScan()
+		close(livenessStopped)
+	}()
+	// Pretend that a request is in progress
+	if !srv.conns.BeginRequest() {
+		t.Fatal("did not begin")
+	}
+	finished := make(chan bool, 1)
+	go func() {
+		finished <- srv.GracefulShutdown(10 * time.Second)
+	}()
+	time.Sleep(500 * time.Millisecond)
+	// New connections are refused while the request is in progress
+	if err := client.Ping(PingRequest{PlainPassword: TEST_RPC_PASS}); err == nil {
+		t.Fatal("server still accepts connections")
+	}
+	select {
+	case <-finished:
+		t.Fatal("did not wait for request in progress")
+	default:
+	}
+	srv.conns.EndRequest()
+	select {
+	case ok := <-finished:
+		if !ok {
+			t.Fatal("did not finish gracefully")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not shut down")
+	}
+	select {
+	case <-digestStopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mail digest did not stop")
+	}
+	select {
+	case <-livenessStopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("liveness scan did not stop")
+	}
+}
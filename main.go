@@ -12,6 +12,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 )
 
@@ -26,16 +27,52 @@ Maintain a key server:
   cryptctl list-keys       Show all encryption keys.
   cryptctl show-key UUID   Display pending-commands and details of a key.
   cryptctl edit-key UUID   Edit stored key information.
-  cryptctl send-command    Record a pending mount/umount command for a disk.
+  cryptctl send-command    Record a pending command for disks and computers.
+  cryptctl show-batch ID   Display the results of a command sent to many
+                           computers or disks at once.
+  cryptctl list-commands   Show scheduled, pending, delivered and completed
+                           commands of all disks.
+                           The six commands above accept "--server host:port"
+                           to manage a remote key server.
   cryptctl clear-commands  Clear all pending commands of a disk.
+  cryptctl issue-client-cert
+                           Issue a client certificate using built-in CA.
+  cryptctl approve-client  Approve or reject a client certificate request.
+  cryptctl revoke-client   Revoke a client certificate or deny a host.
+  cryptctl approve-host    Approve or refuse a computer that asks for a key
+                           it is not known to use.
+  cryptctl approve-operation
+                           Approve or reject a key retrieval or erasure
+                           requested by another administrator.
 
 Encrypt/unlock file systems:
   cryptctl encrypt         Set up a new file system for encryption.
   cryptctl online-unlock   Forcibly unlock all file systems via key server.
-  cryptctl offline-unlock  Unlock a file system via a key record file.`)
+  cryptctl offline-unlock  Unlock a file system via a key record file.
+  cryptctl request-client-cert
+                           Request a client certificate from key server.`)
 	os.Exit(exitStatus)
 }
 
+/*
+Remove "--server host:port" or "--server=host:port" from command line parameters, return the server address and the
+remaining parameters.
+*/
+func extractServerFlag(args []string) (keyServer string, remaining []string) {
+	remaining = make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--server" && i+1 < len(args) {
+			keyServer = args[i+1]
+			i++
+		} else if strings.HasPrefix(args[i], "--server=") {
+			keyServer = strings.TrimPrefix(args[i], "--server=")
+		} else {
+			remaining = append(remaining, args[i])
+		}
+	}
+	return
+}
+
 func main() {
 	// Print stack trace of all goroutines on SIGQUIT for debugging
 	osSignal := make(chan os.Signal, 1)
@@ -75,33 +112,77 @@ func main() {
 		}
 	case "list-keys":
 		// Server - print all key records sorted according to last access
-		if err := command.ListKeys(); err != nil {
+		keyServer, _ := extractServerFlag(os.Args[2:])
+		if err := command.ListKeys(keyServer); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "edit-key":
 		// Server - let user edit key details such as mount point and mount options
-		if len(os.Args) < 3 {
+		keyServer, args := extractServerFlag(os.Args[2:])
+		if len(args) < 1 {
 			sys.ErrorExit("Please specify UUID of the key that you wish to edit.")
 		}
-		if err := command.EditKey(os.Args[2]); err != nil {
+		if err := command.EditKey(keyServer, args[0]); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "show-key":
 		// Server - show key record details except key content
-		if len(os.Args) < 3 {
+		keyServer, args := extractServerFlag(os.Args[2:])
+		if len(args) < 1 {
 			sys.ErrorExit("Please specify UUID of the key that you wish to see.")
 		}
-		if err := command.ShowKey(os.Args[2]); err != nil {
+		if err := command.ShowKey(keyServer, args[0]); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "send-command":
-		if err := command.SendCommand(); err != nil {
+		keyServer, _ := extractServerFlag(os.Args[2:])
+		if err := command.SendCommand(keyServer); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "show-batch":
+		// Server - show the results of a command sent to many computers or disks at once
+		keyServer, args := extractServerFlag(os.Args[2:])
+		if len(args) < 1 {
+			sys.ErrorExit("Please specify ID of the command batch that you wish to see.")
+		}
+		if err := command.ShowCommandBatch(keyServer, args[0]); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "list-commands":
+		// Server - show the commands of all disks, including those scheduled for later
+		keyServer, _ := extractServerFlag(os.Args[2:])
+		if err := command.ListCommands(keyServer); err != nil {
 			sys.ErrorExit("%v", err)
 		}
 	case "clear-commands":
 		if err := command.ClearPendingCommands(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "issue-client-cert":
+		// Server - issue a client certificate using the built-in certificate authority
+		if err := command.IssueClientCert(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "approve-client":
+		// Server - approve or reject a certificate request submitted by client computer
+		if err := command.ApproveClient(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "approve-host":
+		// Server - approve or refuse an unknown computer that asked for a key
+		if err := command.ApproveHost(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "approve-operation":
+		// Server - approve or reject an operation submitted by another administrator
+		if err := command.ApproveOperation(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
+	case "revoke-client":
+		// Server - revoke a client certificate or deny a host from contacting the server
+		if err := command.RevokeClient(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "client-daemon":
 		// Client - run daemon that primarily polls and reacts to pending commands issued by RPC server
 		if err := command.ClientDaemon(); err != nil {
@@ -130,6 +211,11 @@ func main() {
 		if err := command.ManOfflineUnlockFS(); err != nil {
 			sys.ErrorExit("%v", err)
 		}
+	case "request-client-cert":
+		// Client - obtain a client certificate from key server upon administrator's approval
+		if err := command.RequestClientCert(); err != nil {
+			sys.ErrorExit("%v", err)
+		}
 	case "erase":
 		// Client - erase encryption headers for the encrypted disk
 		if err := command.EraseKey(); err != nil {
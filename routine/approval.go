@@ -0,0 +1,54 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package routine
+
+import (
+	"cryptctl/keyserv"
+	"cryptctl/sys"
+	"fmt"
+	"io"
+	"time"
+)
+
+const APPROVAL_POLL_INTERVAL_SEC = 5
+
+/*
+WaitForApproval submits the operation for approval by another administrator if the key server requires so, and waits
+until the operation is approved. Return the approval ID that authorises the operation, or an empty string if the
+operation does not require approval.
+*/
+func WaitForApproval(progressOut io.Writer, client *keyserv.CryptClient, password, operation string, uuids []string) (string, error) {
+	hello, err := client.Hello()
+	if err != nil {
+		// Without knowing the approval policy, the operation must not be attempted
+		return "", fmt.Errorf("WaitForApproval: cannot find out whether %s requires approval - %v", operation, err)
+	} else if !hello.RequiresApproval(operation) {
+		// A server that does not tell its approval policy predates two-person approval
+		return "", nil
+	}
+	hostname, _ := sys.GetHostnameAndIP()
+	approval, err := client.RequestApproval(keyserv.RequestApprovalReq{
+		PlainPassword: password,
+		Operation:     operation,
+		UUIDs:         uuids,
+		Hostname:      hostname,
+	})
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(progressOut, "The key server requires another administrator to approve %s.\n", operation)
+	fmt.Fprintf(progressOut, "Please ask them to run \"cryptctl approve-operation\" on the key server, the approval ID is:\n%s\n",
+		approval.ID)
+	fmt.Fprintf(progressOut, "Waiting for approval until %s...\n", approval.ExpiresAt.Format("2006-01-02 15:04:05"))
+	for {
+		time.Sleep(APPROVAL_POLL_INTERVAL_SEC * time.Second)
+		approval, err = client.GetApproval(keyserv.GetApprovalReq{PlainPassword: password, ID: approval.ID})
+		if err != nil {
+			return "", fmt.Errorf("WaitForApproval: the operation has not been approved - %v", err)
+		}
+		if approval.IsApproved() {
+			fmt.Fprintf(progressOut, "%s has approved the operation.\n", approval.Approver)
+			return approval.ID, nil
+		}
+	}
+}
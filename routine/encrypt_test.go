@@ -364,12 +364,13 @@ func TestEncryptDecrypt(t *testing.T) {
 	for i := 0; i < 2; i++ {
 		go func(i int) {
 			log.Printf("About to run auto-unlock routine #%d on disk %s", i, loop0Dev.UUID)
-			err := AutoOnlineUnlockFS(os.Stdout, client, loop0Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
+			// Both routines run on the same computer, the second retrieval supersedes the lease of the first one.
+			_, err := AutoOnlineUnlockFS(os.Stdout, client, loop0Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
 			// Once key is retrieved successfully, begin sending alive messages.
 			if err == nil {
 				log.Printf("Auto-unlock routine #%d of disk %s succeeded, going to send keep-alive in background.", i, loop0Dev.UUID)
 				go func(i int) {
-					if aliveErr := ReportAlive(os.Stdout, client, loop0Dev.UUID); aliveErr != nil && !reportAliveMayEnd {
+					if aliveErr := ReportAlive(os.Stdout, client, loop0Dev.UUID, ""); aliveErr != nil && !reportAliveMayEnd {
 						log.Printf("Keep-alive routine #%d of disk %s terminated - %v", i, loop0Dev.UUID, aliveErr)
 						t.Log(aliveErr)
 					} else {
@@ -385,11 +386,11 @@ func TestEncryptDecrypt(t *testing.T) {
 	// Next two attempts are made against loop1 that only allows one active user. Only one attempt should succeed.
 	for i := 2; i < 4; i++ {
 		go func(i int) {
-			err := AutoOnlineUnlockFS(os.Stdout, client, loop1Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
+			leaseID, err := AutoOnlineUnlockFS(os.Stdout, client, loop1Dev.UUID, REPORT_ALIVE_INTERVAL_SEC*2)
 			// Once key is retrieved successfully, begin sending alive messages.
 			if err == nil {
 				go func() {
-					if aliveErr := ReportAlive(os.Stdout, client, loop1Dev.UUID); aliveErr != nil && !reportAliveMayEnd {
+					if aliveErr := ReportAlive(os.Stdout, client, loop1Dev.UUID, leaseID); aliveErr != nil && !reportAliveMayEnd {
 						t.Log(aliveErr)
 					} else {
 						finishedReportAlive.Done()
@@ -401,7 +402,8 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 	// The second last attempt is made against a disk that does not have key on the server.
 	go func() {
-		onlineUnlockAttempt[4] <- AutoOnlineUnlockFS(os.Stdout, client, "this-uuid-does-not-exist", 15)
+		_, err := AutoOnlineUnlockFS(os.Stdout, client, "this-uuid-does-not-exist", 15)
+		onlineUnlockAttempt[4] <- err
 	}()
 
 	// Bring server online now
@@ -440,7 +442,7 @@ func TestEncryptDecrypt(t *testing.T) {
 		}
 	}
 	// Sending alive message to non-existing reports should result in immediate rejection
-	if ReportAlive(os.Stdout, client, "this-uuid-does-not-exist") == nil {
+	if ReportAlive(os.Stdout, client, "this-uuid-does-not-exist", "") == nil {
 		t.Fatal("did not error")
 	}
 	/*
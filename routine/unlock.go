@@ -36,11 +36,16 @@ func ManOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, passw
 	if len(reqUUIDs) == 0 {
 		return errors.New("Cannot find any more encrypted file systems.")
 	}
+	approvalID, err := WaitForApproval(progressOut, client, password, keyserv.ApprovalManualRetrieval, reqUUIDs)
+	if err != nil {
+		return err
+	}
 	hostname, _ := sys.GetHostnameAndIP()
 	resp, err := client.ManualRetrieveKey(keyserv.ManualRetrieveKeyReq{
 		UUIDs:         reqUUIDs,
 		Hostname:      hostname,
 		PlainPassword: password,
+		ApprovalID:    approvalID,
 	})
 	if err != nil {
 		return err
@@ -139,17 +144,19 @@ func UnlockFS(progressOut io.Writer, rec keydb.Record, maxAttempts int) error {
 /*
 Make continuous attempts to retrieve encryption key from key server to unlock a file system specified by the UUID.
 If maxRetrySec is zero or negative, then only one attempt will be made to unlock the file system.
+Return the lease given by key server, the lease is renewed by alive reports and should be released once the file system
+is no longer in use. Older key servers do not give a lease.
 */
-func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid string, maxRetrySec int64) error {
+func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid string, maxRetrySec int64) (leaseID string, err error) {
 	sys.LockMem()
 	// Find out UUID of the block device
 	blkDevs := fs.GetBlockDevices()
 	blkDev, found := blkDevs.GetByCriteria(uuid, "", "", "", "", "", "")
 	if !found {
-		return fmt.Errorf("AutoOnlineUnlockFS: failed to get information of \"%s\"", uuid)
+		return "", fmt.Errorf("AutoOnlineUnlockFS: failed to get information of \"%s\"", uuid)
 	} else if !blkDev.IsLUKSEncrypted() {
 		fmt.Fprintf(progressOut, "AutoOnlineUnlockFS: skip \"%s\" as it is not a LUKS-encrypted block device\n", uuid)
-		return nil
+		return "", nil
 	}
 	// Keep trying until maxRetrySec elapses
 	numFailures := 0
@@ -165,20 +172,23 @@ func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid
 			rec, exists := resp.Granted[blkDev.UUID]
 			if exists {
 				// Key has been granted by server, proceed to unlock disk.
-				return UnlockFS(progressOut, rec, 3)
+				return resp.LeaseID, UnlockFS(progressOut, rec, 3)
 			}
 			if len(resp.Missing) > 0 {
 				// Stop trying if the server does not even have the key
-				return fmt.Errorf("AutoOnlineUnlockFS: server does not have encryption key for \"%s\"", blkDev.UUID)
+				return "", fmt.Errorf("AutoOnlineUnlockFS: server does not have encryption key for \"%s\"", blkDev.UUID)
 			}
 		}
 		// Server may have rejected the key request due to MaxActive being exceeded
 		if len(resp.Rejected) > 0 {
 			err = errors.New("MaxActive is exceeded")
+		} else if len(resp.PendingApproval) > 0 {
+			// Keep trying while an administrator approves this computer
+			err = errors.New("this computer is waiting for administrator's approval via \"cryptctl approve-host\"")
 		}
 		// Retry the operation for a while
 		if time.Now().Unix() > begin+maxRetrySec {
-			return fmt.Errorf("AutoOnlineUnlockFS: failed to unlock \"%s\" (%v) and have given up after %d seconds",
+			return "", fmt.Errorf("AutoOnlineUnlockFS: failed to unlock \"%s\" (%v) and have given up after %d seconds",
 				blkDev.UUID, err, maxRetrySec)
 		}
 		// In case of failure, only report the first few occasions among consecutive failures.
@@ -197,9 +207,10 @@ func AutoOnlineUnlockFS(progressOut io.Writer, client *keyserv.CryptClient, uuid
 
 /*
 Continuously send alive reports to server to indicate that this computer is still holding onto the encrypted disk.
+The reports renew the lease given upon key retrieval, the lease ID may be empty for older key servers.
 Block caller until the program quits or server rejects this computer.
 */
-func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid string) error {
+func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid, leaseID string) error {
 	fmt.Fprintf(progressOut, "ReportAlive: begin sending messages for encrypted disk \"%s\"\n", uuid)
 	numFailures := 0
 	for {
@@ -208,6 +219,7 @@ func ReportAlive(progressOut io.Writer, client *keyserv.CryptClient, uuid string
 		rejected, err := client.ReportAlive(keyserv.ReportAliveReq{
 			Hostname: hostname,
 			UUIDs:    []string{uuid},
+			LeaseID:  leaseID,
 		})
 		if len(rejected) > 0 {
 			return fmt.Errorf("ReportAlive: stop sending messages for disk \"%s\" because server has rejected it", uuid)
@@ -241,6 +253,11 @@ func EraseKey(progressOut io.Writer, client *keyserv.CryptClient, password, uuid
 	if !foundHost {
 		return fmt.Errorf("EraseKey: cannot find a block device corresponding to UUID \"%s\"", uuid)
 	}
+	// Obtain approval before the irreversible erasure of encryption metadata
+	approvalID, err := WaitForApproval(progressOut, client, password, keyserv.ApprovalKeyErasure, []string{uuid})
+	if err != nil {
+		return err
+	}
 	unlockedDevPath := MakeDeviceMapperName(hostDev.Path)
 	unlockedDev, foundUnlocked := blkDevs.GetByCriteria("", path.Join("/dev/mapper", unlockedDevPath), "", "", "", "", "")
 	if foundUnlocked {
@@ -264,7 +281,8 @@ func EraseKey(progressOut io.Writer, client *keyserv.CryptClient, password, uuid
 	if err := client.EraseKey(keyserv.EraseKeyReq{
 		PlainPassword: password,
 		Hostname:      hostname,
-		UUID:          uuid}); err != nil {
+		UUID:          uuid,
+		ApprovalID:    approvalID}); err != nil {
 		return err
 	}
 	fmt.Fprintf(progressOut, "Encryption header has been wiped successfully, data in \"%s\" (%s) is now irreversibly lost.\n",
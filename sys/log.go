@@ -0,0 +1,226 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogFormatText = "text" // LogFormatText prints log messages in plain text followed by key=value fields.
+	LogFormatJSON = "json" // LogFormatJSON prints each log message as a JSON object on its own line.
+
+	LogKeyRequestID = "request_id" // LogKeyRequestID is the field that identifies log messages of the same RPC connection.
+
+	SYSCONF_LOG_FORMAT = "LOG_FORMAT" // SYSCONF_LOG_FORMAT is the sysconfig key of log output format, shared by server and client.
+	SYSCONF_LOG_LEVEL  = "LOG_LEVEL"  // SYSCONF_LOG_LEVEL is the sysconfig key of minimum log level, shared by server and client.
+)
+
+// LogLevel determines the importance of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+// String returns the lower case name of the log level.
+func (level LogLevel) String() string {
+	switch level {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarning:
+		return "warning"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("level%d", int(level))
+}
+
+// ParseLogLevel returns the log level of the name, such as "info".
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level := LogDebug; level <= LogError; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return LogInfo, fmt.Errorf("ParseLogLevel: unknown log level \"%s\"", name)
+}
+
+var (
+	logFormat   = LogFormatText
+	logMinLevel = LogInfo
+	logLock     = new(sync.Mutex)
+)
+
+// SetLogFormat changes the output format of all loggers to either LogFormatText or LogFormatJSON.
+func SetLogFormat(format string) error {
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("SetLogFormat: unknown log format \"%s\"", format)
+	}
+	logLock.Lock()
+	defer logLock.Unlock()
+	logFormat = format
+	return nil
+}
+
+// SetLogLevel changes the minimum level of messages printed by all loggers.
+func SetLogLevel(level LogLevel) {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logMinLevel = level
+}
+
+// ApplyLogSysconfig changes log format and level according to the settings in sysconfig.
+func ApplyLogSysconfig(sysconf *Sysconfig) error {
+	level, err := ParseLogLevel(sysconf.GetString(SYSCONF_LOG_LEVEL, LogInfo.String()))
+	if err != nil {
+		return fmt.Errorf("ApplyLogSysconfig: %v", err)
+	}
+	if err := SetLogFormat(sysconf.GetString(SYSCONF_LOG_FORMAT, LogFormatText)); err != nil {
+		return fmt.Errorf("ApplyLogSysconfig: %v", err)
+	}
+	SetLogLevel(level)
+	return nil
+}
+
+// NewRequestID returns a random identifier for the log messages of an RPC connection.
+func NewRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Panicf("NewRequestID: random source ran dry - %v", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+/*
+Logger prints log messages with a level and key/value fields. Fields attached to the logger via With are included in
+every message. Messages go to the output of standard "log" package, in the format chosen by SetLogFormat.
+All functions are safe for concurrent usage, and a nil Logger prints messages without attached fields.
+*/
+type Logger struct {
+	fields []interface{} // fields are alternating keys and values
+}
+
+// NewLogger returns a logger that attaches the key/value pairs to every message.
+func NewLogger(keyvals ...interface{}) *Logger {
+	return (*Logger)(nil).With(keyvals...)
+}
+
+// With returns a new logger that attaches the key/value pairs to every message, in addition to this logger's fields.
+func (logger *Logger) With(keyvals ...interface{}) *Logger {
+	newLogger := &Logger{}
+	if logger != nil {
+		newLogger.fields = append(newLogger.fields, logger.fields...)
+	}
+	newLogger.fields = append(newLogger.fields, keyvals...)
+	return newLogger
+}
+
+// Debug prints a message that is only useful to developers.
+func (logger *Logger) Debug(msg string, keyvals ...interface{}) {
+	logger.print(LogDebug, msg, keyvals)
+}
+
+// Info prints a message about normal operation.
+func (logger *Logger) Info(msg string, keyvals ...interface{}) {
+	logger.print(LogInfo, msg, keyvals)
+}
+
+// Warning prints a message about a problem that does not stop the operation.
+func (logger *Logger) Warning(msg string, keyvals ...interface{}) {
+	logger.print(LogWarning, msg, keyvals)
+}
+
+// Error prints a message about a failed operation.
+func (logger *Logger) Error(msg string, keyvals ...interface{}) {
+	logger.print(LogError, msg, keyvals)
+}
+
+// print writes a message along with all fields in the chosen format.
+func (logger *Logger) print(level LogLevel, msg string, keyvals []interface{}) {
+	var fields []interface{}
+	if logger != nil {
+		fields = append(fields, logger.fields...)
+	}
+	fields = append(fields, keyvals...)
+	if len(fields)%2 != 0 {
+		// A key is missing its value
+		fields = append(fields, nil)
+	}
+	logLock.Lock()
+	defer logLock.Unlock()
+	if level < logMinLevel {
+		return
+	}
+	if logFormat == LogFormatJSON {
+		writeJSONLog(log.Writer(), time.Now(), level, msg, fields)
+		return
+	}
+	var line bytes.Buffer
+	line.WriteString(strings.ToUpper(level.String()))
+	line.WriteRune(' ')
+	line.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		fmt.Fprintf(&line, " %s=%s", fmt.Sprint(fields[i]), formatTextValue(fields[i+1]))
+	}
+	log.Print(line.String())
+}
+
+// formatTextValue prints a field value in text format, the value is quoted if it contains spaces or quotes.
+func formatTextValue(value interface{}) string {
+	var str string
+	if err, isErr := value.(error); isErr {
+		str = err.Error()
+	} else {
+		str = fmt.Sprint(value)
+	}
+	if str == "" || strings.ContainsAny(str, " \t\r\n\"=") {
+		return fmt.Sprintf("%q", str)
+	}
+	return str
+}
+
+// writeJSONLog writes a message as a JSON object on a single line, keys appear in the same order as they were given.
+func writeJSONLog(out io.Writer, now time.Time, level LogLevel, msg string, fields []interface{}) {
+	var line bytes.Buffer
+	line.WriteString(`{"time":`)
+	writeJSONValue(&line, now.Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeJSONValue(&line, level.String())
+	line.WriteString(`,"msg":`)
+	writeJSONValue(&line, msg)
+	for i := 0; i < len(fields); i += 2 {
+		line.WriteRune(',')
+		writeJSONValue(&line, fmt.Sprint(fields[i]))
+		line.WriteRune(':')
+		writeJSONValue(&line, fields[i+1])
+	}
+	line.WriteString("}\n")
+	out.Write(line.Bytes())
+}
+
+// writeJSONValue writes a value in JSON. Errors are written as their message, and values that cannot be encoded are written as strings.
+func writeJSONValue(out *bytes.Buffer, value interface{}) {
+	if err, isErr := value.(error); isErr {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	out.Write(encoded)
+}
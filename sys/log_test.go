@@ -0,0 +1,84 @@
+// cryptctl - Copyright (c) 2017 SUSE Linux GmbH, Germany
+// This source code is licensed under GPL version 3 that can be found in LICENSE file.
+package sys
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	oldFlags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(oldFlags)
+		SetLogFormat(LogFormatText)
+		SetLogLevel(LogInfo)
+	}()
+	logger := NewLogger(LogKeyRequestID, "abc").With("ip", "1.2.3.4")
+	// Text format
+	logger.Info("hello", "uuids", []string{"a", "b"}, "error", errors.New("oh no"))
+	logger.Debug("not printed")
+	if s := out.String(); s != "INFO hello request_id=abc ip=1.2.3.4 uuids=\"[a b]\" error=\"oh no\"\n" {
+		t.Fatal(s)
+	}
+	// Nil logger prints message without fields
+	out.Reset()
+	(*Logger)(nil).Warning("nil", "key")
+	if s := out.String(); s != "WARNING nil key=<nil>\n" {
+		t.Fatal(s)
+	}
+	// JSON format
+	out.Reset()
+	if err := SetLogFormat("xml"); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := SetLogFormat(LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	SetLogLevel(LogDebug)
+	logger.Debug("hello", "uuids", []string{"a", "b"}, "error", errors.New("oh no"), "count", 1)
+	var msg map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &msg); err != nil {
+		t.Fatal(err, out.String())
+	}
+	if msg["level"] != "debug" || msg["msg"] != "hello" || msg[LogKeyRequestID] != "abc" || msg["ip"] != "1.2.3.4" ||
+		msg["error"] != "oh no" || msg["count"] != 1.0 || len(msg["uuids"].([]interface{})) != 2 || msg["time"] == "" {
+		t.Fatal(msg)
+	}
+	if !strings.HasPrefix(out.String(), `{"time":`) {
+		t.Fatal(out.String())
+	}
+}
+
+func TestApplyLogSysconfig(t *testing.T) {
+	defer func() {
+		SetLogFormat(LogFormatText)
+		SetLogLevel(LogInfo)
+	}()
+	sysconf, err := ParseSysconfig("LOG_FORMAT=json\nLOG_LEVEL=warning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyLogSysconfig(sysconf); err != nil {
+		t.Fatal(err)
+	}
+	if logFormat != LogFormatJSON || logMinLevel != LogWarning {
+		t.Fatal(logFormat, logMinLevel)
+	}
+	sysconf.Set(SYSCONF_LOG_LEVEL, "loud")
+	if err := ApplyLogSysconfig(sysconf); err == nil {
+		t.Fatal("did not error")
+	}
+	if id := NewRequestID(); len(id) != 16 || id == NewRequestID() {
+		t.Fatal(id)
+	}
+}